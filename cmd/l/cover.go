@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/driusan/lang/compiler/hlir/vm"
+)
+
+// Returns true if line of src is in a _test.l file, whose code isn't
+// included in the coverage.
+func isTestLine(src *source, line int) bool {
+	name, _ := src.fileLine(line)
+	return strings.HasSuffix(name, "_test.l")
+}
+
+// Prints the percentage of the blocks of each function in src that ran
+// according to cov, in the order that they're in the source, followed by
+// the total.
+func printCoverage(w io.Writer, cov *vm.Coverage, src *source) error {
+	var fns []vm.FuncCoverage
+	for _, f := range cov.Functions() {
+		if f.Blocks > 0 && !isTestLine(src, f.Line) {
+			fns = append(fns, f)
+		}
+	}
+	sort.SliceStable(fns, func(i, j int) bool {
+		return fns[i].Line < fns[j].Line
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	var total vm.FuncCoverage
+	for _, f := range fns {
+		fmt.Fprintf(tw, "%s:\t%s\t%.1f%%\n", src.position(f.Line), f.Func, f.Percent())
+		total.Blocks += f.Blocks
+		total.Covered += f.Covered
+	}
+	fmt.Fprintf(tw, "total:\t\t%.1f%%\n", total.Percent())
+	return tw.Flush()
+}
+
+// Writes the statements in cov to the named file in the format written by
+// go test -coverprofile, so that go tool cover -html can render them as
+// annotated source.
+func writeCoverProfile(name string, cov *vm.Coverage, src *source) error {
+	// go tool cover can only find files outside of Go packages by their
+	// absolute paths. Each line is a block, which ran as many times as the
+	// statement on it that ran the most.
+	type position struct {
+		file string
+		line int
+	}
+	stmts := make(map[position]int)
+	counts := make(map[position]int64)
+	var lines []position
+	for _, b := range cov.Blocks() {
+		if b.Kind != vm.StatementBlock || b.Line == 0 || isTestLine(src, b.Line) {
+			continue
+		}
+		file, line := src.fileLine(b.Line)
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		p := position{abs, line}
+		if stmts[p] == 0 {
+			lines = append(lines, p)
+		}
+		stmts[p]++
+		if b.Count > counts[p] {
+			counts[p] = b.Count
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].file != lines[j].file {
+			return lines[i].file < lines[j].file
+		}
+		return lines[i].line < lines[j].line
+	})
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, "mode: count"); err != nil {
+		return err
+	}
+	for _, p := range lines {
+		if _, err := fmt.Fprintf(f, "%s:%d.1,%d.1 %d %d\n", p.file, p.line, p.line+1, stmts[p], counts[p]); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir/vm"
+)
+
+// How far a debugged program runs before stopping again, other than at a
+// breakpoint.
+type stepMode uint8
+
+const (
+	// Until the program ends.
+	stepContinue stepMode = iota
+
+	// Until the next line, including in a function that gets called.
+	stepInto
+
+	// Until the next line of the current function or its callers.
+	stepOver
+
+	// Until the current function returns.
+	stepOut
+)
+
+// The error that a debugged program is stopped with when the debugger quits.
+var errQuit = errors.New("quit")
+
+type breakpoint struct {
+	// The function or line of the source that the breakpoint stops at.
+	// Only one of them is set.
+	fn   string
+	line int
+}
+
+// A debugger runs a function in the VM, stopping it at breakpoints or after
+// steps to read commands.
+type debugger struct {
+	src    *source
+	in     *bufio.Reader
+	out    io.Writer
+	stdout *programOutput
+
+	breaks []breakpoint
+
+	mode stepMode
+	// The number of calls being made when the program was last stopped.
+	depth int
+
+	// The call depth and line that the program was at before the last
+	// instruction, to tell when it gets to a new line.
+	lastDepth, lastLine int
+
+	// The frame being looked at, counting from the innermost.
+	frame int
+
+	// The last command, which an empty line repeats.
+	last []string
+}
+
+const debugHelp = `Commands:
+	break FUNC|FILE:LINE|LINE	stop when FUNC is called or LINE is reached
+	break				list the breakpoints
+	delete N			delete breakpoint N
+	continue			run until a breakpoint or the end
+	step				run to the next line, stepping into calls
+	next				run to the next line, stepping over calls
+	out				run until the current function returns
+	backtrace			print the calls being made
+	frame N, up, down		look at the Nth call, its caller or its callee
+	locals				print the local variables of the call
+	args				print the arguments of the call
+	print NAME			print a variable of the call
+	quit				stop the program and exit
+An empty line repeats the last command.
+`
+
+// Runs fname in the VM built from src, stopped at its first line. Commands
+// are read from stdin, which the program also reads its input from.
+func debugFunc(src *source, fname string) error {
+	machine, err := vm.ParseFromReader(src.reader())
+	if err != nil {
+		return err
+	}
+	if _, ok := machine.Funcs[fname]; !ok {
+		return fmt.Errorf("No function named %s", fname)
+	}
+	d := &debugger{
+		src:    src,
+		in:     bufio.NewReader(os.Stdin),
+		out:    os.Stdout,
+		stdout: &programOutput{w: os.Stdout},
+		mode:   stepInto,
+	}
+	machine.Stdin = d.in
+	machine.Stdout = d.stdout
+	machine.Stderr = os.Stderr
+	machine.Hook = d.hook
+	_, _, err = vm.RunWithSideEffects(fname, machine)
+	d.stdout.endLine()
+	switch {
+	case errors.Is(err, errQuit):
+		return nil
+	case err != nil:
+		fmt.Fprintf(d.out, "%s failed:\n", fname)
+		printError(d.out, err, src.position)
+		return nil
+	}
+	fmt.Fprintf(d.out, "%s returned\n", fname)
+	return nil
+}
+
+func (d *debugger) hook(ctx *vm.Context) error {
+	depth := ctx.Depth()
+	f := ctx.Frame(0)
+	line := f.Line()
+	called := depth > d.lastDepth
+	newLine := line > 0 && (called || line != d.lastLine)
+	d.lastDepth, d.lastLine = depth, line
+
+	switch {
+	case d.mode == stepOut && depth < d.depth:
+	case !newLine:
+		return nil
+	case d.mode == stepInto:
+	case d.mode == stepOver && depth <= d.depth:
+	default:
+		n := d.breakpointAt(f.Func(), line, called)
+		if n < 0 {
+			return nil
+		}
+		d.stdout.endLine()
+		fmt.Fprintf(d.out, "breakpoint %d, ", n)
+	}
+	d.stdout.endLine()
+	d.depth, d.frame = depth, 0
+	d.printFrame(ctx)
+	return d.prompt(ctx)
+}
+
+// Returns the number of the breakpoint that fn stops at when it's at line, or
+// -1 if there isn't one. called is whether fn was just called.
+func (d *debugger) breakpointAt(fn string, line int, called bool) int {
+	for i, b := range d.breaks {
+		if b.line == line || called && b.fn == fn {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Prints where the frame being looked at is.
+func (d *debugger) printFrame(ctx *vm.Context) {
+	f := ctx.Frame(d.frame)
+	fmt.Fprintf(d.out, "%s at %s\n", f.Func(), d.src.position(f.Line()))
+	if text := d.src.text(f.Line()); text != "" {
+		fmt.Fprintf(d.out, "\t%s\n", strings.TrimSpace(text))
+	}
+}
+
+// Reads and runs commands until one resumes the program.
+func (d *debugger) prompt(ctx *vm.Context) error {
+	for {
+		fmt.Fprint(d.out, "(l) ")
+		line, err := d.in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(d.out)
+			return errQuit
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			args = d.last
+		}
+		if len(args) == 0 {
+			continue
+		}
+		d.last = args
+		resume, err := d.command(ctx, args[0], args[1:])
+		if err != nil {
+			if err == errQuit {
+				return err
+			}
+			fmt.Fprintln(d.out, err)
+		}
+		if resume {
+			return nil
+		}
+	}
+}
+
+// Runs a command, and returns whether the program should resume.
+func (d *debugger) command(ctx *vm.Context, cmd string, args []string) (bool, error) {
+	f := ctx.Frame(d.frame)
+	switch cmd {
+	case "c", "continue":
+		d.mode = stepContinue
+		return true, nil
+	case "s", "step":
+		d.mode = stepInto
+		return true, nil
+	case "n", "next":
+		d.mode = stepOver
+		return true, nil
+	case "o", "out", "finish":
+		d.mode = stepOut
+		return true, nil
+	case "b", "break":
+		if len(args) == 0 {
+			d.printBreakpoints()
+			return false, nil
+		}
+		return false, d.addBreakpoint(ctx, args[0])
+	case "d", "delete":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: delete N")
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 || n > len(d.breaks) || d.breaks[n-1] == (breakpoint{}) {
+			return false, fmt.Errorf("no breakpoint %s", args[0])
+		}
+		// Keep the numbers of the other breakpoints the same.
+		d.breaks[n-1] = breakpoint{}
+	case "bt", "backtrace":
+		for i := 0; i < ctx.Depth(); i++ {
+			c := ctx.Frame(i)
+			marker := " "
+			if i == d.frame {
+				marker = "*"
+			}
+			fmt.Fprintf(d.out, "%s%d %s(%s)\n\t%s\n", marker, i, c.Func(), formatNamed(c.Args()), d.src.position(c.Line()))
+		}
+	case "f", "frame", "up", "down":
+		n := d.frame
+		switch {
+		case cmd == "up":
+			n++
+		case cmd == "down":
+			n--
+		case len(args) == 1:
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				return false, fmt.Errorf("invalid frame %q", args[0])
+			}
+		}
+		if n < 0 || n >= ctx.Depth() {
+			return false, fmt.Errorf("no frame %d", n)
+		}
+		d.frame = n
+		d.printFrame(ctx)
+	case "l", "locals":
+		printNamed(d.out, f.Locals())
+	case "a", "args":
+		printNamed(d.out, f.Args())
+	case "p", "print":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: print NAME")
+		}
+		for _, v := range append(f.Locals(), f.Args()...) {
+			if v.Name == args[0] {
+				fmt.Fprintln(d.out, v.Value)
+				return false, nil
+			}
+		}
+		return false, fmt.Errorf("no variable named %s in %s", args[0], f.Func())
+	case "q", "quit":
+		return false, errQuit
+	case "h", "help":
+		fmt.Fprint(d.out, debugHelp)
+	default:
+		return false, fmt.Errorf("unknown command %q, try help", cmd)
+	}
+	return false, nil
+}
+
+func (d *debugger) addBreakpoint(ctx *vm.Context, where string) error {
+	b := breakpoint{fn: where}
+	if _, err := strconv.Atoi(where); err == nil || strings.Contains(where, ":") {
+		line, err := d.src.line(where)
+		if err != nil {
+			return err
+		}
+		b = breakpoint{line: line}
+	} else if _, ok := ctx.Funcs[where]; !ok {
+		return fmt.Errorf("no function named %s", where)
+	}
+	d.breaks = append(d.breaks, b)
+	fmt.Fprintf(d.out, "breakpoint %d at %s\n", len(d.breaks), d.describe(b))
+	return nil
+}
+
+func (d *debugger) printBreakpoints() {
+	for i, b := range d.breaks {
+		if b != (breakpoint{}) {
+			fmt.Fprintf(d.out, "%d\t%s\n", i+1, d.describe(b))
+		}
+	}
+}
+
+func (d *debugger) describe(b breakpoint) string {
+	if b.fn != "" {
+		return b.fn
+	}
+	return d.src.position(b.line)
+}
+
+func printNamed(w io.Writer, vals []vm.NamedValue) {
+	for _, v := range vals {
+		fmt.Fprintf(w, "%s = %s\n", v.Name, v.Value)
+	}
+}
+
+// Formats vals as a list of "name=value" pairs.
+func formatNamed(vals []vm.NamedValue) string {
+	strs := make([]string, len(vals))
+	for i, v := range vals {
+		strs[i] = v.Name + "=" + v.Value
+	}
+	return strings.Join(strs, ", ")
+}
+
+// The stdout of a debugged program, which keeps track of whether it's in the
+// middle of a line so that the debugger's output can start on a new one.
+type programOutput struct {
+	w       io.Writer
+	partial bool
+}
+
+func (p *programOutput) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		p.partial = b[len(b)-1] != '\n'
+	}
+	return p.w.Write(b)
+}
+
+// Ends the line that the program was in the middle of writing, if any.
+func (p *programOutput) endLine() {
+	if p.partial {
+		fmt.Fprintln(p.w)
+		p.partial = false
+	}
+}
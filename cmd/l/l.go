@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -10,16 +11,48 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/driusan/lang/compiler/codegen"
+	"github.com/driusan/lang/compiler/hlir/opt"
 	"github.com/driusan/lang/compiler/hlir/vm"
 )
 
-var debug bool
+var debug, folds, dumpIR bool
+var o0, o1, o2 bool
+var enable, disable string
+var profile string
+var cover bool
+var coverprofile string
+var timeout time.Duration
 
 func main() {
 	flag.BoolVar(&debug, "debug", false, "do not delete temporary files and print extra information to stderr")
+	flag.BoolVar(&folds, "folds", false, "print the function calls that were evaluated at compile time to stderr")
+	flag.BoolVar(&dumpIR, "dump-ir", false, "print the IR before and after each optimization pass to stderr")
+	flag.DurationVar(&timeout, "timeout", time.Minute, "fail a test if it runs for longer than this (0 for no limit)")
+	flag.StringVar(&profile, "profile", "", "write a profile of the programs run by test or run in the VM to this file in pprof format, and print a report of it to stderr")
+	flag.BoolVar(&cover, "cover", false, "print the percentage of the statements and branches of each function that test ran (disables optimizations unless -O1 or -O2 is given)")
+	flag.StringVar(&coverprofile, "coverprofile", "", "write the coverage of test to this file in the format read by go tool cover (implies -cover)")
+	flag.BoolVar(&o0, "O0", false, "disable optimizations")
+	flag.BoolVar(&o1, "O1", false, "enable cheap optimizations (default)")
+	flag.BoolVar(&o2, "O2", false, "enable all optimizations")
+	passes := strings.Join(opt.Passes(), ", ")
+	flag.StringVar(&enable, "enable", "", "comma separated list of optimization passes to enable (known passes: "+passes+")")
+	flag.StringVar(&disable, "disable", "", "comma separated list of optimization passes to disable (known passes: "+passes+")")
 	flag.Parse()
+	if coverprofile != "" {
+		cover = true
+	}
+	if cover && !o1 && !o2 {
+		// Optimizations can remove branches, or the calls that reach
+		// them, so that they don't run even when the tests do.
+		o0 = true
+	}
+	if err := configureOptimizer(opt.Default); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	// For now, jut assume the command is building a program in the
 	// current directory.
 	if debug {
@@ -31,10 +64,10 @@ func main() {
 	}
 
 	args := flag.Args()
-	inctest := len(args) > 0 && args[0] == "test"
+	inctest := len(args) > 0 && (args[0] == "test" || args[0] == "debug")
 
-	// Combine all the .l files into a MultiReader for BuildProgram
-	var srcFiles []io.Reader
+	// Combine all the .l files into a single source for BuildProgram
+	var srcFiles source
 	for _, f := range files {
 		if filepath.Ext(f.Name()) != ".l" {
 			continue
@@ -47,26 +80,54 @@ func main() {
 			log.Println("Using", f.Name())
 		}
 
-		fi, err := os.Open(f.Name())
-		if err != nil {
+		if err := srcFiles.add(f.Name()); err != nil {
 			log.Println(err)
 			return
 		}
-		defer fi.Close()
-
-		srcFiles = append(srcFiles, fi)
 	}
-	if len(srcFiles) == 0 {
+	// The REPL can be used without any.
+	replMode := len(args) > 0 && args[0] == "repl"
+	if len(srcFiles.files) == 0 && !replMode {
 		fmt.Fprintln(os.Stderr, "No source files available in current directory.")
 		os.Exit(1)
 	}
-	src := io.MultiReader(srcFiles...)
+	src := srcFiles.reader()
+	var prof *vm.Profile
+	if profile != "" {
+		prof = vm.NewProfile()
+	}
 
 	if len(args) > 0 {
 		switch args[0] {
 		case "test":
-			if err := getVMAndRunTests(src); err != nil {
+			if err := getVMAndRunTests(&srcFiles, prof); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if err := writeProfile(prof, &srcFiles); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		case "debug":
+			fname := "main"
+			if len(args) > 1 {
+				fname = args[1]
+			}
+			if err := debugFunc(&srcFiles, fname); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		case "run":
+			status, err := runMain(src, srcFiles.position, args[1:], os.Stdin, os.Stdout, os.Stderr, prof)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if err := writeProfile(prof, &srcFiles); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(status)
+		case "repl":
+			if err := repl(&srcFiles); err != nil {
 				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
 			}
 		default:
 			// And build the program.
@@ -82,6 +143,42 @@ func main() {
 	}
 }
 
+// Configures the optimization passes run by m from the command line flags.
+func configureOptimizer(m *opt.Manager) error {
+	switch {
+	case o2:
+		m.Level = opt.O2
+	case o1:
+		m.Level = opt.O1
+	case o0:
+		m.Level = opt.O0
+	}
+	for _, name := range strings.Split(enable, ",") {
+		if name == "" {
+			continue
+		}
+		if err := m.Enable(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range strings.Split(disable, ",") {
+		if name == "" {
+			continue
+		}
+		if err := m.Disable(name); err != nil {
+			return err
+		}
+	}
+	m.Warnings = os.Stderr
+	if folds {
+		m.SetRemarks("fold", os.Stderr)
+	}
+	if dumpIR {
+		m.Dump = os.Stderr
+	}
+	return nil
+}
+
 // Builds a program in /tmp and copies the result to the current directory.
 func buildAndCopyProgram(src io.Reader) error {
 	// FIXME: BuildProgram should probably be in some other package,
@@ -132,26 +229,53 @@ func copyFile(src, dst string) error {
 	return nil
 }
 
-func getVMAndRunTests(src io.Reader) error {
-	machine, err := vm.ParseFromReader(src)
+// Runs the Test functions in src, and reports their coverage if the -cover
+// flag is set. If prof isn't nil, the tests are added to it.
+func getVMAndRunTests(src *source, prof *vm.Profile) error {
+	machine, err := vm.ParseFromReader(src.reader())
 	if err != nil {
 		return err
 	}
+	var cov *vm.Coverage
+	if cover {
+		cov = vm.NewCoverage(machine)
+	}
 	var fail, run uint
 	for fname := range machine.Funcs {
 		if strings.HasPrefix(fname, "Test") {
 			// Make a clone of the VM to ensure that there's
 			// no interactions between tests
 			m2 := machine.Clone()
+			cancel := func() {}
+			if timeout > 0 {
+				m2.Cancel, cancel = context.WithTimeout(context.Background(), timeout)
+			}
+			if prof != nil {
+				prof.Attach(m2)
+			}
+			if cov != nil {
+				cov.Attach(m2)
+			}
 			_, _, err := vm.RunWithSideEffects(fname, m2)
+			cancel()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "--- FAIL %v:\n", fname)
-				fmt.Fprintf(os.Stderr, "\t%v\n", err)
+				printError(os.Stderr, err, src.position)
 				fail++
 			}
 			run++
 		}
 	}
+	if cov != nil && run > 0 {
+		if err := printCoverage(os.Stdout, cov, src); err != nil {
+			return err
+		}
+		if coverprofile != "" {
+			if err := writeCoverProfile(coverprofile, cov, src); err != nil {
+				return err
+			}
+		}
+	}
 	if run > 0 {
 		if fail == 0 {
 			return nil
@@ -161,3 +285,73 @@ func getVMAndRunTests(src io.Reader) error {
 		return fmt.Errorf("No tests run.")
 	}
 }
+
+// Runs main in src in the VM, with args as its command line arguments and
+// stdin, stdout and stderr as its standard input and outputs, and returns
+// the exit status for it. pos formats a line of src for printing the
+// traceback to stderr if it fails. If prof isn't nil, main is added to it.
+func runMain(src io.Reader, pos func(line int) string, args []string, stdin io.Reader, stdout, stderr io.Writer, prof *vm.Profile) (int, error) {
+	machine, err := vm.ParseFromReader(src)
+	if err != nil {
+		return 2, err
+	}
+	if _, ok := machine.Funcs["main"]; !ok {
+		return 2, fmt.Errorf("No main function.")
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return 2, err
+	}
+	machine.SetArgs(append([]string{path.Base(cwd)}, args...))
+	machine.Stdin = stdin
+	machine.Stdout = stdout
+	machine.Stderr = stderr
+	if prof != nil {
+		prof.Attach(machine)
+	}
+	if _, _, err := vm.RunWithSideEffects("main", machine); err != nil {
+		fmt.Fprintln(stderr, "main failed:")
+		printError(stderr, err, pos)
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Writes prof to the file named by the -profile flag and prints a report of
+// it to stderr, unless it's nil or nothing was run, such as if the program
+// couldn't be parsed.
+func writeProfile(prof *vm.Profile, src *source) error {
+	if prof == nil || prof.Total() == 0 {
+		return nil
+	}
+	f, err := os.Create(profile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := prof.WritePprof(f, src.fileLine); err != nil {
+		return err
+	}
+	if err := prof.WriteReport(os.Stderr, src.position); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Prints an error from running a program in the VM, with its traceback if
+// it has one.
+func printError(w io.Writer, err error, pos func(line int) string) {
+	re, ok := err.(*vm.RuntimeError)
+	if !ok {
+		fmt.Fprintf(w, "\t%v\n", err)
+		return
+	}
+	if len(re.Stack) > 0 && re.Stack[0].Line > 0 {
+		fmt.Fprintf(w, "\t%s: %v: %v\n", pos(re.Stack[0].Line), re.Kind, re.Err)
+	} else {
+		fmt.Fprintf(w, "\t%v: %v\n", re.Kind, re.Err)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(re.Traceback(pos), "\n"), "\n") {
+		fmt.Fprintf(w, "\t\t%s\n", line)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func linePos(line int) string {
+	return fmt.Sprintf("line %d", line)
+}
+
+func TestRunMain(t *testing.T) {
+	src := `func main (args []string) () -> affects(IO, Filesystem) {
+	for i, arg in args {
+		PrintInt(i)
+		PrintString(arg)
+	}
+	mutable dta []byte = {0, 1, 2}
+	let n = Read(0, dta)
+	PrintByteSlice(dta)
+	PrintInt(n)
+}`
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr strings.Builder
+	status, err := runMain(strings.NewReader(src), linePos, []string{"foo", "bar"}, strings.NewReader("xyz"), &stdout, &stderr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0 {
+		t.Errorf("Unexpected exit status: got %v want 0", status)
+	}
+	// The name of the program is the name of the directory that it's in.
+	if want := "0" + path.Base(cwd) + "1foo2barxyz3"; stdout.String() != want {
+		t.Errorf("Unexpected stdout: got %q want %q", stdout.String(), want)
+	}
+	if stderr.String() != "" {
+		t.Errorf("Unexpected stderr: got %q want %q", stderr.String(), "")
+	}
+}
+
+func TestRunMainExitStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		status int
+		// Whether an error is returned rather than printed, and what
+		// stderr should contain.
+		err    bool
+		stderr string
+	}{
+		{
+			name: "AssertionFailure",
+			src: `func main() () -> affects(IO) {
+	PrintString("before")
+	assert(false)
+}`,
+			status: 1,
+			stderr: "main failed:\n\tline 3: assertion failure",
+		},
+		{
+			name: "ParseFailure",
+			src: `func main() () -> affects(IO) {
+	PrintInt(x)
+}`,
+			status: 2,
+			err:    true,
+		},
+		{
+			name: "NoMain",
+			src: `func foo() (int) {
+	return 3
+}`,
+			status: 2,
+			err:    true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			status, err := runMain(strings.NewReader(tc.src), linePos, nil, strings.NewReader(""), &stdout, &stderr, nil)
+			if status != tc.status {
+				t.Errorf("Unexpected exit status: got %v want %v", status, tc.status)
+			}
+			if (err != nil) != tc.err {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if !strings.Contains(stderr.String(), tc.stderr) || (tc.stderr == "" && stderr.String() != "") {
+				t.Errorf("Unexpected stderr: got %q want %q", stderr.String(), tc.stderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir/vm"
+)
+
+// Reads declarations, statements and expressions from stdin and runs them in
+// the VM, after the declarations in src, printing the value and type of each
+// expression.
+func repl(src *source) error {
+	s := vm.NewSession()
+	in := bufio.NewReader(os.Stdin)
+	stdout := &programOutput{w: os.Stdout}
+	s.Context.Stdin = in
+	s.Context.Stdout = stdout
+	s.Context.Stderr = os.Stderr
+	if len(src.files) > 0 {
+		if _, err := s.Eval(src.buf.String()); err != nil {
+			return err
+		}
+	}
+
+	var input strings.Builder
+	for {
+		if input.Len() == 0 {
+			fmt.Print("> ")
+		} else {
+			fmt.Print("... ")
+		}
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		input.WriteString(line)
+		if !complete(input.String()) {
+			continue
+		}
+
+		results, err := s.Eval(input.String())
+		input.Reset()
+		stdout.endLine()
+		if err != nil {
+			printError(os.Stdout, err, func(line int) string {
+				return fmt.Sprintf("line %d", line)
+			})
+		}
+		for _, r := range results {
+			fmt.Println(r)
+		}
+	}
+}
+
+// Returns true if src has as many closing brackets as opening ones, so that
+// it's ready to be run rather than continued on the next line.
+func complete(src string) bool {
+	depth := 0
+	inString := false
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '(' || c == '[':
+			depth++
+		case c == '}' || c == ')' || c == ']':
+			depth--
+		}
+	}
+	return depth <= 0 && !inString
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A source is the .l files of a program, which are parsed as if they were
+// a single file.
+type source struct {
+	buf bytes.Buffer
+
+	// The files in the source, in the order that they were added.
+	files []sourceFile
+}
+
+type sourceFile struct {
+	name string
+
+	// The line of the source that the file starts on.
+	start int
+}
+
+// Adds the named file to the end of s.
+func (s *source) add(name string) error {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, sourceFile{name, bytes.Count(s.buf.Bytes(), []byte("\n")) + 1})
+	s.buf.Write(content)
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		// Make sure the next file starts on a line of its own.
+		s.buf.WriteByte('\n')
+	}
+	return nil
+}
+
+func (s *source) reader() io.Reader {
+	return bytes.NewReader(s.buf.Bytes())
+}
+
+// Returns the file and line in it of a line of s, formatted as "name:line".
+func (s *source) position(line int) string {
+	name, n := s.fileLine(line)
+	if name == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", name, n)
+}
+
+// Returns the file and line in it of a line of s, or "" and line if it isn't
+// in a file.
+func (s *source) fileLine(line int) (string, int) {
+	i := sort.Search(len(s.files), func(i int) bool {
+		return s.files[i].start > line
+	}) - 1
+	if i < 0 {
+		return "", line
+	}
+	return s.files[i].name, line - s.files[i].start + 1
+}
+
+// Returns the line of s for a position in it, which is formatted as
+// "name:line", or as just the line if s has a single file.
+func (s *source) line(pos string) (int, error) {
+	name, n := "", pos
+	if i := strings.LastIndex(pos, ":"); i >= 0 {
+		name, n = pos[:i], pos[i+1:]
+	}
+	line, err := strconv.Atoi(n)
+	if err != nil || line < 1 {
+		return 0, fmt.Errorf("invalid line %q", n)
+	}
+	if name == "" {
+		if len(s.files) != 1 {
+			return 0, fmt.Errorf("line %d is ambiguous, use file:line", line)
+		}
+		name = s.files[0].name
+	}
+	for i, f := range s.files {
+		if f.name != name {
+			continue
+		}
+		if i+1 < len(s.files) && f.start+line >= s.files[i+1].start {
+			return 0, fmt.Errorf("%s has fewer than %d lines", name, line)
+		}
+		return f.start + line - 1, nil
+	}
+	return 0, fmt.Errorf("no source file %s", name)
+}
+
+// Returns the text of a line of s, without its newline.
+func (s *source) text(line int) string {
+	lines := bytes.Split(s.buf.Bytes(), []byte("\n"))
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return string(lines[line-1])
+}
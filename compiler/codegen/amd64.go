@@ -18,372 +18,233 @@ func strLiteralLength(s mlir.StringLiteral) uint {
 	return uint(len([]byte(strings.Replace(string(s), `\n`, "\n", -1))))
 }
 
-type amd64Registers struct {
-	ax, bx, cx, dx, si, di, bp, r8, r9, r10, r11, r12, r13, r14, r15 mlir.Register
-}
+// The label at the start of a function that a tail call to itself jumps
+// to.
+const tailCallEntry = "tailcallentry"
+
 type Amd64 struct {
-	amd64Registers
+	// Where each value in the function lives.
+	*allocation
 
-	// List of what ir pseudo-register each physical register is currently
-	// mapped to.
 	stringLiterals map[mlir.StringLiteral]PhysicalRegister
 
-	// The number of arguments in the currently used function. Used for
-	// ToPhysical to calculate where local (non-parameter) variables start.
+	// The function being compiled, and the number of arguments that it
+	// has. Used to determine what can be tail called.
+	name    string
 	numArgs uint
-
-	// A mapping of mlir.LocalValue IDs to the offset relative to FP in a function
-	lvOffsets map[uint]uint
-
-	// A hack to determine if a local register is a slice base or not, which is necessary
-	// to know if it needs to be de-referenced or not at various places
-	sliceBase map[mlir.Register]bool
-}
-
-func (a *Amd64) isSliceBase(r mlir.Register) bool {
-	if _, ok := r.(mlir.SliceBasePointer); ok {
-		return true
-	}
-	_, ok := a.sliceBase[r]
-	return ok
 }
 
-func (a *amd64Registers) nextPhysicalRegister(r mlir.Register, skipDX bool) (PhysicalRegister, error) {
-	// Avoids AX and BP, since AX is the return register and BP is the first
-	// argument to a function call.
-	if a.bx == nil {
-		a.bx = r
-		return "BX", nil
-	}
-	if a.cx == nil {
-		a.cx = r
-		return "CX", nil
-	}
-	if a.dx == nil && !skipDX {
-		a.dx = r
-		return "DX", nil
-	}
-	if a.si == nil {
-		a.si = r
-		return "SI", nil
-	}
-	if a.di == nil {
-		a.di = r
-		return "DI", nil
-	}
-	if a.r8 == nil {
-		a.r8 = r
-		return "R8", nil
-	}
-	if a.r9 == nil {
-		a.r9 = r
-		return "R9", nil
-	}
-	if a.r10 == nil {
-		a.r10 = r
-		return "R10", nil
-	}
-	if a.r11 == nil {
-		a.r11 = r
-		return "R11", nil
-	}
-	if a.r12 == nil {
-		a.r12 = r
-		return "R12", nil
-	}
-	if a.r13 == nil {
-		a.r13 = r
-		return "R13", nil
-	}
-	if a.r14 == nil {
-		a.r14 = r
-		return "R14", nil
-	}
-	if a.r15 == nil {
-		a.r15 = r
-		return "R15", nil
-	}
-	return "", fmt.Errorf("No physical registers available")
+// A memory operand.
+type memory struct {
+	disp  int
+	base  PhysicalRegister
+	index PhysicalRegister
+	scale uint
 }
 
-func (a *amd64Registers) tempPhysicalRegister(skipDX bool) (PhysicalRegister, error) {
-	// Avoids AX and BP, since AX is the return register and BP is the first
-	// argument to a function call.
-	if a.bx == nil {
-		return "BX", nil
-	}
-	if a.cx == nil {
-		return "CX", nil
-	}
-	if a.dx == nil && !skipDX {
-		return "DX", nil
-	}
-	if a.si == nil {
-		return "SI", nil
-	}
-	if a.di == nil {
-		return "DI", nil
-	}
-	if a.r8 == nil {
-		return "R8", nil
-	}
-	if a.r9 == nil {
-		return "R9", nil
-	}
-	if a.r10 == nil {
-		return "R10", nil
-	}
-	if a.r11 == nil {
-		return "R11", nil
-	}
-	if a.r12 == nil {
-		return "R12", nil
+func (m memory) String() string {
+	if m.index == "" {
+		return fmt.Sprintf("%d(%v)", m.disp, m.base)
 	}
-	if a.r13 == nil {
-		return "R13", nil
-	}
-	if a.r14 == nil {
-		return "R14", nil
-	}
-	if a.r15 == nil {
-		return "R15", nil
-	}
-	return "", fmt.Errorf("No physical registers available")
+	return fmt.Sprintf("%d(%v)(%v*%d)", m.disp, m.base, m.index, m.scale)
 }
 
-// Gets a second physical register to use in resolving the same op.
-func (a *amd64Registers) tempPhysicalRegister2(skipDX bool) (PhysicalRegister, error) {
-	found := false
-	// Avoids AX and BP, since AX is the return register and BP is the first
-	// argument to a function call.
-	if a.bx == nil {
-		found = true
-	}
-	if a.cx == nil {
-		if found {
-			return "CX", nil
-		}
-		found = true
-	}
-	if a.dx == nil && !skipDX {
-		if found {
-			return "DX", nil
-		}
-		found = true
-	}
-	if a.si == nil {
-		if found {
-			return "SI", nil
-		}
-		found = true
-	}
-	if a.di == nil {
-		if found {
-			return "DI", nil
-		}
-		found = true
-	}
-	if a.r8 == nil {
-		if found {
-			return "R8", nil
-		}
-		found = true
-	}
-	if a.r9 == nil {
-		if found {
-			return "R9", nil
+// Returns the location that directly holds the value of r, if there is one
+// that an instruction can use without calculating an address, along with
+// the size of the value there. dst is true if r is being written to, since
+// return values are read from where a called function put them but written
+// to where the caller expects them.
+func (a *Amd64) location(r mlir.Register, dst bool) (PhysicalRegister, int, bool) {
+	if v, ok := variable(r); ok {
+		if reg, ok := a.registers[v]; ok {
+			return reg, 8, true
 		}
-		found = true
-	}
-	if a.r10 == nil {
-		if found {
-			return "R10", nil
-		}
-		found = true
-	}
-	if a.r11 == nil {
-		if found {
-			return "R11", nil
+		if slot, ok := a.slots[v]; ok {
+			size := r.Size()
+			if lv, ok := v.(mlir.LocalValue); size == 0 || ok && a.sliceBase[lv.Id] {
+				// Slice bases are pointers, regardless of the type of
+				// the slice.
+				size = 8
+			}
+			return PhysicalRegister(fmt.Sprintf("%d(SP)", slot)), size, true
 		}
-		found = true
 	}
-	if a.r12 == nil {
-		if found {
-			return "R12", nil
+	switch v := r.(type) {
+	case mlir.FuncRetVal:
+		if v.Id == 0 {
+			return "AX", 8, true
 		}
-		found = true
-	}
-	if a.r13 == nil {
-		if found {
-			return "R13", nil
+		if dst {
+			// FIXME: return values don't have a name, but if we're returning
+			// a return value on the stack it's relative to FP, so we need to
+			// use something for the name.
+			return PhysicalRegister(fmt.Sprintf("rvneedname%d+%d(FP)", v.Id, v.Id*8)), 8, true
 		}
-		found = true
-	}
-	if a.r14 == nil {
-		if found {
-			return "R14", nil
+		return PhysicalRegister(fmt.Sprintf("%d(SP)", v.Id*8)), 8, true
+	case mlir.FuncArg:
+		if v.Reference {
+			return "", 0, false
 		}
-		found = true
-	}
-	if a.r15 == nil {
-		if found {
-			return "R15", nil
+		size := v.Size()
+		if size == 0 {
+			size = 8
 		}
-		found = true
+		return PhysicalRegister(fmt.Sprintf("P%d+%d(FP)", v.Id, v.Id*8)), size, true
 	}
-	return "", fmt.Errorf("No physical registers available")
+	return "", 0, false
 }
 
-func (a amd64Registers) getPhysicalRegister(r mlir.Register) (PhysicalRegister, error) {
-	pr, err := a.getPhysicalRegisterInternal(r)
-	if err != nil {
-		return "", err
+// Returns an operand for the full 64 bit value of r that can be used
+// directly by an instruction. If r isn't in a register, an 8 byte memory
+// location, or a small enough literal, the code to load it into scratch is
+// returned with it.
+func (a *Amd64) source(r mlir.Register, scratch PhysicalRegister) (PhysicalRegister, []string) {
+	if lit, ok := r.(mlir.IntLiteral); ok && int64(lit) == int64(int32(lit)) {
+		return PhysicalRegister(fmt.Sprintf("$%d", lit)), nil
 	}
-	if r, ok := r.(mlir.FuncArg); ok && r.Reference {
-		// It's a pointer, so it needs indirection.
-		return PhysicalRegister(fmt.Sprintf("(%v)", pr)), nil
+	if loc, size, ok := a.location(r, false); ok && (loc.IsRealRegister() || size == 8) {
+		return loc, nil
 	}
-	return pr, nil
-}
-func (a amd64Registers) getPhysicalRegisterInternal(r mlir.Register) (PhysicalRegister, error) {
-	switch {
-	case a.ax == r:
-		return "AX", nil
-	case a.bx == r:
-		return "BX", nil
-	case a.cx == r:
-		return "CX", nil
-	case a.dx == r:
-		return "DX", nil
-	case a.si == r:
-		return "SI", nil
-	case a.di == r:
-		return "DI", nil
-	case a.r8 == r:
-		return "R8", nil
-	case a.r9 == r:
-		return "R9", nil
-	case a.r10 == r:
-		return "R10", nil
-	case a.r11 == r:
-		return "R11", nil
-	case a.r12 == r:
-		return "R12", nil
-	case a.r13 == r:
-		return "R13", nil
-	case a.r14 == r:
-		return "R14", nil
-	case a.r15 == r:
-		return "R15", nil
-	}
-	return "", fmt.Errorf("Register not mapped (%v)", r)
+	return scratch, a.load(r, scratch, r.Signed())
 }
 
-func (a *amd64Registers) clearRegisterMapping() {
-	a.ax = nil
-	a.bx = nil
-	a.cx = nil
-	a.dx = nil
-	a.si = nil
-	a.di = nil
-	a.bp = nil
-	a.r8 = nil
-	a.r9 = nil
-	a.r10 = nil
-	a.r11 = nil
-	a.r12 = nil
-	a.r13 = nil
-	a.r14 = nil
-	a.r15 = nil
+// Returns the instruction that loads a value of size bytes into a 64 bit
+// register, extending it based on signed.
+func loadInstruction(size int, signed bool) string {
+	ext := "ZX"
+	if signed {
+		ext = "SX"
+	}
+	switch size {
+	case 1:
+		return "MOVBQ" + ext
+	case 2:
+		return "MOVWQ" + ext
+	case 4:
+		return "MOVLQ" + ext
+	default:
+		return "MOVQ"
+	}
 }
 
-func (a *Amd64) ToPhysical(r mlir.Register, altform bool) PhysicalRegister {
-	switch v := r.(type) {
-	case mlir.StringLiteral:
-		return PhysicalRegister("$" + string(a.stringLiterals[v]) + "+8(SB)")
-	case mlir.IntLiteral:
-		return PhysicalRegister(fmt.Sprintf("$%d", v))
-	case mlir.FuncCallArg:
-		return PhysicalRegister(fmt.Sprintf("%d(SP)", 8*v.Id))
+// Returns the code to calculate the address that o refers to, and the
+// memory operand for it. The address calculation is only allowed to use
+// the base and index scratch registers.
+func (a *Amd64) address(o mlir.Offset) (memory, []string) {
+	var code []string
+	m := memory{scale: o.Scale}
+	if lit, ok := o.Offset.(mlir.IntLiteral); ok {
+		m.disp = int(lit) * int(o.Scale)
+	} else {
+		validScale := o.Scale == 1 || o.Scale == 2 || o.Scale == 4 || o.Scale == 8
+		if loc, _, ok := a.location(o.Offset, false); ok && loc.IsRealRegister() && validScale {
+			m.index = loc
+		} else {
+			code = append(code, a.load(o.Offset, scratchIndex, o.Offset.Signed())...)
+			m.index = scratchIndex
+			if !validScale {
+				code = append(code, fmt.Sprintf("IMULQ $%d, %v", o.Scale, scratchIndex))
+				m.scale = 1
+			}
+		}
+	}
+	switch b := o.Base.(type) {
 	case mlir.LocalValue:
-		return PhysicalRegister(fmt.Sprintf("%v+%d(FP)", v.String(), a.lvOffsets[v.Id]))
-		//return PhysicalRegister(fmt.Sprintf("%v+%d(FP)", v.String(), (int(v.Id)*8)+(int(a.numArgs)*8)))
-	case mlir.FuncRetVal:
-		if v.Id == 0 {
-			return "AX"
+		if !a.sliceBase[b.Id] {
+			m.base = "SP"
+			m.disp += a.slots[mlir.LocalValue{Id: b.Id}]
+			return m, code
 		}
-		if altform {
-			// FIXME: return values don't have a name, but if we're returning
-			// a return value on the stack it's relative to FP, so we need to
-			// use something for the name.
-			return PhysicalRegister(fmt.Sprintf("%v+%d(FP)", fmt.Sprintf("rvneedname%v", v.Id), int(v.Id)*8))
+		if loc, _, ok := a.location(b, false); ok && loc.IsRealRegister() {
+			m.base = loc
+			return m, code
 		}
-
-		return PhysicalRegister(fmt.Sprintf("%d(SP)", int(v.Id)*8))
+		code = append(code, a.load(b, scratchBase, false)...)
 	case mlir.FuncArg:
-		// First check if the arg is already in a register.
-		if !altform {
-			r, err := a.getPhysicalRegister(v)
-			if err == nil {
-				return r
-			}
+		code = append(code, fmt.Sprintf("MOVQ P%d+%d(FP), %v", b.Id, b.Id*8, scratchBase))
+	case mlir.SliceBasePointer:
+		code = append(code, a.load(b.Register, scratchBase, false)...)
+	default:
+		if loc, _, ok := a.location(b, false); ok && loc.IsRealRegister() {
+			m.base = loc
+			return m, code
 		}
-		// Otherwise, the first arg goes in BP, and the rest are on
-		// the stack.
-		/*if v.Id == 0 {
-			return "BP"
-		}*/
-		// FIXME: The prefix of this is supposed to be the variable name,
-		// not the IR register name..
-		return PhysicalRegister(fmt.Sprintf("%v+%d(FP)", v.String(), int(v.Id)*8))
+		code = append(code, a.load(b, scratchBase, false)...)
+	}
+	m.base = scratchBase
+	return m, code
+}
+
+// Returns the code to load the value of r into the register dst, extended
+// to 64 bits based on signed.
+func (a *Amd64) load(r mlir.Register, dst PhysicalRegister, signed bool) []string {
+	switch v := r.(type) {
+	case mlir.IntLiteral:
+		return []string{fmt.Sprintf("MOVQ $%d, %v", v, dst)}
+	case mlir.StringLiteral:
+		return []string{fmt.Sprintf("MOVQ $%v+8(SB), %v", a.stringLiterals[v], dst)}
 	case mlir.Pointer:
-		switch r := v.Register.(type) {
+		switch p := v.Register.(type) {
 		case mlir.LocalValue:
-			return PhysicalRegister(fmt.Sprintf("$%v", a.ToPhysical(r, false)))
+			return []string{fmt.Sprintf("LEAQ %d(SP), %v", a.slots[mlir.LocalValue{Id: p.Id}], dst)}
 		case mlir.Offset:
-			return PhysicalRegister(fmt.Sprintf("%v", a.ToPhysical(r.Base, false)))
+			m, code := a.address(p)
+			return append(code, fmt.Sprintf("LEAQ %v, %v", m, dst))
 		default:
 			panic(fmt.Sprintf("Not implemented: %v", reflect.TypeOf(v.Register)))
 		}
-	case mlir.TempValue:
-		r, err := a.getPhysicalRegister(v)
-		if err == nil {
-			return r
-		}
-		panic("Unknown TempValue register")
-
 	case mlir.Offset:
-		// Returns the address of the base of the offset. It needs to be manually indexed into
-		// whereever this is called from..
-		return PhysicalRegister(fmt.Sprintf("%v", a.ToPhysical(v.Base, false)))
-	default:
-		panic(fmt.Sprintf("Unhandled register type %v", reflect.TypeOf(v)))
+		m, code := a.address(v)
+		return append(code, fmt.Sprintf("%v %v, %v", loadInstruction(int(v.Scale), false), m, dst))
+	case mlir.FuncArg:
+		if v.Reference {
+			return []string{
+				fmt.Sprintf("MOVQ P%d+%d(FP), %v", v.Id, v.Id*8, dst),
+				fmt.Sprintf("%v (%v), %v", loadInstruction(v.Size(), signed), dst, dst),
+			}
+		}
+	}
+	loc, size, ok := a.location(r, false)
+	if !ok {
+		panic(fmt.Sprintf("Unhandled register type %v", reflect.TypeOf(r)))
+	}
+	if loc == dst {
+		return nil
+	}
+	if loc.IsRealRegister() {
+		return []string{fmt.Sprintf("MOVQ %v, %v", loc, dst)}
 	}
+	return []string{fmt.Sprintf("%v %v, %v", loadInstruction(size, signed), loc, dst)}
 }
 
-func (a Amd64) opSuffix(src, dst mlir.Register) string {
-	srcsize := src.Size()
-	dstsize := dst.Size()
-	var base string
-	if srcsize == 0 {
-		return a.singleRegSuffix(dstsize)
-	} else if dstsize == 0 {
-		return a.singleRegSuffix(srcsize)
-	} else if srcsize == dstsize {
-		return a.singleRegSuffix(dstsize)
-	} else if dstsize > srcsize {
-		base := a.singleRegSuffix(srcsize) + a.singleRegSuffix(dstsize)
-		if dst.Signed() {
-			base += "SX"
-		} else {
-			base += "ZX"
+// Returns the code to store the register src into r, truncating it to the
+// size of r.
+func (a *Amd64) store(src PhysicalRegister, r mlir.Register) []string {
+	switch v := r.(type) {
+	case mlir.Offset:
+		m, code := a.address(v)
+		return append(code, fmt.Sprintf("MOV%v %v, %v", a.singleRegSuffix(int(v.Scale)), src, m))
+	case mlir.FuncArg:
+		if v.Reference {
+			return []string{
+				fmt.Sprintf("MOVQ P%d+%d(FP), %v", v.Id, v.Id*8, scratchBase),
+				fmt.Sprintf("MOV%v %v, (%v)", a.singleRegSuffix(v.Size()), src, scratchBase),
+			}
 		}
-		return base
-	} else if dstsize < srcsize {
-		return a.singleRegSuffix(dstsize)
 	}
-	return base
+	loc, size, ok := a.location(r, true)
+	if !ok {
+		panic(fmt.Sprintf("Unhandled destination type %v", reflect.TypeOf(r)))
+	}
+	if loc == src {
+		return nil
+	}
+	if loc.IsRealRegister() {
+		return []string{fmt.Sprintf("MOVQ %v, %v", src, loc)}
+	}
+	return []string{fmt.Sprintf("MOV%v %v, %v", a.singleRegSuffix(size), src, loc)}
 }
+
 func (a Amd64) singleRegSuffix(sizeInBytes int) string {
 	switch sizeInBytes {
 	case 1:
@@ -392,7 +253,7 @@ func (a Amd64) singleRegSuffix(sizeInBytes int) string {
 		return "W"
 	case 4:
 		return "L"
-	case 0, 8:
+	case 0, 8, 16:
 		return "Q"
 	default:
 		panic("Unhandled register size in MOV")
@@ -401,793 +262,326 @@ func (a Amd64) singleRegSuffix(sizeInBytes int) string {
 
 func (a *Amd64) ConvertInstruction(i int, ops []mlir.Opcode) string {
 	op := ops[i]
+	var code []string
 	switch o := op.(type) {
 	case mlir.Label:
 		return o.String()
 	case mlir.MOV:
-		returning := false
-		v := ""
-		var src, dst PhysicalRegister
-		suffix := a.opSuffix(o.Src, o.Dst)
-		switch o.Dst.(type) {
-		case mlir.FuncRetVal:
-			returning = true
-			dst = a.ToPhysical(o.Dst, true)
-		case mlir.TempValue:
-			d, err := a.getPhysicalRegister(o.Dst)
-			if err != nil {
-				d, err = a.nextPhysicalRegister(o.Dst, false)
-				if err != nil {
-					panic(err)
-				}
-			}
-			dst = d
-		case mlir.Offset:
-			//suffix = "Q"
-			dst = a.ToPhysical(o.Dst, true)
-		default:
-			dst = a.ToPhysical(o.Dst, true)
-		}
-
-		switch val := o.Src.(type) {
-		case mlir.Pointer:
-			switch off := val.Register.(type) {
-			case mlir.Offset:
-				// Moving an offset pointer into a local value means we're dealing with
-				// finding the basis pointer for a slice creation, and this needs special
-				// care for now.
-				// First check if the arg is already in a register.
-				r, err := a.getPhysicalRegister(val)
-				if err == nil {
-					src = r
-					break
-				}
-				idx, err := a.tempPhysicalRegister(false)
-				if err != nil {
-					panic(err)
-				}
-				src, err = a.tempPhysicalRegister(false)
-				if err != nil {
-					panic(err)
-				}
-				//Note: val.Offset should be a literal.
-				v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(off.Offset, returning), idx)
-
-				v += fmt.Sprintf("\tMOVQ $%v(%v*%v), %v\n\t", a.ToPhysical(off.Base, returning), idx, off.Scale, src)
-				v += fmt.Sprintf("MOVQ %v, %v", src, dst)
-				a.sliceBase[o.Dst] = true
-				return v
-			default:
-				// First check if the arg is already in a register.
-				r, err := a.getPhysicalRegister(val)
-				if err == nil {
-					src = r
-					break
-				}
-				src, err = a.tempPhysicalRegister(false)
-				if err != nil {
-					panic(err)
-				}
-				v += fmt.Sprintf("\tMOV%v %v, %v\n\t", suffix, a.ToPhysical(val, returning), src)
-			}
-		case mlir.LocalValue, mlir.FuncRetVal, mlir.FuncArg, mlir.StringLiteral:
-			// First check if the arg is already in a register.
-			r, err := a.getPhysicalRegister(val)
-			if err == nil {
-				src = r
-				break
-			}
-			src, err = a.tempPhysicalRegister(false)
-			if err != nil {
-				panic(err)
-			}
-			v += fmt.Sprintf("\tMOV%v %v, %v\n\t", suffix, a.ToPhysical(val, returning), src)
-		case mlir.Offset:
-			// First check if the arg is already in a register.
-			r, err := a.getPhysicalRegister(val)
-			if err == nil {
-				src = r
-				break
-			}
-			src, err = a.tempPhysicalRegister(false)
-			if err != nil {
-				panic(err)
-			}
-			offset, err := a.getPhysicalRegister(val.Offset)
-			suffix := a.singleRegSuffix(int(val.Scale))
-			if err != nil {
-				offset, err = a.nextPhysicalRegister(val.Offset, false)
-				if err != nil {
-					panic(err)
-				}
-			}
-			v += fmt.Sprintf("\tMOV%v %v, %v\n\t", suffix, a.ToPhysical(val.Offset, false), offset)
-			v += fmt.Sprintf("\tMOV%v %v(%v*%d), %v\n\t", suffix, a.ToPhysical(val, returning), offset, val.Scale, src)
-		case mlir.TempValue:
-			var err error
-			src, err = a.getPhysicalRegister(val)
-			if err != nil {
-				panic(err)
-			}
-		default:
-			src = a.ToPhysical(val, returning)
-		}
-
-		switch d := o.Dst.(type) {
-		case mlir.FuncArg:
-			if d.Reference {
-				// FIXME: This is far more inefficient than it should be
-				reg, err := a.nextPhysicalRegister(d, false)
-				if err != nil {
-					panic(err)
-				}
-
-				v += fmt.Sprintf("\tMOV%v %v, %v\n\t", a.opSuffix(o.Src, o.Dst), dst, reg)
-				v += fmt.Sprintf("\tMOV%v %v, (%v)", a.singleRegSuffix(o.Dst.Size()), src, reg)
-			} else {
-				v += fmt.Sprintf("MOV%v %v, %v", a.opSuffix(o.Src, o.Dst), src, dst)
-			}
-		case mlir.LocalValue:
-			v += fmt.Sprintf("MOV%v %v, %v", a.opSuffix(o.Src, o.Dst), src, dst)
-			if phys := a.ToPhysical(o.Dst, false); dst != phys {
-				// dst is a physical register, so also save the value in the canonical
-				// memory location in case someone else looks it up there..
-				v += fmt.Sprintf("MOV%v %v, %v", a.singleRegSuffix(o.Dst.Size()), dst, phys)
-			}
-		case mlir.Offset:
-			offset, err := a.getPhysicalRegister(d.Offset)
-			if err != nil {
-				offset, err = a.nextPhysicalRegister(d.Offset, false)
-				if err != nil {
-					panic(err)
-				}
-				var suffix string
-				switch d.Offset.(type) {
-				case mlir.IntLiteral:
-					suffix = "Q"
-				default:
-					suffix = a.opSuffix(d.Base, fakeRegister{8, o.Dst.Signed()})
-				}
-				v += fmt.Sprintf("\tMOV%v %v, %v\n\t", suffix, a.ToPhysical(d.Offset, false), offset)
-			}
-			suffix := a.singleRegSuffix(int(d.Scale))
-			switch d.Base.(type) {
-			case mlir.LocalValue:
-				tmp, err := a.tempPhysicalRegister(false)
-				if err != nil {
-					panic(err)
-				}
-				v += fmt.Sprintf("\tMOVQ $%v, %v\n\t", dst, tmp)
-				v += fmt.Sprintf("\tMOV%v %v, (%v)(%v*%d)\n\t", suffix, src, tmp, offset, d.Scale)
-			case mlir.FuncArg:
-				tmp, err := a.tempPhysicalRegister(false)
-				if err != nil {
-					panic(err)
-				}
-				v += fmt.Sprintf("\tMOVQ %v, %v\n\t", dst, tmp)
-				v += fmt.Sprintf("\tMOV%v %v, (%v)(%v*%d)\n\t", suffix, src, tmp, offset, d.Scale)
-			default:
-				v += fmt.Sprintf("\tMOV%v %v, %v(%v*%d)\n\t", suffix, src, dst, offset, d.Scale)
-			}
-		default:
-			v += fmt.Sprintf("MOV%v %v, %v", suffix, src, dst)
-		}
-		return v
-	case mlir.CALL:
-		var v string
-		if o.TailCall {
-			// Make sure every FuncArg used is in a physical register,
-			// so that it doesn't get clobbered by a previous argument
-			// also back up LocalValues that may conflict with the FP
-			for _, arg := range o.Args {
-				switch arg.(type) {
-				case mlir.FuncArg, mlir.LocalValue:
-					src := a.ToPhysical(arg, false)
-					physArg, err := a.nextPhysicalRegister(arg, false)
-					if err != nil {
-						panic(err)
-					}
-					suffix := a.singleRegSuffix(arg.Size())
-					v += fmt.Sprintf("//Preserving FA %v\n\tMOV%v %v, %v\n\t", arg, suffix, src, physArg)
-				}
-			}
-		}
-		for i, arg := range o.Args {
-			var fa PhysicalRegister
-			var dst mlir.Register
-			if o.TailCall {
-				// If it's a tail call, the dst should get optimized
-				// to the same location as this call's.
-				dst = mlir.FuncArg{uint(i), ast.TypeInfo{arg.Size(), arg.Signed()}, false, nil}
-				fa = a.ToPhysical(dst, true)
-			} else {
-				dst = mlir.FuncCallArg{i, ast.TypeInfo{8, arg.Signed()}}
-				fa = a.ToPhysical(dst, true)
-			}
-			var physArg PhysicalRegister
-			var src PhysicalRegister
-
-			var suffix string = "Q"
-			switch val := arg.(type) {
-			case mlir.StringLiteral:
-				suffix = a.opSuffix(val, dst)
-				// First check if the arg is already in a register.
-				src = a.ToPhysical(arg, false)
-				r, err := a.getPhysicalRegister(arg)
-				if err == nil {
-					physArg = r
-					break
-				}
-				physArg, err = a.tempPhysicalRegister(false)
-				if err != nil {
-					panic(err)
-				}
-				//v += fmt.Sprintf("MOVQ $%v, %v\n\t", strLiteralLength(val), fa)
-				switch d := dst.(type) {
-				case mlir.FuncArg:
-					d.Id++
-					fa = a.ToPhysical(d, true)
-				case mlir.FuncCallArg:
-				//	d.Id++
-				//	fa = a.ToPhysical(d, true)
-				default:
-					panic("Unknown type of call destination register")
-				}
-				v += fmt.Sprintf("MOVQ %v, %v\n\t", src, physArg)
-			case mlir.SliceBasePointer:
-				// First check if the arg is already in a register.
-				src = a.ToPhysical(val.Register, false)
-				r, err := a.getPhysicalRegister(arg)
-				if err == nil {
-					physArg = r
-					break
-				}
-				physArg, err = a.tempPhysicalRegister(false)
-				if err != nil {
-					panic(err)
-				}
-				switch r := val.Register.(type) {
-				case mlir.Offset:
-					offr, err := a.tempPhysicalRegister2(false)
-					if err != nil {
-						panic(err)
-					}
-
-					v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(r.Offset, false), offr)
-					v += fmt.Sprintf("\tLEAQ %v(%v*%d), %v\n\t", src, offr, r.Scale, physArg)
-				case mlir.LocalValue:
-					// Pass the address of the base, not the value
-					v += fmt.Sprintf("\tMOVQ $%v, %v\n\t", src, physArg)
-				case mlir.FuncArg:
-					// The base was already converted to address when passed as
-					// an argument the first time, so pass the value.
-					v += fmt.Sprintf("\tMOVQ %v, %v\n\t", src, physArg)
-				default:
-					panic(fmt.Sprintf("Unhandled slicebasepointer type %v", reflect.TypeOf(r)))
-				}
-				suffix = "Q"
-			case mlir.LocalValue, mlir.FuncArg, mlir.Pointer:
-				suffix = a.opSuffix(val, dst)
-				// First check if the arg is already in a register.
-				src = a.ToPhysical(arg, false)
-				r, err := a.getPhysicalRegister(arg)
-				if err == nil {
-					physArg = r
-					break
-				}
-				physArg, err = a.tempPhysicalRegister(false)
-				if err != nil {
-					panic(err)
-				}
-				if _, ok := arg.(mlir.Pointer); ok {
-					suffix = "Q"
-				}
-				v += fmt.Sprintf("\tMOV%v %v, %v\n\t", suffix, src, physArg)
-				suffix = "Q"
-			case mlir.TempValue:
-				v += fmt.Sprintf("// TempValue\n\t")
-				suffix = a.opSuffix(val, dst)
-				r, err := a.getPhysicalRegister(arg)
-				if err != nil {
-					panic(err)
-				}
-				physArg = r
-			case mlir.Offset:
-				src = a.ToPhysical(arg, false)
-				r, err := a.getPhysicalRegister(val)
-				if err == nil {
-					physArg = r
-					break
-				}
-
-				physArg, err = a.nextPhysicalRegister(arg, false)
-				if err != nil {
-					panic(err)
-				}
-
-				_, isFuncArg := val.Base.(mlir.FuncArg)
-				switch val.Offset.(type) {
-				case mlir.IntLiteral, mlir.LocalValue, mlir.FuncArg, mlir.TempValue:
-					// Get the offset from memory into a register
-					offr, err := a.getPhysicalRegister(val.Offset)
-					if err != nil {
-						offr, err = a.nextPhysicalRegister(arg, false)
-						if err != nil {
-							panic(err)
-						}
-						v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(val.Offset, false), offr)
-					}
-
-					baseAddr, err := a.tempPhysicalRegister(false)
-					if err != nil {
-						panic(err)
-					}
-					if isFuncArg || a.isSliceBase(val.Base) {
-						v += fmt.Sprintf("\tMOVQ %v, %v\n\t", src, baseAddr)
-					} else {
-						v += fmt.Sprintf("\tMOVQ $%v, %v\n\t", src, baseAddr)
-					}
-					// Offset from base into a physical register
-					suff := a.opSuffix(val.Base, dst)
-
-					fakescale := false
-					if val.Scale == 16 {
-						// Scales need to be 1, 2, 4, or 8, so if it's 16 we multiply the offset
-						// by 2 and use a scale of 8 in the asm.
-						v += fmt.Sprintf("\tSAL%v $1, %v\n\t", suffix, offr)
-						val.Scale = 8
-						fakescale = true
-					}
-					if fa, ok := val.Base.(mlir.FuncArg); ok {
-						// FIXME: This is a hack. It isn't very robust.
-						switch t := fa.Type.(type) {
-						case ast.ArrayType:
-							if t.Base.TypeName() == "byte" {
-								suff = "BQZX"
-							}
-						}
-
-					}
-					v += fmt.Sprintf("\tMOV%v (%v)(%v*%d), %v\n\t", suff, baseAddr, offr, val.Scale, physArg)
-					if fakescale {
-						// Scale of 16 implies size of 16,
-						// so after moving the first piece, add 1 to the index and copy the second
-						v += fmt.Sprintf("MOV%v %v, %v\n\t", suffix, physArg, fa)
-
-						if o.TailCall {
-							panic("Unhandled tail call")
-						} else {
-							dst := mlir.FuncCallArg{i*2 + 1, ast.TypeInfo{8, arg.Signed()}}
-							fa = a.ToPhysical(dst, true)
-						}
-						v += fmt.Sprintf("\tINC%v %v\n", suff, offr)
-						v += fmt.Sprintf("\tMOV%v (%v)(%v*%d), %v\n\t", suff, baseAddr, offr, val.Scale, physArg)
-					}
-				default:
-					panic(fmt.Sprintf("Unhandled offset type %v", reflect.TypeOf(val.Offset)))
-				}
-			default:
-				physArg = a.ToPhysical(arg, true)
-			}
-			v += fmt.Sprintf("MOV%v %v, %v\n\t", suffix, physArg, fa)
-		}
-		if o.TailCall {
-			// Optimize the call away to a JMP and reuse the stack
-			// frame.
-			tmp, err := a.tempPhysicalRegister(false)
-			if err != nil {
-				panic(err)
-			}
-			// Jump 1 instruction past the start of this symbol.
-			// The first instruction is SUBQ $k, SP which the linker
-			// inserts. We want to reuse the stack, not push to it.
-			//
-			// FIXME: This needs to manually adjust SP if the stack
-			// space reserved for the new symbol isn't the same as
-			// the current function.
-			v += fmt.Sprintf("MOVQ $%v+14(SB), %v\n\t", o.FName, tmp)
-			return v + fmt.Sprintf("JMP %v", tmp)
-		}
-		v += fmt.Sprintf("CALL %v+0(SB)", o.FName)
-		// The call likely screwed up all the registers that we knew about, so reset our
-		// representation of them to fresh..
-		a.clearRegisterMapping()
-		return v
-	case mlir.RET:
-		return fmt.Sprintf("RET")
+		code = a.mov(o)
 	case mlir.ADD:
-		dst, err := a.getPhysicalRegister(o.Dst)
-		v := ""
-		if err != nil {
-			dst, err = a.nextPhysicalRegister(o.Dst, false)
-			if err != nil {
-				panic(err)
-			}
-			// This is the first time using this register for this
-			// value, so just MOV the value into it and trash whatever
-			// was there before.
-			return fmt.Sprintf("MOVQ %v, %v", a.ToPhysical(o.Src, false), dst)
-		}
-		var src PhysicalRegister
-		switch val := o.Src.(type) {
-		case mlir.LocalValue:
-			// First check if the arg is already in a register.
-			r, err := a.getPhysicalRegister(val)
-			if err == nil {
-				src = r
-				break
-			}
-			src, err = a.tempPhysicalRegister(false)
-			if err != nil {
-				panic(err)
-			}
-			v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(val, false), src)
-		case mlir.Offset:
-			// First check if the arg is already in a register.
-			r, err := a.getPhysicalRegister(val)
-			if err == nil {
-				src = r
-				break
-			}
-			src, err = a.tempPhysicalRegister(false)
-			if err != nil {
-				panic(err)
-			}
-			suffix := a.singleRegSuffix(int(val.Scale))
-			offset, err := a.getPhysicalRegister(val.Offset)
-			if err != nil {
-				offset, err = a.nextPhysicalRegister(val.Offset, false)
-				if err != nil {
-					panic(err)
-				}
-
-			}
-			v += fmt.Sprintf("\tMOV%v %v, %v\n\t", suffix, a.ToPhysical(val.Offset, false), offset)
-			v += fmt.Sprintf("\tMOV%v %v(%v*%d), %v\n\t", suffix, a.ToPhysical(val, false), offset, val.Scale, src)
-		case mlir.TempValue:
-			src, err = a.getPhysicalRegister(val)
-		default:
-			src = a.ToPhysical(val, false)
-		}
-
-		switch o.Dst.(type) {
-		case mlir.TempValue:
-			dst, err := a.getPhysicalRegister(o.Dst)
-			if err != nil {
-				dst, err = a.nextPhysicalRegister(o.Dst, false)
-				if err != nil {
-					panic(err)
-				}
-			}
-			return v + fmt.Sprintf("ADDQ %v, %v", src, dst)
-		default:
-			return v + fmt.Sprintf("ADDQ %v, %v", src, a.ToPhysical(o.Dst, false))
-		}
+		code = a.arithmetic("ADDQ", o.Src, o.Dst)
 	case mlir.SUB:
-		// Special cases: 1, 0, and -1
-		if o.Src == mlir.IntLiteral(0) {
-			// Subtracting 0 from something is stupid.
-			return ""
-		} else if o.Src == mlir.IntLiteral(1) {
-			if dst, err := a.getPhysicalRegister(o.Dst); err == nil {
-				return fmt.Sprintf("DECQ %v", dst)
-			}
-			//return fmt.Sprintf("DECQ %v", a.ToPhysical(o.Dst, false))
-		} else if o.Src == mlir.IntLiteral(-1) {
-			if dst, err := a.getPhysicalRegister(o.Dst); err == nil {
-				return fmt.Sprintf("INCQ %v", dst)
-			}
-		}
-		// Normal subtraction.
-		// FIXME: This is only required if o.Right isn't really a register,
-		// but a fake register like "$15".
-		r, err := a.tempPhysicalRegister(true)
-		if err != nil {
-			panic(err)
-		}
-
-		v := ""
-		switch o.Src.(type) {
-		case mlir.TempValue:
-			src, err := a.getPhysicalRegister(o.Src)
-			if err != nil {
-				panic(err)
-			}
-			v += fmt.Sprintf("MOVQ %v, %v\n\t", src, r)
-		default:
-			v += fmt.Sprintf("MOVQ %v, %v\n\t", a.ToPhysical(o.Src, false), r)
-		}
-		switch o.Dst.(type) {
-		case mlir.TempValue:
-			dst, err := a.getPhysicalRegister(o.Dst)
-			if err != nil {
-				dst, err = a.nextPhysicalRegister(o.Dst, false)
-				if err != nil {
-					panic(err)
-				}
-			}
-			return v + fmt.Sprintf("SUBQ %v, %v", r, dst)
-		default:
-			return v + fmt.Sprintf("SUBQ %v, %v", r, a.ToPhysical(o.Dst, false))
-		}
-	case mlir.MOD:
-		v := ""
-		// DIV clobbers DX with the result of the MOD, so if there's
-		// anything there preserve it
-		popax, popdx := false, false
-		if a.ax != nil && a.ax != o.Left {
-			v += "PUSHQ AX\n\t"
-			popax = true
-		}
-
-		if a.dx != nil && a.dx != o.Dst {
-			v += "PUSHQ DX\n\t"
-			popdx = true
-		}
-		if off, isoffset := o.Left.(mlir.Offset); isoffset {
-			r, err := a.tempPhysicalRegister(false)
-			if err != nil {
-				panic(err)
-			}
-			r2, err := a.tempPhysicalRegister2(false)
-			if err != nil {
-				panic(err)
-			}
-			// Offsets need to be resolved before being moved into AX
-			//Note: val.Offset should be a literal.
-			v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(off.Offset, false), r)
-			v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(off.Base, false), r2)
-			switch off.Scale {
-			case 1:
-				v += fmt.Sprintf("\tMOVBQZX (%v)(%v*%v), %v\n\t", r2, r, off.Scale, r)
-			case 2:
-				v += fmt.Sprintf("\tMOWLQZX (%v)(%v*%v), %v\n\t", r2, r, off.Scale, r)
-			case 4:
-				v += fmt.Sprintf("\tMOVLQZXQ (%v)(%v*%v), %v\n\t", r2, r, off.Scale, r)
-			case 8:
-				v += fmt.Sprintf("\tMOVQ (%v)(%v*%v), %v\n\t", r2, r, off.Scale, r)
-			default:
-			}
-
-			v += fmt.Sprintf("MOVQ %v, AX\n\t", r)
-		} else {
-			v += fmt.Sprintf("MOVQ %v, AX // %v\n\t", a.ToPhysical(o.Left, false), o.Left)
-		}
-		v += "MOVQ $0, DX\n\t"
-
-		// FIXME: This is only required if o.Right isn't really a register,
-		// but a fake register like "$15".
-		r, err := a.tempPhysicalRegister2(true)
-		if err != nil {
-			panic(err)
-		}
-
-		v += fmt.Sprintf("MOVQ %v, %v\n\t", a.ToPhysical(o.Right, false), r)
-
-		if o.Left.Signed() {
-			v += fmt.Sprintf("IDIVQ %v\n\t", r)
-		} else {
-			v += fmt.Sprintf("DIVQ %v\n\t", r)
-		}
-		switch o.Dst.(type) {
-		case mlir.TempValue:
-			r, err = a.nextPhysicalRegister(o.Dst, false)
-			if err != nil {
-				panic(err)
-			}
-			v += fmt.Sprintf("MOVQ DX, %v", r)
-		default:
-			v += fmt.Sprintf("MOVQ DX, %v", a.ToPhysical(o.Dst, false))
-		}
-		if popdx {
-			v += "\n\tPOPQ DX"
-		}
-		if popax {
-			v += "\n\tPOPQ AX"
-		}
-		return v
-	case mlir.DIV:
-		v := ""
-		// DIV clobbers DX with the result of the MOD, so if there's
-		// anything there preserve it
-		popax, popdx := false, false
-		if a.ax != nil && a.ax != o.Left {
-			v += "PUSHQ AX\n\t"
-			popax = true
-		}
-
-		if a.dx != nil && a.dx != o.Dst {
-			v += "PUSHQ DX\n\t"
-			popdx = true
-		}
-		v += "MOVQ $0, DX\n\t"
-		v += fmt.Sprintf("MOVQ %v, AX // %v\n\t", a.ToPhysical(o.Left, false), o.Left)
-
-		// FIXME: This is only required if o.Right isn't really a register,
-		// but a fake register like "$15".
-		r, err := a.tempPhysicalRegister(true)
-		if err != nil {
-			panic(err)
-		}
-
-		v += fmt.Sprintf("MOVQ %v, %v\n\t", a.ToPhysical(o.Right, false), r)
-		v += fmt.Sprintf("IDIVQ %v\n\t", r)
-		switch o.Dst.(type) {
-		case mlir.TempValue:
-			dst, err := a.nextPhysicalRegister(o.Dst, false)
-			if err != nil {
-				panic(err)
-			}
-			v += fmt.Sprintf("MOVQ AX, %v", dst)
-		default:
-			v += fmt.Sprintf("MOVQ AX, %v", a.ToPhysical(o.Dst, false))
-		}
-		if popdx {
-			v += "\n\tPOPQ DX"
-		}
-		if popax {
-			v += "\n\tPOPQ AX"
-		}
-		return v
+		code = a.arithmetic("SUBQ", o.Src, o.Dst)
 	case mlir.MUL:
-		v := ""
-		// MUL multiples AX by the operand, and puts the overflow in
-		// DX, so preserve them if there's anything there.
-		popax, popdx := false, false
-		if a.ax != nil && a.ax != o.Left {
-			v += "PUSHQ AX\n\t"
-			popax = true
-		}
-
-		if a.dx != nil && a.dx != o.Dst {
-			v += "PUSHQ DX\n\t"
-			popdx = true
-		}
-		l, err := a.getPhysicalRegister(o.Left)
-		if err != nil {
-			l = a.ToPhysical(o.Left, false)
-		}
-		v += fmt.Sprintf("MOVQ %v, AX // %v\n\t", l, o.Left)
-
-		// FIXME: This is only required if o.Right isn't really a register,
-		// but a fake register like "$15".
-		r, err := a.tempPhysicalRegister(true)
-		if err != nil {
-			panic(err)
-		}
-
-		rt, err := a.getPhysicalRegister(o.Right)
-		if err != nil {
-			rt = a.ToPhysical(o.Right, false)
-		}
-		v += fmt.Sprintf("MOVQ %v, %v\n\t", rt, r)
-		v += fmt.Sprintf("MULQ %v\n\t", r)
-		switch o.Dst.(type) {
-		case mlir.TempValue:
-			dst, err := a.getPhysicalRegister(o.Dst)
-			if err != nil {
-				dst, err = a.nextPhysicalRegister(o.Dst, false)
-				if err != nil {
-					panic(err)
-				}
-			}
-			v += fmt.Sprintf("MOVQ AX, %v", dst)
-		default:
-			v += fmt.Sprintf("MOVQ AX, %v", a.ToPhysical(o.Dst, false))
-		}
-		if popdx {
-			v += "\n\tPOPQ DX"
-		}
-		if popax {
-			v += "\n\tPOPQ AX"
-		}
-		return v
+		code = a.mul(o)
+	case mlir.DIV:
+		code = a.div(i, o.Left, o.Right, o.Dst, true, true)
+	case mlir.MOD:
+		code = a.div(i, o.Left, o.Right, o.Dst, false, o.Left.Signed())
+	case mlir.CALL:
+		code = a.call(i, o)
+	case mlir.RET:
+		code = append(a.restoreSaved(), "RET")
 	case mlir.JMP:
 		return fmt.Sprintf("JMP %v", o.Label.Inline())
 	case mlir.JE:
-		return a.cJmpIR("JE", o.ConditionalJump)
+		code = a.cJmpIR("JE", o.ConditionalJump)
 	case mlir.JL:
-		return a.cJmpIR("JL", o.ConditionalJump)
+		code = a.cJmpIR("JL", o.ConditionalJump)
 	case mlir.JLE:
-		return a.cJmpIR("JLE", o.ConditionalJump)
+		code = a.cJmpIR("JLE", o.ConditionalJump)
 	case mlir.JNE:
-		return a.cJmpIR("JNE", o.ConditionalJump)
+		code = a.cJmpIR("JNE", o.ConditionalJump)
 	case mlir.JGE:
-		return a.cJmpIR("JGE", o.ConditionalJump)
+		code = a.cJmpIR("JGE", o.ConditionalJump)
 	case mlir.JG:
-		return a.cJmpIR("JG", o.ConditionalJump)
+		code = a.cJmpIR("JG", o.ConditionalJump)
 	default:
 		panic(fmt.Sprintf("Unhandled instruction in AMD64 code generation %v", reflect.TypeOf(o)))
 	}
+	return strings.Join(code, "\n\t")
 }
 
-func (a Amd64) cJmpIR(op string, o mlir.ConditionalJump) string {
-	switch src := o.Src.(type) {
-	case mlir.TempValue:
-		srcr, err := a.getPhysicalRegister(src)
-		if err != nil {
-			panic(err)
+func (a *Amd64) mov(o mlir.MOV) []string {
+	// Moving to a larger register extends the value based on the
+	// signedness of the destination.
+	signed := o.Src.Signed()
+	if src, dst := o.Src.Size(), o.Dst.Size(); src != 0 && src < dst && src < 8 {
+		signed = o.Dst.Signed()
+	}
+	if lit, ok := o.Src.(mlir.IntLiteral); ok {
+		if code, ok := a.storeLiteral(lit, o.Dst); ok {
+			return code
 		}
-		return fmt.Sprintf("\n\tCMPQ %v, %v\n\t%v %v", srcr, a.ToPhysical(o.Dst, false), op, o.Label.Inline())
-	case mlir.Offset:
-		var v string
-		dst, err := a.getPhysicalRegister(o.Dst)
-		if err != nil {
-			dst, err = a.nextPhysicalRegister(o.Dst, false)
-			if err != nil {
-				panic(err)
+	}
+	if loc, size, ok := a.location(o.Dst, true); ok {
+		if loc.IsRealRegister() {
+			return a.load(o.Src, loc, signed)
+		}
+		if size == 8 {
+			if src, code := a.source(o.Src, scratchValue); code == nil && !src.isMemory() {
+				return []string{fmt.Sprintf("MOVQ %v, %v", src, loc)}
 			}
-			v += fmt.Sprintf("MOV%v %v, %v\n\t", a.singleRegSuffix(o.Dst.Size()), a.ToPhysical(o.Dst, false), dst)
 		}
+	}
+	return append(a.load(o.Src, scratchValue, signed), a.store(scratchValue, o.Dst)...)
+}
 
-		idx, err := a.tempPhysicalRegister(false)
-		if err != nil {
-			panic(err)
-		}
-		srcr, err := a.tempPhysicalRegister2(false)
-		if err != nil {
-			panic(err)
+// Returns the code to store lit directly into memory at r, if lit can be
+// encoded as an immediate of r's size.
+func (a *Amd64) storeLiteral(lit mlir.IntLiteral, r mlir.Register) ([]string, bool) {
+	var code []string
+	var dst string
+	var size int
+	switch v := r.(type) {
+	case mlir.Offset:
+		m, addrcode := a.address(v)
+		code, dst, size = addrcode, m.String(), int(v.Scale)
+	default:
+		loc, locsize, ok := a.location(r, true)
+		if !ok || !loc.isMemory() {
+			return nil, false
 		}
+		dst, size = string(loc), locsize
+	}
+	var fits bool
+	switch size {
+	case 1:
+		fits = lit >= -1<<7 && lit < 1<<8
+	case 2:
+		fits = lit >= -1<<15 && lit < 1<<16
+	case 4, 8:
+		fits = int64(lit) == int64(int32(lit))
+	}
+	if !fits {
+		return nil, false
+	}
+	return append(code, fmt.Sprintf("MOV%v $%d, %v", a.singleRegSuffix(size), lit, dst)), true
+}
 
-		v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(src.Offset, false), idx)
-
-		switch src.Base.(type) {
-		case mlir.FuncArg:
-			v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(src.Base, false), srcr)
-		case mlir.LocalValue:
-			if a.isSliceBase(src.Base) {
-				v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(src.Base, false), srcr)
-			} else {
-				v += fmt.Sprintf("\tMOVQ $%v, %v\n\t", a.ToPhysical(src.Base, false), srcr)
+func (a *Amd64) arithmetic(instr string, src, dst mlir.Register) []string {
+	loc, size, ok := a.location(dst, true)
+	if ok && (loc.IsRealRegister() || size == 8) {
+		if lit, isLit := src.(mlir.IntLiteral); isLit {
+			if instr == "SUBQ" {
+				lit = -lit
+			}
+			switch lit {
+			case 0:
+				return nil
+			case 1:
+				return []string{fmt.Sprintf("INCQ %v", loc)}
+			case -1:
+				return []string{fmt.Sprintf("DECQ %v", loc)}
 			}
-		default:
-			panic("Unhandled type for offset")
-			//v += fmt.Sprintf("\tMOVQ %v, %v\n\t", a.ToPhysical(src.Base, false), srcr)
 		}
-		suffix := a.opSuffix(src.Base, fakeRegister{8, src.Base.Signed()})
-		v += fmt.Sprintf("MOV%v (%v)(%v*%v), %v\n\t", suffix, srcr, idx, src.Scale, srcr)
+		op, code := a.source(src, scratchValue)
+		if loc.isMemory() && op.isMemory() {
+			code = append(code, fmt.Sprintf("MOVQ %v, %v", op, scratchValue))
+			op = scratchValue
+		}
+		return append(code, fmt.Sprintf("%v %v, %v", instr, op, loc))
+	}
+	code := a.load(dst, scratchValue, dst.Signed())
+	op, srccode := a.source(src, scratchOther)
+	code = append(code, srccode...)
+	code = append(code, fmt.Sprintf("%v %v, %v", instr, op, scratchValue))
+	return append(code, a.store(scratchValue, dst)...)
+}
 
-		v += fmt.Sprintf("CMPQ %v, %v\n\t", srcr, dst)
-		v += fmt.Sprintf("%v %v", op, o.Label.Inline())
-		return v
-	default:
-		srcr, err := a.tempPhysicalRegister(false)
-		if err != nil {
-			panic(err)
+func (a *Amd64) mul(o mlir.MUL) []string {
+	left, right := o.Left, o.Right
+	dst := scratchValue
+	if loc, _, ok := a.location(o.Dst, true); ok && loc.IsRealRegister() && loc != "AX" {
+		dst = loc
+		if rloc, _, ok := a.location(right, false); ok && rloc == dst {
+			left, right = right, left
 		}
-		switch o.Dst.(type) {
-		case mlir.TempValue:
-			dst, err := a.getPhysicalRegister(o.Dst)
-			if err != nil {
-				dst, err = a.nextPhysicalRegister(o.Dst, false)
-				if err != nil {
-					panic(err)
+	}
+	code := a.load(left, dst, left.Signed())
+	op, srccode := a.source(right, scratchOther)
+	code = append(code, srccode...)
+	code = append(code, fmt.Sprintf("IMULQ %v, %v", op, dst))
+	return append(code, a.store(dst, o.Dst)...)
+}
+
+// Generates the code for the i'th instruction, which divides left by right
+// and stores either the quotient or the remainder in dst.
+func (a *Amd64) div(i int, left, right, dst mlir.Register, quotient, signed bool) []string {
+	var code []string
+	// DIV uses AX, which is also the first return value.
+	saveAX := a.liveOut[i][mlir.FuncRetVal{}]
+	if fr, ok := dst.(mlir.FuncRetVal); ok && fr.Id == 0 {
+		saveAX = false
+	}
+	if saveAX {
+		code = append(code, fmt.Sprintf("MOVQ AX, %v", scratchOther))
+	}
+	// The divisor needs to be calculated first, since it may be in AX.
+	divisor, size, ok := a.location(right, false)
+	if !ok || divisor == "AX" || size != 8 {
+		code = append(code, a.load(right, scratchValue, right.Signed())...)
+		divisor = scratchValue
+	}
+	code = append(code, a.load(left, "AX", left.Signed())...)
+	if signed {
+		code = append(code, "CQO", fmt.Sprintf("IDIVQ %v", divisor))
+	} else {
+		code = append(code, "XORL DX, DX", fmt.Sprintf("DIVQ %v", divisor))
+	}
+	if quotient {
+		code = append(code, a.store("AX", dst)...)
+	} else {
+		code = append(code, a.store("DX", dst)...)
+	}
+	if saveAX {
+		code = append(code, fmt.Sprintf("MOVQ %v, AX", scratchOther))
+	}
+	return code
+}
+
+// Returns the code to move the arguments for a CALL onto the stack. Also
+// returns the number of words that were written.
+func (a *Amd64) callArgs(args []mlir.Register) ([]string, int) {
+	var code []string
+	words := 0
+	slot := func(n int) string {
+		if n+1 > words {
+			words = n + 1
+		}
+		return fmt.Sprintf("%d(SP)", n*8)
+	}
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case mlir.SliceBasePointer:
+			switch b := v.Register.(type) {
+			case mlir.LocalValue:
+				code = append(code, a.load(mlir.Pointer{Register: b}, scratchValue, false)...)
+			case mlir.Offset:
+				code = append(code, a.load(mlir.Pointer{Register: b}, scratchValue, false)...)
+			default:
+				code = append(code, a.load(b, scratchValue, b.Signed())...)
+			}
+			code = append(code, fmt.Sprintf("MOVQ %v, %v", scratchValue, slot(i)))
+		case mlir.Offset:
+			m, addrcode := a.address(v)
+			code = append(code, addrcode...)
+			if v.Scale == 16 {
+				hi := m
+				hi.disp += 8
+				code = append(code,
+					fmt.Sprintf("MOVQ %v, %v", m, scratchValue),
+					fmt.Sprintf("MOVQ %v, %v", scratchValue, slot(i)),
+					fmt.Sprintf("MOVQ %v, %v", hi, scratchValue),
+					fmt.Sprintf("MOVQ %v, %v", scratchValue, slot(i*2+1)),
+				)
+				continue
+			}
+			size := v.Base.Size()
+			if fa, ok := v.Base.(mlir.FuncArg); ok {
+				size = 8
+				if t, ok := fa.Type.(ast.ArrayType); ok && t.Base.TypeName() == "byte" {
+					size = 1
 				}
 			}
-			// FIXME: Only required if both src and dst are not really registers.
-			suffix := a.opSuffix(o.Src, o.Dst)
-			v := fmt.Sprintf("MOV%v %v, %v", suffix, a.ToPhysical(o.Src, false), srcr)
-			return v + fmt.Sprintf("\n\tCMP%v %v, %v\n\t%v %v", a.singleRegSuffix(o.Dst.Size()), src, dst, op, o.Label.Inline())
+			code = append(code,
+				fmt.Sprintf("%v %v, %v", loadInstruction(size, false), m, scratchValue),
+				fmt.Sprintf("MOVQ %v, %v", scratchValue, slot(i)),
+			)
 		default:
-			// FIXME: Only required if both src and dst are not really registers
-			suffix := a.opSuffix(o.Src, o.Dst)
-			v := fmt.Sprintf("MOV%v %v, %v", suffix, a.ToPhysical(o.Src, false), srcr)
-			return v + fmt.Sprintf("\n\tCMP%v %v, %v\n\t%v %v", a.singleRegSuffix(o.Dst.Size()), srcr, a.ToPhysical(o.Dst, false), op, o.Label.Inline())
+			op, srccode := a.source(arg, scratchValue)
+			if op.isMemory() {
+				srccode = append(srccode, fmt.Sprintf("MOVQ %v, %v", op, scratchValue))
+				op = scratchValue
+			}
+			code = append(code, srccode...)
+			code = append(code, fmt.Sprintf("MOVQ %v, %v", op, slot(i)))
 		}
 	}
+	return code, words
+}
+
+// Generates the i'th instruction, a CALL.
+func (a *Amd64) call(i int, o mlir.CALL) []string {
+	args, words := a.callArgs(o.Args)
+	if o.TailCall {
+		return a.tailCall(o, args, words)
+	}
+	// Anything that's still needed after the call and is in a caller
+	// saved register is saved around it.
+	var save, restore []string
+	for _, v := range a.liveRegisters(i) {
+		save = append(save, fmt.Sprintf("MOVQ %v, %d(SP)", a.registers[v], a.slots[v]))
+		restore = append(restore, fmt.Sprintf("MOVQ %d(SP), %v", a.slots[v], a.registers[v]))
+	}
+	code := append(save, args...)
+	code = append(code, fmt.Sprintf("CALL %v+0(SB)", o.FName))
+	return append(code, restore...)
 }
 
-// Fake a type of register. Usually used to force something to be
-// sign extended with opSuffix.
-type fakeRegister struct {
-	size   int
-	signed bool
+// Generates a tail call. The arguments are calculated in the area for
+// calling functions before being copied over this function's arguments,
+// so that calculating them doesn't clobber any arguments that are still
+// needed.
+func (a *Amd64) tailCall(o mlir.CALL, args []string, words int) []string {
+	if uint(words) > a.numArgs {
+		// The arguments don't fit in the space the caller reserved for
+		// ours, so make a regular call instead.
+		code := append(args, fmt.Sprintf("CALL %v+0(SB)", o.FName))
+		return append(append(code, a.restoreSaved()...), "RET")
+	}
+	code := args
+	for n := 0; n < words; n++ {
+		code = append(code,
+			fmt.Sprintf("MOVQ %d(SP), %v", n*8, scratchValue),
+			fmt.Sprintf("MOVQ %v, P%d+%d(FP)", scratchValue, n, n*8),
+		)
+	}
+	if string(o.FName) == a.name {
+		// The entry point is after the callee saved registers are
+		// saved, so they're still saved for the original caller.
+		return append(code, fmt.Sprintf("JMP %v", tailCallEntry))
+	}
+	// RET with a target tears down the stack frame before jumping.
+	code = append(code, a.restoreSaved()...)
+	return append(code, fmt.Sprintf("RET %v(SB)", o.FName))
 }
 
-func (f fakeRegister) Signed() bool {
-	return f.signed
+// Returns the code which saves the callee saved registers that the
+// function uses when it's entered.
+func (a *Amd64) saveSaved() []string {
+	var code []string
+	for _, r := range a.savedRegisters() {
+		code = append(code, fmt.Sprintf("MOVQ %v, %d(SP)", r, a.saved[r]))
+	}
+	return code
+}
+
+// Returns the code which restores the callee saved registers that the
+// function uses before it returns.
+func (a *Amd64) restoreSaved() []string {
+	var code []string
+	for _, r := range a.savedRegisters() {
+		code = append(code, fmt.Sprintf("MOVQ %d(SP), %v", a.saved[r], r))
+	}
+	return code
 }
 
-func (f fakeRegister) Size() int {
-	return f.size
+func (a *Amd64) cJmpIR(op string, o mlir.ConditionalJump) []string {
+	var code []string
+	left, size, ok := a.location(o.Src, false)
+	if !ok || size != 8 {
+		code = a.load(o.Src, scratchValue, o.Src.Signed())
+		left = scratchValue
+	}
+	right, srccode := a.source(o.Dst, scratchOther)
+	if left.isMemory() && right.isMemory() {
+		srccode = append(srccode, fmt.Sprintf("MOVQ %v, %v", right, scratchOther))
+		right = scratchOther
+	}
+	code = append(code, srccode...)
+	return append(code,
+		fmt.Sprintf("CMPQ %v, %v", left, right),
+		fmt.Sprintf("%v %v", op, o.Label.Inline()),
+	)
 }
@@ -0,0 +1,210 @@
+package codegen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/driusan/lang/compiler/mlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// Tests the assembly generated for functions, which doesn't need the
+// toolchain to build it.
+func TestCompileAssembly(t *testing.T) {
+	i64 := ast.TypeInfo{Size: 8, Signed: true}
+	lv := func(id uint) mlir.LocalValue { return mlir.LocalValue{Id: id, Info: i64} }
+	arg := func(id uint) mlir.FuncArg { return mlir.FuncArg{Id: id, Info: i64} }
+	tests := []struct {
+		Name string
+		Func mlir.Func
+		Want string
+	}{
+		{
+			// LV0 is live across both calls, so it goes in a callee
+			// saved register which is saved once by the function
+			// rather than around each call.
+			"CalleeSaved",
+			mlir.Func{
+				Name: "across",
+				Body: []mlir.Opcode{
+					mlir.MOV{Src: mlir.IntLiteral(3), Dst: lv(0)},
+					mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.IntLiteral(4)}},
+					mlir.CALL{FName: "PrintInt", Args: []mlir.Register{lv(0)}},
+					mlir.RET{},
+				},
+				NumLocals:       1,
+				LargestFuncCall: 1,
+			},
+			`TEXT across(SB), 4+16, $24
+	MOVQ R12, 16(SP)
+	MOVQ $3, R12
+	MOVQ $4, 0(SP)
+	CALL PrintInt+0(SB)
+	MOVQ R12, 0(SP)
+	CALL PrintInt+0(SB)
+	MOVQ 16(SP), R12
+	RET
+`,
+		},
+		{
+			// Only one value fits in a callee saved register, so the
+			// other is saved around the call.
+			"CallerSaved",
+			mlir.Func{
+				Name: "sum",
+				Body: []mlir.Opcode{
+					mlir.MOV{Src: mlir.IntLiteral(3), Dst: lv(0)},
+					mlir.MOV{Src: mlir.IntLiteral(4), Dst: lv(1)},
+					mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.IntLiteral(5)}},
+					mlir.ADD{Src: lv(1), Dst: lv(0)},
+					mlir.MOV{Src: lv(0), Dst: mlir.FuncRetVal{}},
+					mlir.RET{},
+				},
+				NumLocals:       2,
+				LargestFuncCall: 1,
+			},
+			`TEXT sum(SB), 4+16, $32
+	MOVQ R12, 24(SP)
+	MOVQ $3, R12
+	MOVQ $4, CX
+	MOVQ CX, 16(SP)
+	MOVQ $5, 0(SP)
+	CALL PrintInt+0(SB)
+	MOVQ 16(SP), CX
+	ADDQ CX, R12
+	MOVQ R12, AX
+	MOVQ 24(SP), R12
+	RET
+`,
+		},
+		{
+			"Arithmetic",
+			mlir.Func{
+				Name: "arith",
+				Body: []mlir.Opcode{
+					mlir.MOV{Src: arg(0), Dst: mlir.TempValue(0)},
+					mlir.ADD{Src: mlir.IntLiteral(2), Dst: mlir.TempValue(0)},
+					mlir.MUL{Left: mlir.TempValue(0), Right: arg(1), Dst: mlir.TempValue(1)},
+					mlir.DIV{Left: mlir.TempValue(1), Right: mlir.IntLiteral(3), Dst: mlir.TempValue(2)},
+					mlir.MOV{Src: mlir.TempValue(2), Dst: mlir.FuncRetVal{}},
+					mlir.RET{},
+				},
+				NumArgs: 2,
+			},
+			`TEXT arith(SB), 4+16, $8-16
+	MOVQ P0+0(FP), CX
+	ADDQ $2, CX
+	MOVQ CX, SI
+	IMULQ P1+8(FP), SI
+	MOVQ $3, BX
+	MOVQ SI, AX
+	CQO
+	IDIVQ BX
+	MOVQ AX, DI
+	RET
+`,
+		},
+		{
+			"Index",
+			mlir.Func{
+				Name: "index",
+				Body: []mlir.Opcode{
+					mlir.MOV{Src: mlir.IntLiteral(1), Dst: lv(0)},
+					mlir.MOV{Src: mlir.IntLiteral(2), Dst: lv(1)},
+					mlir.MOV{Src: mlir.IntLiteral(3), Dst: lv(2)},
+					mlir.MOV{Src: mlir.Offset{Offset: arg(0), Scale: 8, Base: lv(0)}, Dst: mlir.TempValue(0)},
+					mlir.MOV{Src: mlir.TempValue(0), Dst: mlir.FuncRetVal{}},
+					mlir.RET{},
+				},
+				NumArgs:   1,
+				NumLocals: 3,
+			},
+			`TEXT index(SB), 4+16, $32-8
+	MOVQ $1, 8(SP)
+	MOVQ $2, 16(SP)
+	MOVQ $3, 24(SP)
+	MOVQ P0+0(FP), R14
+	MOVQ 8(SP)(R14*8), CX
+	MOVQ CX, AX
+	RET
+`,
+		},
+		{
+			// The recursive call is a jump back to the start of the
+			// function.
+			"SelfTailCall",
+			mlir.Func{
+				Name: "count",
+				Body: []mlir.Opcode{
+					mlir.Label("loop"),
+					mlir.JLE{mlir.ConditionalJump{Label: "done", Src: arg(0), Dst: mlir.IntLiteral(0)}},
+					mlir.MOV{Src: arg(0), Dst: mlir.TempValue(0)},
+					mlir.SUB{Src: mlir.IntLiteral(1), Dst: mlir.TempValue(0)},
+					mlir.CALL{FName: "count", Args: []mlir.Register{mlir.TempValue(0)}, TailCall: true},
+					mlir.Label("done"),
+					mlir.MOV{Src: mlir.IntLiteral(0), Dst: mlir.FuncRetVal{}},
+					mlir.RET{},
+				},
+				NumArgs:         1,
+				LargestFuncCall: 1,
+			},
+			`TEXT count(SB), 4+16, $16-8
+tailcallentry:
+	loop:
+
+	CMPQ P0+0(FP), $0
+	JLE done
+	MOVQ P0+0(FP), CX
+	DECQ CX
+	MOVQ CX, 0(SP)
+	MOVQ CX, BX
+	MOVQ BX, P0+0(FP)
+	JMP tailcallentry
+	done:
+
+	MOVQ $0, AX
+	RET
+`,
+		},
+		{
+			// The callee saved register is restored before the tail
+			// call, which returns to this function's caller.
+			"TailCall",
+			mlir.Func{
+				Name: "tail",
+				Body: []mlir.Opcode{
+					mlir.MOV{Src: arg(0), Dst: lv(0)},
+					mlir.CALL{FName: "PrintInt", Args: []mlir.Register{lv(0)}},
+					mlir.CALL{FName: "count", Args: []mlir.Register{lv(0)}, TailCall: true},
+				},
+				NumArgs:         1,
+				NumLocals:       1,
+				LargestFuncCall: 1,
+			},
+			`TEXT tail(SB), 4+16, $24-8
+	MOVQ R12, 16(SP)
+	MOVQ P0+0(FP), R12
+	MOVQ R12, 0(SP)
+	CALL PrintInt+0(SB)
+	MOVQ R12, 0(SP)
+	MOVQ R12, BX
+	MOVQ BX, P0+0(FP)
+	MOVQ 16(SP), R12
+	RET count(SB)
+	MOVQ 16(SP), R12
+	RET
+`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			var w strings.Builder
+			if err := Compile(&w, tc.Func); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.String(); got != tc.Want {
+				t.Errorf("Unexpected assembly: got\n%s\nwant\n%s", got, tc.Want)
+			}
+		})
+	}
+}
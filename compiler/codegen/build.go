@@ -6,11 +6,15 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"runtime"
 
 	"github.com/driusan/lang/stdlib"
 
 	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/compiler/hlir/opt"
+	"github.com/driusan/lang/compiler/hlir/vm"
 	"github.com/driusan/lang/compiler/mlir"
+	"github.com/driusan/lang/compiler/mlir/ssa"
 
 	"github.com/driusan/lang/parser/ast"
 	"github.com/driusan/lang/parser/token"
@@ -36,6 +40,9 @@ func buildFunc(dst io.Writer, src string) error {
 //
 // Returns the name of the executable created in d or an error
 func BuildProgram(d string, src io.Reader) (string, error) {
+	if entrypoint == "" {
+		return "", fmt.Errorf("Can not build programs on %v", runtime.GOOS)
+	}
 	mlir.Debug = false
 	// FIXME: This should be a library, not hardcoded string consts.
 	// FIXME: Make other architecture entrypoints..
@@ -96,21 +103,28 @@ func BuildProgram(d string, src io.Reader) (string, error) {
 
 	}
 
-	// Generate the IR for the functions.
-	for _, v := range prog {
-		switch v.(type) {
-		case ast.FuncDecl:
-			fnc, _, err := mlir.Generate(v, ti, c, enums)
-			if err != nil {
-				return "", err
-			}
-			if err := Compile(f, fnc); err != nil {
-				return "", err
-			}
-		case ast.TypeDefn, ast.EnumTypeDefn:
-			// No IR for types, we've already verified them.
-		default:
-			panic("Unhandled AST node type for code generation")
+	consts, err := vm.EvaluateConstants(prog, ti, c, enums)
+	if err != nil {
+		return "", err
+	}
+
+	// Generate the IR for the functions and optimize it. There's no IR
+	// for types or constants, they've already been verified or
+	// evaluated.
+	ir, err := opt.Generate(prog, ti, c, enums, consts)
+	if err != nil {
+		return "", err
+	}
+	if err := opt.Default.Run(ir); err != nil {
+		return "", err
+	}
+	for _, fnc := range ir.Funcs {
+		mf := mlir.Convert(fnc, c, ir.RegisterData[fnc.Name])
+		if opt.Default.Level >= opt.O2 {
+			mf = ssa.Optimize(mf)
+		}
+		if err := Compile(f, mf); err != nil {
+			return "", err
 		}
 	}
 
@@ -56,17 +56,17 @@ reverse:
 
 	MOVQ R8, R11 // R11 = end char to swap idx
 	DECQ R11
-	MOVQ $0, R12 // R12 = start char to swap idx
+	MOVQ $0, R14 // R14 = start char to swap idx. R12 is callee saved.
 	SARQ $1, R8 // R8 /= 2.. otherwise we'd reverse twice
 rloop:
 	CMPQ R8, $0
 	JE print 
 
 	MOVB (DI)(R11*1), AX
-	MOVB (DI)(R12*1), CX
-	MOVB AX, (DI)(R12*1)
+	MOVB (DI)(R14*1), CX
+	MOVB AX, (DI)(R14*1)
 	MOVB CX, (DI)(R11*1) 
-	INCQ R12
+	INCQ R14
 	DECQ R11
 	DECQ R8
 	JMP rloop
@@ -0,0 +1,22 @@
+//go:build !dragonfly && !linux && !darwin && !plan9
+// +build !dragonfly,!linux,!darwin,!plan9
+
+package codegen
+
+// Programs can't be built on other OSes, since the builtins make syscalls
+// which are specific to the OS, but they can still be run in the VM.
+const (
+	entrypoint = ""
+	exits      = ""
+	write      = ""
+	read       = ""
+	open       = ""
+	// createf is formatted with the mode that files are created with.
+	createf  = "// Create: unsupported (mode %d)"
+	closestr = ""
+)
+
+const (
+	O_CREAT  = 0
+	O_WRONLY = 0
+)
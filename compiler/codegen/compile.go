@@ -13,35 +13,40 @@ var debug bool = false
 // Compile takes an AST and writes the assembly that it compiles to to
 // w.
 func Compile(w io.Writer, f mlir.Func) error {
-	fmt.Fprintf(w, "TEXT %v(SB), 4+16, $%v\n", f.Name, reserveStackSize(f))
+	alloc := allocate(f)
+	fmt.Fprintf(w, "TEXT %v(SB), 4+16, $%v\n", f.Name, reserveStackSize(f, alloc))
 	data := dataLiterals(w, f)
-	cpu := Amd64{stringLiterals: data, numArgs: f.NumArgs, lvOffsets: make(map[uint]uint), sliceBase: make(map[mlir.Register]bool)}
-	cpu.clearRegisterMapping()
-	// calculate the offsets of every local value
-	offset := uint(f.NumArgs * 8)
+	cpu := Amd64{allocation: alloc, stringLiterals: data, name: f.Name, numArgs: f.NumArgs}
+	for _, instr := range cpu.saveSaved() {
+		fmt.Fprintf(w, "\t%s\n", instr)
+	}
 	for _, op := range f.Body {
-		regs := op.Registers()
-		for _, r := range regs {
-			switch lv := r.(type) {
-			case mlir.LocalValue:
-				_, ok := cpu.lvOffsets[lv.Id]
-				if !ok {
-					cpu.lvOffsets[lv.Id] = offset
-					offset += uint(lv.Size())
-				}
-			}
+		if call, ok := op.(mlir.CALL); ok && call.TailCall && string(call.FName) == f.Name {
+			fmt.Fprintf(w, "%v:\n", tailCallEntry)
+			break
 		}
-
 	}
+	var code []string
 	for i := range f.Body {
+		instr := cpu.ConvertInstruction(i, f.Body)
+		if instr == "" {
+			continue
+		}
 		// For debugging, add a comment with the IR serialization
+		// and leave the code unoptimized so that it lines up.
 		if debug {
-			fmt.Fprintf(w, "\t%s // %s", cpu.ConvertInstruction(i, f.Body), f.Body[i])
-		} else {
-			fmt.Fprintf(w, "\t%s\n", cpu.ConvertInstruction(i, f.Body))
+			fmt.Fprintf(w, "\t%s // %s", instr, f.Body[i])
+			continue
 		}
+		code = append(code, strings.Split(instr, "\n\t")...)
+	}
+	for _, instr := range peephole(code, peepholeRules) {
+		fmt.Fprintf(w, "\t%s\n", instr)
 	}
 	if len(f.Body) == 0 || f.Body[len(f.Body)-1] != (mlir.RET{}) {
+		for _, instr := range cpu.restoreSaved() {
+			fmt.Fprintf(w, "\t%s\n", instr)
+		}
 		fmt.Fprintf(w, "\tRET\n")
 	}
 
@@ -59,6 +64,29 @@ func (pr PhysicalRegister) IsRealRegister() bool {
 	}
 }
 
+// Returns true if pr is a memory operand.
+func (pr PhysicalRegister) isMemory() bool {
+	return strings.HasSuffix(string(pr), ")")
+}
+
+// Returns true if pr is a memory operand whose address is calculated from
+// the register r, such as 8(R13) or 0(SP)(R13*8) for R13.
+func (pr PhysicalRegister) addressUses(r PhysicalRegister) bool {
+	if !pr.isMemory() {
+		return false
+	}
+	for _, part := range strings.Split(string(pr), "(")[1:] {
+		part = strings.TrimSuffix(part, ")")
+		if i := strings.Index(part, "*"); i >= 0 {
+			part = part[:i]
+		}
+		if PhysicalRegister(part) == r {
+			return true
+		}
+	}
+	return false
+}
+
 var stringNum uint
 
 func dataLiterals(w io.Writer, f mlir.Func) map[mlir.StringLiteral]PhysicalRegister {
@@ -111,13 +139,9 @@ func printDataLiteral(w io.Writer, str string) PhysicalRegister {
 	return PhysicalRegister(name)
 }
 
-func reserveStackSize(f mlir.Func) string {
-	if f.NumLocals == 0 && f.NumArgs == 0 {
-		return fmt.Sprintf("%v", (f.LargestFuncCall+1)*8)
-	} else if f.NumLocals == 0 {
-		return fmt.Sprintf("%v-%d", (f.LargestFuncCall+1)*8, (f.NumArgs * 8))
-	} else if f.NumArgs == 0 {
-		return fmt.Sprintf("%d", (f.NumLocals*8)+((f.LargestFuncCall+1)*8))
+func reserveStackSize(f mlir.Func, alloc *allocation) string {
+	if f.NumArgs == 0 {
+		return fmt.Sprintf("%d", alloc.frameSize)
 	}
-	return fmt.Sprintf("%d-%d", (f.NumLocals*8)+(f.LargestFuncCall*8)+8, f.NumArgs*8)
+	return fmt.Sprintf("%d-%d", alloc.frameSize, f.NumArgs*8)
 }
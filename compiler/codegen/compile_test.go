@@ -596,6 +596,24 @@ func TestTestSuite(t *testing.T) {
 		{"sliceprint", "Foo", "Bar"},
 		{"arrayparam", "16", ""},
 		{"mutarrayparam", "", ""},
+		{"forrange", "01234\n10", ""},
+		{"forarray", "0:4\n1:5\n2:6\n", ""},
+		{"forslice", "10", ""},
+		{"forstring", "2", ""},
+		{"forexpr", "468\n2", ""},
+		{"forecho", "bar baz\n", ""},
+		{"break", "14", ""},
+		{"continue", "13579\n369", ""},
+		{"labeledloop", "0\n01\n012\ndone", ""},
+		{"tupleassign", "54\ngoodbye2\n45", ""},
+		{"tuplewith", "q310\np43\np413", ""},
+		{"matchnested", "5\n33\n-1\n0\nred\nnot red\nno colour\n", ""},
+		{"matchguard", "positive\nnegative\nzero\nnothing\nbig\n", ""},
+		{"matchtuple", "1 2 Fizz 4 Buzz Fizz 7 8 Fizz Buzz 11 Fizz 13 14 FizzBuzz \n7\nlots of green\n", ""},
+		{"ifexpr", "big\n9\n1 -1 0\n4\n", ""},
+		{"matchexpr", "none\nsome\nbig\n8 0\nfour\nlarge\n", ""},
+		{"constants", "hello\n1 16 17\nbig\n9\nconstant\n", ""},
+		{"inline", "6\n64\nhello 3\n", ""},
 	}
 
 	for _, tst := range tests {
@@ -0,0 +1,199 @@
+package codegen
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A peepholeRule rewrites a short sequence of generated instructions into
+// a cheaper equivalent.
+type peepholeRule struct {
+	name string
+	// Returns the instructions which replace the first n instructions of
+	// code if the rule matches. n is 0 if it doesn't.
+	rewrite func(code []string) (replacement []string, n int)
+}
+
+var peepholeRules = []peepholeRule{
+	{"move back", moveBack},
+	{"load after store", loadAfterStore},
+	{"constant compare", constantCompare},
+	{"jump to next", jumpToNext},
+	{"unreachable", unreachable},
+}
+
+// Runs the peephole rules over code until none of them match.
+func peephole(code []string, rules []peepholeRule) []string {
+	for changed := true; changed; {
+		changed = false
+		var out []string
+		for i := 0; i < len(code); {
+			matched := false
+			for _, rule := range rules {
+				if replacement, n := rule.rewrite(code[i:]); n > 0 {
+					out = append(out, replacement...)
+					i += n
+					matched, changed = true, true
+					break
+				}
+			}
+			if !matched {
+				out = append(out, code[i])
+				i++
+			}
+		}
+		code = out
+	}
+	return code
+}
+
+// Splits an instruction into its opcode and operands.
+func parseInstruction(instr string) (string, []string) {
+	parts := strings.SplitN(instr, " ", 2)
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return parts[0], strings.Split(parts[1], ", ")
+}
+
+// Returns the label that instr defines, if it's a label.
+func label(instr string) (string, bool) {
+	if !strings.HasSuffix(instr, ":\n") {
+		return "", false
+	}
+	return strings.TrimSuffix(instr, ":\n"), true
+}
+
+// Returns true if the operand is an immediate.
+func isImmediate(operand string) bool {
+	return strings.HasPrefix(operand, "$")
+}
+
+// MOVQ A, B; MOVQ B, A drops the second MOVQ, since A already has the
+// value. It doesn't if A is a memory operand whose address uses B, since
+// the first MOVQ changes which memory the second one stores to.
+func moveBack(code []string) ([]string, int) {
+	if len(code) < 2 {
+		return nil, 0
+	}
+	op1, args1 := parseInstruction(code[0])
+	op2, args2 := parseInstruction(code[1])
+	if op1 != "MOVQ" || op2 != "MOVQ" || len(args1) != 2 || len(args2) != 2 {
+		return nil, 0
+	}
+	if PhysicalRegister(args1[0]).addressUses(PhysicalRegister(args1[1])) {
+		return nil, 0
+	}
+	if args1[0] == args2[1] && args1[1] == args2[0] && !isImmediate(args1[0]) {
+		return code[:1], 2
+	}
+	return nil, 0
+}
+
+// MOVQ R, mem; MOVQ mem, R2 uses R instead of reloading the value that was
+// just stored.
+func loadAfterStore(code []string) ([]string, int) {
+	if len(code) < 2 {
+		return nil, 0
+	}
+	op1, args1 := parseInstruction(code[0])
+	op2, args2 := parseInstruction(code[1])
+	if op1 != "MOVQ" || op2 != "MOVQ" || len(args1) != 2 || len(args2) != 2 {
+		return nil, 0
+	}
+	src, mem := args1[0], args1[1]
+	if !PhysicalRegister(mem).isMemory() || args2[0] != mem {
+		return nil, 0
+	}
+	if !PhysicalRegister(src).IsRealRegister() && !isImmediate(src) {
+		return nil, 0
+	}
+	if src == args2[1] {
+		return code[:1], 2
+	}
+	return []string{code[0], fmt.Sprintf("MOVQ %v, %v", src, args2[1])}, 2
+}
+
+// MOVQ $a, R; CMPQ R, $b; Jcc L is either an unconditional jump or
+// nothing, depending on a and b.
+func constantCompare(code []string) ([]string, int) {
+	if len(code) < 3 {
+		return nil, 0
+	}
+	op1, args1 := parseInstruction(code[0])
+	op2, args2 := parseInstruction(code[1])
+	jcc, target := parseInstruction(code[2])
+	if op1 != "MOVQ" || op2 != "CMPQ" || len(args1) != 2 || len(args2) != 2 || len(target) != 1 {
+		return nil, 0
+	}
+	if !isImmediate(args1[0]) || args2[0] != args1[1] || !isImmediate(args2[1]) {
+		return nil, 0
+	}
+	a, err := strconv.ParseInt(args1[0][1:], 10, 64)
+	if err != nil {
+		return nil, 0
+	}
+	b, err := strconv.ParseInt(args2[1][1:], 10, 64)
+	if err != nil {
+		return nil, 0
+	}
+	var taken bool
+	switch jcc {
+	case "JE":
+		taken = a == b
+	case "JNE":
+		taken = a != b
+	case "JL":
+		taken = a < b
+	case "JLE":
+		taken = a <= b
+	case "JG":
+		taken = a > b
+	case "JGE":
+		taken = a >= b
+	default:
+		return nil, 0
+	}
+	// The register may still be used, so the MOVQ stays.
+	if taken {
+		return []string{code[0], "JMP " + target[0]}, 3
+	}
+	return code[:1], 3
+}
+
+// A jump to a label that immediately follows it does nothing.
+func jumpToNext(code []string) ([]string, int) {
+	op, args := parseInstruction(code[0])
+	if !strings.HasPrefix(op, "J") || len(args) != 1 {
+		return nil, 0
+	}
+	for _, instr := range code[1:] {
+		l, ok := label(instr)
+		if !ok {
+			return nil, 0
+		}
+		if l == args[0] {
+			return nil, 1
+		}
+	}
+	return nil, 0
+}
+
+// Nothing after a JMP or RET runs until the next label.
+func unreachable(code []string) ([]string, int) {
+	if op, _ := parseInstruction(code[0]); op != "JMP" && op != "RET" {
+		return nil, 0
+	}
+	n := 1
+	for n < len(code) {
+		if _, ok := label(code[n]); ok {
+			break
+		}
+		n++
+	}
+	if n == 1 {
+		return nil, 0
+	}
+	return code[:1], n
+}
@@ -0,0 +1,226 @@
+package codegen
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPeepholeRules(t *testing.T) {
+	tests := []struct {
+		Rule string
+		In   []string
+		Want []string
+
+		// A program from the testsuite which the rule applies to, and
+		// its output, which mustn't change when the rule is applied.
+		Program string
+		Stdout  string
+	}{
+		{
+			"move back",
+			[]string{"MOVQ CX, 32(SP)", "MOVQ 32(SP), CX", "CALL PrintInt+0(SB)"},
+			[]string{"MOVQ CX, 32(SP)", "CALL PrintInt+0(SB)"},
+			"equalcomparison", "true\n3\n",
+		},
+		{
+			"load after store",
+			[]string{"MOVQ BX, 24(SP)", "MOVQ 24(SP), R13", "MOVBQZX 1(R13), BX"},
+			[]string{"MOVQ BX, 24(SP)", "MOVQ BX, R13", "MOVBQZX 1(R13), BX"},
+			"slicefromarray", "34",
+		},
+		{
+			"constant compare",
+			[]string{"MOVQ $3, BX", "CMPQ BX, $4", "JL if0else", "MOVQ $1, 0(SP)", "MOVQ $5, BX", "CMPQ BX, $4", "JLE if1else"},
+			[]string{"MOVQ $3, BX", "JMP if0else", "MOVQ $1, 0(SP)", "MOVQ $5, BX"},
+			"greatercomparison", "4\n",
+		},
+		{
+			"jump to next",
+			[]string{"JMP if0elsedone", "if0else:\n", "if0elsedone:\n", "RET"},
+			[]string{"if0else:\n", "if0elsedone:\n", "RET"},
+			"break", "14",
+		},
+		{
+			"unreachable",
+			[]string{"RET", "JMP if0elsedone", "MOVQ $1, BX", "if0else:\n", "RET"},
+			[]string{"RET", "if0else:\n", "RET"},
+			"labeledloop", "0\n01\n012\ndone",
+		},
+	}
+	saved := peepholeRules
+	defer func() { peepholeRules = saved }()
+	for _, tc := range tests {
+		t.Run(tc.Rule, func(t *testing.T) {
+			var rule []peepholeRule
+			for _, r := range saved {
+				if r.name == tc.Rule {
+					rule = append(rule, r)
+				}
+			}
+			if len(rule) != 1 {
+				t.Fatalf("No rule named %v", tc.Rule)
+			}
+			if got := peephole(tc.In, rule); fmt.Sprint(got) != fmt.Sprint(tc.Want) {
+				t.Errorf("got %q want %q", got, tc.Want)
+			}
+
+			peepholeRules = nil
+			runTest(t, tc.Program, tc.Stdout, "")
+			peepholeRules = rule
+			runTest(t, tc.Program, tc.Stdout, "")
+		})
+	}
+}
+
+func TestPeepholeRewrites(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Rewrite func([]string) ([]string, int)
+		In      []string
+		Want    []string
+		N       int
+	}{
+		{
+			"MoveBack",
+			moveBack,
+			[]string{"MOVQ CX, 32(SP)", "MOVQ 32(SP), CX", "RET"},
+			[]string{"MOVQ CX, 32(SP)"},
+			2,
+		},
+		{
+			"MoveBackImmediate",
+			moveBack,
+			[]string{"MOVQ $3, CX", "MOVQ CX, $3"},
+			nil,
+			0,
+		},
+		{
+			"MoveBackDifferent",
+			moveBack,
+			[]string{"MOVQ CX, 32(SP)", "MOVQ 32(SP), DX"},
+			nil,
+			0,
+		},
+		{
+			// The load changes the address that's stored to.
+			"MoveBackAddressUsesDestination",
+			moveBack,
+			[]string{"MOVQ (R13), R13", "MOVQ R13, (R13)"},
+			nil,
+			0,
+		},
+		{
+			"MoveBackIndexUsesDestination",
+			moveBack,
+			[]string{"MOVQ 0(SP)(R13*8), R13", "MOVQ R13, 0(SP)(R13*8)"},
+			nil,
+			0,
+		},
+		{
+			"LoadAfterStore",
+			loadAfterStore,
+			[]string{"MOVQ BX, 24(SP)", "MOVQ 24(SP), R13"},
+			[]string{"MOVQ BX, 24(SP)", "MOVQ BX, R13"},
+			2,
+		},
+		{
+			"LoadAfterStoreSameRegister",
+			loadAfterStore,
+			[]string{"MOVQ BX, 24(SP)", "MOVQ 24(SP), BX"},
+			[]string{"MOVQ BX, 24(SP)"},
+			2,
+		},
+		{
+			"LoadAfterStoreImmediate",
+			loadAfterStore,
+			[]string{"MOVQ $4, 24(SP)", "MOVQ 24(SP), R13"},
+			[]string{"MOVQ $4, 24(SP)", "MOVQ $4, R13"},
+			2,
+		},
+		{
+			"LoadAfterStoreOtherMemory",
+			loadAfterStore,
+			[]string{"MOVQ BX, 24(SP)", "MOVQ 32(SP), R13"},
+			nil,
+			0,
+		},
+		{
+			"LoadAfterStoreToRegister",
+			loadAfterStore,
+			[]string{"MOVQ BX, CX", "MOVQ CX, R13"},
+			nil,
+			0,
+		},
+		{
+			"ConstantCompareTaken",
+			constantCompare,
+			[]string{"MOVQ $3, BX", "CMPQ BX, $4", "JL if0else"},
+			[]string{"MOVQ $3, BX", "JMP if0else"},
+			3,
+		},
+		{
+			"ConstantCompareNotTaken",
+			constantCompare,
+			[]string{"MOVQ $5, BX", "CMPQ BX, $4", "JLE if1else"},
+			[]string{"MOVQ $5, BX"},
+			3,
+		},
+		{
+			"ConstantCompareOtherRegister",
+			constantCompare,
+			[]string{"MOVQ $5, BX", "CMPQ CX, $4", "JLE if1else"},
+			nil,
+			0,
+		},
+		{
+			"ConstantCompareUnknownJump",
+			constantCompare,
+			[]string{"MOVQ $5, BX", "CMPQ BX, $4", "JCC if1else"},
+			nil,
+			0,
+		},
+		{
+			"JumpToNext",
+			jumpToNext,
+			[]string{"JMP if0elsedone", "if0else:\n", "if0elsedone:\n", "RET"},
+			nil,
+			1,
+		},
+		{
+			"JumpPastInstruction",
+			jumpToNext,
+			[]string{"JMP if0elsedone", "RET", "if0elsedone:\n"},
+			nil,
+			0,
+		},
+		{
+			"Unreachable",
+			unreachable,
+			[]string{"RET", "JMP if0elsedone", "MOVQ $1, BX", "if0else:\n", "RET"},
+			[]string{"RET"},
+			3,
+		},
+		{
+			"UnreachableToEnd",
+			unreachable,
+			[]string{"JMP loop0", "MOVQ $1, BX"},
+			[]string{"JMP loop0"},
+			2,
+		},
+		{
+			"ReachableLabel",
+			unreachable,
+			[]string{"JMP loop0", "if0else:\n", "RET"},
+			nil,
+			0,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			got, n := tc.Rewrite(tc.In)
+			if n != tc.N || fmt.Sprint(got) != fmt.Sprint(tc.Want) {
+				t.Errorf("got %q, %d want %q, %d", got, n, tc.Want, tc.N)
+			}
+		})
+	}
+}
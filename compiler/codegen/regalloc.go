@@ -0,0 +1,549 @@
+package codegen
+
+import (
+	"sort"
+
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// The registers that variables can be allocated to. AX and DX are used
+// implicitly by DIV (and AX holds the first return value), and the scratch
+// registers are used to load values that an instruction can't use directly,
+// so none of them are allocated.
+var allocatable = append(append([]PhysicalRegister(nil), callerSaved...), calleeSaved...)
+
+// Caller saved registers may be clobbered by a CALL, so the caller saves
+// any values in them that are still needed afterwards around it. The
+// builtins pass arguments to syscalls in them, and syscalls clobber CX and
+// R11.
+var callerSaved = []PhysicalRegister{"CX", "SI", "DI", "R8", "R9", "R10", "R11"}
+
+// Callee saved registers are preserved by every function, including the
+// builtins, so values in them survive a CALL. A function which uses one
+// saves it when it's entered and restores it before returning.
+var calleeSaved = []PhysicalRegister{"R12"}
+
+// Scratch registers. Each instruction is free to use them, and nothing is
+// kept in them from one instruction to the next.
+const (
+	// Holds the value being operated on.
+	scratchValue PhysicalRegister = "BX"
+	// The base and index registers of memory being indexed into.
+	scratchBase  PhysicalRegister = "R13"
+	scratchIndex PhysicalRegister = "R14"
+	// Holds a second value, when an instruction needs two.
+	scratchOther PhysicalRegister = "R15"
+)
+
+// An allocation describes where every value of a function lives.
+type allocation struct {
+	// The register allocated to each variable that lives in a register.
+	registers map[mlir.Register]PhysicalRegister
+	// The offset from SP of each variable that lives on the stack, and
+	// of the slot that a register is saved in when it needs to be
+	// preserved across a CALL.
+	slots map[mlir.Register]int
+
+	// LocalValues which hold the address of the first element of a
+	// slice, rather than being the first element of an array.
+	sliceBase map[uint]bool
+
+	// The variables live after each instruction.
+	liveOut []map[mlir.Register]bool
+
+	// The offset from SP of the slot that each callee saved register
+	// used by the function is saved in.
+	saved map[PhysicalRegister]int
+
+	// The size of the stack frame.
+	frameSize int
+}
+
+// Returns the variable that r refers to, if it's a value that's tracked by
+// the liveness analysis. LocalValues are identified by their Id.
+func variable(r mlir.Register) (mlir.Register, bool) {
+	switch v := r.(type) {
+	case mlir.TempValue, mlir.UTempValue:
+		return v, true
+	case mlir.LocalValue:
+		return mlir.LocalValue{Id: v.Id}, true
+	case mlir.FuncRetVal:
+		// FR0 is AX. It isn't allocated, but DIV and MOD need to know
+		// when it's live.
+		if v.Id == 0 {
+			return mlir.FuncRetVal{}, true
+		}
+	}
+	return nil, false
+}
+
+// Calls fn for every register read by r when it's used as an operand,
+// including the registers nested inside of it. If r is the destination of
+// an instruction, it's not read, but the registers nested in it are.
+func nestedRegisters(r mlir.Register, fn func(mlir.Register)) {
+	switch v := r.(type) {
+	case mlir.Offset:
+		fn(v.Offset)
+		nestedRegisters(v.Offset, fn)
+		fn(v.Base)
+		nestedRegisters(v.Base, fn)
+	case mlir.Pointer:
+		fn(v.Register)
+		nestedRegisters(v.Register, fn)
+	case mlir.SliceBasePointer:
+		fn(v.Register)
+		nestedRegisters(v.Register, fn)
+	}
+}
+
+// Returns the registers read and written by op.
+func useDef(op mlir.Opcode) (uses []mlir.Register, def mlir.Register) {
+	read := func(r mlir.Register) {
+		uses = append(uses, r)
+		nestedRegisters(r, func(n mlir.Register) { uses = append(uses, n) })
+	}
+	write := func(r mlir.Register) {
+		def = r
+		nestedRegisters(r, func(n mlir.Register) { uses = append(uses, n) })
+	}
+	switch o := op.(type) {
+	case mlir.MOV:
+		read(o.Src)
+		write(o.Dst)
+	case mlir.ADD:
+		read(o.Src)
+		read(o.Dst)
+		write(o.Dst)
+	case mlir.SUB:
+		read(o.Src)
+		read(o.Dst)
+		write(o.Dst)
+	case mlir.MUL:
+		read(o.Left)
+		read(o.Right)
+		write(o.Dst)
+	case mlir.DIV:
+		read(o.Left)
+		read(o.Right)
+		write(o.Dst)
+	case mlir.MOD:
+		read(o.Left)
+		read(o.Right)
+		write(o.Dst)
+	case mlir.CALL:
+		for _, a := range o.Args {
+			read(a)
+		}
+		if !o.TailCall {
+			def = mlir.FuncRetVal{}
+		}
+	case mlir.RET:
+		uses = append(uses, mlir.FuncRetVal{})
+	default:
+		if j, ok := conditionalJump(op); ok {
+			read(j.Src)
+			read(j.Dst)
+		}
+	}
+	return uses, def
+}
+
+// Returns the ConditionalJump of op, if it's a conditional jump.
+func conditionalJump(op mlir.Opcode) (mlir.ConditionalJump, bool) {
+	switch o := op.(type) {
+	case mlir.JE:
+		return o.ConditionalJump, true
+	case mlir.JNE:
+		return o.ConditionalJump, true
+	case mlir.JL:
+		return o.ConditionalJump, true
+	case mlir.JLE:
+		return o.ConditionalJump, true
+	case mlir.JG:
+		return o.ConditionalJump, true
+	case mlir.JGE:
+		return o.ConditionalJump, true
+	}
+	return mlir.ConditionalJump{}, false
+}
+
+// Returns the indexes of the instructions which can run after the i'th
+// instruction of body.
+func successors(body []mlir.Opcode, i int, labels map[mlir.Label]int) []int {
+	switch o := body[i].(type) {
+	case mlir.RET:
+		return nil
+	case mlir.CALL:
+		if o.TailCall {
+			return nil
+		}
+	case mlir.JMP:
+		return []int{labels[o.Label]}
+	default:
+		if j, ok := conditionalJump(o); ok {
+			if i+1 < len(body) {
+				return []int{labels[j.Label], i + 1}
+			}
+			return []int{labels[j.Label]}
+		}
+	}
+	if i+1 < len(body) {
+		return []int{i + 1}
+	}
+	return nil
+}
+
+// Returns the LocalValues which can be allocated to a register. They need
+// to be 8 bytes, and their address can't be taken. Arrays are laid out
+// as consecutive LocalValues and indexed from the first element, so any
+// LocalValue after one that has its address taken may be part of an array.
+func registerLocals(body []mlir.Opcode) map[uint]bool {
+	addressed := -1
+	sizes := make(map[uint]int)
+	consistent := make(map[uint]bool)
+	address := func(r mlir.Register) {
+		if lv, ok := r.(mlir.LocalValue); ok {
+			if addressed < 0 || int(lv.Id) < addressed {
+				addressed = int(lv.Id)
+			}
+		}
+	}
+	var visit func(r mlir.Register)
+	visit = func(r mlir.Register) {
+		switch v := r.(type) {
+		case mlir.LocalValue:
+			if size, ok := sizes[v.Id]; !ok {
+				sizes[v.Id] = v.Size()
+				consistent[v.Id] = v.Size() == 8
+			} else if size != v.Size() {
+				consistent[v.Id] = false
+			}
+		case mlir.Offset:
+			address(v.Base)
+			visit(v.Base)
+			visit(v.Offset)
+		case mlir.Pointer:
+			address(v.Register)
+			visit(v.Register)
+		case mlir.SliceBasePointer:
+			address(v.Register)
+			visit(v.Register)
+		}
+	}
+	for _, op := range body {
+		for _, r := range op.Registers() {
+			visit(r)
+		}
+		if mov, ok := op.(mlir.MOV); ok {
+			if _, ok := mov.Src.(mlir.Pointer); ok {
+				address(mov.Dst)
+			}
+		}
+	}
+	locals := make(map[uint]bool)
+	for id, ok := range consistent {
+		if ok && (addressed < 0 || int(id) < addressed) {
+			locals[id] = true
+		}
+	}
+	return locals
+}
+
+// Returns the variables live after each instruction of body.
+func liveness(body []mlir.Opcode, tracked func(mlir.Register) (mlir.Register, bool)) []map[mlir.Register]bool {
+	labels := make(map[mlir.Label]int)
+	for i, op := range body {
+		if l, ok := op.(mlir.Label); ok {
+			labels[l] = i
+		}
+	}
+	uses := make([][]mlir.Register, len(body))
+	defs := make([]mlir.Register, len(body))
+	for i, op := range body {
+		u, d := useDef(op)
+		for _, r := range u {
+			if v, ok := tracked(r); ok {
+				uses[i] = append(uses[i], v)
+			}
+		}
+		if v, ok := tracked(d); ok && d != nil {
+			defs[i] = v
+		}
+	}
+
+	liveIn := make([]map[mlir.Register]bool, len(body))
+	liveOut := make([]map[mlir.Register]bool, len(body))
+	for i := range body {
+		liveIn[i] = make(map[mlir.Register]bool)
+		liveOut[i] = make(map[mlir.Register]bool)
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(body) - 1; i >= 0; i-- {
+			for _, s := range successors(body, i, labels) {
+				for v := range liveIn[s] {
+					if !liveOut[i][v] {
+						liveOut[i][v] = true
+						changed = true
+					}
+				}
+			}
+			for v := range liveOut[i] {
+				if v != defs[i] && !liveIn[i][v] {
+					liveIn[i][v] = true
+					changed = true
+				}
+			}
+			for _, v := range uses[i] {
+				if !liveIn[i][v] {
+					liveIn[i][v] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return liveOut
+}
+
+// The range of instructions that a variable is live for.
+type interval struct {
+	v          mlir.Register
+	start, end int
+}
+
+// Allocates a register or stack slot to every value in f, using linear scan
+// register allocation over the live ranges of the variables.
+func allocate(f mlir.Func) *allocation {
+	a := &allocation{
+		registers: make(map[mlir.Register]PhysicalRegister),
+		slots:     make(map[mlir.Register]int),
+		sliceBase: make(map[uint]bool),
+		saved:     make(map[PhysicalRegister]int),
+	}
+	// The area for the arguments to functions that f calls comes first,
+	// and then the LocalValues which live in memory, in the order that
+	// they're first used so that arrays are laid out consecutively.
+	offset := int(f.LargestFuncCall+1) * 8
+	for _, op := range f.Body {
+		// 16 byte arguments take up an extra word after the arguments.
+		if call, ok := op.(mlir.CALL); ok {
+			for i, arg := range call.Args {
+				if o, ok := arg.(mlir.Offset); ok && o.Scale == 16 && (i*2+2)*8 > offset {
+					offset = (i*2 + 2) * 8
+				}
+			}
+		}
+	}
+	locals := registerLocals(f.Body)
+	for _, op := range f.Body {
+		if mov, ok := op.(mlir.MOV); ok {
+			if p, ok := mov.Src.(mlir.Pointer); ok {
+				if _, ok := p.Register.(mlir.Offset); ok {
+					if lv, ok := mov.Dst.(mlir.LocalValue); ok {
+						a.sliceBase[lv.Id] = true
+					}
+				}
+			}
+		}
+	}
+	for _, op := range f.Body {
+		for _, r := range op.Registers() {
+			var layout func(r mlir.Register)
+			layout = func(r mlir.Register) {
+				if lv, ok := r.(mlir.LocalValue); ok && !locals[lv.Id] {
+					key := mlir.LocalValue{Id: lv.Id}
+					if _, ok := a.slots[key]; !ok {
+						a.slots[key] = offset
+						if size := lv.Size(); size > 0 && !a.sliceBase[lv.Id] {
+							offset += size
+						} else {
+							offset += 8
+						}
+					}
+				}
+				nestedRegisters(r, layout)
+			}
+			layout(r)
+		}
+	}
+	offset = (offset + 7) &^ 7
+
+	tracked := func(r mlir.Register) (mlir.Register, bool) {
+		v, ok := variable(r)
+		if lv, isLV := v.(mlir.LocalValue); isLV && !locals[lv.Id] {
+			return nil, false
+		}
+		return v, ok
+	}
+	a.liveOut = liveness(f.Body, tracked)
+
+	// Find the live range of each variable.
+	ranges := make(map[mlir.Register]*interval)
+	extend := func(v mlir.Register, i int) {
+		if _, ok := v.(mlir.FuncRetVal); ok {
+			return
+		}
+		if r, ok := ranges[v]; ok {
+			if i < r.start {
+				r.start = i
+			}
+			if i > r.end {
+				r.end = i
+			}
+			return
+		}
+		ranges[v] = &interval{v, i, i}
+	}
+	for i, op := range f.Body {
+		uses, def := useDef(op)
+		for _, r := range append(uses, def) {
+			if v, ok := tracked(r); ok && r != nil {
+				extend(v, i)
+			}
+		}
+		for v := range a.liveOut[i] {
+			extend(v, i)
+		}
+	}
+	// Values which are live across a call would have to be saved around
+	// it in a caller saved register, so they go in callee saved ones
+	// when they can.
+	acrossCall := make(map[mlir.Register]bool)
+	for i, op := range f.Body {
+		if call, ok := op.(mlir.CALL); ok && !call.TailCall {
+			for v := range a.liveOut[i] {
+				acrossCall[v] = true
+			}
+		}
+	}
+	intervals := make([]*interval, 0, len(ranges))
+	for _, r := range ranges {
+		intervals = append(intervals, r)
+	}
+	sort.Slice(intervals, func(i, j int) bool {
+		if intervals[i].start != intervals[j].start {
+			return intervals[i].start < intervals[j].start
+		}
+		return intervals[i].end < intervals[j].end
+	})
+
+	spill := func(v mlir.Register) {
+		if _, ok := a.slots[v]; !ok {
+			a.slots[v] = offset
+			offset += 8
+		}
+	}
+	freeCaller := append([]PhysicalRegister(nil), callerSaved...)
+	freeCallee := append([]PhysicalRegister(nil), calleeSaved...)
+	var active []*interval
+	for _, cur := range intervals {
+		// Free the registers of the intervals that have ended.
+		stillActive := active[:0]
+		for _, act := range active {
+			if act.end < cur.start {
+				if r := a.registers[act.v]; isCalleeSaved(r) {
+					freeCallee = append(freeCallee, r)
+				} else {
+					freeCaller = append(freeCaller, r)
+				}
+				continue
+			}
+			stillActive = append(stillActive, act)
+		}
+		active = stillActive
+
+		prefer, other := &freeCaller, &freeCallee
+		if acrossCall[cur.v] {
+			prefer, other = other, prefer
+		}
+		if len(*prefer) == 0 {
+			prefer = other
+		}
+		if free := *prefer; len(free) > 0 {
+			a.registers[cur.v] = free[0]
+			*prefer = free[1:]
+			active = append(active, cur)
+			continue
+		}
+		// Spill whichever interval ends last.
+		last := cur
+		for _, act := range active {
+			if act.end > last.end {
+				last = act
+			}
+		}
+		if last != cur {
+			a.registers[cur.v] = a.registers[last.v]
+			delete(a.registers, last.v)
+			for i, act := range active {
+				if act == last {
+					active[i] = cur
+				}
+			}
+		}
+		spill(last.v)
+	}
+
+	// Caller saved registers that are still needed after a CALL need
+	// somewhere to be saved, and so do the callee saved registers that
+	// the function uses.
+	for i, op := range f.Body {
+		if _, ok := op.(mlir.CALL); !ok {
+			continue
+		}
+		for v := range a.liveOut[i] {
+			if r, ok := a.registers[v]; ok && !isCalleeSaved(r) {
+				spill(v)
+			}
+		}
+	}
+	for _, r := range calleeSaved {
+		for _, used := range a.registers {
+			if used == r {
+				a.saved[r] = offset
+				offset += 8
+				break
+			}
+		}
+	}
+	a.frameSize = offset
+	return a
+}
+
+// Returns true if r is preserved by the functions that are called.
+func isCalleeSaved(r PhysicalRegister) bool {
+	for _, c := range calleeSaved {
+		if r == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the variables which are in caller saved registers and live after
+// the i'th instruction, sorted by register so that the generated code is
+// deterministic.
+func (a *allocation) liveRegisters(i int) []mlir.Register {
+	var live []mlir.Register
+	for v := range a.liveOut[i] {
+		if r, ok := a.registers[v]; ok && !isCalleeSaved(r) {
+			live = append(live, v)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return a.registers[live[i]] < a.registers[live[j]]
+	})
+	return live
+}
+
+// Returns the callee saved registers that the function uses, in the order
+// that they're saved in.
+func (a *allocation) savedRegisters() []PhysicalRegister {
+	var saved []PhysicalRegister
+	for _, r := range calleeSaved {
+		if _, ok := a.saved[r]; ok {
+			saved = append(saved, r)
+		}
+	}
+	return saved
+}
@@ -0,0 +1,237 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/driusan/lang/compiler/mlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+func TestAllocateAcrossCall(t *testing.T) {
+	i64 := ast.TypeInfo{Size: 8, Signed: true}
+	f := mlir.Func{
+		Name: "main",
+		Body: []mlir.Opcode{
+			mlir.MOV{Src: mlir.IntLiteral(3), Dst: mlir.LocalValue{Id: 0, Info: i64}},
+			mlir.MOV{Src: mlir.IntLiteral(4), Dst: mlir.TempValue(0)},
+			mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.TempValue(0)}},
+			mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.LocalValue{Id: 0, Info: i64}}},
+		},
+		NumLocals:       1,
+		LargestFuncCall: 1,
+	}
+	a := allocate(f)
+	lv0, tv0 := mlir.LocalValue{Id: 0}, mlir.TempValue(0)
+	if a.registers[lv0] == "" || a.registers[tv0] == "" {
+		t.Fatalf("Values not allocated to registers: %v", a.registers)
+	}
+	if a.registers[lv0] == a.registers[tv0] {
+		t.Errorf("Live values allocated to the same register %v", a.registers[lv0])
+	}
+	// LV0 is needed after the first call, so goes in a callee saved
+	// register, which is saved once rather than around the call. TV0
+	// isn't, so goes in a caller saved register.
+	if r := a.registers[lv0]; !isCalleeSaved(r) {
+		t.Errorf("LV0 allocated to caller saved register %v", r)
+	}
+	if r := a.registers[tv0]; isCalleeSaved(r) {
+		t.Errorf("TV0 allocated to callee saved register %v", r)
+	}
+	if len(a.slots) != 0 {
+		t.Errorf("Unnecessary slots: %v", a.slots)
+	}
+	if got := a.liveRegisters(2); len(got) != 0 {
+		t.Errorf("Unexpected caller saved registers live after CALL: got %v want []", got)
+	}
+	if _, ok := a.saved[a.registers[lv0]]; !ok {
+		t.Errorf("No slot to save %v in", a.registers[lv0])
+	}
+	if want := 16 + 8; a.frameSize != want {
+		t.Errorf("Unexpected frame size: got %v want %v", a.frameSize, want)
+	}
+}
+
+func TestAllocateCallerSavedAcrossCall(t *testing.T) {
+	// More values are live across the call than there are callee saved
+	// registers, so the rest are saved around it.
+	n := len(calleeSaved) + 2
+	var body []mlir.Opcode
+	for i := 0; i < n; i++ {
+		body = append(body, mlir.MOV{Src: mlir.IntLiteral(i), Dst: mlir.TempValue(i)})
+	}
+	body = append(body, mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.IntLiteral(0)}})
+	for i := 1; i < n; i++ {
+		body = append(body, mlir.ADD{Src: mlir.TempValue(i), Dst: mlir.TempValue(0)})
+	}
+	body = append(body, mlir.MOV{Src: mlir.TempValue(0), Dst: mlir.FuncRetVal{}}, mlir.RET{})
+
+	a := allocate(mlir.Func{Name: "sum", Body: body, LargestFuncCall: 1})
+	callee, caller := 0, 0
+	for i := 0; i < n; i++ {
+		v := mlir.TempValue(i)
+		r, ok := a.registers[v]
+		if !ok {
+			t.Fatalf("%v not allocated to a register", v)
+		}
+		_, slot := a.slots[v]
+		if isCalleeSaved(r) {
+			callee++
+			if slot {
+				t.Errorf("Unnecessary slot for %v in %v", v, r)
+			}
+		} else {
+			caller++
+			if !slot {
+				t.Errorf("No slot to save %v in %v across CALL", v, r)
+			}
+		}
+	}
+	if callee != len(calleeSaved) || caller != 2 {
+		t.Errorf("Unexpected registers: got %d callee and %d caller saved want %d and 2", callee, caller, len(calleeSaved))
+	}
+	if got := a.liveRegisters(n); len(got) != 2 {
+		t.Errorf("Unexpected caller saved registers live after CALL: got %v want 2", got)
+	}
+}
+
+func TestAllocateSpill(t *testing.T) {
+	// Add up more values than there are registers, keeping them all live
+	// until the end.
+	n := len(allocatable) + 2
+	var body []mlir.Opcode
+	for i := 0; i < n; i++ {
+		body = append(body, mlir.MOV{Src: mlir.IntLiteral(i), Dst: mlir.TempValue(i)})
+	}
+	for i := 1; i < n; i++ {
+		body = append(body, mlir.ADD{Src: mlir.TempValue(i), Dst: mlir.TempValue(0)})
+	}
+	body = append(body, mlir.MOV{Src: mlir.TempValue(0), Dst: mlir.FuncRetVal{}}, mlir.RET{})
+
+	a := allocate(mlir.Func{Name: "sum", Body: body})
+	if len(a.registers) != len(allocatable) {
+		t.Errorf("Unexpected number of values in registers: got %v want %v", len(a.registers), len(allocatable))
+	}
+	spilled := 0
+	for i := 0; i < n; i++ {
+		_, inreg := a.registers[mlir.TempValue(i)]
+		_, onstack := a.slots[mlir.TempValue(i)]
+		if inreg == onstack {
+			t.Errorf("TV%d: in register %v, on stack %v", i, inreg, onstack)
+		}
+		if onstack {
+			spilled++
+		}
+	}
+	if spilled != 2 {
+		t.Errorf("Unexpected number of spilled values: got %v want 2", spilled)
+	}
+}
+
+func TestAllocateLoop(t *testing.T) {
+	// TV1 is last used at the top of the loop, but is still live until
+	// the JMP back to it, so TV2 can't reuse its register. The other
+	// registers are kept busy until after the loop, so TV1's is the only
+	// one that TV2 could otherwise get.
+	var fill []mlir.Register
+	for i := 3; i < len(allocatable)+1; i++ {
+		fill = append(fill, mlir.TempValue(i))
+	}
+	var body []mlir.Opcode
+	for i, v := range fill {
+		body = append(body, mlir.MOV{Src: mlir.IntLiteral(i), Dst: v})
+	}
+	body = append(body,
+		mlir.MOV{Src: mlir.IntLiteral(0), Dst: mlir.TempValue(0)},
+		mlir.MOV{Src: mlir.IntLiteral(10), Dst: mlir.TempValue(1)},
+		mlir.Label("loop"),
+		mlir.JGE{mlir.ConditionalJump{Label: "done", Src: mlir.TempValue(0), Dst: mlir.TempValue(1)}},
+		mlir.MOV{Src: mlir.IntLiteral(1), Dst: mlir.TempValue(2)},
+		mlir.ADD{Src: mlir.TempValue(2), Dst: mlir.TempValue(0)},
+		mlir.JMP{"loop"},
+		mlir.Label("done"),
+	)
+	jmp := len(body) - 2
+	for _, v := range fill {
+		body = append(body, mlir.ADD{Src: v, Dst: mlir.TempValue(0)})
+	}
+	body = append(body, mlir.MOV{Src: mlir.TempValue(0), Dst: mlir.FuncRetVal{}}, mlir.RET{})
+
+	a := allocate(mlir.Func{Name: "count", Body: body})
+	tv0, tv1, tv2 := mlir.TempValue(0), mlir.TempValue(1), mlir.TempValue(2)
+	for _, v := range []mlir.Register{tv1, tv2} {
+		if a.registers[v] == "" {
+			t.Fatalf("%v not allocated to a register: %v", v, a.registers)
+		}
+	}
+	if !a.liveOut[jmp][tv1] || !a.liveOut[jmp][tv0] {
+		t.Errorf("TV0 and TV1 not live across the back-edge: %v", a.liveOut[jmp])
+	}
+	if a.liveOut[jmp][tv2] {
+		t.Errorf("TV2 live across the back-edge")
+	}
+	if a.registers[tv1] == a.registers[tv2] {
+		t.Errorf("TV1 and TV2 allocated to the same register %v", a.registers[tv1])
+	}
+	if r, ok := a.registers[tv0]; ok && r == a.registers[tv2] {
+		t.Errorf("TV0 and TV2 allocated to the same register %v", r)
+	}
+}
+
+func TestAllocateReuse(t *testing.T) {
+	// Use every register, then let TV0 die before a new value is made.
+	// The new value should get TV0's register rather than be spilled.
+	n := len(allocatable)
+	var body []mlir.Opcode
+	for i := 0; i < n; i++ {
+		body = append(body, mlir.MOV{Src: mlir.IntLiteral(i), Dst: mlir.TempValue(i)})
+	}
+	body = append(body,
+		mlir.ADD{Src: mlir.TempValue(0), Dst: mlir.TempValue(1)},
+		mlir.MOV{Src: mlir.IntLiteral(n), Dst: mlir.TempValue(n)},
+	)
+	for i := 2; i <= n; i++ {
+		body = append(body, mlir.ADD{Src: mlir.TempValue(i), Dst: mlir.TempValue(1)})
+	}
+	body = append(body, mlir.MOV{Src: mlir.TempValue(1), Dst: mlir.FuncRetVal{}}, mlir.RET{})
+
+	a := allocate(mlir.Func{Name: "sum", Body: body})
+	if len(a.slots) != 0 {
+		t.Errorf("Unexpected spilled values: %v", a.slots)
+	}
+	if len(a.registers) != n+1 {
+		t.Errorf("Unexpected number of values in registers: got %v want %v", len(a.registers), n+1)
+	}
+	if got, want := a.registers[mlir.TempValue(n)], a.registers[mlir.TempValue(0)]; got != want || got == "" {
+		t.Errorf("Register not reused: got %v want %v", got, want)
+	}
+}
+
+func TestAllocateNoScratch(t *testing.T) {
+	// Keep more values live than there are registers, across a call, so
+	// that every allocatable register is needed.
+	n := len(allocatable) + 4
+	var body []mlir.Opcode
+	for i := 0; i < n; i++ {
+		body = append(body, mlir.MOV{Src: mlir.IntLiteral(i), Dst: mlir.TempValue(i)})
+	}
+	body = append(body, mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.TempValue(0)}})
+	for i := 1; i < n; i++ {
+		body = append(body, mlir.ADD{Src: mlir.TempValue(i), Dst: mlir.TempValue(0)})
+	}
+	body = append(body, mlir.MOV{Src: mlir.TempValue(0), Dst: mlir.FuncRetVal{}}, mlir.RET{})
+
+	a := allocate(mlir.Func{Name: "sum", Body: body, LargestFuncCall: 1})
+	used := make(map[PhysicalRegister]bool)
+	for v, r := range a.registers {
+		switch r {
+		case scratchValue, scratchBase, scratchIndex, scratchOther, "AX", "DX":
+			t.Errorf("%v allocated to reserved register %v", v, r)
+		}
+		used[r] = true
+	}
+	for _, r := range allocatable {
+		if !used[r] {
+			t.Errorf("Register %v not allocated", r)
+		}
+	}
+}
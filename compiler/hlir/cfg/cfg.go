@@ -0,0 +1,280 @@
+// Package cfg builds control flow graphs of basic blocks from the nested
+// control flow of HLIR functions, and provides dataflow analyses over them.
+//
+// HLIR represents control flow as a tree of IF, LOOP, JumpTable and ASSERT
+// opcodes whose bodies contain more opcodes. A Graph flattens the tree into
+// Blocks of opcodes which always run from start to end, with edges between
+// them for each jump that can happen at the end of a block.
+package cfg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// A Block is a basic block: a sequence of opcodes without any control flow,
+// which are always run from the first to the last.
+type Block struct {
+	// The index of the block in the Blocks of the Graph that it's in.
+	ID int
+
+	// The opcodes in the block. A block never contains an IF, LOOP,
+	// JumpTable, ASSERT, BREAK or CONTINUE, since they're represented by
+	// the edges between blocks. A RET is always the last opcode of the
+	// block that it's in.
+	Ops []hlir.Opcode
+
+	// If non-nil, the block ends by comparing Cond to 0. The first
+	// successor is jumped to if it's not 0, and the second if it is.
+	// Otherwise, the block has at most one successor which it always
+	// continues to.
+	Cond hlir.Register
+
+	Succs []*Block
+	Preds []*Block
+}
+
+func (b *Block) String() string {
+	return fmt.Sprintf("B%d", b.ID)
+}
+
+// A Graph is the control flow graph of a function.
+type Graph struct {
+	Func string
+
+	// The block that the function starts in, and an empty block that
+	// every return from the function goes to. A failed assertion also
+	// goes to Exit, since it also leaves the function.
+	Entry, Exit *Block
+
+	// All of the blocks in the graph, in the order that the code that
+	// they're made of appears in the function. Entry is always the first
+	// block and Exit the last. Blocks which can not be reached from
+	// Entry are included if they contain any opcodes, so that dead code
+	// can be found.
+	Blocks []*Block
+}
+
+// New returns the control flow graph of f.
+func New(f hlir.Func) *Graph {
+	b := &builder{g: &Graph{Func: f.Name}}
+	b.g.Entry = b.newBlock()
+	b.start(b.g.Entry)
+	b.block(f.Body)
+
+	// Falling off the end of the function returns from it.
+	exit := b.newBlock()
+	b.jump(exit)
+	b.g.Exit = exit
+	for _, r := range b.returns {
+		addEdge(r, exit)
+	}
+	b.g.removeEmptyUnreachable()
+	return b.g
+}
+
+// The state of a loop in the function while building a graph.
+type loop struct {
+	// The block which evaluates the loop's condition and the block
+	// after the loop.
+	header, exit *Block
+}
+
+type builder struct {
+	g *Graph
+
+	// The block that opcodes are currently being added to.
+	cur *Block
+
+	// The enclosing loops, from outermost to innermost.
+	loops []loop
+
+	// The blocks ending in a RET or a failed ASSERT, which need an
+	// edge to the exit block once it's created.
+	returns []*Block
+}
+
+func (b *builder) newBlock() *Block {
+	return &Block{}
+}
+
+// Makes blk the current block. Blocks are added to the graph when they're
+// started, so that they're in the same order as the code.
+func (b *builder) start(blk *Block) {
+	blk.ID = len(b.g.Blocks)
+	b.g.Blocks = append(b.g.Blocks, blk)
+	b.cur = blk
+}
+
+func addEdge(from, to *Block) {
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
+
+// Ends the current block with an unconditional jump to to, and makes
+// it the current block.
+func (b *builder) jump(to *Block) {
+	addEdge(b.cur, to)
+	b.start(to)
+}
+
+// Ends the current block with a conditional jump on r, to t if r is not 0 or
+// f if it is.
+func (b *builder) branch(r hlir.Register, t, f *Block) {
+	b.cur.Cond = r
+	addEdge(b.cur, t)
+	addEdge(b.cur, f)
+}
+
+// Ends the current block after an opcode which never continues to the next
+// one. Anything after it in the same HLIR block is unreachable, so it goes
+// in a new block with no predecessors.
+func (b *builder) terminate(to *Block) {
+	if to != nil {
+		addEdge(b.cur, to)
+	}
+	b.start(b.newBlock())
+}
+
+// Adds ops to the graph, starting in the current block.
+func (b *builder) block(ops []hlir.Opcode) {
+	for _, op := range ops {
+		b.op(op)
+	}
+}
+
+func (b *builder) op(op hlir.Opcode) {
+	switch o := op.(type) {
+	case hlir.IF:
+		b.block(o.Initializer)
+		b.block(o.Condition.Body)
+		then, els, join := b.newBlock(), b.newBlock(), b.newBlock()
+		b.branch(o.Condition.Register, then, els)
+
+		b.start(then)
+		b.block(o.Body)
+		addEdge(b.cur, join)
+
+		b.start(els)
+		b.block(o.ElseBody)
+		b.jump(join)
+	case hlir.LOOP:
+		b.block(o.Initializer)
+		header := b.newBlock()
+		b.jump(header)
+		b.block(o.Condition.Body)
+		body, exit := b.newBlock(), b.newBlock()
+		b.branch(o.Condition.Register, body, exit)
+
+		b.loops = append(b.loops, loop{header: header, exit: exit})
+		b.start(body)
+		b.block(o.Body)
+		addEdge(b.cur, header)
+		b.loops = b.loops[:len(b.loops)-1]
+		b.start(exit)
+	case hlir.JumpTable:
+		// The condition of each case is only evaluated if the
+		// cases before it didn't match.
+		exit := b.newBlock()
+		for _, c := range o {
+			b.block(c.Initializer)
+			b.block(c.Condition.Body)
+			body, next := b.newBlock(), b.newBlock()
+			b.branch(c.Condition.Register, body, next)
+
+			b.start(body)
+			b.block(c.Body)
+			addEdge(b.cur, exit)
+			b.start(next)
+		}
+		b.jump(exit)
+	case hlir.ASSERT:
+		b.block(o.Predicate.Body)
+		next := b.newBlock()
+		b.returns = append(b.returns, b.cur)
+		b.cur.Cond = o.Predicate.Register
+		addEdge(b.cur, next)
+		b.start(next)
+	case hlir.BREAK:
+		b.terminate(b.enclosing(o.Depth).exit)
+	case hlir.CONTINUE:
+		b.terminate(b.enclosing(o.Depth).header)
+	case hlir.RET:
+		b.cur.Ops = append(b.cur.Ops, op)
+		b.returns = append(b.returns, b.cur)
+		b.terminate(nil)
+	case hlir.CALL, hlir.MOV, hlir.ADD, hlir.SUB, hlir.MUL, hlir.DIV, hlir.MOD,
+		hlir.EQ, hlir.NEQ, hlir.GT, hlir.GEQ, hlir.LT, hlir.LTE, hlir.LINE:
+		b.cur.Ops = append(b.cur.Ops, op)
+	default:
+		panic(fmt.Sprintf("Unhandled opcode type when building control flow graph: %v", reflect.TypeOf(op)))
+	}
+}
+
+// Returns the loop that a BREAK or CONTINUE with depth refers to.
+func (b *builder) enclosing(depth uint) loop {
+	if int(depth) >= len(b.loops) {
+		panic(fmt.Sprintf("Branch out of %d loops inside of %d", depth+1, len(b.loops)))
+	}
+	return b.loops[len(b.loops)-1-int(depth)]
+}
+
+// Removes the blocks that were started after a jump, but never had anything
+// added to them, and renumbers the remaining blocks.
+func (g *Graph) removeEmptyUnreachable() {
+	for removed := true; removed; {
+		removed = false
+		blocks := g.Blocks[:0]
+		for _, b := range g.Blocks {
+			if b != g.Entry && b != g.Exit && len(b.Preds) == 0 && len(b.Ops) == 0 {
+				for _, s := range b.Succs {
+					s.Preds = removeBlock(s.Preds, b)
+				}
+				removed = true
+				continue
+			}
+			blocks = append(blocks, b)
+		}
+		g.Blocks = blocks
+	}
+	for i, b := range g.Blocks {
+		b.ID = i
+	}
+}
+
+// Removes the first occurrence of b from blocks.
+func removeBlock(blocks []*Block, b *Block) []*Block {
+	for i, blk := range blocks {
+		if blk == b {
+			return append(blocks[:i:i], blocks[i+1:]...)
+		}
+	}
+	return blocks
+}
+
+// Reachable returns the blocks which can be reached from the entry of g.
+func (g *Graph) Reachable() Set {
+	seen := make(Set)
+	var visit func(*Block)
+	visit = func(b *Block) {
+		if seen[b] {
+			return
+		}
+		seen[b] = true
+		for _, s := range b.Succs {
+			visit(s)
+		}
+	}
+	visit(g.Entry)
+	return seen
+}
+
+// Sorts blocks in the order that they appear in their graph.
+func sortBlocks(blocks []*Block) {
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].ID < blocks[j].ID
+	})
+}
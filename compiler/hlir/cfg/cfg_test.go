@@ -0,0 +1,168 @@
+package cfg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// Describes the blocks of g and the edges between them, one block per line.
+func describe(g *Graph) string {
+	var s strings.Builder
+	for _, b := range g.Blocks {
+		var ops []string
+		for _, op := range b.Ops {
+			ops = append(ops, strings.TrimSpace(op.String()))
+		}
+		fmt.Fprintf(&s, "%v: %v", b, strings.Join(ops, "; "))
+		if b.Cond != nil {
+			fmt.Fprintf(&s, " IF %v", b.Cond)
+		}
+		fmt.Fprintf(&s, " -> %v\n", b.Succs)
+	}
+	return s.String()
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Body     []hlir.Opcode
+		Expected string
+	}{
+		{
+			"Straight",
+			[]hlir.Opcode{
+				hlir.MOV{Src: hlir.IntLiteral(1), Dst: hlir.LocalValue(0)},
+				hlir.MOV{Src: hlir.LocalValue(0), Dst: hlir.FuncRetVal(0)},
+				hlir.RET{},
+			},
+			"B0: MOV $1, LV0; MOV LV0, FR0; RET -> [B1]\nB1:  -> []\n",
+		},
+		{
+			"IfElse",
+			[]hlir.Opcode{
+				hlir.IF{
+					ControlFlow: hlir.ControlFlow{
+						Condition: hlir.Condition{
+							Body:     []hlir.Opcode{hlir.GT{Left: hlir.FuncArg{Id: 0}, Right: hlir.IntLiteral(0), Dst: hlir.TempValue(0)}},
+							Register: hlir.TempValue(0),
+						},
+						Body: []hlir.Opcode{hlir.MOV{Src: hlir.IntLiteral(1), Dst: hlir.LocalValue(0)}},
+					},
+					ElseBody: []hlir.Opcode{hlir.MOV{Src: hlir.IntLiteral(2), Dst: hlir.LocalValue(0)}},
+				},
+				hlir.CALL{FName: "PrintInt", Args: []hlir.Register{hlir.LocalValue(0)}},
+			},
+			"B0: GT P0 (false), $0, TV0 IF TV0 -> [B1 B2]\n" +
+				"B1: MOV $1, LV0 -> [B3]\n" +
+				"B2: MOV $2, LV0 -> [B3]\n" +
+				"B3: CALL PrintInt ([LV0]) -> [B4]\n" +
+				"B4:  -> []\n",
+		},
+		{
+			"ReturnInIf",
+			[]hlir.Opcode{
+				hlir.IF{
+					ControlFlow: hlir.ControlFlow{
+						Condition: hlir.Condition{Register: hlir.FuncArg{Id: 0}},
+						Body:      []hlir.Opcode{hlir.RET{}},
+					},
+				},
+				hlir.CALL{FName: "PrintInt", Args: []hlir.Register{hlir.IntLiteral(1)}},
+			},
+			"B0:  IF P0 (false) -> [B1 B2]\n" +
+				"B1: RET -> [B4]\n" +
+				"B2:  -> [B3]\n" +
+				"B3: CALL PrintInt ([$1]) -> [B4]\n" +
+				"B4:  -> []\n",
+		},
+		{
+			"DeadCode",
+			[]hlir.Opcode{
+				hlir.RET{},
+				hlir.CALL{FName: "PrintInt", Args: []hlir.Register{hlir.IntLiteral(1)}},
+			},
+			"B0: RET -> [B2]\n" +
+				"B1: CALL PrintInt ([$1]) -> [B2]\n" +
+				"B2:  -> []\n",
+		},
+		{
+			"Loop",
+			// while x < 10 { if x == 5 { break } x = x + 1; continue }
+			[]hlir.Opcode{
+				hlir.LOOP{
+					Initializer: []hlir.Opcode{hlir.MOV{Src: hlir.IntLiteral(0), Dst: hlir.LocalValue(0)}},
+					Condition: hlir.Condition{
+						Body:     []hlir.Opcode{hlir.LT{Left: hlir.LocalValue(0), Right: hlir.IntLiteral(10), Dst: hlir.TempValue(0)}},
+						Register: hlir.TempValue(0),
+					},
+					Body: []hlir.Opcode{
+						hlir.IF{
+							ControlFlow: hlir.ControlFlow{
+								Condition: hlir.Condition{
+									Body:     []hlir.Opcode{hlir.EQ{Left: hlir.LocalValue(0), Right: hlir.IntLiteral(5), Dst: hlir.TempValue(1)}},
+									Register: hlir.TempValue(1),
+								},
+								Body: []hlir.Opcode{hlir.BREAK{}},
+							},
+						},
+						hlir.ADD{Left: hlir.LocalValue(0), Right: hlir.IntLiteral(1), Dst: hlir.LocalValue(0)},
+						hlir.CONTINUE{},
+					},
+				},
+				hlir.CALL{FName: "PrintInt", Args: []hlir.Register{hlir.LocalValue(0)}},
+			},
+			"B0: MOV $0, LV0 -> [B1]\n" +
+				"B1: LT LV0, $10, TV0 IF TV0 -> [B2 B6]\n" +
+				"B2: EQ LV0, $5, TV1 IF TV1 -> [B3 B4]\n" +
+				"B3:  -> [B6]\n" +
+				"B4:  -> [B5]\n" +
+				"B5: ADD LV0 + $1 => LV0 -> [B1]\n" +
+				"B6: CALL PrintInt ([LV0]) -> [B7]\n" +
+				"B7:  -> []\n",
+		},
+		{
+			"JumpTable",
+			[]hlir.Opcode{
+				hlir.JumpTable{
+					{
+						Condition: hlir.Condition{Register: hlir.FuncArg{Id: 0}},
+						Body:      []hlir.Opcode{hlir.MOV{Src: hlir.IntLiteral(1), Dst: hlir.FuncRetVal(0)}},
+					},
+					{
+						Condition: hlir.Condition{Register: hlir.FuncArg{Id: 1}},
+						Body:      []hlir.Opcode{hlir.MOV{Src: hlir.IntLiteral(2), Dst: hlir.FuncRetVal(0)}},
+					},
+				},
+				hlir.RET{},
+			},
+			"B0:  IF P0 (false) -> [B1 B2]\n" +
+				"B1: MOV $1, FR0 -> [B5]\n" +
+				"B2:  IF P1 (false) -> [B3 B4]\n" +
+				"B3: MOV $2, FR0 -> [B5]\n" +
+				"B4:  -> [B5]\n" +
+				"B5: RET -> [B6]\n" +
+				"B6:  -> []\n",
+		},
+		{
+			"Assert",
+			[]hlir.Opcode{
+				hlir.ASSERT{Predicate: hlir.Condition{Register: hlir.FuncArg{Id: 0}}},
+				hlir.CALL{FName: "PrintInt", Args: []hlir.Register{hlir.IntLiteral(1)}},
+			},
+			"B0:  IF P0 (false) -> [B1 B2]\n" +
+				"B1: CALL PrintInt ([$1]) -> [B2]\n" +
+				"B2:  -> []\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			g := New(hlir.Func{Name: "f", Body: tc.Body})
+			if got := describe(g); got != tc.Expected {
+				t.Errorf("Unexpected graph: got\n%v\nwant\n%v", got, tc.Expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package cfg
+
+// A Set is a set of facts about a point in a program, such as the registers
+// which are live or the blocks which dominate it.
+type Set map[interface{}]bool
+
+// Copy returns a copy of s.
+func (s Set) Copy() Set {
+	c := make(Set, len(s))
+	for k := range s {
+		c[k] = true
+	}
+	return c
+}
+
+// Equal returns true if s and o contain the same facts.
+func (s Set) Equal(o Set) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for k := range s {
+		if !o[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// Union returns a new set with the facts that are in either a or b.
+func Union(a, b Set) Set {
+	u := a.Copy()
+	for k := range b {
+		u[k] = true
+	}
+	return u
+}
+
+// Intersect returns a new set with the facts that are in both a and b.
+func Intersect(a, b Set) Set {
+	i := make(Set)
+	for k := range a {
+		if b[k] {
+			i[k] = true
+		}
+	}
+	return i
+}
+
+// A Direction is the direction that facts flow through a graph.
+type Direction int
+
+const (
+	// Facts flow from the start of a block to its end, and from a block
+	// to its successors.
+	Forward Direction = iota
+	// Facts flow from the end of a block to its start, and from a block
+	// to its predecessors.
+	Backward
+)
+
+// An Analysis describes a dataflow problem to be solved with Solve.
+type Analysis struct {
+	Direction Direction
+
+	// Combines the facts flowing into a block from more than one edge.
+	// Usually Union or Intersect.
+	Meet func(a, b Set) Set
+
+	// The facts at the start of the entry block for a forward analysis,
+	// or the end of the exit block for a backward one.
+	Boundary Set
+
+	// The facts initially assumed for every other block, before
+	// anything is known about it. This is usually the empty set when
+	// Meet is Union, and the set of all facts when it's Intersect.
+	Initial func(*Block) Set
+
+	// Returns the facts after the block for a forward analysis, given
+	// the facts before it, or before the block for a backward analysis,
+	// given the facts after it. It must not modify its argument.
+	Transfer func(b *Block, facts Set) Set
+}
+
+// The solution to an Analysis.
+type Result struct {
+	// The facts at the start and end of each block.
+	In, Out map[*Block]Set
+}
+
+// Solve solves the analysis a over g, and returns the facts at the start and
+// end of every block.
+func Solve(g *Graph, a Analysis) Result {
+	res := Result{In: make(map[*Block]Set), Out: make(map[*Block]Set)}
+
+	// For a backward analysis, the roles of in and out are swapped so
+	// that the rest of the solver only deals with one direction.
+	before, after := res.In, res.Out
+	start := g.Entry
+	edgesIn := func(b *Block) []*Block { return b.Preds }
+	order := g.Blocks
+	if a.Direction == Backward {
+		before, after = res.Out, res.In
+		start = g.Exit
+		edgesIn = func(b *Block) []*Block { return b.Succs }
+		order = make([]*Block, 0, len(g.Blocks))
+		for i := len(g.Blocks) - 1; i >= 0; i-- {
+			order = append(order, g.Blocks[i])
+		}
+	}
+
+	for _, b := range g.Blocks {
+		after[b] = a.Initial(b)
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range order {
+			var facts Set
+			if b == start {
+				facts = a.Boundary.Copy()
+			} else {
+				for i, e := range edgesIn(b) {
+					if i == 0 {
+						facts = after[e].Copy()
+					} else {
+						facts = a.Meet(facts, after[e])
+					}
+				}
+				if facts == nil {
+					// Unreachable
+					facts = a.Initial(b)
+				}
+			}
+			before[b] = facts
+			out := a.Transfer(b, facts)
+			if !out.Equal(after[b]) {
+				after[b] = out
+				changed = true
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,171 @@
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// sum(n int) (int), which adds the numbers from 0 to n-1 in a loop.
+var sumFunc = hlir.Func{
+	Name:      "sum",
+	NumArgs:   1,
+	NumLocals: 2,
+	Body: []hlir.Opcode{
+		hlir.MOV{Src: hlir.IntLiteral(0), Dst: hlir.LocalValue(0)},
+		hlir.LOOP{
+			Initializer: []hlir.Opcode{hlir.MOV{Src: hlir.IntLiteral(0), Dst: hlir.LocalValue(1)}},
+			Condition: hlir.Condition{
+				Body:     []hlir.Opcode{hlir.LT{Left: hlir.LocalValue(1), Right: hlir.FuncArg{Id: 0}, Dst: hlir.TempValue(0)}},
+				Register: hlir.TempValue(0),
+			},
+			Body: []hlir.Opcode{
+				hlir.ADD{Left: hlir.LocalValue(0), Right: hlir.LocalValue(1), Dst: hlir.LocalValue(0)},
+				hlir.ADD{Left: hlir.LocalValue(1), Right: hlir.IntLiteral(1), Dst: hlir.LocalValue(1)},
+			},
+		},
+		hlir.MOV{Src: hlir.LocalValue(0), Dst: hlir.FuncRetVal(0)},
+		hlir.RET{},
+	},
+}
+
+// Returns the facts in s as a sorted, space separated string.
+func sorted(s Set) string {
+	var facts []string
+	for f := range s {
+		facts = append(facts, fmt.Sprint(f))
+	}
+	sort.Strings(facts)
+	return strings.Join(facts, " ")
+}
+
+func TestLiveness(t *testing.T) {
+	g := New(sumFunc)
+	live := Liveness(g)
+	expected := []struct{ In, Out string }{
+		{"P0 (false)", "LV0 LV1 P0 (false)"},
+		{"LV0 LV1 P0 (false)", "LV0 LV1 P0 (false)"},
+		{"LV0 LV1 P0 (false)", "LV0 LV1 P0 (false)"},
+		{"LV0", "FR0"},
+		{"FR0", "FR0"},
+	}
+	if len(g.Blocks) != len(expected) {
+		t.Fatalf("Unexpected graph:\n%v", describe(g))
+	}
+	for i, e := range expected {
+		b := g.Blocks[i]
+		if got := sorted(live.In[b]); got != e.In {
+			t.Errorf("%v: unexpected live in: got %v want %v", b, got, e.In)
+		}
+		if got := sorted(live.Out[b]); got != e.Out {
+			t.Errorf("%v: unexpected live out: got %v want %v", b, got, e.Out)
+		}
+	}
+
+	after := LiveAfter(g.Blocks[3], live.Out[g.Blocks[3]])
+	if got := sorted(after[0]); got != "FR0" {
+		t.Errorf("Unexpected live registers after MOV: got %v want FR0", got)
+	}
+}
+
+func TestReachingDefinitions(t *testing.T) {
+	g := New(sumFunc)
+	reaching := ReachingDefinitions(g)
+	expected := []struct{ In, Out string }{
+		{"", "LV0@B0:0 LV1@B0:1"},
+		// TV0 reaches the loop header from the previous iteration.
+		{"LV0@B0:0 LV0@B2:0 LV1@B0:1 LV1@B2:1 TV0@B1:0", "LV0@B0:0 LV0@B2:0 LV1@B0:1 LV1@B2:1 TV0@B1:0"},
+		{"LV0@B0:0 LV0@B2:0 LV1@B0:1 LV1@B2:1 TV0@B1:0", "LV0@B2:0 LV1@B2:1 TV0@B1:0"},
+		{"LV0@B0:0 LV0@B2:0 LV1@B0:1 LV1@B2:1 TV0@B1:0", "FR0@B3:0 LV0@B0:0 LV0@B2:0 LV1@B0:1 LV1@B2:1 TV0@B1:0"},
+	}
+	for i, e := range expected {
+		b := g.Blocks[i]
+		if got := sorted(reaching.In[b]); got != e.In {
+			t.Errorf("%v: unexpected reaching definitions in: got %v want %v", b, got, e.In)
+		}
+		if got := sorted(reaching.Out[b]); got != e.Out {
+			t.Errorf("%v: unexpected reaching definitions out: got %v want %v", b, got, e.Out)
+		}
+	}
+
+	defs := DefinitionsOf(reaching.In[g.Blocks[3]], hlir.LocalValue(0))
+	if len(defs) != 2 {
+		t.Fatalf("Unexpected definitions of LV0: %v", defs)
+	}
+	for _, d := range defs {
+		if _, ok := d.Op().(hlir.MOV); ok && d.Block != g.Entry {
+			t.Errorf("Unexpected definition of LV0: %v", d)
+		}
+	}
+}
+
+func TestDominators(t *testing.T) {
+	g := New(sumFunc)
+	dom := NewDominators(g)
+	b := g.Blocks
+
+	idoms := []*Block{nil, b[0], b[1], b[1], b[3]}
+	for i, want := range idoms {
+		if got := dom.Immediate(b[i]); got != want {
+			t.Errorf("Unexpected immediate dominator of %v: got %v want %v", b[i], got, want)
+		}
+	}
+	if !dom.Dominates(b[1], b[4]) {
+		t.Error("Loop header should dominate exit")
+	}
+	if dom.Dominates(b[2], b[3]) {
+		t.Error("Loop body should not dominate the code after the loop")
+	}
+	if got := fmt.Sprint(dom.Dominated(b[1])); got != "[B1 B2 B3 B4]" {
+		t.Errorf("Unexpected blocks dominated by loop header: got %v", got)
+	}
+}
+
+func TestDominatorsUnreachable(t *testing.T) {
+	g := New(hlir.Func{
+		Name: "f",
+		Body: []hlir.Opcode{
+			hlir.RET{},
+			hlir.CALL{FName: "PrintInt", Args: []hlir.Register{hlir.IntLiteral(1)}},
+		},
+	})
+	dom := NewDominators(g)
+	dead := g.Blocks[1]
+	if g.Reachable()[dead] {
+		t.Fatalf("Block after return should be unreachable:\n%v", describe(g))
+	}
+	if dom.Immediate(dead) != nil {
+		t.Errorf("Unreachable block should not have an immediate dominator")
+	}
+	if got := dom.Immediate(g.Exit); got != g.Entry {
+		t.Errorf("Unexpected immediate dominator of exit: got %v want %v", got, g.Entry)
+	}
+}
+
+func TestDot(t *testing.T) {
+	var dot bytes.Buffer
+	if err := New(sumFunc).Dot(&dot); err != nil {
+		t.Fatal(err)
+	}
+	expected := `digraph "sum" {
+	node [shape=box fontname=monospace];
+	B0 [label="B0 (entry)\lMOV $0, LV0\lMOV $0, LV1\l"];
+	B1 [label="B1\lLT LV1, P0 (false), TV0\lIF TV0\l"];
+	B2 [label="B2\lADD LV0 + LV1 => LV0\lADD LV1 + $1 => LV1\l"];
+	B3 [label="B3\lMOV LV0, FR0\lRET\l"];
+	B4 [label="B4 (exit)\l"];
+	B0 -> B1;
+	B1 -> B2 [label="true"];
+	B1 -> B3 [label="false"];
+	B2 -> B1;
+	B3 -> B4;
+}
+`
+	if got := dot.String(); got != expected {
+		t.Errorf("Unexpected dot: got\n%v\nwant\n%v", got, expected)
+	}
+}
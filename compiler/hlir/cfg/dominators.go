@@ -0,0 +1,79 @@
+package cfg
+
+// Dominators describes which blocks of a graph dominate each other. A block
+// dominates another block if every path from the entry of the graph to the
+// other block goes through it. Every block dominates itself.
+type Dominators struct {
+	dom  map[*Block]Set
+	idom map[*Block]*Block
+}
+
+// NewDominators calculates the dominators of the blocks in g. Blocks which
+// can not be reached from the entry are dominated by every block.
+func NewDominators(g *Graph) *Dominators {
+	all := make(Set)
+	for _, b := range g.Blocks {
+		all[b] = true
+	}
+	res := Solve(g, Analysis{
+		Direction: Forward,
+		Meet:      Intersect,
+		Boundary:  make(Set),
+		Initial:   func(*Block) Set { return all },
+		Transfer: func(b *Block, in Set) Set {
+			out := in.Copy()
+			out[b] = true
+			return out
+		},
+	})
+
+	d := &Dominators{dom: res.Out, idom: make(map[*Block]*Block)}
+	reachable := g.Reachable()
+	for _, b := range g.Blocks {
+		if !reachable[b] {
+			continue
+		}
+		// The immediate dominator is the strict dominator which is
+		// dominated by all of the others, so it has the most
+		// dominators of its own.
+		var idom *Block
+		for s := range d.dom[b] {
+			sb := s.(*Block)
+			if sb == b {
+				continue
+			}
+			if idom == nil || len(d.dom[sb]) > len(d.dom[idom]) {
+				idom = sb
+			}
+		}
+		if idom != nil {
+			d.idom[b] = idom
+		}
+	}
+	return d
+}
+
+// Dominates returns true if a dominates b.
+func (d *Dominators) Dominates(a, b *Block) bool {
+	return d.dom[b][a]
+}
+
+// Immediate returns the immediate dominator of b: the block which strictly
+// dominates b, and is dominated by every other block that does. The entry
+// block and unreachable blocks have no immediate dominator, so nil is
+// returned.
+func (d *Dominators) Immediate(b *Block) *Block {
+	return d.idom[b]
+}
+
+// Dominated returns the blocks which b dominates.
+func (d *Dominators) Dominated(b *Block) []*Block {
+	var blocks []*Block
+	for blk, doms := range d.dom {
+		if doms[b] {
+			blocks = append(blocks, blk)
+		}
+	}
+	sortBlocks(blocks)
+	return blocks
+}
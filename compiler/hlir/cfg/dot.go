@@ -0,0 +1,61 @@
+package cfg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dot writes g to w in the Graphviz dot format. Each block is a node labelled
+// with its opcodes, and conditional edges are labelled with whether they're
+// taken when the condition is true or false.
+func (g *Graph) Dot(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "digraph %q {\n\tnode [shape=box fontname=monospace];\n", g.Func); err != nil {
+		return err
+	}
+	for _, b := range g.Blocks {
+		if _, err := fmt.Fprintf(w, "\t%v [label=\"%s\"];\n", b, dotLabel(g, b)); err != nil {
+			return err
+		}
+	}
+	for _, b := range g.Blocks {
+		for i, s := range b.Succs {
+			attrs := ""
+			if b.Cond != nil {
+				if i == 0 {
+					attrs = ` [label="true"]`
+				} else {
+					attrs = ` [label="false"]`
+				}
+			}
+			if _, err := fmt.Fprintf(w, "\t%v -> %v%s;\n", b, s, attrs); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "}\n")
+	return err
+}
+
+// Returns the label of the node for b, with each line left justified.
+func dotLabel(g *Graph, b *Block) string {
+	label := b.String()
+	switch b {
+	case g.Entry:
+		label += " (entry)"
+	case g.Exit:
+		label += " (exit)"
+	}
+	label += `\l`
+	for _, op := range b.Ops {
+		label += dotEscape(strings.TrimSpace(op.String())) + `\l`
+	}
+	if b.Cond != nil {
+		label += dotEscape(fmt.Sprintf("IF %v", b.Cond)) + `\l`
+	}
+	return label
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\l`).Replace(s)
+}
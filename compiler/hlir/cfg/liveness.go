@@ -0,0 +1,138 @@
+package cfg
+
+import (
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// Returns true if r is a register which holds a value of its own, rather
+// than a literal or a location computed from other registers.
+func isVariable(r hlir.Register) bool {
+	switch r.(type) {
+	case hlir.LocalValue, hlir.TempValue, hlir.FuncArg, hlir.FuncRetVal, hlir.LastFuncCallRetVal:
+		return true
+	}
+	return false
+}
+
+// Uses returns the registers whose value is read by op. Writing through an
+// Offset or Pointer reads the registers used to calculate the address, and
+// only modifies part of the value, so they're included too.
+func Uses(op hlir.Opcode) []hlir.Register {
+	var uses []hlir.Register
+	seen := make(map[hlir.Register]bool)
+	add := func(r hlir.Register) hlir.Register {
+		if isVariable(r) && !seen[r] {
+			seen[r] = true
+			uses = append(uses, r)
+		}
+		return r
+	}
+	hlir.ReplaceOpUses(op, add)
+	for _, dst := range op.ModifiedRegisters() {
+		switch dst.(type) {
+		case hlir.Offset, hlir.Pointer:
+			// Find the registers that make up the address the
+			// same way as if it were being read.
+			hlir.ReplaceOpUses(hlir.MOV{Src: dst}, add)
+		}
+	}
+	return uses
+}
+
+// Defs returns the registers which op replaces the value of.
+//
+// A CALL doesn't define the LastFuncCallRetVal registers that it returns,
+// since the call number isn't known from the CALL itself.
+func Defs(op hlir.Opcode) []hlir.Register {
+	var defs []hlir.Register
+	for _, dst := range op.ModifiedRegisters() {
+		if isVariable(dst) {
+			defs = append(defs, dst)
+		}
+	}
+	return defs
+}
+
+// Returns the registers used by b before being defined in it, and the
+// registers defined by it.
+func useDef(b *Block) (use, def Set) {
+	use, def = make(Set), make(Set)
+	for _, op := range b.Ops {
+		for _, r := range Uses(op) {
+			if !def[r] {
+				use[r] = true
+			}
+		}
+		for _, r := range Defs(op) {
+			def[r] = true
+		}
+	}
+	if b.Cond != nil && isVariable(b.Cond) && !def[b.Cond] {
+		use[b.Cond] = true
+	}
+	return use, def
+}
+
+// Liveness returns the registers which are live at the start and end of each
+// block of g: the registers whose current value may be read later.
+//
+// The return values of the function, and any arguments passed by reference,
+// are live when the function returns, since the caller reads them.
+func Liveness(g *Graph) Result {
+	exit := make(Set)
+	for _, b := range g.Blocks {
+		for _, op := range b.Ops {
+			for _, r := range append(Uses(op), Defs(op)...) {
+				switch v := r.(type) {
+				case hlir.FuncRetVal:
+					exit[r] = true
+				case hlir.FuncArg:
+					if v.Reference {
+						exit[r] = true
+					}
+				}
+			}
+		}
+	}
+
+	uses := make(map[*Block]Set)
+	defs := make(map[*Block]Set)
+	for _, b := range g.Blocks {
+		uses[b], defs[b] = useDef(b)
+	}
+	return Solve(g, Analysis{
+		Direction: Backward,
+		Meet:      Union,
+		Boundary:  exit,
+		Initial:   func(*Block) Set { return make(Set) },
+		Transfer: func(b *Block, out Set) Set {
+			in := uses[b].Copy()
+			for r := range out {
+				if !defs[b][r] {
+					in[r] = true
+				}
+			}
+			return in
+		},
+	})
+}
+
+// LiveAfter returns the registers which are live after each opcode in b,
+// given the registers live at the end of b.
+func LiveAfter(b *Block, out Set) []Set {
+	live := out.Copy()
+	if b.Cond != nil && isVariable(b.Cond) {
+		live[b.Cond] = true
+	}
+	after := make([]Set, len(b.Ops))
+	for i := len(b.Ops) - 1; i >= 0; i-- {
+		after[i] = live.Copy()
+		for _, r := range Defs(b.Ops[i]) {
+			delete(live, r)
+		}
+		for _, r := range Uses(b.Ops[i]) {
+			live[r] = true
+		}
+	}
+	return after
+}
@@ -0,0 +1,79 @@
+package cfg
+
+import (
+	"fmt"
+
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// A Definition is an opcode that defines the value of a register.
+type Definition struct {
+	Block *Block
+	// The index of the opcode in Block.Ops.
+	Index    int
+	Register hlir.Register
+}
+
+func (d Definition) String() string {
+	return fmt.Sprintf("%v@%v:%d", d.Register, d.Block, d.Index)
+}
+
+// Op returns the opcode which makes the definition.
+func (d Definition) Op() hlir.Opcode {
+	return d.Block.Ops[d.Index]
+}
+
+// ReachingDefinitions returns the definitions which reach the start and end
+// of each block of g: the definitions which may have set the current value
+// of their register, without being replaced by another definition of it.
+//
+// The sets in the result contain Definitions. A register which is used
+// without a definition reaching it, such as a function argument, has the
+// value that it had when the function was called.
+func ReachingDefinitions(g *Graph) Result {
+	gen := make(map[*Block]Set)
+	defined := make(map[*Block]map[hlir.Register]bool)
+	for _, b := range g.Blocks {
+		gen[b] = make(Set)
+		defined[b] = make(map[hlir.Register]bool)
+
+		// Only the last definition of a register in a block
+		// reaches the end of the block.
+		last := make(map[hlir.Register]Definition)
+		for i, op := range b.Ops {
+			for _, r := range Defs(op) {
+				last[r] = Definition{b, i, r}
+				defined[b][r] = true
+			}
+		}
+		for _, d := range last {
+			gen[b][d] = true
+		}
+	}
+	return Solve(g, Analysis{
+		Direction: Forward,
+		Meet:      Union,
+		Boundary:  make(Set),
+		Initial:   func(*Block) Set { return make(Set) },
+		Transfer: func(b *Block, in Set) Set {
+			out := gen[b].Copy()
+			for d := range in {
+				if !defined[b][d.(Definition).Register] {
+					out[d] = true
+				}
+			}
+			return out
+		},
+	})
+}
+
+// DefinitionsOf returns the definitions in reaching which are of r.
+func DefinitionsOf(reaching Set, r hlir.Register) []Definition {
+	var defs []Definition
+	for d := range reaching {
+		if def := d.(Definition); def.Register == r {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
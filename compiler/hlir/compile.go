@@ -12,15 +12,29 @@ type EnumMap map[string]int
 
 var callNum uint
 
+// EmitLines makes Generate start the code for each statement whose line in
+// the source is known with a LINE. It's used by the VM to report where
+// errors happened.
+var EmitLines = false
+
 // Compile takes an AST and writes the assembly that it compiles to to
 // w.
 func Generate(node ast.Node, typeInfo ast.TypeInformation, callables ast.Callables, enums EnumMap) (Func, EnumMap, RegisterData, error) {
+	return GenerateWithConstants(node, typeInfo, callables, enums, nil)
+}
+
+// Constants maps top level constants to the literal register that their
+// value was evaluated to at compile time.
+type Constants map[ast.VarWithType]Register
+
+// GenerateWithConstants is like Generate, but any use of a constant in
+// consts in node is replaced with the constant's value.
+func GenerateWithConstants(node ast.Node, typeInfo ast.TypeInformation, callables ast.Callables, enums EnumMap, consts Constants) (Func, EnumMap, RegisterData, error) {
 	callNum = 0
 	context := &variableLayout{
 		make(map[ast.VarWithType]Register),
 		make(map[ast.VarWithType]Register),
 		0,
-		0,
 		typeInfo,
 		nil,
 		nil,
@@ -31,6 +45,10 @@ func Generate(node ast.Node, typeInfo ast.TypeInformation, callables ast.Callabl
 		make(RegisterData),
 		false,
 		nil,
+		nil,
+	}
+	for k, v := range consts {
+		context.values[k] = v
 	}
 	switch n := node.(type) {
 	case ast.FuncDecl:
@@ -211,6 +229,7 @@ func callFunc(fc ast.FuncCall, context *variableLayout, tailcall bool) ([]Opcode
 		}
 		switch a := arg.(type) {
 		case ast.EnumValue:
+			first := len(argRegs)
 			argRegs = append(argRegs, getRegister(a, context))
 			for _, v := range a.Parameters {
 				arg, r, err := evaluateValue(v, context)
@@ -218,7 +237,29 @@ func callFunc(fc ast.FuncCall, context *variableLayout, tailcall bool) ([]Opcode
 					return nil, err
 				}
 				ops = append(ops, arg...)
-				argRegs = append(argRegs, r[0])
+				argRegs = append(argRegs, r...)
+			}
+			// An option such as Nothing doesn't use every register of
+			// the type, but the callee still expects them to be passed.
+			if funcArgs != nil {
+				for n := len(argRegs) - first; n < registerCount(funcArgs[i].Type()); n++ {
+					argRegs = append(argRegs, IntLiteral(0))
+				}
+			}
+		case ast.IfExpr, ast.MatchExpr:
+			// The value of an expression is in a local for every
+			// register of its type.
+			first := len(argRegs)
+			body, r, err := evaluateValue(a, context)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, body...)
+			argRegs = append(argRegs, r...)
+			if funcArgs != nil {
+				for n := len(argRegs) - first; n < registerCount(funcArgs[i].Type()); n++ {
+					argRegs = append(argRegs, IntLiteral(0))
+				}
 			}
 		case ast.StringLiteral:
 			// Decompose strings into len, literal pairs so we don't need special cases in
@@ -367,6 +408,10 @@ func callFunc(fc ast.FuncCall, context *variableLayout, tailcall bool) ([]Opcode
 				context.registerInfo[lv] = info
 				if a.Type().TypeName() == "string" {
 					switch lvl := lv.(type) {
+					case StringLiteral:
+						// A top level constant.
+						argRegs = append(argRegs, IntLiteral(len(strings.Replace(string(lvl), `\n`, "\n", -1))))
+						argRegs = append(argRegs, lvl)
 					case LocalValue:
 						argRegs = append(argRegs, lvl)
 						lvl++
@@ -375,11 +420,16 @@ func callFunc(fc ast.FuncCall, context *variableLayout, tailcall bool) ([]Opcode
 						argRegs = append(argRegs, lvl)
 						lvl.Id++
 						argRegs = append(argRegs, lvl)
+					case Offset:
+						// A for loop variable referring to an element
+						// of a string array, pass it the same way as
+						// an indexed value.
+						argRegs = append(argRegs, lvl)
 					default:
 						panic(fmt.Sprintf("Unhandled register type for string: %v", reflect.TypeOf(lvl)))
 					}
 				} else {
-					argRegs = append(argRegs, lv)
+					argRegs = append(argRegs, valueRegisters(lv, a.Type())...)
 				}
 			}
 		case ast.FuncCall:
@@ -437,8 +487,8 @@ func callFunc(fc ast.FuncCall, context *variableLayout, tailcall bool) ([]Opcode
 			rv++
 		}
 	}
+	ops = append(ops, CALL{FName: FName(fc.Name), Args: argRegs, TailCall: tailcall, CallNum: callNum})
 	callNum++
-	ops = append(ops, CALL{FName: FName(fc.Name), Args: argRegs, TailCall: tailcall})
 	return ops, nil
 }
 
@@ -466,7 +516,10 @@ func getRegister(n ast.Node, context *variableLayout) Register {
 
 func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error) {
 	var ops []Opcode
-	for _, stmt := range block.Stmts {
+	for i, stmt := range block.Stmts {
+		if EmitLines && i < len(block.Lines) && block.Lines[i] > 0 {
+			ops = append(ops, LINE{block.Lines[i]})
+		}
 		switch s := stmt.(type) {
 		case ast.FuncCall:
 			fc, err := callFunc(s, context, false)
@@ -491,31 +544,11 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 					goto hack
 				}
 			case ast.TupleType:
-				val, ok := s.Val.(ast.TupleValue)
-				if !ok {
-					return nil, fmt.Errorf("Tuple must be assigned to a tuple value")
-				}
-				basename := s.Var.Name
-				var vr ast.VarWithType
-				for i := range t {
-					vr.Name = basename + "." + ast.Variable(t[i].Name)
-					vr.Typ = t[i].Typ
-					body, rvs, err := evaluateValue(val[i], context)
-					if err != nil {
-						return nil, err
-					}
-					ops = append(ops, body...)
-					for i, v := range rvs {
-						if i > 0 {
-							vr.Name = ast.Variable(fmt.Sprintf("%s.%s[%d]", basename, t[i].Name, i))
-						}
-						reg := context.NextLocalRegister(vr)
-						ops = append(ops, MOV{
-							Src: v,
-							Dst: reg,
-						})
-					}
+				tops, err := declareTuple(s.Var, t, s.Val, context)
+				if err != nil {
+					return nil, err
 				}
+				ops = append(ops, tops...)
 				s.Var.Typ = ast.TypeLiteral(t.TypeName())
 				continue
 			}
@@ -590,9 +623,6 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 
 					if i == 0 {
 						context.values[s.Var] = reg
-						if !oldval {
-							context.tempVars--
-						}
 					}
 				}
 			case ast.SliceType:
@@ -607,7 +637,9 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 			default:
 				for i, r := range rvs {
 					newvar := s.Var
-					newvar.Name = s.Var.Name + ast.Variable(fmt.Sprintf("%s[%d]", s.Var.Name, i))
+					if i > 0 {
+						newvar.Name = ast.Variable(fmt.Sprintf("%s[%d]", s.Var.Name, i))
+					}
 					reg := context.NextLocalRegister(newvar)
 
 					// Copy the type info from the return value to the implicitly created
@@ -631,13 +663,18 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 							s.Var.Typ = ast.TypeLiteral(t.TypeName())
 						}
 						context.values[s.Var] = reg
-						if !oldval {
-							context.tempVars--
-						}
 					}
 				}
 			}
 		case ast.MutStmt:
+			if t, ok := ast.UnderlyingTuple(s.Var.Typ); ok {
+				tops, err := declareTuple(s.Var, t, s.InitialValue, context)
+				if err != nil {
+					return nil, err
+				}
+				ops = append(ops, tops...)
+				continue
+			}
 
 			// If it's a slice, start by putting the size before calling evaluateValue.
 			// evaluateValue only deals with the literal and doesn't know if it's in a slice
@@ -702,7 +739,6 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 
 					if i == 0 {
 						context.values[s.Var] = reg
-						context.tempVars--
 					}
 				}
 			case ast.SliceType:
@@ -747,20 +783,21 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 				ops = append(ops, fc...)
 				// Calling the function already will have left
 				// the value in FuncRetValRegister[0]
-			case ast.EnumValue:
-				// The variant of the enum goes into FR0
-				ops = append(ops, MOV{
-					Src: getRegister(arg, context),
-					Dst: FuncRetVal(0),
-				})
-
-				// The parameters go into FRn + i
-				for i := range arg.Parameters {
-					ops = append(ops, MOV{
-						Src: getRegister(arg.Parameters[i], context),
-						Dst: FuncRetVal(1 + uint(i)),
-					})
+			case ast.EnumValue, ast.IfExpr, ast.MatchExpr:
+				// The variant of an enum goes into FR0, and the
+				// registers for the parameters go into FRn + i.
+				// Expressions put each register of their value
+				// into the corresponding return register.
+				body, r, err := evaluateValue(arg, context)
+				if err != nil {
+					return nil, err
+				}
+				ops = append(ops, body...)
+				dsts := make([]Register, len(r))
+				for i := range r {
+					dsts[i] = FuncRetVal(i)
 				}
+				ops = append(ops, moveFields(r, dsts)...)
 			case ast.AdditionOperator, ast.SubtractionOperator, ast.MulOperator, ast.DivOperator, ast.ModOperator:
 				body, r, err := evaluateValue(arg, context)
 				if err != nil {
@@ -815,12 +852,23 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 		case ast.AssignmentOperator:
 			switch v := s.Variable.(type) {
 			case ast.VarWithType:
+				if t, ok := ast.UnderlyingTuple(v.Typ); ok {
+					tops, err := assignTuple(v, t, s.Value, context)
+					if err != nil {
+						return nil, err
+					}
+					ops = append(ops, tops...)
+					continue
+				}
 				dst := context.Get(v)
 				body, rvs, err := evaluateValue(s.Value, context)
 				if err != nil {
 					return nil, err
 				}
 				ops = append(ops, body...)
+				if v.Typ.TypeName() == "string" && len(rvs) == 1 {
+					rvs = stringRegisters(rvs[0])
+				}
 
 				for i, r := range rvs {
 					var dstReg Register
@@ -918,7 +966,9 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 			context.loopCond = false
 			context.loop = nil
 
+			context.loops = append(context.loops, loopInfo{label: s.Label})
 			lbody, err := compileBlock(s.Body, context)
+			context.loops = context.loops[:len(context.loops)-1]
 			if err != nil {
 				return nil, err
 			}
@@ -926,166 +976,494 @@ func compileBlock(block ast.BlockStmt, context *variableLayout) ([]Opcode, error
 			l.Condition = Condition{Body: cbody, Register: c[0]}
 			l.Body = lbody
 			ops = append(ops, l)
+		case ast.ForLoop:
+			oldvalues := context.CloneValues()
+			l, err := compileForLoop(s, context)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, l)
+			context.values = oldvalues
+		case ast.BreakStmt:
+			depth, _ := context.getLoop(s.Label)
+			ops = append(ops, BREAK{depth})
+		case ast.ContinueStmt:
+			depth, loop := context.getLoop(s.Label)
+			ops = append(ops, loop.post...)
+			ops = append(ops, CONTINUE{depth})
 		case ast.MatchStmt:
-			var jt JumpTable
-			var condleft []Register
-			switch s.Condition.Type().(type) {
-			//case ast.SumType:
-			// Don't evaluate it if it's a sum type, because it needs
-			// to be destructured
-			default:
-				body, condleft2, err := evaluateValue(s.Condition, context)
-				if err != nil {
-					return nil, err
-				}
-				condleft = condleft2
-				ops = append(ops, body...)
+			mops, err := compileMatch(s, context, func(b ast.BlockStmt) ([]Opcode, error) {
+				return compileBlock(b, context)
+			})
+			if err != nil {
+				return nil, err
 			}
+			ops = append(ops, mops...)
+		case ast.Assertion:
+			pbody, pregister, err := evaluateValue(s.Predicate, context)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, ASSERT{
+				Predicate: Condition{pbody, pregister[0]},
+				Message:   StringLiteral(s.Message),
+				Node:      s.Predicate,
+			})
 
-			// Generate jump table
-			for i := range s.Cases {
-				var casestmt ControlFlow
-				switch t := s.Condition.Type().(type) {
-				case ast.SumType:
-					// Type destructuring of sum type.
-					matched := false
-					// Shadow the variable with the destructured version for the
-					// duration of the case statement.
-					oldVals := make(map[ast.VarWithType]Register)
-					for k, v := range context.values {
-						oldVals[k] = v
-					}
-
-					r := context.NextTempRegister()
-					for j, subtype := range t {
-						if subtype.TypeName() == s.Cases[i].Variable.Type().TypeName() {
-							matched = true
-							casestmt.Condition.Body = []Opcode{
-								EQ{
-									Left:  condleft[0],
-									Right: IntLiteral(j),
-									Dst:   r,
-								},
-							}
-							casestmt.Condition.Register = r
-
-							switch v := s.Cases[i].Variable.(type) {
-							case ast.VarWithType:
-								switch lv := condleft[0].(type) {
-								case FuncArg:
-									lv.Id++
-									context.values[v] = lv
-								case LocalValue:
-									lv++
-									context.values[v] = lv
-								default:
-									panic(fmt.Sprintf("Unhandled register type for type destructuring: %v", reflect.TypeOf(condleft[0])))
-								}
-							default:
-								panic("Bad type destructuring")
-							}
-							break
-						}
-					}
-					if !matched {
-						return nil, fmt.Errorf("No match for type in sum type destructuring")
-					}
+		default:
+			panic(fmt.Sprintf("Statement type not implemented: %v", reflect.TypeOf(s)))
+		}
+	}
+	return ops, nil
+}
 
-					body, err := compileBlock(s.Cases[i].Body, context)
-					if err != nil {
-						return nil, err
-					}
+// Lowers a match statement to a JumpTable. The body of each case is compiled
+// by compileBody, so that a match expression can also store the value of
+// each case.
+func compileMatch(s ast.MatchStmt, context *variableLayout, compileBody func(ast.BlockStmt) ([]Opcode, error)) ([]Opcode, error) {
+	var ops []Opcode
+	var jt JumpTable
+	var condleft []Register
+	switch s.Condition.Type().(type) {
+	//case ast.SumType:
+	// Don't evaluate it if it's a sum type, because it needs
+	// to be destructured
+	default:
+		if _, ok := ast.UnderlyingTuple(s.Condition.Type()); ok {
+			// Tuples can only be matched by patterns, which
+			// evaluate each field below.
+			break
+		}
+		body, condleft2, err := evaluateValue(s.Condition, context)
+		if err != nil {
+			return nil, err
+		}
+		condleft = condleft2
+		ops = append(ops, body...)
+	}
+	if hasPatterns(s) {
+		body, condregs, err := matchRegisters(s.Condition, condleft, context)
+		if err != nil {
+			return nil, err
+		}
+		condleft = condregs
+		ops = append(ops, body...)
+	}
 
-					casestmt.Body = body
-					// Finally, add the case to the jumptable and restore the context.
-					jt = append(jt, casestmt)
-					context.values = oldVals
-				default:
-					// Generate the comparison
-					body, condright, err := evaluateValue(s.Cases[i].Variable, context)
-					if err != nil {
-						return nil, err
-					}
-					if s.Condition == ast.BoolLiteral(true) {
-						casestmt.Condition = Condition{
-							Body:     body,
-							Register: condright[0],
-						}
-					} else {
-						r := context.NextTempRegister()
-						casestmt.Condition.Body = append(
-							body,
-							EQ{Left: condleft[0], Right: condright[0], Dst: r},
-						)
-						casestmt.Condition.Register = r
-					}
+	// Generate jump table
+	for i := range s.Cases {
+		var casestmt ControlFlow
+		switch t := s.Condition.Type().(type) {
+		case ast.SumType:
+			// Type destructuring of sum type.
+			matched := false
+			// Shadow the variable with the destructured version for the
+			// duration of the case statement.
+			oldVals := make(map[ast.VarWithType]Register)
+			for k, v := range context.values {
+				oldVals[k] = v
+			}
 
-					// Generate the bodies
-					//
-					// Store the old values of variables for enum options that get
-					// shadowed, and ensure they don't leak outside of the case
-					oldVals := make(map[ast.VarWithType]Register)
-					for k, v := range context.values {
-						oldVals[k] = v
+			r := context.NextTempRegister()
+			for j, subtype := range t {
+				if subtype.TypeName() == s.Cases[i].Variable.Type().TypeName() {
+					matched = true
+					casestmt.Condition.Body = []Opcode{
+						EQ{
+							Left:  condleft[0],
+							Right: IntLiteral(j),
+							Dst:   r,
+						},
 					}
+					casestmt.Condition.Register = r
 
-					switch ev := s.Cases[i].Variable.(type) {
-					case ast.EnumOption:
-						// If the case was an EnumOption, it means the MatchStmt
-						// variable was an enumerated data type. The index of the
-						// original variable + i is the i'th parameter, so set
-						// the appropriate LocalVariables in the context for
-						// the case.
-						val, ok := s.Condition.(ast.VarWithType)
-						if !ok {
-							panic("Unexpected pattern matching on non-variable")
-						}
-						vreg := context.Get(val)
-						switch lv := vreg.(type) {
+					switch v := s.Cases[i].Variable.(type) {
+					case ast.VarWithType:
+						switch lv := condleft[0].(type) {
 						case FuncArg:
-							for j := range ev.Parameters {
-								lv.Id += 1
-								context.SetLocalRegister(s.Cases[i].LocalVariables[j], lv)
-							}
-
+							lv.Id++
+							context.values[v] = lv
 						case LocalValue:
-							for j := range ev.Parameters {
-								lv += 1
-								context.SetLocalRegister(s.Cases[i].LocalVariables[j], lv)
-							}
+							lv++
+							context.values[v] = lv
 						default:
-							panic(fmt.Sprintf("Expected enumeration to be a local variable or function argument: got %v", reflect.TypeOf(vreg)))
+							panic(fmt.Sprintf("Unhandled register type for type destructuring: %v", reflect.TypeOf(condleft[0])))
 						}
+					default:
+						panic("Bad type destructuring")
 					}
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("No match for type in sum type destructuring")
+			}
 
-					body, err = compileBlock(s.Cases[i].Body, context)
-					if err != nil {
-						return nil, err
-					}
-					casestmt.Body = body
+			body, err := compileBody(s.Cases[i].Body)
+			if err != nil {
+				return nil, err
+			}
 
-					// Finally, add the case to the jumptable and restore the context.
-					jt = append(jt, casestmt)
-					context.values = oldVals
+			casestmt.Body = body
+			// Finally, add the case to the jumptable and restore the context.
+			jt = append(jt, casestmt)
+			context.values = oldVals
+		default:
+			// Store the old values of variables bound by the case,
+			// and ensure they don't leak outside of it.
+			oldVals := make(map[ast.VarWithType]Register)
+			for k, v := range context.values {
+				oldVals[k] = v
+			}
+			if p := s.Cases[i].Pattern; p != nil {
+				checks, err := compilePattern(p, condleft, context)
+				if err != nil {
+					return nil, err
 				}
+				casestmt.Condition, err = caseCondition(checks, s.Cases[i].Guard, context)
+				if err != nil {
+					return nil, err
+				}
+				body, err := compileBody(s.Cases[i].Body)
+				if err != nil {
+					return nil, err
+				}
+				casestmt.Body = body
+				jt = append(jt, casestmt)
+				context.values = oldVals
+				continue
 			}
-			ops = append(ops, jt)
-		case ast.Assertion:
-			pbody, pregister, err := evaluateValue(s.Predicate, context)
+
+			// Generate the comparison
+			body, condright, err := evaluateValue(s.Cases[i].Variable, context)
 			if err != nil {
 				return nil, err
 			}
-			ops = append(ops, ASSERT{
-				Predicate: Condition{pbody, pregister[0]},
-				Message:   StringLiteral(s.Message),
-				Node:      s.Predicate,
-			})
+			if s.Condition == ast.BoolLiteral(true) {
+				casestmt.Condition = Condition{
+					Body:     body,
+					Register: condright[0],
+				}
+			} else {
+				r := context.NextTempRegister()
+				casestmt.Condition.Body = append(
+					body,
+					EQ{Left: condleft[0], Right: condright[0], Dst: r},
+				)
+				casestmt.Condition.Register = r
+			}
+			if s.Cases[i].Guard != nil {
+				casestmt.Condition, err = allConditions([]Condition{casestmt.Condition}, s.Cases[i].Guard, context)
+				if err != nil {
+					return nil, err
+				}
+			}
 
+			// Generate the bodies
+			body, err = compileBody(s.Cases[i].Body)
+			if err != nil {
+				return nil, err
+			}
+			casestmt.Body = body
+
+			// Finally, add the case to the jumptable and restore the context.
+			jt = append(jt, casestmt)
+			context.values = oldVals
+		}
+	}
+	return append(ops, jt), nil
+}
+
+// Returns the name of the variable holding the i'th field of the tuple
+// variable v. The fields of a tuple literal don't have names, so they're
+// named by their index instead.
+func fieldVariable(v ast.Variable, t ast.TupleType, i int) ast.Variable {
+	if t[i].Name == "" {
+		return ast.Variable(fmt.Sprintf("%s.%d", v, i))
+	}
+	return v + "." + t[i].Name
+}
+
+// Returns the values of each field of the tuple value val, which is of type t.
+func tupleFields(val ast.Value, t ast.TupleType) (ast.TupleValue, error) {
+	switch v := val.(type) {
+	case ast.TupleValue:
+		return v, nil
+	case ast.TupleUpdate:
+		return v.Values, nil
+	case ast.VarWithType:
+		fields := make(ast.TupleValue, len(t))
+		for i := range t {
+			fields[i] = ast.VarWithType{
+				Name:      fieldVariable(v.Name, t, i),
+				Typ:       t[i].Typ,
+				Reference: v.Reference,
+			}
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("Tuple must be assigned to a tuple value")
+}
+
+// Evaluates every field of a tuple value before any of them are assigned,
+// so that a field can be assigned from the old value of another field of
+// the same tuple. Returns the registers for each field.
+func evaluateTupleFields(val ast.Value, t ast.TupleType, context *variableLayout) ([]Opcode, [][]Register, error) {
+	fields, err := tupleFields(val, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fields) != len(t) {
+		return nil, nil, fmt.Errorf("incorrect size for tuple value")
+	}
+	var ops []Opcode
+	regs := make([][]Register, len(t))
+	for i := range t {
+		body, rvs, err := evaluateValue(fields[i], context)
+		if err != nil {
+			return nil, nil, err
+		}
+		ops = append(ops, body...)
+		if t[i].Typ.TypeName() == "string" && len(rvs) == 1 {
+			rvs = stringRegisters(rvs[0])
+		}
+		regs[i] = rvs
+	}
+	return ops, regs, nil
+}
+
+// Returns the length and pointer registers for a string variable whose
+// first register is r.
+func stringRegisters(r Register) []Register {
+	switch reg := r.(type) {
+	case LocalValue:
+		return []Register{reg, reg + 1}
+	case FuncArg:
+		ptr := reg
+		ptr.Id++
+		return []Register{reg, ptr}
+	default:
+		return []Register{r}
+	}
+}
+
+// Allocates registers for each field of the tuple variable v, initialized to
+// the value val.
+func declareTuple(v ast.VarWithType, t ast.TupleType, val ast.Value, context *variableLayout) ([]Opcode, error) {
+	ops, fields, err := evaluateTupleFields(val, t, context)
+	if err != nil {
+		return nil, err
+	}
+	var srcs, dsts []Register
+	for i := range t {
+		vr := ast.VarWithType{
+			Name: fieldVariable(v.Name, t, i),
+			Typ:  t[i].Typ,
+		}
+		for j, r := range fields[i] {
+			if j > 0 {
+				vr.Name = ast.Variable(fmt.Sprintf("%s[%d]", fieldVariable(v.Name, t, i), j))
+			}
+			srcs = append(srcs, r)
+			dsts = append(dsts, context.NextLocalRegister(vr))
+		}
+	}
+	return append(ops, moveFields(srcs, dsts)...), nil
+}
+
+// Assigns val to every field of the mutable tuple variable v.
+func assignTuple(v ast.VarWithType, t ast.TupleType, val ast.Value, context *variableLayout) ([]Opcode, error) {
+	ops, fields, err := evaluateTupleFields(val, t, context)
+	if err != nil {
+		return nil, err
+	}
+	var srcs, dsts []Register
+	for i := range t {
+		dst := context.Get(ast.VarWithType{
+			Name:      fieldVariable(v.Name, t, i),
+			Typ:       t[i].Typ,
+			Reference: v.Reference,
+		})
+		if len(fields[i]) > 1 {
+			dsts = append(dsts, stringRegisters(dst)...)
+		} else {
+			dsts = append(dsts, dst)
+		}
+		srcs = append(srcs, fields[i]...)
+	}
+	if len(srcs) != len(dsts) {
+		return nil, fmt.Errorf("incorrect size for tuple value")
+	}
+
+	// If a field is being assigned the value of a different field of the
+	// same variable (ie. when swapping them) it needs to be copied
+	// somewhere else first so that it isn't overwritten before it's read.
+	for i, src := range srcs {
+		switch src.(type) {
+		case LocalValue, FuncArg:
+			for j, dst := range dsts {
+				if i != j && src == dst {
+					tmp := context.NextTempRegister()
+					ops = append(ops, MOV{Src: src, Dst: tmp})
+					srcs[i] = tmp
+					break
+				}
+			}
+		}
+	}
+	return append(ops, moveFields(srcs, dsts)...), nil
+}
+
+// Moves each of srcs into the corresponding dst, after all the values of a
+// tuple have been evaluated. Values in temporary registers are moved last, in
+// the opposite order that they were created, since some backends (wasm) treat
+// TempValues as a stack.
+func moveFields(srcs, dsts []Register) []Opcode {
+	var ops, temps []Opcode
+	for i := range srcs {
+		if tv, ok := srcs[i].(TempValue); ok {
+			mov := MOV{Src: srcs[i], Dst: dsts[i]}
+			j := 0
+			for j < len(temps) && temps[j].(MOV).Src.(TempValue) > tv {
+				j++
+			}
+			temps = append(temps[:j], append([]Opcode{mov}, temps[j:]...)...)
+			continue
+		}
+		if srcs[i] == dsts[i] {
+			// The field isn't changing.
+			continue
+		}
+		ops = append(ops, MOV{
+			Src: srcs[i],
+			Dst: dsts[i],
+		})
+	}
+	return append(ops, temps...)
+}
+
+// Lowers a for loop to a LOOP. The index is initialized by the loop's
+// Initializer and incremented at the end of each iteration, and the value
+// variable (if any) is loaded from the collection at the start of each
+// iteration.
+func compileForLoop(s ast.ForLoop, context *variableLayout) (LOOP, error) {
+	var l LOOP
+
+	idxVar := s.Index
+	if idxVar.Name == "" {
+		idxVar = ast.VarWithType{Name: "for.index", Typ: ast.TypeLiteral("int")}
+	}
+
+	var end Register
+	if s.Start != nil {
+		sops, start, err := evaluateValue(s.Start, context)
+		if err != nil {
+			return LOOP{}, err
+		}
+		eops, e, err := evaluateValue(s.End, context)
+		if err != nil {
+			return LOOP{}, err
+		}
+		idx := context.NextLocalRegister(idxVar)
+		l.Initializer = append(l.Initializer, sops...)
+		l.Initializer = append(l.Initializer, MOV{Src: start[0], Dst: idx})
+
+		// The end of the range is only evaluated once, before the
+		// first iteration.
+		switch e[0].(type) {
+		case IntLiteral:
+			end = e[0]
 		default:
-			panic(fmt.Sprintf("Statement type not implemented: %v", reflect.TypeOf(s)))
+			end = context.NextLocalRegister(ast.VarWithType{Name: "for.end", Typ: s.End.Type()})
+			l.Initializer = append(l.Initializer, eops...)
+			l.Initializer = append(l.Initializer, MOV{Src: e[0], Dst: end})
+		}
+	} else {
+		if s.CollectionValue != nil {
+			// Evaluate the expression into the hidden variable
+			// that the loop iterates over.
+			let := ast.LetStmt{Var: s.Collection, Val: s.CollectionValue}
+			cops, err := compileBlock(ast.BlockStmt{Stmts: []ast.Node{let}}, context)
+			if err != nil {
+				return LOOP{}, err
+			}
+			l.Initializer = append(l.Initializer, cops...)
+		}
+		switch t := s.Collection.Typ.(type) {
+		case ast.ArrayType:
+			end = IntLiteral(t.Size)
+		default:
+			// Both slices and strings store the length in
+			// the first register of the variable.
+			end = context.Get(s.Collection)
 		}
+		idx := context.NextLocalRegister(idxVar)
+		l.Initializer = append(l.Initializer, MOV{Src: IntLiteral(0), Dst: idx})
 	}
-	return ops, nil
+	idx := context.Get(idxVar)
+
+	cond := context.NextTempRegister()
+	l.Condition = Condition{
+		Body:     []Opcode{LT{Left: idx, Right: end, Dst: cond}},
+		Register: cond,
+	}
+
+	if s.Value.Name != "" {
+		var elem Register
+		switch s.Collection.Typ.(type) {
+		case ast.ArrayType, ast.SliceType:
+			eops, e, err := evaluateValue(ast.ArrayValue{Base: s.Collection, Index: idxVar}, context)
+			if err != nil {
+				return LOOP{}, err
+			}
+			l.Body = append(l.Body, eops...)
+			elem = e[0]
+		default:
+			// Strings are a length, pointer pair, and iterating over
+			// them gives the bytes.
+			var ptr Register
+			switch r := context.Get(s.Collection).(type) {
+			case LocalValue:
+				ptr = r + 1
+			case FuncArg:
+				r.Id++
+				ptr = r
+			default:
+				panic(fmt.Sprintf("Unhandled register type for string: %v", reflect.TypeOf(r)))
+			}
+			elem = Offset{
+				Base:      SliceBasePointer{ptr},
+				Offset:    idx,
+				Scale:     1,
+				Container: s.Collection,
+			}
+		}
+		if s.Value.Type().TypeName() == "string" {
+			// Strings take two registers, so rather than copying them
+			// refer to the element directly. The loop variable is
+			// immutable, so nothing can modify it through the alias.
+			context.SetLocalRegister(s.Value, elem)
+		} else {
+			v := context.NextLocalRegister(s.Value)
+			l.Body = append(l.Body, MOV{Src: elem, Dst: v})
+		}
+	}
+
+	next := context.NextTempRegister()
+	post := []Opcode{
+		ADD{Left: idx, Right: IntLiteral(1), Dst: next},
+		MOV{Src: next, Dst: idx},
+	}
+
+	context.loops = append(context.loops, loopInfo{label: s.Label, post: post})
+	body, err := compileBlock(s.Body, context)
+	context.loops = context.loops[:len(context.loops)-1]
+	if err != nil {
+		return LOOP{}, err
+	}
+	l.Body = append(l.Body, body...)
+	l.Body = append(l.Body, post...)
+	return l, nil
 }
 
 // Evaluates a value expression and returns the opcodes to evaluate it, and the
@@ -1195,7 +1573,16 @@ func evaluateValue(val ast.Value, context *variableLayout) ([]Opcode, []Register
 	case ast.StringLiteral:
 		length := len(strings.Replace(string(s), `\n`, "x", -1))
 		return nil, []Register{getRegister(ast.IntLiteral(length), context), getRegister(s, context)}, nil
-	case ast.VarWithType, ast.IntLiteral, ast.BoolLiteral, ast.EnumOption:
+	case ast.VarWithType:
+		r := getRegister(s, context)
+		if str, ok := r.(StringLiteral); ok {
+			// A string constant, which gets decomposed the same way
+			// as a string literal.
+			length := len(strings.Replace(string(str), `\n`, "x", -1))
+			return nil, []Register{IntLiteral(length), str}, nil
+		}
+		return nil, []Register{r}, nil
+	case ast.IntLiteral, ast.BoolLiteral, ast.EnumOption:
 		return nil, []Register{getRegister(s, context)}, nil
 	case ast.ArrayValue:
 		base := getRegister(s.Base, context)
@@ -1463,7 +1850,7 @@ func evaluateValue(val ast.Value, context *variableLayout) ([]Opcode, []Register
 				return nil, nil, err
 			}
 			ops = append(ops, arg...)
-			regs = append(regs, r[0])
+			regs = append(regs, r...)
 		}
 		return ops, regs, nil
 	case ast.ArrayLiteral:
@@ -1518,6 +1905,12 @@ func evaluateValue(val ast.Value, context *variableLayout) ([]Opcode, []Register
 
 		ops = append(ops, MOV{Src: r[0], Dst: lv})
 		return ops, []Register{lv}, nil
+	case ast.IfExpr:
+		return compileIfExpr(s, context)
+	case ast.MatchExpr:
+		return compileMatchExpr(s, context)
+	case ast.TupleUpdate:
+		return evaluateValue(s.Values, context)
 	case ast.TupleValue:
 		var rv []Register
 		for _, c := range s {
@@ -24,7 +24,6 @@ type RegisterInfo struct {
 type variableLayout struct {
 	values       map[ast.VarWithType]Register
 	sliceBase    map[ast.VarWithType]Register
-	tempVars     int
 	tempRegs     uint
 	typeinfo     ast.TypeInformation
 	funcargs     []ast.VarWithType
@@ -36,6 +35,29 @@ type variableLayout struct {
 	registerInfo RegisterData
 	loopCond     bool
 	loop         *LOOP
+
+	// The loops enclosing the block currently being compiled, with the
+	// innermost loop last.
+	loops []loopInfo
+}
+
+type loopInfo struct {
+	label string
+
+	// Opcodes that need to run before a CONTINUE to this loop, such
+	// as a for loop incrementing its index.
+	post []Opcode
+}
+
+// Returns the depth of the loop with the given label, or the innermost
+// loop if label is empty, and the loop itself.
+func (c variableLayout) getLoop(label string) (uint, loopInfo) {
+	for i := len(c.loops) - 1; i >= 0; i-- {
+		if label == "" || c.loops[i].label == label {
+			return uint(len(c.loops) - 1 - i), c.loops[i]
+		}
+	}
+	panic("Could not find loop " + label)
 }
 
 func (c variableLayout) GetTypeInfo(t string) ast.TypeInfo {
@@ -68,23 +90,17 @@ func (c *variableLayout) NextLocalRegister(varname ast.VarWithType) Register {
 		panic("No name for variable")
 	}
 
-	c.numLocals++
-
 	switch t := varname.Type().(type) {
 	case ast.SumType, ast.EnumTypeDefn, ast.TupleType, ast.UserType:
 		// Hack, since SumType is unhashable and can't
 		// be used as a key for c.values
 		varname.Typ = ast.TypeLiteral(t.TypeName())
 	}
-	// If this variable is shadowing another variable, increase tempVars to
-	// make sure the next calls increment the LocalVariable number and don't
-	// reuse the same variable.
-	_, postInc := c.values[varname]
-	lv := LocalValue(uint(len(c.values) + c.tempVars))
+	// Locals are never reused, even if the variable is shadowing another
+	// one or the variable that had the register went out of scope.
+	lv := LocalValue(c.numLocals)
+	c.numLocals++
 	c.values[varname] = lv
-	if postInc {
-		c.tempVars++
-	}
 	c.registerInfo[lv] = RegisterInfo{
 		string(varname.Name),
 		c.typeinfo[varname.Type().TypeName()],
@@ -99,7 +115,6 @@ func (c *variableLayout) NextLocalRegister(varname ast.VarWithType) Register {
 // Reserves a register for a function parameter. This must be done for every
 // parameter, before any LocalRegister calls are made.
 func (c *variableLayout) FuncParamRegister(varname ast.VarWithType, i int) Register {
-	c.tempVars--
 	fa := FuncArg{uint(i), varname.Reference}
 	switch t := varname.Type().(type) {
 	case ast.SumType:
@@ -122,6 +137,12 @@ func (c *variableLayout) FuncParamRegister(varname ast.VarWithType, i int) Regis
 // Sets a variable to refer to an existing register, without generating a new
 // one.
 func (c *variableLayout) SetLocalRegister(varname ast.VarWithType, val Register) {
+	switch t := varname.Type().(type) {
+	case ast.SumType, ast.EnumTypeDefn, ast.TupleType, ast.UserType:
+		// Hack, since SumType is unhashable and can't
+		// be used as a key for c.values
+		varname.Typ = ast.TypeLiteral(t.TypeName())
+	}
 	c.values[varname] = val
 }
 
@@ -0,0 +1,107 @@
+package hlir
+
+import (
+	"fmt"
+
+	"github.com/driusan/lang/parser/ast"
+)
+
+// Reserves the local registers that the value of every branch of an if or
+// match expression of type t gets moved into, so that the value is in the
+// same place no matter which branch was taken.
+func branchResult(name string, t ast.Type, context *variableLayout) []Register {
+	var regs []Register
+	for i := 0; i < registerCount(t); i++ {
+		v := ast.VarWithType{Name: ast.Variable(name), Typ: t}
+		if i > 0 {
+			v = ast.VarWithType{
+				Name: ast.Variable(fmt.Sprintf("%s[%d]", name, i)),
+				Typ:  ast.TypeLiteral("int"),
+			}
+		}
+		regs = append(regs, context.NextLocalRegister(v))
+	}
+	return regs
+}
+
+// Compiles the body of a branch of an expression, and moves the value of the
+// branch into result. Variables declared in the branch don't outlive it.
+func compileBranch(b ast.BlockStmt, result []Register, t ast.Type, context *variableLayout) ([]Opcode, error) {
+	oldvalues := context.CloneValues()
+	defer func() {
+		context.values = oldvalues
+	}()
+
+	last := len(b.Stmts) - 1
+	val, ok := b.Stmts[last].(ast.Value)
+	if !ok {
+		return nil, fmt.Errorf("Branch of expression must end with a value")
+	}
+	lines := b.Lines
+	if len(lines) > last {
+		lines = lines[:last]
+	}
+	ops, err := compileBlock(ast.BlockStmt{Stmts: b.Stmts[:last], Lines: lines}, context)
+	if err != nil {
+		return nil, err
+	}
+	body, rvs, err := evaluateValue(val, context)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, body...)
+	if len(rvs) == 1 {
+		rvs = valueRegisters(rvs[0], t)
+	}
+	if _, ok := val.(ast.EnumValue); ok {
+		for len(rvs) < len(result) {
+			// Enum variants with fewer parameters than the
+			// largest one don't set all the registers.
+			rvs = append(rvs, IntLiteral(0))
+		}
+	}
+	if len(rvs) != len(result) {
+		return nil, fmt.Errorf("Incorrect number of values for branch of expression")
+	}
+	return append(ops, moveFields(rvs, result)...), nil
+}
+
+// Lowers an if expression to an IF which moves the value of the branch that
+// was taken into a new local.
+func compileIfExpr(s ast.IfExpr, context *variableLayout) ([]Opcode, []Register, error) {
+	cbody, c, err := evaluateValue(s.Condition, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := branchResult("if.result", s.Typ, context)
+	body, err := compileBranch(s.Body, result, s.Typ, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	elsebody, err := compileBranch(s.Else, result, s.Typ, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []Opcode{
+		IF{
+			ControlFlow: ControlFlow{
+				Condition: Condition{cbody, c[0]},
+				Body:      body,
+			},
+			ElseBody: elsebody,
+		},
+	}, result, nil
+}
+
+// Lowers a match expression to a JumpTable where each case moves its value
+// into a new local.
+func compileMatchExpr(s ast.MatchExpr, context *variableLayout) ([]Opcode, []Register, error) {
+	result := branchResult("match.result", s.Typ, context)
+	ops, err := compileMatch(s.MatchStmt, context, func(b ast.BlockStmt) ([]Opcode, error) {
+		return compileBranch(b, result, s.Typ, context)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ops, result, nil
+}
@@ -31,6 +31,10 @@ type CALL struct {
 	FName    FName
 	Args     []Register
 	TailCall bool
+
+	// The number of the call in its function, which the
+	// LastFuncCallRetVals of the values that it returns have.
+	CallNum uint
 }
 
 func (c CALL) String() string {
@@ -232,6 +236,42 @@ func (o LOOP) ModifiedRegisters() []Register {
 	return ControlFlow(o).ModifiedRegisters()
 }
 
+// BREAK exits the loop Depth levels out from the innermost enclosing
+// LOOP. A Depth of 0 exits the innermost loop.
+type BREAK struct {
+	Depth uint
+}
+
+func (o BREAK) String() string {
+	return fmt.Sprintf("BREAK %d\n", o.Depth)
+}
+
+func (o BREAK) Registers() []Register {
+	return nil
+}
+
+func (o BREAK) ModifiedRegisters() []Register {
+	return nil
+}
+
+// CONTINUE jumps back to the condition of the loop Depth levels out from
+// the innermost enclosing LOOP, exiting any loops nested inside of it.
+type CONTINUE struct {
+	Depth uint
+}
+
+func (o CONTINUE) String() string {
+	return fmt.Sprintf("CONTINUE %d\n", o.Depth)
+}
+
+func (o CONTINUE) Registers() []Register {
+	return nil
+}
+
+func (o CONTINUE) ModifiedRegisters() []Register {
+	return nil
+}
+
 type JumpTable []ControlFlow
 
 func (jt JumpTable) String() string {
@@ -355,6 +395,25 @@ func (o LTE) ModifiedRegisters() []Register {
 	return []Register{o.Dst}
 }
 
+// LINE marks the start of the code for a statement which is on line Line
+// of the source. It doesn't do anything when run, but lets the VM say where
+// in the source it is.
+type LINE struct {
+	Line int
+}
+
+func (o LINE) String() string {
+	return fmt.Sprintf("LINE %d", o.Line)
+}
+
+func (o LINE) Registers() []Register {
+	return nil
+}
+
+func (o LINE) ModifiedRegisters() []Register {
+	return nil
+}
+
 type ASSERT struct {
 	Predicate Condition
 	Message   StringLiteral
@@ -0,0 +1,312 @@
+package opt
+
+import (
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// constfold evaluates arithmetic and comparisons on literals at compile time,
+// simplifies arithmetic with an identity (x+0, x*1, ...), and propagates
+// literal values through temporaries and locals that are only assigned once.
+type constfold struct{}
+
+func (constfold) Name() string {
+	return "constfold"
+}
+
+func (constfold) Run(p *Program) error {
+	for i, f := range p.Funcs {
+		p.Funcs[i].Body = foldConstants(f.Body, p.RegisterData[f.Name])
+	}
+	return nil
+}
+
+// Folds the constants in the body of a function whose registers are
+// described by rd.
+func foldConstants(body []hlir.Opcode, rd hlir.RegisterData) []hlir.Opcode {
+	// Propagating a value can make another operation's operands
+	// literals, so keep going until nothing changes.
+	for {
+		cf := &constFolder{values: constantValues(body, rd)}
+		body = cf.block(hlir.ReplaceUses(body, cf.replace))
+		if !cf.changed {
+			return body
+		}
+	}
+}
+
+// The state of a single round of folding constants in a function.
+type constFolder struct {
+	// The literal value of each register which is known to have a
+	// constant value. Uses of the register are replaced by the value.
+	values map[hlir.Register]hlir.Register
+
+	changed bool
+}
+
+// Replaces a register with its value, if it's known.
+func (cf *constFolder) replace(r hlir.Register) hlir.Register {
+	if v, ok := cf.values[r]; ok {
+		cf.changed = true
+		return v
+	}
+	return r
+}
+
+// Simplifies the opcodes in ops and the blocks nested in it.
+func (cf *constFolder) block(ops []hlir.Opcode) []hlir.Opcode {
+	if ops == nil {
+		return nil
+	}
+	newops := make([]hlir.Opcode, 0, len(ops))
+	for _, op := range ops {
+		switch o := op.(type) {
+		case hlir.IF:
+			o.ControlFlow = cf.controlFlow(o.ControlFlow)
+			o.ElseBody = cf.block(o.ElseBody)
+			op = o
+		case hlir.LOOP:
+			op = hlir.LOOP(cf.controlFlow(hlir.ControlFlow(o)))
+		case hlir.JumpTable:
+			jt := make(hlir.JumpTable, 0, len(o))
+			for _, c := range o {
+				jt = append(jt, cf.controlFlow(c))
+			}
+			op = jt
+		case hlir.ASSERT:
+			o.Predicate.Body = cf.block(o.Predicate.Body)
+			op = o
+		case hlir.MOV:
+			if _, ok := cf.values[o.Dst]; ok {
+				if _, ok := o.Dst.(hlir.TempValue); ok {
+					// Every use of the temporary was replaced.
+					cf.changed = true
+					continue
+				}
+			}
+		default:
+			simplified, ok := simplify(op)
+			if !ok {
+				break
+			}
+			cf.changed = true
+			if mov, ok := simplified.(hlir.MOV); ok {
+				if _, ok := cf.values[mov.Dst]; ok {
+					if _, ok := mov.Dst.(hlir.TempValue); ok {
+						continue
+					}
+				}
+			}
+			op = simplified
+		}
+		newops = append(newops, op)
+	}
+	return newops
+}
+
+func (cf *constFolder) controlFlow(c hlir.ControlFlow) hlir.ControlFlow {
+	c.Condition.Body = cf.block(c.Condition.Body)
+	c.Initializer = cf.block(c.Initializer)
+	c.Body = cf.block(c.Body)
+	return c
+}
+
+// Returns the literal value that op calculates, if its operands are literals.
+func evaluate(op hlir.Opcode) (hlir.IntLiteral, bool) {
+	var l, r hlir.Register
+	switch o := op.(type) {
+	case hlir.MOV:
+		v, ok := o.Src.(hlir.IntLiteral)
+		return v, ok
+	case hlir.ADD:
+		l, r = o.Left, o.Right
+	case hlir.SUB:
+		l, r = o.Left, o.Right
+	case hlir.MUL:
+		l, r = o.Left, o.Right
+	case hlir.DIV:
+		l, r = o.Left, o.Right
+	case hlir.MOD:
+		l, r = o.Left, o.Right
+	case hlir.EQ:
+		l, r = o.Left, o.Right
+	case hlir.NEQ:
+		l, r = o.Left, o.Right
+	case hlir.GT:
+		l, r = o.Left, o.Right
+	case hlir.GEQ:
+		l, r = o.Left, o.Right
+	case hlir.LT:
+		l, r = o.Left, o.Right
+	case hlir.LTE:
+		l, r = o.Left, o.Right
+	default:
+		return 0, false
+	}
+	left, ok := l.(hlir.IntLiteral)
+	if !ok {
+		return 0, false
+	}
+	right, ok := r.(hlir.IntLiteral)
+	if !ok {
+		return 0, false
+	}
+	switch op.(type) {
+	case hlir.ADD:
+		return left + right, true
+	case hlir.SUB:
+		return left - right, true
+	case hlir.MUL:
+		return left * right, true
+	case hlir.DIV:
+		if right == 0 {
+			// Leave it for the program to fail at runtime.
+			return 0, false
+		}
+		return left / right, true
+	case hlir.MOD:
+		if right == 0 {
+			return 0, false
+		}
+		return left % right, true
+	case hlir.EQ:
+		return boolLiteral(left == right), true
+	case hlir.NEQ:
+		return boolLiteral(left != right), true
+	case hlir.GT:
+		return boolLiteral(left > right), true
+	case hlir.GEQ:
+		return boolLiteral(left >= right), true
+	case hlir.LT:
+		return boolLiteral(left < right), true
+	case hlir.LTE:
+		return boolLiteral(left <= right), true
+	}
+	return 0, false
+}
+
+func boolLiteral(b bool) hlir.IntLiteral {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Returns a simpler opcode to replace op with, if there is one.
+func simplify(op hlir.Opcode) (hlir.Opcode, bool) {
+	if _, ok := op.(hlir.MOV); ok {
+		return nil, false
+	}
+	if v, ok := evaluate(op); ok {
+		return hlir.MOV{Src: v, Dst: op.ModifiedRegisters()[0]}, true
+	}
+	switch o := op.(type) {
+	case hlir.ADD:
+		if o.Right == hlir.IntLiteral(0) {
+			return hlir.MOV{Src: o.Left, Dst: o.Dst}, true
+		}
+		if o.Left == hlir.IntLiteral(0) {
+			return hlir.MOV{Src: o.Right, Dst: o.Dst}, true
+		}
+	case hlir.SUB:
+		if o.Right == hlir.IntLiteral(0) {
+			return hlir.MOV{Src: o.Left, Dst: o.Dst}, true
+		}
+	case hlir.MUL:
+		if o.Right == hlir.IntLiteral(1) {
+			return hlir.MOV{Src: o.Left, Dst: o.Dst}, true
+		}
+		if o.Left == hlir.IntLiteral(1) {
+			return hlir.MOV{Src: o.Right, Dst: o.Dst}, true
+		}
+	case hlir.DIV:
+		if o.Right == hlir.IntLiteral(1) {
+			return hlir.MOV{Src: o.Left, Dst: o.Dst}, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the registers in ops which always have the same literal value
+// when they're used.
+//
+// A temporary qualifies if it's only assigned once, with a value that can be
+// calculated at compile time. A local qualifies if it's only assigned once
+// with an integer literal, outside of any control flow, its address is never
+// taken, and arithmetic on it doesn't depend on its size.
+func constantValues(ops []hlir.Opcode, rd hlir.RegisterData) map[hlir.Register]hlir.Register {
+	defs := make(map[hlir.Register]int)
+	walk(ops, true, func(op hlir.Opcode, top bool) {
+		for _, r := range op.ModifiedRegisters() {
+			defs[r]++
+		}
+	})
+
+	addressed := lowestAddressed(ops)
+
+	values := make(map[hlir.Register]hlir.Register)
+	walk(ops, true, func(op hlir.Opcode, top bool) {
+		dst := op.ModifiedRegisters()
+		if len(dst) != 1 || defs[dst[0]] != 1 {
+			return
+		}
+		switch r := dst[0].(type) {
+		case hlir.TempValue:
+			if v, ok := evaluate(op); ok {
+				values[r] = v
+			}
+		case hlir.LocalValue:
+			mov, ok := op.(hlir.MOV)
+			if !ok || !top || r >= addressed {
+				return
+			}
+			src, ok := mov.Src.(hlir.IntLiteral)
+			if !ok {
+				return
+			}
+			// Only propagate scalars. The registers making up
+			// a string, slice or array are used together.
+			info := rd[r]
+			switch info.Variable.Type() {
+			case ast.TypeLiteral("bool"):
+			case ast.TypeLiteral("string"), nil:
+				return
+			default:
+				if _, ok := info.Variable.Type().(ast.TypeLiteral); !ok {
+					return
+				}
+				if info.TypeInfo.Size > 0 && info.TypeInfo.Size < 8 {
+					// Arithmetic on a sized int wraps,
+					// so the value of a calculation
+					// using it depends on more than
+					// its value.
+					return
+				}
+			}
+			values[r] = src
+		}
+	})
+
+	// Temporaries are used in the order that they're calculated by some
+	// backends, so a literal can't take the place of a temporary that's
+	// used before another temporary that still needs to be calculated.
+	// Leave the temporary alone when the order matters.
+	walk(ops, true, func(op hlir.Opcode, top bool) {
+		var replaced []hlir.Register
+		hlir.ReplaceOpUses(op, func(r hlir.Register) hlir.Register {
+			if _, ok := r.(hlir.TempValue); !ok {
+				return r
+			}
+			if _, ok := values[r]; ok {
+				replaced = append(replaced, r)
+			} else {
+				for _, tv := range replaced {
+					delete(values, tv)
+				}
+				replaced = nil
+			}
+			return r
+		})
+	})
+	return values
+}
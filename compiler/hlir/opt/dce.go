@@ -0,0 +1,226 @@
+package opt
+
+import (
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// dce eliminates dead code: the branches of an IF whose condition is a
+// literal, loops whose condition is always false, code after a RET, BREAK
+// or CONTINUE, and writes to registers which are never read. Code after a
+// RET, BREAK or CONTINUE is reported as a warning, since the user wrote it.
+type dce struct{}
+
+func (dce) Name() string {
+	return "dce"
+}
+
+func (dce) Run(p *Program) error {
+	for i, f := range p.Funcs {
+		warnUnreachable(p, f.Name, f.Body)
+		f.Body = pruneBlock(p, f.Name, f.Body)
+
+		// Removing a write can make the registers that it read unused,
+		// so keep going until nothing changes.
+		for {
+			body, removed := removeDeadWrites(p, f.Name, f.Body)
+			f.Body = body
+			if !removed {
+				break
+			}
+		}
+		p.Funcs[i] = f
+	}
+	return nil
+}
+
+// Returns a description of op if it unconditionally leaves the block that
+// it's in.
+func terminator(op hlir.Opcode) (string, bool) {
+	switch op.(type) {
+	case hlir.RET:
+		return "return", true
+	case hlir.BREAK:
+		return "break", true
+	case hlir.CONTINUE:
+		return "continue", true
+	}
+	return "", false
+}
+
+// Warns about any code in ops which can never be reached because it comes
+// after a terminator in the same block.
+func warnUnreachable(p *Program, fname string, ops []hlir.Opcode) {
+	for i, op := range ops {
+		if kind, ok := terminator(op); ok {
+			if i != len(ops)-1 {
+				p.Warn("%v: unreachable code after %v", fname, kind)
+			}
+			return
+		}
+		switch o := op.(type) {
+		case hlir.IF:
+			warnUnreachable(p, fname, o.Body)
+			warnUnreachable(p, fname, o.ElseBody)
+		case hlir.LOOP:
+			warnUnreachable(p, fname, o.Body)
+		case hlir.JumpTable:
+			for _, c := range o {
+				warnUnreachable(p, fname, c.Body)
+			}
+		}
+	}
+}
+
+// Removes the code from ops which can never run, and replaces branches
+// whose condition is known with the code that always runs.
+func pruneBlock(p *Program, fname string, ops []hlir.Opcode) []hlir.Opcode {
+	if ops == nil {
+		return nil
+	}
+	newops := make([]hlir.Opcode, 0, len(ops))
+	for _, op := range ops {
+		switch o := op.(type) {
+		case hlir.IF:
+			o.Body = pruneBlock(p, fname, o.Body)
+			o.ElseBody = pruneBlock(p, fname, o.ElseBody)
+			if v, ok := o.Condition.Register.(hlir.IntLiteral); ok {
+				newops = append(newops, o.Condition.Body...)
+				if v != 0 {
+					p.Remark("%v: removed else branch of if with true condition", fname)
+					newops = append(newops, o.Body...)
+				} else {
+					p.Remark("%v: removed body of if with false condition", fname)
+					newops = append(newops, o.ElseBody...)
+				}
+				if len(newops) > 0 {
+					if _, ok := terminator(newops[len(newops)-1]); ok {
+						return newops
+					}
+				}
+				continue
+			}
+			op = o
+		case hlir.LOOP:
+			o.Body = pruneBlock(p, fname, o.Body)
+			if o.Condition.Register == hlir.IntLiteral(0) {
+				// The initializer and condition still run once.
+				p.Remark("%v: removed loop with false condition", fname)
+				newops = append(newops, o.Initializer...)
+				newops = append(newops, o.Condition.Body...)
+				continue
+			}
+			op = o
+		case hlir.JumpTable:
+			jt := make(hlir.JumpTable, 0, len(o))
+			for _, c := range o {
+				c.Body = pruneBlock(p, fname, c.Body)
+				jt = append(jt, c)
+			}
+			op = jt
+		}
+		newops = append(newops, op)
+		if _, ok := terminator(op); ok {
+			return newops
+		}
+	}
+	return newops
+}
+
+// Removes the opcodes from ops that only write to a temporary or local which
+// is never read. Returns true if anything was removed.
+func removeDeadWrites(p *Program, fname string, ops []hlir.Opcode) ([]hlir.Opcode, bool) {
+	used := make(map[hlir.Register]bool)
+	hlir.ReplaceUses(ops, func(r hlir.Register) hlir.Register {
+		used[r] = true
+		return r
+	})
+	addressed := lowestAddressed(ops)
+
+	removed := false
+	body := filterBlock(ops, func(op hlir.Opcode) bool {
+		switch o := op.(type) {
+		case hlir.DIV:
+			// Dividing by zero fails at runtime, whether or not the
+			// result is used.
+			if !nonZeroLiteral(o.Right) {
+				return true
+			}
+		case hlir.MOD:
+			if !nonZeroLiteral(o.Right) {
+				return true
+			}
+		case hlir.MOV, hlir.ADD, hlir.SUB, hlir.MUL,
+			hlir.EQ, hlir.NEQ, hlir.GT, hlir.GEQ, hlir.LT, hlir.LTE:
+		default:
+			return true
+		}
+		for _, r := range op.ModifiedRegisters() {
+			switch dst := r.(type) {
+			case hlir.TempValue:
+			case hlir.LocalValue:
+				if dst >= addressed {
+					return true
+				}
+			default:
+				return true
+			}
+			if used[r] {
+				return true
+			}
+		}
+		p.Remark("%v: removed unused %v", fname, strings.TrimSpace(op.String()))
+		removed = true
+		return false
+	})
+	return body, removed
+}
+
+// Returns true if r is a literal other than 0, which can be divided by
+// without failing.
+func nonZeroLiteral(r hlir.Register) bool {
+	l, ok := r.(hlir.IntLiteral)
+	return ok && l != 0
+}
+
+// Returns a copy of ops, including the opcodes nested in control flow, with
+// only the opcodes that aren't control flow for which keep returns true.
+func filterBlock(ops []hlir.Opcode, keep func(hlir.Opcode) bool) []hlir.Opcode {
+	if ops == nil {
+		return nil
+	}
+	newops := make([]hlir.Opcode, 0, len(ops))
+	for _, op := range ops {
+		switch o := op.(type) {
+		case hlir.IF:
+			o.ControlFlow = filterControlFlow(o.ControlFlow, keep)
+			o.ElseBody = filterBlock(o.ElseBody, keep)
+			op = o
+		case hlir.LOOP:
+			op = hlir.LOOP(filterControlFlow(hlir.ControlFlow(o), keep))
+		case hlir.JumpTable:
+			jt := make(hlir.JumpTable, 0, len(o))
+			for _, c := range o {
+				jt = append(jt, filterControlFlow(c, keep))
+			}
+			op = jt
+		case hlir.ASSERT:
+			o.Predicate.Body = filterBlock(o.Predicate.Body, keep)
+			op = o
+		default:
+			if !keep(op) {
+				continue
+			}
+		}
+		newops = append(newops, op)
+	}
+	return newops
+}
+
+func filterControlFlow(c hlir.ControlFlow, keep func(hlir.Opcode) bool) hlir.ControlFlow {
+	c.Condition.Body = filterBlock(c.Condition.Body, keep)
+	c.Initializer = filterBlock(c.Initializer, keep)
+	c.Body = filterBlock(c.Body, keep)
+	return c
+}
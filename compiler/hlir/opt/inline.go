@@ -0,0 +1,349 @@
+package opt
+
+import (
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// inline replaces calls to small functions, and to functions without effects
+// that are called with a literal argument, with the body of the function. A
+// function declared with "-> inline" is inlined regardless of its size, and
+// one declared with "-> noinline" never is.
+//
+// Only functions which take and return scalars and only return at the end of
+// their body can be inlined. The callers are then simplified with constfold,
+// since the literal arguments of a call are usually what makes inlining it
+// worthwhile.
+type inline struct{}
+
+const (
+	// The largest function, in opcodes, that's inlined by default.
+	inlineSmall = 8
+
+	// The largest function without effects, in opcodes, that's inlined
+	// when it's called with a literal argument.
+	inlineConstArg = 32
+
+	// The number of times to inline the calls in a function. Calls
+	// in an inlined body can themselves be inlined in the next round.
+	inlineRounds = 4
+)
+
+func (inline) Name() string {
+	return "inline"
+}
+
+func (inline) Run(p *Program) error {
+	for i := range p.Funcs {
+		changed := false
+		for round := 0; round < inlineRounds; round++ {
+			in := newInliner(p, i)
+			body := in.block(p.Funcs[i].Body)
+			if !in.inlined {
+				break
+			}
+			changed = true
+			p.Funcs[i].Body = hlir.ReplaceRegisters(body, func(r hlir.Register) hlir.Register {
+				if cv, ok := r.(hlir.LastFuncCallRetVal); ok {
+					if vals, ok := in.results[cv.CallNum]; ok {
+						return vals[cv.RetNum]
+					}
+				}
+				return r
+			})
+		}
+		if changed {
+			p.Funcs[i].Body = foldConstants(p.Funcs[i].Body, p.RegisterData[p.Funcs[i].Name])
+		}
+	}
+	return nil
+}
+
+// The state of inlining the calls in a single function.
+type inliner struct {
+	p      *Program
+	caller *hlir.Func
+	rd     hlir.RegisterData
+
+	// The next unused temporary and call number in the caller.
+	nextTemp, nextCall uint
+
+	// The locals holding the values returned by each inlined call,
+	// by call number.
+	results map[uint][]hlir.Register
+
+	inlined bool
+}
+
+func newInliner(p *Program, i int) *inliner {
+	in := &inliner{
+		p:       p,
+		caller:  &p.Funcs[i],
+		rd:      p.RegisterData[p.Funcs[i].Name],
+		results: make(map[uint][]hlir.Register),
+	}
+	in.nextTemp, in.nextCall = unusedNumbers(in.caller.Body)
+	return in
+}
+
+// Returns the lowest temporary and call number which are higher than any
+// used in ops.
+func unusedNumbers(ops []hlir.Opcode) (temp, call uint) {
+	hlir.RenumberCalls(ops, func(n uint) uint {
+		if n >= call {
+			call = n + 1
+		}
+		return n
+	})
+	hlir.ReplaceRegisters(ops, func(r hlir.Register) hlir.Register {
+		switch v := r.(type) {
+		case hlir.TempValue:
+			if uint(v) >= temp {
+				temp = uint(v) + 1
+			}
+		case hlir.LastFuncCallRetVal:
+			if v.CallNum >= call {
+				call = v.CallNum + 1
+			}
+		}
+		return r
+	})
+	return temp, call
+}
+
+// Inlines the calls in ops and the blocks nested in it.
+func (in *inliner) block(ops []hlir.Opcode) []hlir.Opcode {
+	if ops == nil {
+		return nil
+	}
+	newops := make([]hlir.Opcode, 0, len(ops))
+	for _, op := range ops {
+		switch o := op.(type) {
+		case hlir.CALL:
+			if body, ok := in.call(o); ok {
+				newops = append(newops, body...)
+				continue
+			}
+		case hlir.IF:
+			o.ControlFlow = in.controlFlow(o.ControlFlow)
+			o.ElseBody = in.block(o.ElseBody)
+			op = o
+		case hlir.LOOP:
+			op = hlir.LOOP(in.controlFlow(hlir.ControlFlow(o)))
+		case hlir.JumpTable:
+			jt := make(hlir.JumpTable, 0, len(o))
+			for _, c := range o {
+				jt = append(jt, in.controlFlow(c))
+			}
+			op = jt
+		case hlir.ASSERT:
+			o.Predicate.Body = in.block(o.Predicate.Body)
+			op = o
+		}
+		newops = append(newops, op)
+	}
+	return newops
+}
+
+func (in *inliner) controlFlow(c hlir.ControlFlow) hlir.ControlFlow {
+	c.Condition.Body = in.block(c.Condition.Body)
+	c.Initializer = in.block(c.Initializer)
+	c.Body = in.block(c.Body)
+	return c
+}
+
+// Returns the function called by call and its declaration, if it's a
+// function in the program which can be inlined.
+func (in *inliner) callee(call hlir.CALL) (hlir.Func, ast.FuncDecl, bool) {
+	if call.TailCall || string(call.FName) == in.caller.Name {
+		return hlir.Func{}, ast.FuncDecl{}, false
+	}
+	decls := in.p.Callables[string(call.FName)]
+	if len(decls) != 1 {
+		return hlir.Func{}, ast.FuncDecl{}, false
+	}
+	fd, ok := decls[0].(ast.FuncDecl)
+	if !ok || fd.Inline == ast.InlineNever {
+		return hlir.Func{}, ast.FuncDecl{}, false
+	}
+	for _, f := range in.p.Funcs {
+		if f.Name == fd.Name {
+			return f, fd, inlinable(f, fd)
+		}
+	}
+	// Builtins
+	return hlir.Func{}, ast.FuncDecl{}, false
+}
+
+// Returns true if the body of f can replace a call to it.
+func inlinable(f hlir.Func, fd ast.FuncDecl) bool {
+	for _, arg := range fd.Args {
+		if arg.Reference || !isScalar(arg.Type()) {
+			return false
+		}
+	}
+	for _, ret := range fd.Return {
+		if !isScalar(ret.Type()) {
+			return false
+		}
+	}
+	if f.NumArgs != uint(len(fd.Args)) {
+		return false
+	}
+
+	// A RET anywhere but the end would need to jump past the rest of
+	// the inlined body.
+	body := f.Body
+	if len(body) > 0 && body[len(body)-1] == (hlir.RET{}) {
+		body = body[:len(body)-1]
+	}
+	ok := true
+	walk(body, true, func(op hlir.Opcode, top bool) {
+		switch o := op.(type) {
+		case hlir.RET:
+			ok = false
+		case hlir.CALL:
+			if o.TailCall || string(o.FName) == f.Name {
+				ok = false
+			}
+		}
+		for _, r := range op.ModifiedRegisters() {
+			if _, isArg := r.(hlir.FuncArg); isArg {
+				ok = false
+			}
+		}
+	})
+	return ok
+}
+
+// Returns true if values of type t fit in a single register.
+func isScalar(t ast.Type) bool {
+	switch t.TypeName() {
+	case "int", "uint", "int8", "uint8", "byte", "int16", "uint16",
+		"int32", "uint32", "int64", "uint64", "bool":
+		return true
+	}
+	return false
+}
+
+// Returns true if a call to f with args should be inlined.
+func shouldInline(f hlir.Func, fd ast.FuncDecl, args []hlir.Register) bool {
+	if fd.Inline == ast.InlineAlways {
+		return true
+	}
+	size := 0
+	walk(f.Body, true, func(op hlir.Opcode, top bool) {
+		size++
+	})
+	if size <= inlineSmall {
+		return true
+	}
+	if len(fd.Effects) > 0 || size > inlineConstArg {
+		return false
+	}
+	for _, arg := range args {
+		if _, ok := arg.(hlir.IntLiteral); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Attempts to inline call. If it can be inlined, the opcodes to replace it
+// with are returned.
+func (in *inliner) call(call hlir.CALL) ([]hlir.Opcode, bool) {
+	f, fd, ok := in.callee(call)
+	if !ok || !shouldInline(f, fd, call.Args) {
+		return nil, false
+	}
+
+	calleeRD := in.p.RegisterData[f.Name]
+
+	var ops []hlir.Opcode
+	args := make(map[hlir.FuncArg]hlir.Register)
+	for i, arg := range call.Args {
+		fa := hlir.FuncArg{Id: uint(i)}
+		if in.passDirectly(arg, calleeRD[fa]) {
+			args[fa] = arg
+			continue
+		}
+		lv := in.newLocal(calleeRD[fa])
+		ops = append(ops, hlir.MOV{Src: arg, Dst: lv})
+		args[fa] = lv
+	}
+	var results []hlir.Register
+	for i := range fd.Return {
+		results = append(results, in.newLocal(calleeRD[hlir.FuncRetVal(i)]))
+	}
+
+	localBase := hlir.LocalValue(in.caller.NumLocals)
+	in.caller.NumLocals += f.NumLocals
+	tempBase, callBase := in.nextTemp, in.nextCall
+	temps, calls := unusedNumbers(f.Body)
+	in.nextTemp += temps
+	in.nextCall += calls
+
+	rename := func(r hlir.Register) hlir.Register {
+		switch v := r.(type) {
+		case hlir.LocalValue:
+			return localBase + v
+		case hlir.TempValue:
+			return hlir.TempValue(tempBase) + v
+		case hlir.LastFuncCallRetVal:
+			return hlir.LastFuncCallRetVal{CallNum: callBase + v.CallNum, RetNum: v.RetNum}
+		case hlir.FuncArg:
+			return args[hlir.FuncArg{Id: v.Id}]
+		case hlir.FuncRetVal:
+			return results[v]
+		}
+		return r
+	}
+	for r, info := range calleeRD {
+		switch r.(type) {
+		case hlir.LocalValue, hlir.TempValue, hlir.LastFuncCallRetVal:
+			in.rd[rename(r)] = info
+		}
+	}
+	body := f.Body
+	if len(body) > 0 && body[len(body)-1] == (hlir.RET{}) {
+		body = body[:len(body)-1]
+	}
+	body = hlir.RenumberCalls(body, func(n uint) uint {
+		return callBase + n
+	})
+	ops = append(ops, hlir.ReplaceRegisters(body, rename)...)
+
+	if len(results) > 0 {
+		in.results[call.CallNum] = results
+	}
+	in.inlined = true
+	in.p.Remark("%v: inlined %v", in.caller.Name, f.Name)
+	return ops, true
+}
+
+// Returns true if arg can be used in place of an argument described by info
+// in the inlined body, rather than being copied into a new local. Arguments
+// are never modified by an inlinable function, so a literal, or a local or
+// argument of the same size in the caller, can be.
+func (in *inliner) passDirectly(arg hlir.Register, info hlir.RegisterInfo) bool {
+	switch a := arg.(type) {
+	case hlir.IntLiteral:
+		return true
+	case hlir.FuncArg:
+		if a.Reference {
+			return false
+		}
+	case hlir.LocalValue:
+	default:
+		return false
+	}
+	return in.rd[arg].TypeInfo == info.TypeInfo
+}
+
+// Reserves a new local in the caller, described by info.
+func (in *inliner) newLocal(info hlir.RegisterInfo) hlir.LocalValue {
+	lv := hlir.LocalValue(in.caller.NumLocals)
+	in.caller.NumLocals++
+	in.rd[lv] = info
+	return lv
+}
@@ -0,0 +1,254 @@
+// Package opt implements optimization passes over the HLIR of a program,
+// and a Manager to decide which passes to run.
+package opt
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// A Program is the HLIR of every function in a program.
+type Program struct {
+	// The functions in the order that they were declared.
+	Funcs        []hlir.Func
+	RegisterData map[string]hlir.RegisterData
+	Callables    ast.Callables
+
+	// If non-nil, the pass being run writes a line describing each
+	// change that it makes to Remarks.
+	Remarks io.Writer
+
+	// If non-nil, passes write warnings about problems that they find
+	// in the program, such as unreachable code, to Warnings.
+	Warnings io.Writer
+}
+
+// Generate generates the HLIR for the functions in nodes.
+func Generate(nodes []ast.Node, ti ast.TypeInformation, callables ast.Callables, enums hlir.EnumMap, consts hlir.Constants) (*Program, error) {
+	p := &Program{
+		RegisterData: make(map[string]hlir.RegisterData),
+		Callables:    callables,
+	}
+	for _, v := range nodes {
+		if _, ok := v.(ast.FuncDecl); !ok {
+			continue
+		}
+		fnc, _, rd, err := hlir.GenerateWithConstants(v, ti, callables, enums, consts)
+		if err != nil {
+			return nil, err
+		}
+		p.Funcs = append(p.Funcs, fnc)
+		p.RegisterData[fnc.Name] = rd
+	}
+	return p, nil
+}
+
+// Remark writes a remark about a change made by a pass, if remarks are
+// enabled.
+func (p *Program) Remark(format string, args ...interface{}) {
+	if p.Remarks != nil {
+		fmt.Fprintf(p.Remarks, format+"\n", args...)
+	}
+}
+
+// Warn writes a warning about the program, if warnings are enabled.
+func (p *Program) Warn(format string, args ...interface{}) {
+	if p.Warnings != nil {
+		fmt.Fprintf(p.Warnings, "Warning: "+format+"\n", args...)
+	}
+}
+
+// Writes the IR of every function in p to w.
+func (p *Program) dump(w io.Writer) {
+	for _, f := range p.Funcs {
+		fmt.Fprintf(w, "func %v:\n%s", f.Name, hlir.PrettyPrint(1, f.Body))
+	}
+}
+
+// A Pass is an optimization over the HLIR of a program.
+type Pass interface {
+	// The name used to enable or disable the pass.
+	Name() string
+
+	// Run the pass, modifying p in place.
+	Run(p *Program) error
+}
+
+// A Level is an optimization level. Each pass is enabled by default at the
+// level that it was registered with and any higher level.
+type Level int
+
+const (
+	// No optimizations.
+	O0 Level = iota
+	// Optimizations that are cheap and don't make the program larger.
+	O1
+	// All optimizations.
+	O2
+)
+
+// DefaultLevel is the optimization level used when none is specified.
+const DefaultLevel = O1
+
+// Default is the Manager used by the compiler and VM to optimize programs.
+var Default = NewManager(DefaultLevel)
+
+type registration struct {
+	pass  Pass
+	level Level
+}
+
+// The known passes, in the order that they run.
+var passes []registration
+
+func init() {
+	Register(constfold{}, O1)
+	Register(inline{}, O2)
+	Register(dce{}, O1)
+}
+
+// Register adds p to the passes known to the package. Passes run in the
+// order that they were registered.
+func Register(p Pass, l Level) {
+	if lookup(p.Name()) != nil {
+		panic(fmt.Sprintf("Pass %v registered twice", p.Name()))
+	}
+	passes = append(passes, registration{p, l})
+}
+
+// RegisterAfter is like Register, but the pass runs immediately after the
+// pass named after instead of after every other pass.
+func RegisterAfter(p Pass, l Level, after string) {
+	if lookup(p.Name()) != nil {
+		panic(fmt.Sprintf("Pass %v registered twice", p.Name()))
+	}
+	for i := range passes {
+		if passes[i].pass.Name() == after {
+			passes = append(passes[:i+1], append([]registration{{p, l}}, passes[i+1:]...)...)
+			return
+		}
+	}
+	panic(fmt.Sprintf("Pass %v registered after unknown pass %v", p.Name(), after))
+}
+
+func lookup(name string) *registration {
+	for i := range passes {
+		if passes[i].pass.Name() == name {
+			return &passes[i]
+		}
+	}
+	return nil
+}
+
+// Passes returns the names of all known passes, in the order that they run.
+func Passes() []string {
+	var names []string
+	for _, r := range passes {
+		names = append(names, r.pass.Name())
+	}
+	return names
+}
+
+// A Manager runs the passes enabled at an optimization level, with any
+// passes explicitly enabled or disabled.
+type Manager struct {
+	Level Level
+
+	// If non-nil, the IR of the program is written to Dump before and
+	// after each pass that runs.
+	Dump io.Writer
+
+	// If non-nil, warnings found by the passes are written to Warnings.
+	Warnings io.Writer
+
+	overrides map[string]bool
+	remarks   map[string]io.Writer
+}
+
+// NewManager returns a Manager which runs the passes for level l.
+func NewManager(l Level) *Manager {
+	return &Manager{
+		Level:     l,
+		overrides: make(map[string]bool),
+		remarks:   make(map[string]io.Writer),
+	}
+}
+
+// Enable enables the named pass, regardless of the optimization level.
+func (m *Manager) Enable(name string) error {
+	return m.override(name, true)
+}
+
+// Disable disables the named pass, regardless of the optimization level.
+func (m *Manager) Disable(name string) error {
+	return m.override(name, false)
+}
+
+func (m *Manager) override(name string, enabled bool) error {
+	if lookup(name) == nil {
+		return fmt.Errorf("Unknown optimization pass %v (known passes: %v)", name, strings.Join(Passes(), ", "))
+	}
+	m.overrides[name] = enabled
+	return nil
+}
+
+// SetRemarks sets where the named pass writes remarks about the changes it
+// makes.
+func (m *Manager) SetRemarks(name string, w io.Writer) error {
+	if lookup(name) == nil {
+		return fmt.Errorf("Unknown optimization pass %v (known passes: %v)", name, strings.Join(Passes(), ", "))
+	}
+	m.remarks[name] = w
+	return nil
+}
+
+// Enabled returns true if the named pass will be run.
+func (m *Manager) Enabled(name string) bool {
+	if enabled, ok := m.overrides[name]; ok {
+		return enabled
+	}
+	r := lookup(name)
+	return r != nil && m.Level >= r.level && m.Level > O0
+}
+
+// EnabledPasses returns the names of the passes that will be run, in order.
+func (m *Manager) EnabledPasses() []string {
+	var names []string
+	for _, name := range Passes() {
+		if m.Enabled(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Run runs the enabled passes on p.
+func (m *Manager) Run(p *Program) error {
+	p.Warnings = m.Warnings
+	defer func() { p.Warnings = nil }()
+	for _, r := range passes {
+		name := r.pass.Name()
+		if !m.Enabled(name) {
+			continue
+		}
+		if m.Dump != nil {
+			fmt.Fprintf(m.Dump, "=== before %v ===\n", name)
+			p.dump(m.Dump)
+		}
+		p.Remarks = m.remarks[name]
+		err := r.pass.Run(p)
+		p.Remarks = nil
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		if m.Dump != nil {
+			fmt.Fprintf(m.Dump, "=== after %v ===\n", name)
+			p.dump(m.Dump)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package opt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+func generate(t *testing.T, src string) *Program {
+	t.Helper()
+	nodes, ti, c, err := ast.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Generate(nodes, ti, c, make(hlir.EnumMap), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestManagerLevels(t *testing.T) {
+	if m := NewManager(O0); m.Enabled("constfold") {
+		t.Error("constfold should not be enabled at O0")
+	}
+	if m := NewManager(O1); !m.Enabled("constfold") {
+		t.Error("constfold should be enabled at O1")
+	}
+	if m := NewManager(O2); !m.Enabled("constfold") {
+		t.Error("constfold should be enabled at O2")
+	}
+
+	m := NewManager(O2)
+	if err := m.Disable("constfold"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Enabled("constfold") {
+		t.Error("constfold should not be enabled after being disabled")
+	}
+
+	m = NewManager(O0)
+	if err := m.Enable("constfold"); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.EnabledPasses(); len(got) != 1 || got[0] != "constfold" {
+		t.Errorf("Unexpected enabled passes: got %v want [constfold]", got)
+	}
+
+	if err := m.Enable("nosuchpass"); err == nil {
+		t.Error("Expected an error enabling an unknown pass")
+	}
+}
+
+const square = `
+func square(x int) (int) {
+	return x * x
+}
+
+func main() () -> affects(IO) {
+	PrintInt(square(3))
+}`
+
+func TestNoOptimizations(t *testing.T) {
+	p := generate(t, square)
+	var dump bytes.Buffer
+	m := NewManager(O0)
+	m.Dump = &dump
+	if err := m.Run(p); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Len() != 0 {
+		t.Errorf("Unexpected dump with no passes: %v", dump.String())
+	}
+	if len(p.Funcs[1].Body) != 2 {
+		t.Errorf("Unexpected body: %v", p.Funcs[1].Body)
+	}
+}
+
+// Runs only the constfold pass on src, and returns the IR of the function
+// named fn.
+func runConstfold(t *testing.T, src, fn string) string {
+	t.Helper()
+	p := generate(t, src)
+	m := NewManager(O0)
+	if err := m.Enable("constfold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(p); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range p.Funcs {
+		if f.Name == fn {
+			return hlir.PrettyPrint(0, f.Body)
+		}
+	}
+	t.Fatalf("No function %v", fn)
+	return ""
+}
+
+func TestConstFold(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Src      string
+		Func     string
+		Expected string
+	}{
+		{
+			"Arithmetic",
+			`func main() () -> affects(IO) {
+	let x = 1 + 2 * 3 - 4 / 2
+	PrintInt(x)
+	PrintInt(7 % 3)
+}`,
+			"main",
+			"MOV $5, LV0\nCALL PrintInt ([$5])\nCALL PrintInt ([$1])\n",
+		},
+		{
+			"Identities",
+			`func f(x int) (int) {
+	return x * 1 + 0
+}
+
+func main() () -> affects(IO) {
+	PrintInt(f(3))
+}`,
+			"f",
+			"MOV P0 (false), TV0\nMOV TV0, TV1\nMOV TV1, FR0\nRET\n",
+		},
+		{
+			"DivideByZero",
+			`func main() () -> affects(IO) {
+	PrintInt(1 / 0)
+}`,
+			"main",
+			"DIV $1 / $0 => TV0\nCALL PrintInt ([TV0])\n",
+		},
+		{
+			"Comparison",
+			`func main() () -> affects(IO) {
+	let x = 3
+	if x > 2 {
+		PrintInt(x)
+	}
+}`,
+			"main",
+			"MOV $3, LV0\nIF $1\n\tCALL PrintInt ([$3])\nEND\n",
+		},
+		{
+			"Mutable",
+			`func main() () -> affects(IO) {
+	mutable x = 3
+	while x > 0 {
+		x = x - 1
+	}
+	PrintInt(x)
+}`,
+			"main",
+			"MOV $3, LV0\nLOOP TV0:\n\t\tGT LV0, $0, TV0\n\tSUB LV0 - $1 => TV1\n\tMOV TV1, LV0\nEND\nCALL PrintInt ([LV0])\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := runConstfold(t, tc.Src, tc.Func); got != tc.Expected {
+				t.Errorf("Unexpected IR: got\n%v\nwant\n%v", got, tc.Expected)
+			}
+		})
+	}
+}
+
+func TestDCE(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Src      string
+		Func     string
+		Expected string
+		Warnings string
+	}{
+		{
+			"IfFalse",
+			`func main() () -> affects(IO) {
+	if false {
+		PrintInt(1)
+	} else {
+		PrintInt(2)
+	}
+}`,
+			"main",
+			"CALL PrintInt ([$2])\n",
+			"",
+		},
+		{
+			"IfTrue",
+			`func main() () -> affects(IO) {
+	if true {
+		PrintInt(1)
+	} else {
+		PrintInt(2)
+	}
+}`,
+			"main",
+			"CALL PrintInt ([$1])\n",
+			"",
+		},
+		{
+			"WhileFalse",
+			`func main() () -> affects(IO) {
+	while false {
+		PrintInt(1)
+	}
+	PrintInt(2)
+}`,
+			"main",
+			"CALL PrintInt ([$2])\n",
+			"",
+		},
+		{
+			"UnusedWrites",
+			`func main() () -> affects(IO) {
+	let x = 3
+	let y = x + 4
+	let z = y > 2
+	PrintInt(5)
+}`,
+			"main",
+			"CALL PrintInt ([$5])\n",
+			"",
+		},
+		{
+			"UnusedDivideByZero",
+			`func main() () -> affects(IO) {
+	let z int = 5 / 0
+	PrintInt(1)
+}`,
+			"main",
+			"DIV $5 / $0 => TV0\nCALL PrintInt ([$1])\n",
+			"",
+		},
+		{
+			"UnusedDivideByVariable",
+			`func f(x int) () -> affects(IO) {
+	let z int = 5 % x
+	let y int = x / 2
+	PrintInt(1)
+}
+
+func main() () -> affects(IO) {
+	f(0)
+}`,
+			"f",
+			"MOD $5, P0 (false), TV0\nCALL PrintInt ([$1])\n",
+			"",
+		},
+		{
+			"UsedWrites",
+			`func main() () -> affects(IO) {
+	mutable x = 3
+	while x > 0 {
+		x = x - 1
+	}
+}`,
+			"main",
+			"MOV $3, LV0\nLOOP TV0:\n\t\tGT LV0, $0, TV0\n\tSUB LV0 - $1 => TV1\n\tMOV TV1, LV0\nEND\n",
+			"",
+		},
+		{
+			"AfterReturn",
+			`func f(x int) (int) {
+	return x
+	PrintInt(x)
+}
+
+func main() () -> affects(IO) {
+	PrintInt(f(3))
+}`,
+			"f",
+			"MOV P0 (false), FR0\nRET\n",
+			"Warning: f: unreachable code after return\n",
+		},
+		{
+			"AfterBreak",
+			`func main() () -> affects(IO) {
+	while true {
+		break
+		PrintInt(1)
+	}
+}`,
+			"main",
+			"LOOP $1\n\tBREAK 0\nEND\n",
+			"Warning: main: unreachable code after break\n",
+		},
+		{
+			"ConstantReturn",
+			`func main() () -> affects(IO) {
+	let debug = false
+	if debug {
+		return
+	}
+	PrintInt(1)
+}`,
+			"main",
+			"CALL PrintInt ([$1])\n",
+			"",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			p := generate(t, tc.Src)
+			var warnings bytes.Buffer
+			m := NewManager(O1)
+			m.Warnings = &warnings
+			if err := m.Run(p); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range p.Funcs {
+				if f.Name != tc.Func {
+					continue
+				}
+				if got := hlir.PrettyPrint(0, f.Body); got != tc.Expected {
+					t.Errorf("Unexpected IR: got\n%v\nwant\n%v", got, tc.Expected)
+				}
+			}
+			if got := warnings.String(); got != tc.Warnings {
+				t.Errorf("Unexpected warnings: got %q want %q", got, tc.Warnings)
+			}
+		})
+	}
+}
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Src      string
+		Expected string
+		Remarks  string
+	}{
+		{
+			"Small",
+			`func add(x int, y int) (int) {
+	return x + y
+}
+
+func main() () -> affects(IO) {
+	mutable a = 3
+	a = a + 1
+	PrintInt(add(a, 2))
+}`,
+			"MOV $3, LV0\nADD LV0 + $1 => TV0\nMOV TV0, LV0\nADD LV0 + $2 => TV1\nMOV TV1, LV1\nCALL PrintInt ([LV1])\n",
+			"main: inlined add\n",
+		},
+		{
+			"NoInline",
+			`func add(x int, y int) (int) -> noinline {
+	return x + y
+}
+
+func main() () -> affects(IO) {
+	mutable a = 3
+	a = a + 1
+	PrintInt(add(a, 2))
+}`,
+			"MOV $3, LV0\nADD LV0 + $1 => TV0\nMOV TV0, LV0\nCALL add ([LV0 $2])\nCALL PrintInt ([CV(0,0)])\n",
+			"",
+		},
+		{
+			"Large",
+			`func poly(x int) (int) {
+	let a = x * x
+	let b = a * x
+	let c = b * x
+	let d = c * x
+	return a + b + c + d
+}
+
+func main() () -> affects(IO) {
+	mutable a = 3
+	a = a + 1
+	PrintInt(poly(a))
+}`,
+			"MOV $3, LV0\nADD LV0 + $1 => TV0\nMOV TV0, LV0\nCALL poly ([LV0])\nCALL PrintInt ([CV(0,0)])\n",
+			"",
+		},
+		{
+			"LargeLiteralArg",
+			`func poly(x int) (int) {
+	let a = x * x
+	let b = a * x
+	let c = b * x
+	let d = c * x
+	return a + b + c + d
+}
+
+func main() () -> affects(IO) {
+	PrintInt(poly(2))
+}`,
+			"MOV $4, LV1\nMOV $8, LV2\nMOV $16, LV3\nMOV $32, LV4\nMOV $60, LV0\nCALL PrintInt ([$60])\n",
+			"main: inlined poly\n",
+		},
+		{
+			"ForceInline",
+			`func poly(x int) (int) -> inline {
+	let a = x * x
+	let b = a * x
+	let c = b * x
+	let d = c * x
+	return a + b + c + d
+}
+
+func main() () -> affects(IO) {
+	mutable a = 3
+	a = a + 1
+	PrintInt(poly(a))
+}`,
+			"MOV $3, LV0\nADD LV0 + $1 => TV0\nMOV TV0, LV0\n" +
+				"MUL LV0 * LV0 => TV1\nMOV TV1, LV2\n" +
+				"MUL LV2 * LV0 => TV2\nMOV TV2, LV3\n" +
+				"MUL LV3 * LV0 => TV3\nMOV TV3, LV4\n" +
+				"MUL LV4 * LV0 => TV4\nMOV TV4, LV5\n" +
+				"ADD LV4 + LV5 => TV5\nADD LV3 + TV5 => TV6\nADD LV2 + TV6 => TV7\nMOV TV7, LV1\n" +
+				"CALL PrintInt ([LV1])\n",
+			"main: inlined poly\n",
+		},
+		{
+			"EarlyReturn",
+			`func abs(x int) (int) {
+	if x < 0 {
+		return 0 - x
+	}
+	return x
+}
+
+func main() () -> affects(IO) {
+	PrintInt(abs(0 - 3))
+}`,
+			"SUB $0 - $3 => TV0\nCALL abs ([TV0])\nCALL PrintInt ([CV(0,0)])\n",
+			"",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			p := generate(t, tc.Src)
+			var remarks bytes.Buffer
+			m := NewManager(O0)
+			if err := m.Enable("inline"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetRemarks("inline", &remarks); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Run(p); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range p.Funcs {
+				if f.Name != "main" {
+					continue
+				}
+				if got := hlir.PrettyPrint(0, f.Body); got != tc.Expected {
+					t.Errorf("Unexpected IR: got\n%v\nwant\n%v", got, tc.Expected)
+				}
+			}
+			if got := remarks.String(); got != tc.Remarks {
+				t.Errorf("Unexpected remarks: got %q want %q", got, tc.Remarks)
+			}
+		})
+	}
+}
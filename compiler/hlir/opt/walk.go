@@ -0,0 +1,58 @@
+package opt
+
+import (
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// Calls f on every opcode in ops that isn't control flow, including the
+// opcodes nested in control flow. top is true for the opcodes that aren't
+// nested.
+func walk(ops []hlir.Opcode, top bool, f func(op hlir.Opcode, top bool)) {
+	for _, op := range ops {
+		switch o := op.(type) {
+		case hlir.IF:
+			walkControlFlow(o.ControlFlow, f)
+			walk(o.ElseBody, false, f)
+		case hlir.LOOP:
+			walkControlFlow(hlir.ControlFlow(o), f)
+		case hlir.JumpTable:
+			for _, c := range o {
+				walkControlFlow(c, f)
+			}
+		case hlir.ASSERT:
+			walk(o.Predicate.Body, false, f)
+		default:
+			f(op, top)
+		}
+	}
+}
+
+func walkControlFlow(c hlir.ControlFlow, f func(op hlir.Opcode, top bool)) {
+	walk(c.Condition.Body, false, f)
+	walk(c.Initializer, false, f)
+	walk(c.Body, false, f)
+}
+
+// Returns the lowest local in ops which is used as the base of an Offset,
+// Pointer or SliceBasePointer. The elements of arrays and slices are
+// accessed relative to a base register, so any local from the lowest base
+// up may be read or modified without being named by an opcode.
+func lowestAddressed(ops []hlir.Opcode) hlir.LocalValue {
+	addressed := hlir.LocalValue(^uint(0) >> 1)
+	hlir.ReplaceRegisters(ops, func(r hlir.Register) hlir.Register {
+		var base hlir.Register
+		switch o := r.(type) {
+		case hlir.Offset:
+			base = o.Base
+		case hlir.Pointer:
+			base = o.Register
+		case hlir.SliceBasePointer:
+			base = o.Register
+		}
+		if lv, ok := base.(hlir.LocalValue); ok && lv < addressed {
+			addressed = lv
+		}
+		return r
+	})
+	return addressed
+}
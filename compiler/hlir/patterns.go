@@ -0,0 +1,221 @@
+package hlir
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/driusan/lang/parser/ast"
+)
+
+// A patternCheck is a comparison that must be equal for a pattern in a match
+// case to match.
+type patternCheck struct {
+	Left, Right Register
+}
+
+// Returns the number of registers used to store a value of type t.
+//
+// Enumerated types are stored as the variant, followed by the registers for
+// each parameter, so a "Maybe Maybe int" uses 3 registers. Strings are
+// stored as a length and a pointer.
+func registerCount(t ast.Type) int {
+	if t == nil {
+		return 1
+	}
+	if tt, ok := ast.UnderlyingTuple(t); ok {
+		n := 0
+		for _, field := range tt {
+			n += registerCount(field.Typ)
+		}
+		return n
+	}
+	switch t.(type) {
+	case ast.SumType, ast.SliceType, ast.ArrayType:
+		return 1
+	}
+	if t.TypeName() == "string" {
+		return 2
+	}
+	if words := len(strings.Fields(t.TypeName())); words > 1 {
+		return words
+	}
+	return 1
+}
+
+// Returns every register used by the value of type t whose first register
+// is r. Only variables have their remaining registers directly after the
+// first one.
+func valueRegisters(r Register, t ast.Type) []Register {
+	regs := []Register{r}
+	for i := 1; i < registerCount(t); i++ {
+		switch reg := r.(type) {
+		case LocalValue:
+			regs = append(regs, reg+LocalValue(i))
+		case FuncArg:
+			reg.Id += uint(i)
+			regs = append(regs, reg)
+		default:
+			return regs
+		}
+	}
+	return regs
+}
+
+// Returns true if any case of the match statement destructures the
+// condition with a pattern.
+func hasPatterns(s ast.MatchStmt) bool {
+	for _, c := range s.Cases {
+		if c.Pattern != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the registers for every part of the value being matched by the
+// condition of a match statement, given the registers that it was evaluated
+// to (if it's not a tuple.)
+//
+// Patterns compare parts of the value more than once and bind variables to
+// them, so if the value isn't already stored in variables it's copied into
+// new ones.
+func matchRegisters(cond ast.Value, regs []Register, context *variableLayout) ([]Opcode, []Register, error) {
+	var ops []Opcode
+	if tt, ok := ast.UnderlyingTuple(cond.Type()); ok {
+		fops, fields, err := evaluateTupleFields(cond, tt, context)
+		if err != nil {
+			return nil, nil, err
+		}
+		ops = fops
+		regs = nil
+		for i, field := range fields {
+			if len(field) == 1 {
+				field = valueRegisters(field[0], tt[i].Typ)
+			}
+			regs = append(regs, field...)
+		}
+	} else if len(regs) == 1 {
+		regs = valueRegisters(regs[0], cond.Type())
+	}
+
+	copyValue := false
+	for _, r := range regs {
+		switch r.(type) {
+		case LocalValue, FuncArg:
+		default:
+			copyValue = true
+		}
+	}
+	if !copyValue {
+		return ops, regs, nil
+	}
+	var srcs, dsts []Register
+	for i, r := range regs {
+		srcs = append(srcs, r)
+		dsts = append(dsts, context.NextLocalRegister(ast.VarWithType{
+			Name: ast.Variable(fmt.Sprintf("match.value[%d]", i)),
+			Typ:  ast.TypeLiteral("int"),
+		}))
+	}
+	return append(ops, moveFields(srcs, dsts)...), dsts, nil
+}
+
+// Returns the checks that must all be equal for the value in regs to match
+// the pattern p, and binds any variables in the pattern to the registers
+// that they refer to.
+func compilePattern(p ast.Pattern, regs []Register, context *variableLayout) ([]patternCheck, error) {
+	if len(regs) < registerCount(p.Type()) {
+		return nil, fmt.Errorf("Can not match pattern %v against value", p)
+	}
+	switch pt := p.(type) {
+	case ast.WildcardPattern:
+		return nil, nil
+	case ast.VarWithType:
+		context.SetLocalRegister(pt, regs[0])
+		if tt, ok := ast.UnderlyingTuple(pt.Typ); ok {
+			// Tuple variables are accessed by their fields.
+			offset := 0
+			for i, field := range tt {
+				context.SetLocalRegister(ast.VarWithType{
+					Name: fieldVariable(pt.Name, tt, i),
+					Typ:  field.Typ,
+				}, regs[offset])
+				offset += registerCount(field.Typ)
+			}
+		}
+		return nil, nil
+	case ast.IntLiteral, ast.BoolLiteral:
+		return []patternCheck{{regs[0], getRegister(pt, context)}}, nil
+	case ast.ConstructorPattern:
+		checks := []patternCheck{{regs[0], IntLiteral(context.GetEnumIndex(pt.Constructor.Constructor))}}
+		offset := 1
+		for _, sub := range pt.Parameters {
+			n := registerCount(sub.Type())
+			subchecks, err := compilePattern(sub, regs[offset:], context)
+			if err != nil {
+				return nil, err
+			}
+			checks = append(checks, subchecks...)
+			offset += n
+		}
+		return checks, nil
+	case ast.TuplePattern:
+		var checks []patternCheck
+		offset := 0
+		for i, sub := range pt.Fields {
+			n := registerCount(pt.Typ[i].Typ)
+			subchecks, err := compilePattern(sub, regs[offset:], context)
+			if err != nil {
+				return nil, err
+			}
+			checks = append(checks, subchecks...)
+			offset += n
+		}
+		return checks, nil
+	}
+	return nil, fmt.Errorf("Unhandled pattern %v", p)
+}
+
+// Builds the condition for a match case which is true if every check is
+// equal and the guard (if any) is true.
+func caseCondition(checks []patternCheck, guard ast.Value, context *variableLayout) (Condition, error) {
+	if len(checks) == 1 && guard == nil {
+		r := context.NextTempRegister()
+		return Condition{
+			Body:     []Opcode{EQ{Left: checks[0].Left, Right: checks[0].Right, Dst: r}},
+			Register: r,
+		}, nil
+	}
+	var conds []Condition
+	for _, c := range checks {
+		r := context.NextTempRegister()
+		conds = append(conds, Condition{
+			Body:     []Opcode{EQ{Left: c.Left, Right: c.Right, Dst: r}},
+			Register: r,
+		})
+	}
+	return allConditions(conds, guard, context)
+}
+
+// Combines conds and the guard (if any) into a single condition that is
+// true if all of them are. Each condition is only evaluated if the ones
+// before it were true, and the guard is evaluated last, so a guard can
+// safely use the variables bound by a pattern that matched.
+func allConditions(conds []Condition, guard ast.Value, context *variableLayout) (Condition, error) {
+	if guard != nil {
+		body, g, err := evaluateValue(guard, context)
+		if err != nil {
+			return Condition{}, err
+		}
+		conds = append(conds, Condition{Body: body, Register: g[0]})
+	}
+	matched := context.NextLocalRegister(ast.VarWithType{Name: "match.case", Typ: ast.TypeLiteral("bool")})
+	body := []Opcode{MOV{Src: IntLiteral(1), Dst: matched}}
+	for i := len(conds) - 1; i >= 0; i-- {
+		body = []Opcode{IF{ControlFlow: ControlFlow{Condition: conds[i], Body: body}}}
+	}
+	r := context.NextTempRegister()
+	body = append([]Opcode{MOV{Src: IntLiteral(0), Dst: matched}}, body...)
+	body = append(body, NEQ{Left: matched, Right: IntLiteral(0), Dst: r})
+	return Condition{Body: body, Register: r}, nil
+}
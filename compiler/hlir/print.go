@@ -2,21 +2,57 @@ package hlir
 
 import (
 	"fmt"
+	"strings"
 )
 
 func PrettyPrint(level uint, ops []Opcode) string {
 	ret := ""
+	indent := strings.Repeat("\t", int(level))
 	for _, op := range ops {
-		for i := uint(0); i < level; i++ {
-			ret += fmt.Sprintf("\t")
-		}
-		switch op.(type) {
-		case RET, CALL, MOV, ADD, SUB, DIV, MUL, MOD:
-			ret += fmt.Sprintf("%v", op)
+		switch o := op.(type) {
+		case RET, CALL, MOV, ADD, SUB, DIV, MUL, MOD, EQ, NEQ, GEQ, GT, LT, LTE, BREAK, CONTINUE, LINE:
+			ret += indent + strings.TrimSpace(fmt.Sprintf("%v", op)) + "\n"
+		case IF:
+			ret += indent + "IF " + prettyCondition(level, o.Condition) + "\n"
+			ret += PrettyPrint(level+1, o.Body)
+			if len(o.ElseBody) > 0 {
+				ret += indent + "ELSE\n"
+				ret += PrettyPrint(level+1, o.ElseBody)
+			}
+			ret += indent + "END\n"
+		case LOOP:
+			if len(o.Initializer) > 0 {
+				ret += indent + "INIT\n"
+				ret += PrettyPrint(level+1, o.Initializer)
+			}
+			ret += indent + "LOOP " + prettyCondition(level, o.Condition) + "\n"
+			ret += PrettyPrint(level+1, o.Body)
+			ret += indent + "END\n"
+		case JumpTable:
+			ret += indent + "JumpTable\n"
+			for _, cf := range o {
+				ret += indent + "CASE " + prettyCondition(level, cf.Condition) + "\n"
+				ret += PrettyPrint(level+1, cf.Body)
+			}
+			ret += indent + "END\n"
+		case ASSERT:
+			ret += indent + "ASSERT " + prettyCondition(level, o.Predicate)
+			if o.Message != "" {
+				ret += fmt.Sprintf(", %v", o.Message)
+			}
+			ret += "\n"
 		default:
 			panic("Unhandled op in PrettyPrint")
 		}
-		ret += "\n"
 	}
 	return ret
 }
+
+// Prints the condition c of a control flow opcode. The body of the
+// condition, if any, is printed on the lines after it.
+func prettyCondition(level uint, c Condition) string {
+	if len(c.Body) == 0 {
+		return fmt.Sprintf("%v", c.Register)
+	}
+	return fmt.Sprintf("%v:\n%s", c.Register, strings.TrimRight(PrettyPrint(level+2, c.Body), "\n"))
+}
@@ -0,0 +1,192 @@
+package hlir
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ReplaceRegisters returns a copy of ops where every register r used by an
+// opcode, including the opcodes nested in control flow and the registers
+// that make up an Offset or Pointer, is replaced by f(r).
+func ReplaceRegisters(ops []Opcode, f func(Register) Register) []Opcode {
+	return replaceBlock(ops, f, func(reg Register) Register {
+		return replaceRegister(reg, f)
+	})
+}
+
+// ReplaceOpRegisters is like ReplaceRegisters for a single opcode.
+func ReplaceOpRegisters(op Opcode, f func(Register) Register) Opcode {
+	return replaceBlock([]Opcode{op}, f, func(reg Register) Register {
+		return replaceRegister(reg, f)
+	})[0]
+}
+
+// ReplaceUses is like ReplaceRegisters, but only replaces the registers
+// that are read by an opcode. The destination of an opcode is left alone,
+// except for the registers used to calculate an Offset.
+func ReplaceUses(ops []Opcode, f func(Register) Register) []Opcode {
+	return replaceBlock(ops, f, usesOnly(f))
+}
+
+// ReplaceOpUses is like ReplaceUses for a single opcode.
+func ReplaceOpUses(op Opcode, f func(Register) Register) Opcode {
+	return replaceOp(op, f, usesOnly(f))
+}
+
+// RenumberCalls returns a copy of ops where the number of every CALL,
+// including the CALLs nested in control flow, is replaced by f(n). The
+// LastFuncCallRetVals of the calls aren't changed, they can be replaced
+// with ReplaceRegisters.
+func RenumberCalls(ops []Opcode, f func(uint) uint) []Opcode {
+	if ops == nil {
+		return nil
+	}
+	newops := make([]Opcode, 0, len(ops))
+	for _, op := range ops {
+		switch o := op.(type) {
+		case CALL:
+			o.CallNum = f(o.CallNum)
+			op = o
+		case IF:
+			o.ControlFlow = renumberControlFlow(o.ControlFlow, f)
+			o.ElseBody = RenumberCalls(o.ElseBody, f)
+			op = o
+		case LOOP:
+			op = LOOP(renumberControlFlow(ControlFlow(o), f))
+		case JumpTable:
+			jt := make(JumpTable, 0, len(o))
+			for _, cf := range o {
+				jt = append(jt, renumberControlFlow(cf, f))
+			}
+			op = jt
+		case ASSERT:
+			o.Predicate.Body = RenumberCalls(o.Predicate.Body, f)
+			op = o
+		}
+		newops = append(newops, op)
+	}
+	return newops
+}
+
+func renumberControlFlow(cf ControlFlow, f func(uint) uint) ControlFlow {
+	cf.Condition.Body = RenumberCalls(cf.Condition.Body, f)
+	cf.Initializer = RenumberCalls(cf.Initializer, f)
+	cf.Body = RenumberCalls(cf.Body, f)
+	return cf
+}
+
+// Returns a function to replace the registers used to calculate a
+// destination, but not the destination itself.
+func usesOnly(f func(Register) Register) func(Register) Register {
+	return func(reg Register) Register {
+		if o, ok := reg.(Offset); ok {
+			o.Offset = replaceRegister(o.Offset, f)
+			return o
+		}
+		return reg
+	}
+}
+
+// Replaces the registers in op, using use for the registers read and
+// dst for the registers written.
+func replaceOp(op Opcode, f, dst func(Register) Register) Opcode {
+	r := func(reg Register) Register {
+		return replaceRegister(reg, f)
+	}
+	switch o := op.(type) {
+	case CALL:
+		var args []Register
+		for _, a := range o.Args {
+			args = append(args, r(a))
+		}
+		o.Args = args
+		return o
+	case MOV:
+		return MOV{Src: r(o.Src), Dst: dst(o.Dst)}
+	case ADD:
+		return ADD{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case SUB:
+		return SUB{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case MUL:
+		return MUL{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case DIV:
+		return DIV{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case MOD:
+		return MOD{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case EQ:
+		return EQ{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case NEQ:
+		return NEQ{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case GEQ:
+		return GEQ{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case GT:
+		return GT{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case LT:
+		return LT{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case LTE:
+		return LTE{Left: r(o.Left), Right: r(o.Right), Dst: dst(o.Dst)}
+	case IF:
+		o.ControlFlow = replaceControlFlow(o.ControlFlow, f, dst)
+		o.ElseBody = replaceBlock(o.ElseBody, f, dst)
+		return o
+	case LOOP:
+		return LOOP(replaceControlFlow(ControlFlow(o), f, dst))
+	case JumpTable:
+		jt := make(JumpTable, 0, len(o))
+		for _, cf := range o {
+			jt = append(jt, replaceControlFlow(cf, f, dst))
+		}
+		return jt
+	case ASSERT:
+		o.Predicate = replaceCondition(o.Predicate, f, dst)
+		return o
+	case RET, BREAK, CONTINUE, LINE:
+		return o
+	default:
+		panic(fmt.Sprintf("Unhandled opcode type when replacing registers: %v", reflect.TypeOf(op)))
+	}
+}
+
+func replaceBlock(ops []Opcode, f, dst func(Register) Register) []Opcode {
+	if ops == nil {
+		return nil
+	}
+	newops := make([]Opcode, 0, len(ops))
+	for _, op := range ops {
+		newops = append(newops, replaceOp(op, f, dst))
+	}
+	return newops
+}
+
+func replaceControlFlow(cf ControlFlow, f, dst func(Register) Register) ControlFlow {
+	return ControlFlow{
+		Condition:   replaceCondition(cf.Condition, f, dst),
+		Initializer: replaceBlock(cf.Initializer, f, dst),
+		Body:        replaceBlock(cf.Body, f, dst),
+	}
+}
+
+func replaceCondition(c Condition, f, dst func(Register) Register) Condition {
+	return Condition{
+		Body:     replaceBlock(c.Body, f, dst),
+		Register: replaceRegister(c.Register, f),
+	}
+}
+
+// Replaces reg and any register that it's composed of.
+func replaceRegister(reg Register, f func(Register) Register) Register {
+	switch r := reg.(type) {
+	case nil:
+		return nil
+	case Offset:
+		r.Offset = replaceRegister(r.Offset, f)
+		r.Base = replaceRegister(r.Base, f)
+		return f(r)
+	case Pointer:
+		return f(Pointer{replaceRegister(r.Register, f)})
+	case SliceBasePointer:
+		return f(SliceBasePointer{replaceRegister(r.Register, f)})
+	default:
+		return f(reg)
+	}
+}
@@ -2,6 +2,7 @@ package vm
 
 import (
 	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/compiler/hlir/opt"
 	"github.com/driusan/lang/parser/ast"
 	"io"
 	"strings"
@@ -12,6 +13,14 @@ func Parse(val string) (*Context, error) {
 }
 
 func ParseFromReader(src io.Reader) (*Context, error) {
+	// Keep track of the lines of the source in the HLIR, so that errors
+	// can say where they happened.
+	emitLines := hlir.EmitLines
+	hlir.EmitLines = true
+	defer func() {
+		hlir.EmitLines = emitLines
+	}()
+
 	as, ti, c, err := ast.ParseFromReader(src)
 	if err != nil {
 		return nil, err
@@ -33,22 +42,27 @@ func ParseFromReader(src io.Reader) (*Context, error) {
 		}
 	}
 
+	consts, err := EvaluateConstants(as, ti, c, enums)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate and optimize all the functions
+	prog, err := opt.Generate(as, ti, c, enums, consts)
+	if err != nil {
+		return nil, err
+	}
+	if err := opt.Default.Run(prog); err != nil {
+		return nil, err
+	}
+
 	ctx := NewContext()
 	ctx.Callables = c
-	// Generate all the functions
-	ret := make(map[string]hlir.Func)
-	for _, v := range as {
-		switch v.(type) {
-		case ast.FuncDecl:
-			fnc, _, rd, err := hlir.Generate(v, ti, c, enums)
-			if err != nil {
-				return nil, err
-			}
-			ret[fnc.Name] = fnc
-			ctx.RegisterData[fnc.Name] = rd
-		}
+	ctx.Funcs = make(map[string]hlir.Func)
+	for _, fnc := range prog.Funcs {
+		ctx.Funcs[fnc.Name] = fnc
+		ctx.RegisterData[fnc.Name] = prog.RegisterData[fnc.Name]
 	}
-	ctx.Funcs = ret
 
 	return ctx, nil
 }
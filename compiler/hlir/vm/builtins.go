@@ -0,0 +1,252 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// A builtin is a function which is implemented by the VM, rather than by
+// the program. It's called with the frame of the caller and the registers
+// of the arguments in that frame, and returns the value that the call
+// returns, if any.
+type builtin func(ctx *Context, fr *frame, args []hlir.Register) (value, error)
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"Write":          builtinWrite,
+		"PrintString":    builtinPrintString,
+		"PrintByteSlice": builtinPrintByteSlice,
+		"len":            builtinLen,
+		"PrintInt":       builtinPrintInt,
+		"Create":         builtinOpen(FileSystem.Create),
+		"Open":           builtinOpen(FileSystem.Open),
+		"Read":           builtinRead,
+		"Close":          builtinClose,
+	}
+}
+
+func builtinWrite(ctx *Context, fr *frame, args []hlir.Register) (value, error) {
+	fd := evalRegister(args[0], fr)
+	l := evalRegister(args[1], fr)
+	s := evalRegister(args[2], fr)
+
+	w, err := ctx.writer(fd.int())
+	if err != nil {
+		return value{}, err
+	}
+	if s.kind == kindString {
+		_, err = io.WriteString(w, s.s)
+		return value{}, err
+	}
+	return value{}, writeByteSlice(w, l.int(), args[2], fr)
+}
+
+// Writes the l bytes of the slice r to w.
+func writeByteSlice(w io.Writer, l int, r hlir.Register, fr *frame) error {
+	base, nfr := dereferencePointer(r, fr)
+outer:
+	for {
+		switch o := base.(type) {
+		case hlir.LocalValue:
+			break outer
+		case hlir.Offset:
+			base, nfr = resolveOffset(o, nfr)
+			break outer
+		case hlir.SliceBasePointer:
+			break outer
+		default:
+			base, nfr = dereferencePointer(base, nfr)
+		}
+
+	}
+	ptr, ok := base.(hlir.SliceBasePointer)
+	if ok {
+		// It might not be a SliceBasePointer if it's
+		// a string
+		if o, ok := ptr.Register.(hlir.Offset); ok {
+			base, nfr = resolveOffset(o, nfr)
+		} else {
+			base = ptr.Register
+		}
+	}
+	for i := 0; i < l; i++ {
+		ch := evalRegister(base, nfr)
+		if ch.kind == kindString {
+			// Hack because Strings and Byte slices aren't represented
+			// the same way in the VM, even though they should be
+			_, err := io.WriteString(w, ch.s)
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%c", ch.iface()); err != nil {
+			return err
+		}
+		switch b := base.(type) {
+		case hlir.LocalValue:
+			base = b + 1
+		default:
+			panic(fmt.Sprintf("Unhandled register type in Write of byte slice %v", reflect.TypeOf(b)))
+		}
+	}
+	return nil
+}
+
+func builtinPrintString(ctx *Context, fr *frame, args []hlir.Register) (value, error) {
+	// Special case for some things in stdlib.
+	// FIXME: This should be more robust.
+	if len(args) == 1 {
+		// It's a string literal
+		fmt.Fprintf(ctx.Stdout, "%v", evalRegister(args[0], fr))
+	} else if len(args) == 2 {
+		// It's a len, localvalue pair
+		l := evalRegister(args[0], fr)
+		s := evalRegister(args[1], fr)
+		if s.kind == kindString {
+			fmt.Fprintf(ctx.Stdout, "%v", s.s)
+		} else {
+			base, nfr := dereferencePointer(args[1], fr)
+
+			for i := 0; i < l.int(); i++ {
+				ch := evalRegister(base, nfr)
+				if ch.kind == kindString {
+					// Hack because Strings and Byte slices aren't represented
+					// the same way in the VM, even though they should be
+					fmt.Fprintf(ctx.Stdout, "%s", ch.s)
+					break
+				}
+				fmt.Fprintf(ctx.Stdout, "%c", ch.iface())
+				switch b := base.(type) {
+				case hlir.LocalValue:
+					base = b + 1
+				case hlir.FuncArg:
+				default:
+					panic("Unhandled register type in PrintByteSlice")
+				}
+			}
+		}
+	} else {
+		panic("Unhandled PrintString")
+	}
+	return value{}, nil
+}
+
+func builtinPrintByteSlice(ctx *Context, fr *frame, args []hlir.Register) (value, error) {
+	// FIXME: This should be way more robust and also more efficient.
+	if len(args) != 2 {
+		panic("Unhandled byte slice")
+	}
+	// It's a len, localvalue pair
+	l := evalRegister(args[0], fr)
+	base, nfr := dereferencePointer(args[1], fr)
+
+	for i := 0; i < l.int(); i++ {
+		ch := evalRegister(base, nfr)
+		if ch.kind == kindString {
+			// Hack because Strings and Byte slices aren't represented
+			// the same way in the VM, even though they should be
+			fmt.Fprintf(ctx.Stdout, "%s", ch.s)
+			break
+		}
+		fmt.Fprintf(ctx.Stdout, "%c", ch.iface())
+		switch b := base.(type) {
+		case hlir.LocalValue:
+			base = b + 1
+		default:
+			panic("Unhandled register type in PrintByteSlice")
+		}
+	}
+	return value{}, nil
+}
+
+func builtinLen(ctx *Context, fr *frame, args []hlir.Register) (value, error) {
+	return evalRegister(args[0], fr), nil
+}
+
+func builtinPrintInt(ctx *Context, fr *frame, args []hlir.Register) (value, error) {
+	fmt.Fprintf(ctx.Stdout, "%v", evalRegister(args[0], fr))
+	return value{}, nil
+}
+
+// Returns the builtin for a syscall which opens a file in the filesystem
+// of the Context.
+func builtinOpen(syscall func(FileSystem, string) (File, error)) builtin {
+	return func(ctx *Context, fr *frame, args []hlir.Register) (value, error) {
+		var name string
+		if len(args) == 1 {
+			// It's a string literal
+			s := evalRegister(args[0], fr)
+			name = s.s
+		} else if len(args) == 2 {
+			// It's a len, localvalue pair
+			l := evalRegister(args[0], fr)
+			s := evalRegister(args[1], fr)
+			if s.kind == kindString {
+				name = s.s
+			} else {
+				base, nfr := dereferencePointer(args[1], fr)
+
+				for i := 0; i < l.int(); i++ {
+					ch := evalRegister(base, nfr)
+					if ch.kind == kindString {
+						// Hack because Strings and Byte slices aren't represented
+						// the same way in the VM, even though they should be
+						name = ch.s
+						break
+					}
+					name += fmt.Sprintf("%c", ch.iface())
+					switch b := base.(type) {
+					case hlir.LocalValue:
+						base = b + 1
+					default:
+						panic("Unhandled register type in PrintByteSlice")
+					}
+				}
+			}
+		}
+
+		f, err := syscall(ctx.FS, name)
+		if err != nil {
+			return value{}, err
+		}
+		return intValue(ctx.addFile(f)), nil
+	}
+}
+
+func builtinRead(ctx *Context, fr *frame, args []hlir.Register) (value, error) {
+	fd := evalRegister(args[0], fr)
+	l := evalRegister(args[1], fr).int()
+	base, nfr := dereferencePointer(args[2], fr)
+	f, err := ctx.reader(fd.int())
+	if err != nil {
+		return value{}, err
+	}
+	bytes := make([]byte, l, l)
+	n, err := f.Read(bytes)
+	if err != nil && err != io.EOF {
+		return value{}, err
+	}
+	for i := 0; i < l; i++ {
+		reg := base.(hlir.LocalValue) + hlir.LocalValue(i)
+		setRegister(reg, byteValue(bytes[i]), nfr)
+	}
+	return intValue(n), nil
+}
+
+func builtinClose(ctx *Context, fr *frame, args []hlir.Register) (value, error) {
+	fd := evalRegister(args[0], fr).int()
+	if fd <= 2 {
+		// The standard input and outputs belong to whoever set up
+		// the Context, not the program.
+		return value{}, nil
+	}
+	f, ok := ctx.files[fd]
+	if !ok {
+		return value{}, fmt.Errorf("Close of bad file descriptor %d", fd)
+	}
+	delete(ctx.files, fd)
+	return value{}, f.Close()
+}
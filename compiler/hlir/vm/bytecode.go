@@ -0,0 +1,642 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// An opcode is the operation of a bytecode instruction.
+type opcode uint8
+
+const (
+	// dst = a
+	opMOV opcode = iota
+
+	// dst = a op b
+	opADD
+	opSUB
+	opMUL
+	opDIV
+	opMOD
+	opLT
+	opGT
+	opLTE
+	opGEQ
+	opEQ
+	opNEQ
+
+	// Jump to target, or jump to target if a is false.
+	opJMP
+	opJZ
+
+	opCALL
+	opRET
+
+	// Fail if a is false.
+	opASSERT
+
+	// dst = the value of reg, for registers without a slot.
+	opLOAD
+	// Set reg to a, for registers without a slot.
+	opSTORE
+	// Make the destination of a MOV of a pointer point to its source.
+	opPOINTER
+
+	// A BREAK or CONTINUE that isn't inside of enough loops, which
+	// returns an error.
+	opBRANCH
+)
+
+var opcodeNames = [...]string{
+	opMOV:     "MOV",
+	opADD:     "ADD",
+	opSUB:     "SUB",
+	opMUL:     "MUL",
+	opDIV:     "DIV",
+	opMOD:     "MOD",
+	opLT:      "LT",
+	opGT:      "GT",
+	opLTE:     "LTE",
+	opGEQ:     "GEQ",
+	opEQ:      "EQ",
+	opNEQ:     "NEQ",
+	opJMP:     "JMP",
+	opJZ:      "JZ",
+	opCALL:    "CALL",
+	opRET:     "RET",
+	opASSERT:  "ASSERT",
+	opLOAD:    "LOAD",
+	opSTORE:   "STORE",
+	opPOINTER: "POINTER",
+	opBRANCH:  "BRANCH",
+}
+
+func (op opcode) String() string {
+	return opcodeNames[op]
+}
+
+// An instruction is a single bytecode instruction.
+type instruction struct {
+	op        opcode
+	dst, a, b operand
+
+	// The instruction to jump to.
+	target int
+
+	// The register for LOAD and STORE.
+	reg hlir.Register
+
+	call *callSite
+
+	// The HLIR opcode that the instruction was lowered from.
+	src hlir.Opcode
+}
+
+func (in instruction) String() string {
+	switch in.op {
+	case opMOV:
+		return fmt.Sprintf("MOV %v, %v", in.a, in.dst)
+	case opJMP:
+		return fmt.Sprintf("JMP %d", in.target)
+	case opJZ:
+		return fmt.Sprintf("JZ %v, %d", in.a, in.target)
+	case opCALL:
+		return fmt.Sprintf("CALL %v", in.call.name)
+	case opRET, opPOINTER, opBRANCH:
+		return in.op.String()
+	case opASSERT:
+		return fmt.Sprintf("ASSERT %v", in.a)
+	case opLOAD:
+		return fmt.Sprintf("LOAD %v, %v", in.reg, in.dst)
+	case opSTORE:
+		return fmt.Sprintf("STORE %v, %v", in.a, in.reg)
+	default:
+		return fmt.Sprintf("%v %v, %v, %v", in.op, in.a, in.b, in.dst)
+	}
+}
+
+func (o operand) String() string {
+	switch o.class {
+	case classScratch:
+		return fmt.Sprintf("S%d", o.idx)
+	case classConst:
+		return fmt.Sprintf("K%d", o.idx)
+	case classCallRet:
+		return fmt.Sprintf("CR%d", o.idx)
+	default:
+		return fmt.Sprint(o.register())
+	}
+}
+
+// A callSite is everything about a CALL needed to make it.
+type callSite struct {
+	name string
+
+	// The function implementing a builtin, and the arguments passed to
+	// it. builtin is nil for calls to functions in the program.
+	builtin builtin
+	args    []hlir.Register
+
+	params []callArg
+
+	tail bool
+
+	// The slot in the caller of each value that the call returns, by
+	// the value's number, or -1 for values which the caller doesn't use.
+	callNum uint
+	rets    []int
+
+	// The function called, once it's been looked up.
+	fn *function
+
+	// Set for calls which are evaluated as part of an assertion, which
+	// can't have any effects.
+	noEffects bool
+}
+
+// A callArg is an argument passed to a function in the program.
+type callArg struct {
+	farg hlir.FuncArg
+
+	// The register that the argument points to, or nil if the argument is
+	// passed by value in val.
+	pointer hlir.Register
+	val     operand
+
+	// Set if the callee has no register data for the argument.
+	missing bool
+}
+
+// A function is the bytecode for an HLIR function.
+type function struct {
+	name string
+
+	// The HLIR that the function was compiled from, to detect when it
+	// changes.
+	body []hlir.Opcode
+
+	code   []instruction
+	consts []value
+
+	// The line of the source that each instruction is from, or 0 if
+	// it's not known.
+	lines []int
+
+	// What the registers of the function are in the source.
+	rd hlir.RegisterData
+
+	// The statements and bodies of code in the function, in the order
+	// that they start in.
+	blocks []block
+
+	// The number of slots of each class that a frame running the
+	// function needs.
+	slots [numClasses]int
+
+	// The slot of each value returned by a call that the function uses.
+	// Every call has its own slots, since a value returned by one can
+	// still be needed after the next one is made.
+	callRets map[hlir.LastFuncCallRetVal]uint32
+}
+
+// Returns the bytecode for the function named name, or nil if there's no
+// such function.
+func (ctx *Context) function(name string) *function {
+	f, ok := ctx.Funcs[name]
+	if !ok {
+		return nil
+	}
+	if fn, ok := ctx.code[name]; ok && sameBody(fn.body, f.Body) {
+		return fn
+	}
+	fn := compile(f, ctx)
+	ctx.code[name] = fn
+	return fn
+}
+
+// Drops the bytecode if any of Funcs have changed since they were compiled.
+// All of it is dropped, since call sites refer to the bytecode of the
+// function that they call.
+func (ctx *Context) checkCode() {
+	for name, fn := range ctx.code {
+		if f, ok := ctx.Funcs[name]; !ok || !sameBody(fn.body, f.Body) {
+			for k := range ctx.code {
+				delete(ctx.code, k)
+			}
+			return
+		}
+	}
+}
+
+// Returns true if a and b are the same slice.
+func sameBody(a, b []hlir.Opcode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
+
+// Lowers f to bytecode.
+func compile(f hlir.Func, ctx *Context) *function {
+	c := compiler{
+		ctx: ctx,
+		fn: &function{
+			name:     f.Name,
+			body:     f.Body,
+			rd:       ctx.RegisterData[f.Name],
+			callRets: make(map[hlir.LastFuncCallRetVal]uint32),
+		},
+		consts: make(map[value]uint32),
+	}
+	c.block(f.Body)
+
+	// Now that every use of the values returned by calls has a slot,
+	// tell the calls where to put them.
+	for _, cs := range c.calls {
+		for cv, idx := range c.fn.callRets {
+			if cv.CallNum != cs.callNum {
+				continue
+			}
+			for uint(len(cs.rets)) <= cv.RetNum {
+				cs.rets = append(cs.rets, -1)
+			}
+			cs.rets[cv.RetNum] = int(idx)
+		}
+	}
+
+	// Drop the bodies which didn't have any instructions to run.
+	blocks := c.fn.blocks[:0]
+	for _, b := range c.fn.blocks {
+		if b.pc >= 0 {
+			blocks = append(blocks, b)
+		}
+	}
+	c.fn.blocks = blocks
+	return c.fn
+}
+
+type compiler struct {
+	ctx    *Context
+	fn     *function
+	consts map[value]uint32
+
+	// The loops that the opcode being compiled is in, innermost last.
+	loops []*loopLabels
+
+	// The calls made by the function.
+	calls []*callSite
+
+	// The number of scratch slots used by the current opcode.
+	scratch uint32
+
+	// The opcode being compiled, and the line of the source that it's
+	// from.
+	src  hlir.Opcode
+	line int
+
+	// The line of a statement which hasn't had any instructions emitted
+	// for it yet, or 0.
+	stmt int
+
+	noEffects bool
+}
+
+type loopLabels struct {
+	// The instruction that a CONTINUE jumps to.
+	cont int
+
+	// The jumps to the end of the loop, which are patched once its end
+	// is known.
+	breaks []int
+}
+
+func (c *compiler) emit(in instruction) int {
+	in.src = c.src
+	c.fn.code = append(c.fn.code, in)
+	c.fn.lines = append(c.fn.lines, c.line)
+	pc := len(c.fn.code) - 1
+	if c.stmt > 0 {
+		c.fn.blocks = append(c.fn.blocks, block{kind: StatementBlock, pc: pc, line: c.stmt, end: c.stmt})
+		c.stmt = 0
+	}
+	return pc
+}
+
+// Compiles the body of an IF, ELSE, JumpTable case or LOOP, and returns the
+// index of its block. If the body has no instructions, the pc of the block is
+// -1 until it's set by fill.
+func (c *compiler) body(kind BlockKind, ops []hlir.Opcode) int {
+	i := len(c.fn.blocks)
+	start := len(c.fn.code)
+	c.fn.blocks = append(c.fn.blocks, block{kind: kind, pc: start, line: c.line, end: c.line})
+	c.block(ops)
+	// A statement at the end which didn't have any instructions isn't
+	// run by whatever comes after the body.
+	c.stmt = 0
+
+	b := &c.fn.blocks[i]
+	if len(c.fn.code) == start {
+		b.pc = -1
+		return i
+	}
+	first := true
+	for _, line := range c.fn.lines[start:] {
+		if line == 0 {
+			continue
+		}
+		if first || line < b.line {
+			b.line = line
+		}
+		if first || line > b.end {
+			b.end = line
+		}
+		first = false
+	}
+	return i
+}
+
+// Sets the pc of a block for a body without any instructions to pc, which
+// runs only when the body would.
+func (c *compiler) fill(i, pc int) {
+	if c.fn.blocks[i].pc < 0 {
+		c.fn.blocks[i].pc = pc
+	}
+}
+
+// Sets the target of the jump at pc to the next instruction.
+func (c *compiler) patch(pc int) {
+	c.fn.code[pc].target = len(c.fn.code)
+}
+
+func (c *compiler) block(ops []hlir.Opcode) {
+	for _, op := range ops {
+		c.op(op)
+	}
+}
+
+func (c *compiler) op(op hlir.Opcode) {
+	src := c.src
+	c.src = op
+	defer func() { c.src = src }()
+	c.scratch = 0
+
+	switch o := op.(type) {
+	case hlir.MOV:
+		if fa, ok := o.Dst.(hlir.FuncArg); ok && fa.Reference {
+			// If moving into a variable that was declared as a
+			// reference, mutate it in the caller.
+			c.emit(instruction{op: opSTORE, a: c.source(o.Src), reg: o.Dst})
+		} else if _, ok := o.Src.(hlir.Pointer); ok {
+			c.emit(instruction{op: opPOINTER})
+		} else {
+			a := c.source(o.Src)
+			c.assign(opMOV, a, operand{}, o.Dst)
+		}
+	case hlir.ADD:
+		c.binary(opADD, o.Left, o.Right, o.Dst)
+	case hlir.SUB:
+		c.binary(opSUB, o.Left, o.Right, o.Dst)
+	case hlir.MUL:
+		c.binary(opMUL, o.Left, o.Right, o.Dst)
+	case hlir.DIV:
+		c.binary(opDIV, o.Left, o.Right, o.Dst)
+	case hlir.MOD:
+		c.binary(opMOD, o.Left, o.Right, o.Dst)
+	case hlir.LT:
+		c.binary(opLT, o.Left, o.Right, o.Dst)
+	case hlir.GT:
+		c.binary(opGT, o.Left, o.Right, o.Dst)
+	case hlir.LTE:
+		c.binary(opLTE, o.Left, o.Right, o.Dst)
+	case hlir.GEQ:
+		c.binary(opGEQ, o.Left, o.Right, o.Dst)
+	case hlir.EQ:
+		c.binary(opEQ, o.Left, o.Right, o.Dst)
+	case hlir.NEQ:
+		c.binary(opNEQ, o.Left, o.Right, o.Dst)
+	case hlir.RET:
+		c.emit(instruction{op: opRET})
+	case hlir.CALL:
+		c.call(o)
+	case hlir.IF:
+		c.block(o.Initializer)
+		jz := c.emit(instruction{op: opJZ, a: c.condition(o.Condition)})
+		body := c.body(IfBlock, o.Body)
+		if len(o.ElseBody) == 0 {
+			c.patch(jz)
+			break
+		}
+		jmp := c.emit(instruction{op: opJMP})
+		c.fill(body, jmp)
+		c.patch(jz)
+		c.body(ElseBlock, o.ElseBody)
+		c.patch(jmp)
+	case hlir.LOOP:
+		c.block(o.Initializer)
+		l := &loopLabels{cont: len(c.fn.code)}
+		jz := c.emit(instruction{op: opJZ, a: c.condition(o.Condition)})
+		c.loops = append(c.loops, l)
+		body := c.body(LoopBlock, o.Body)
+		c.loops = c.loops[:len(c.loops)-1]
+		c.fill(body, c.emit(instruction{op: opJMP, target: l.cont}))
+		c.patch(jz)
+		for _, pc := range l.breaks {
+			c.patch(pc)
+		}
+	case hlir.BREAK:
+		if l := c.loop(o.Depth); l != nil {
+			l.breaks = append(l.breaks, c.emit(instruction{op: opJMP}))
+		}
+	case hlir.CONTINUE:
+		if l := c.loop(o.Depth); l != nil {
+			c.emit(instruction{op: opJMP, target: l.cont})
+		}
+	case hlir.JumpTable:
+		var ends []int
+		for _, cse := range o {
+			c.block(cse.Initializer)
+			jz := c.emit(instruction{op: opJZ, a: c.condition(cse.Condition)})
+			body := c.body(CaseBlock, cse.Body)
+			ends = append(ends, c.emit(instruction{op: opJMP}))
+			c.fill(body, ends[len(ends)-1])
+			c.patch(jz)
+		}
+		for _, pc := range ends {
+			c.patch(pc)
+		}
+	case hlir.LINE:
+		c.line = o.Line
+		c.stmt = o.Line
+	case hlir.ASSERT:
+		noEffects := c.noEffects
+		c.noEffects = true
+		a := c.condition(o.Predicate)
+		c.noEffects = noEffects
+		c.emit(instruction{op: opASSERT, a: a})
+	default:
+		panic(fmt.Sprintf("Unrecognized op: %v", reflect.TypeOf(op).Name()))
+	}
+}
+
+// Returns the loop that a BREAK or CONTINUE with depth refers to. If it's
+// not in that many loops, a BRANCH is emitted instead and nil is returned.
+func (c *compiler) loop(depth uint) *loopLabels {
+	if int(depth) >= len(c.loops) {
+		c.emit(instruction{op: opBRANCH, target: int(depth) - len(c.loops)})
+		return nil
+	}
+	return c.loops[len(c.loops)-1-int(depth)]
+}
+
+// Compiles the body of cond, and returns the operand with its result.
+func (c *compiler) condition(cond hlir.Condition) operand {
+	c.block(cond.Body)
+	c.scratch = 0
+	return c.source(cond.Register)
+}
+
+func (c *compiler) binary(op opcode, left, right, dst hlir.Register) {
+	a := c.source(left)
+	b := c.source(right)
+	c.assign(op, a, b, dst)
+}
+
+// Emits op with the result going to dst.
+func (c *compiler) assign(op opcode, a, b operand, dst hlir.Register) {
+	d, ok := c.operand(dst)
+	if ok && d.class == classConst {
+		ok = false
+	}
+	if !ok {
+		d = c.scratchSlot()
+	}
+	c.emit(instruction{op: op, dst: d, a: a, b: b})
+	if !ok {
+		c.emit(instruction{op: opSTORE, a: d, reg: dst})
+	}
+}
+
+// Returns the slot of the value cv returned by a call, allocating it if
+// it doesn't have one yet.
+func (c *compiler) callRet(cv hlir.LastFuncCallRetVal) uint32 {
+	idx, ok := c.fn.callRets[cv]
+	if !ok {
+		idx = uint32(len(c.fn.callRets))
+		c.fn.callRets[cv] = idx
+	}
+	return idx
+}
+
+func (c *compiler) call(o hlir.CALL) {
+	cs := &callSite{
+		name:      string(o.FName),
+		tail:      o.TailCall,
+		callNum:   o.CallNum,
+		noEffects: c.noEffects,
+	}
+	c.calls = append(c.calls, cs)
+	if b, ok := builtins[cs.name]; ok {
+		cs.builtin = b
+		cs.args = o.Args
+		// Builtins evaluate their arguments themselves, but the values
+		// returned by calls still need slots to be found in.
+		for _, r := range o.Args {
+			if cv, ok := r.(hlir.LastFuncCallRetVal); ok {
+				c.slot(classCallRet, c.callRet(cv))
+			}
+		}
+		c.emit(instruction{op: opCALL, call: cs})
+		return
+	}
+
+	rd := c.ctx.RegisterData[cs.name]
+	for i, r := range o.Args {
+		arg := callArg{farg: hlir.FuncArg{uint(i), false}}
+		if _, ok := rd[arg.farg]; !ok {
+			arg.farg.Reference = true
+			if _, okref := rd[arg.farg]; !okref {
+				arg.missing = true
+			}
+		}
+		if !arg.farg.Reference {
+			switch r := r.(type) {
+			case hlir.Pointer:
+				arg.pointer = r
+			case hlir.SliceBasePointer:
+				// Convert it to a normal pointer when passing
+				// as an argument so that it dereferences properly.
+				arg.pointer = hlir.Pointer{r.Register}
+			default:
+				if !arg.missing {
+					arg.val = c.source(r)
+				}
+			}
+		} else {
+			arg.pointer = r
+		}
+		cs.params = append(cs.params, arg)
+	}
+	c.emit(instruction{op: opCALL, call: cs})
+}
+
+// Returns the operand with the value of r, loading it into a scratch slot
+// if it doesn't have a slot of its own.
+func (c *compiler) source(r hlir.Register) operand {
+	if o, ok := c.operand(r); ok {
+		return o
+	}
+	o := c.scratchSlot()
+	c.emit(instruction{op: opLOAD, dst: o, reg: r})
+	return o
+}
+
+// Returns the slot for r, if it has one.
+func (c *compiler) operand(r hlir.Register) (operand, bool) {
+	switch reg := r.(type) {
+	case hlir.LocalValue:
+		return c.slot(classLocal, uint32(reg)), true
+	case hlir.TempValue:
+		return c.slot(classTemp, uint32(reg)), true
+	case hlir.FuncArg:
+		if reg.Reference {
+			return operand{}, false
+		}
+		return c.slot(classArg, uint32(reg.Id)), true
+	case hlir.FuncRetVal:
+		return c.slot(classRet, uint32(reg)), true
+	case hlir.LastFuncCallRetVal:
+		return c.slot(classCallRet, c.callRet(reg)), true
+	case hlir.IntLiteral:
+		return c.constant(intValue(int(reg))), true
+	case hlir.StringLiteral:
+		return c.constant(stringValue(strings.Replace(string(reg), `\n`, "\n", -1))), true
+	default:
+		return operand{}, false
+	}
+}
+
+func (c *compiler) slot(class regClass, idx uint32) operand {
+	if int(idx) >= c.fn.slots[class] {
+		c.fn.slots[class] = int(idx) + 1
+	}
+	return operand{class, idx}
+}
+
+func (c *compiler) scratchSlot() operand {
+	o := c.slot(classScratch, c.scratch)
+	c.scratch++
+	return o
+}
+
+func (c *compiler) constant(v value) operand {
+	idx, ok := c.consts[v]
+	if !ok {
+		idx = uint32(len(c.fn.consts))
+		c.consts[v] = idx
+		c.fn.consts = append(c.fn.consts, v)
+	}
+	return operand{classConst, idx}
+}
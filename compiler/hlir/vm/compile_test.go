@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
@@ -8,6 +9,8 @@ import (
 	"testing"
 
 	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/compiler/hlir/opt"
+	"github.com/driusan/lang/parser/ast"
 	"github.com/driusan/lang/parser/sampleprograms"
 )
 
@@ -18,27 +21,11 @@ func compileAndTestWithArgs(t *testing.T, name string, prog io.Reader, args []st
 		t.Fatal(err)
 	}
 
-	args = append([]string{name}, args...)
-
-	// Create a new environment to put the StringLiterals in, so that they can be
-	// treated the same as any other call in how they're passed
-	env := NewContext()
-	env.stdout = ctx.stdout
-	env.stderr = ctx.stderr
-
-	for i, s := range args {
-		env.localValues[hlir.LocalValue(2*i)] = len([]byte(s))
-		env.localValues[hlir.LocalValue(2*i+1)] = s //hlir.StringLiteral(s)
-
-	}
-	ctx.pointers[hlir.Pointer{hlir.FuncArg{1, false}}] = Pointer{hlir.Pointer{hlir.LocalValue(0)}, env}
-
-	ctx.funcArg[hlir.FuncArg{0, false}] = int(len(args))
-	//ctx.funcArg[hlir.FuncArg{uint(1), false}] = hlir.Pointer{hlir.FuncArg{1, false}}
+	ctx.SetArgs(append([]string{name}, args...))
 
 	stdout, stderr, err := RunWithSideEffects("main", ctx)
 	if err != nil {
-		if _, assert := err.(assertionError); !assert {
+		if re, ok := err.(*RuntimeError); !ok || re.Kind != AssertionFailure {
 			t.Fatal(err)
 		}
 	}
@@ -513,7 +500,14 @@ func TestIfElseMatch(t *testing.T) {
 }
 
 func TestGenericEnumType(t *testing.T) {
-	compileAndTest(t, sampleprograms.GenericEnumType, "5\nI am nothing!\n", "")
+	// The optimizer can fold the call returning Just 5 away, which
+	// mustn't leave the call returning Nothing without a payload.
+	def := opt.Default
+	defer func() { opt.Default = def }()
+	for _, level := range []opt.Level{opt.O0, opt.O1, opt.O2} {
+		opt.Default = opt.NewManager(level)
+		compileAndTest(t, sampleprograms.GenericEnumType, "5\nI am nothing!\n", "")
+	}
 }
 
 func TestMatchParam(t *testing.T) {
@@ -704,9 +698,164 @@ func TestTestSuite(t *testing.T) {
 		{"sliceprint", "Foo", "Bar"},
 		{"arrayparam", "16", ""},
 		{"mutarrayparam", "", ""},
+		{"forrange", "01234\n10", ""},
+		{"forarray", "0:4\n1:5\n2:6\n", ""},
+		{"forslice", "10", ""},
+		{"forstring", "2", ""},
+		{"forexpr", "468\n2", ""},
+		{"forecho", "bar baz\n", ""},
+		{"break", "14", ""},
+		{"continue", "13579\n369", ""},
+		{"labeledloop", "0\n01\n012\ndone", ""},
+		{"tupleassign", "54\ngoodbye2\n45", ""},
+		{"tuplewith", "q310\np43\np413", ""},
+		{"matchnested", "5\n33\n-1\n0\nred\nnot red\nno colour\n", ""},
+		{"matchguard", "positive\nnegative\nzero\nnothing\nbig\n", ""},
+		{"matchtuple", "1 2 Fizz 4 Buzz Fizz 7 8 Fizz Buzz 11 Fizz 13 14 FizzBuzz \n7\nlots of green\n", ""},
+		{"ifexpr", "big\n9\n1 -1 0\n4\n", ""},
+		{"matchexpr", "none\nsome\nbig\n8 0\nfour\nlarge\n", ""},
+		{"constants", "hello\n1 16 17\nbig\n9\nconstant\n", ""},
+		{"inline", "6\n64\nhello 3\n", ""},
 	}
 
 	for _, tc := range tests {
 		compileAndTestFromFile(t, tc.Name, tc.Stdout, tc.Stderr)
 	}
 }
+
+func TestConstantWithEffects(t *testing.T) {
+	_, err := Parse(`
+func greet() (int) -> affects(IO) {
+	PrintString("hello")
+	return 3
+}
+
+let Greeting = greet()
+
+func main() () -> affects(IO) {
+	PrintInt(Greeting)
+}`)
+	if err == nil {
+		t.Fatal("Expected an error evaluating a constant with side effects")
+	}
+	if !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestFoldCalls(t *testing.T) {
+	// Parse would fold the calls itself.
+	def := opt.Default
+	opt.Default = opt.NewManager(opt.O0)
+	defer func() { opt.Default = def }()
+
+	ctx, err := Parse(`
+func square(x int) (int) {
+	return x * x
+}
+
+func forever(x int) (int) {
+	mutable y = x
+	while y > 0 {
+		y = y + 1
+	}
+	return y
+}
+
+func noisy(x int) (int) {
+	PrintInt(x)
+	return x
+}
+
+func four() (int) {
+	return square(2)
+}
+
+func main() () -> affects(IO) {
+	if square(2) > 3 {
+		PrintInt(square(square(2)))
+	}
+	let x = square(3)
+	PrintInt(x + 1)
+	PrintInt(noisy(3))
+}
+
+func spin() () -> affects(IO) {
+	PrintInt(forever(1))
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folds := ctx.FoldCalls(1000)
+	expected := []string{
+		"four: folded square($2) to $4",
+		"main: folded square($2) to $4",
+		"main: folded square($2) to $4",
+		"main: folded square($3) to $9",
+		"main: folded square($4) to $16",
+	}
+	if len(folds) != len(expected) {
+		t.Fatalf("Unexpected folds: got %v want %v", folds, expected)
+	}
+	for i, f := range folds {
+		if f.String() != expected[i] {
+			t.Errorf("Unexpected fold %d: got %v want %v", i, f, expected[i])
+		}
+	}
+
+	stdout, _, err := RunWithSideEffects("main", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := ioutil.ReadAll(stdout); string(out) != "161033" {
+		t.Errorf("Unexpected stdout: got %s want %s", out, "161033")
+	}
+}
+
+func TestFoldPass(t *testing.T) {
+	nodes, ti, c, err := ast.Parse(`
+func square(x int) (int) {
+	return x * x
+}
+
+func main() () -> affects(IO) {
+	PrintInt(square(3))
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := opt.Generate(nodes, ti, c, make(hlir.EnumMap), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remarks, dump bytes.Buffer
+	m := opt.NewManager(opt.O1)
+	m.Dump = &dump
+	m.SetRemarks("fold", &remarks)
+	if err := m.Run(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := remarks.String(); got != "main: folded square($3) to $9\n" {
+		t.Errorf("Unexpected remarks: got %q", got)
+	}
+	main := p.Funcs[1]
+	expected := []hlir.Opcode{
+		hlir.CALL{FName: "PrintInt", Args: []hlir.Register{hlir.IntLiteral(9)}},
+	}
+	if len(main.Body) != len(expected) || main.Body[0].String() != expected[0].String() {
+		t.Errorf("Unexpected body: got %v want %v", main.Body, expected)
+	}
+
+	d := dump.String()
+	before := strings.Index(d, "=== before fold ===\n")
+	after := strings.Index(d, "=== after fold ===\n")
+	if before < 0 || after < before {
+		t.Fatalf("Unexpected dump: %v", d)
+	}
+	if !strings.Contains(d[before:after], "CALL square") {
+		t.Errorf("Call missing from IR before fold: %v", d[before:after])
+	}
+	if strings.Contains(d[after:], "CALL square") {
+		t.Errorf("Call not removed from IR after fold: %v", d[after:])
+	}
+}
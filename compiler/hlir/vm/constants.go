@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// ConstantFuel is the number of opcodes that the initializer of a constant
+// can run before it's given up on, so that an initializer which never
+// finishes can't hang the compiler.
+const ConstantFuel = 10000000
+
+// EvaluateConstants evaluates the initializers of the top level constants in
+// nodes at compile time, and returns the value that each constant should be
+// replaced with.
+//
+// Constants are evaluated in the order that they're declared, with no side
+// effects allowed, so an initializer can only use the functions and constants
+// declared before it.
+func EvaluateConstants(nodes []ast.Node, ti ast.TypeInformation, callables ast.Callables, enums hlir.EnumMap) (hlir.Constants, error) {
+	consts := make(hlir.Constants)
+	ctx := NewContext()
+	ctx.Callables = callables
+	ctx.Funcs = make(map[string]hlir.Func)
+	ctx.MaxSteps = ConstantFuel
+	for _, v := range nodes {
+		switch n := v.(type) {
+		case ast.FuncDecl:
+			if err := ctx.compileFunc(n, ti, enums, consts); err != nil {
+				return nil, err
+			}
+		case ast.LetStmt:
+			val, err := ctx.evaluateConstant(n, ti, enums, consts)
+			if err != nil {
+				return nil, fmt.Errorf("Could not evaluate constant %v: %w", n.Var.Name, err)
+			}
+			consts[n.Var] = val
+		}
+	}
+	return consts, nil
+}
+
+func (ctx *Context) compileFunc(fd ast.FuncDecl, ti ast.TypeInformation, enums hlir.EnumMap, consts hlir.Constants) error {
+	fnc, _, rd, err := hlir.GenerateWithConstants(fd, ti, ctx.Callables, enums, consts)
+	if err != nil {
+		return err
+	}
+	ctx.Funcs[fnc.Name] = fnc
+	ctx.RegisterData[fnc.Name] = rd
+	return nil
+}
+
+// Evaluates the initializer of a constant by compiling it into a function
+// which returns it and running the function in the VM.
+func (ctx *Context) evaluateConstant(l ast.LetStmt, ti ast.TypeInformation, enums hlir.EnumMap, consts hlir.Constants) (hlir.Register, error) {
+	// The name can't conflict with a real function, since it isn't a
+	// valid identifier.
+	name := "const " + string(l.Var.Name)
+	fd := ast.FuncDecl{
+		Name:   name,
+		Return: []ast.VarWithType{{"", l.Var.Typ, false}},
+		Body:   ast.BlockStmt{Stmts: []ast.Node{ast.ReturnStmt{returnable(l.Val, l.Var.Typ)}}},
+	}
+	if err := ctx.compileFunc(fd, ti, enums, consts); err != nil {
+		return nil, err
+	}
+	defer delete(ctx.Funcs, name)
+
+	fctx := ctx.Clone()
+	if _, _, err := RunWithLimitedEffects(name, fctx, nil); err != nil {
+		return nil, err
+	}
+
+	if l.Var.Type().TypeName() == "string" {
+		// Depending on the initializer the string is either returned
+		// on its own or after its length.
+		for i := 0; i < 2; i++ {
+			if v := fctx.frame.value(classRet, i); v.kind == kindString {
+				return hlir.StringLiteral(strings.Replace(v.s, "\n", `\n`, -1)), nil
+			}
+		}
+		return nil, fmt.Errorf("Initializer did not return a string")
+	}
+	switch v := fctx.frame.value(classRet, 0); v.kind {
+	case kindInt, kindBool:
+		return hlir.IntLiteral(v.n), nil
+	default:
+		return nil, fmt.Errorf("Initializer did not return a value")
+	}
+}
+
+// Returns a value which can be returned from a function of type t, which is
+// the same as v other than for comparisons. They only produce a value as the
+// condition of a branch, so the bool is returned from an if expression.
+func returnable(v ast.Value, t ast.Type) ast.Value {
+	if b, ok := v.(ast.BoolValue); ok && t.TypeName() == "bool" {
+		return ast.IfExpr{
+			Condition: b,
+			Body:      ast.BlockStmt{Stmts: []ast.Node{ast.BoolLiteral(true)}},
+			Else:      ast.BlockStmt{Stmts: []ast.Node{ast.BoolLiteral(false)}},
+			Typ:       t,
+		}
+	}
+	return v
+}
@@ -1,17 +1,20 @@
 package vm
 
 import (
+	"context"
 	"fmt"
-	"reflect"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/driusan/lang/compiler/hlir"
 	"github.com/driusan/lang/parser/ast"
 )
 
+// A Pointer is a register in another frame.
 type Pointer struct {
-	r   hlir.Register
-	ctx *Context
+	r  hlir.Register
+	fr *frame
 }
 
 func (p Pointer) String() string {
@@ -23,73 +26,173 @@ type Context struct {
 	Callables    ast.Callables
 	RegisterData map[string]hlir.RegisterData
 
-	// FIXME: This should probably be an io.ReadWriter instead
-	stdout, stderr *strings.Builder
+	// The standard input and outputs of programs run in the VM, and the
+	// files that they can open. By default, the input is the process's
+	// stdin, output is collected in memory, and files are on the host.
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+	FS             FileSystem
 
-	localValues        map[hlir.LocalValue]interface{}
-	funcRetVal         map[hlir.FuncRetVal]interface{}
-	lastFuncCallRetVal map[hlir.LastFuncCallRetVal]interface{}
-	tempValue          map[hlir.TempValue]interface{}
-	funcArg            map[hlir.FuncArg]interface{}
-	pointers           map[hlir.Pointer]Pointer
+	// The files which have been opened by the program, by descriptor.
+	files  map[int]File
+	nextFd int
+
+	// The frame that functions run with RunWithSideEffects or
+	// RunWithLimitedEffects use.
+	frame *frame
+
+	// The frames of the functions that are currently being called,
+	// which are reused for later calls at the same depth.
+	stack []*frame
+	depth int
+
+	// Limits on running a function with RunWithSideEffects or
+	// RunWithLimitedEffects. MaxSteps is the number of instructions that
+	// can be run and MaxDepth is how deep calls can be nested, either of
+	// which is unlimited if it's 0. If Cancel is set, the function stops
+	// once it's done. When a limit is hit the function fails with a
+	// RuntimeError of kind LimitExceeded.
+	MaxSteps int
+	MaxDepth int
+	Cancel   context.Context
+
+	// If Hook is set, it's called before each instruction of a function
+	// run with RunWithSideEffects or RunWithLimitedEffects.
+	Hook Hook
+
+	// The bytecode for Funcs, by name. It's shared with clones.
+	code map[string]*function
+
+	// The number of instructions that can be run before the limits need
+	// to be checked again, and the number of the MaxSteps that haven't
+	// been given out yet.
+	steps, remaining int
 }
 
 func (c *Context) String() string {
-	return fmt.Sprintf("\tLocalValues: %v\n\tFuncRetVals: %v\n\tLastFuncCallRetVals: %v\n\tTempValues: %v\n\tFuncArgs: %v\n\tPointers: %v\n", c.localValues, c.funcRetVal, c.lastFuncCallRetVal, c.tempValue, c.funcArg, c.pointers)
+	return c.frame.String()
 }
+
 func NewContext() *Context {
 	c := &Context{}
-	c.stdout = &strings.Builder{}
-	c.stderr = &strings.Builder{}
+	c.Stdin = os.Stdin
+	c.Stdout = &strings.Builder{}
+	c.Stderr = &strings.Builder{}
+	c.FS = HostFS{}
 	c.RegisterData = make(map[string]hlir.RegisterData)
-
-	// One map for each register type's value in the current context
-	c.localValues = make(map[hlir.LocalValue]interface{})
-	c.funcRetVal = make(map[hlir.FuncRetVal]interface{})
-	c.lastFuncCallRetVal = make(map[hlir.LastFuncCallRetVal]interface{})
-	c.tempValue = make(map[hlir.TempValue]interface{})
-	c.funcArg = make(map[hlir.FuncArg]interface{})
-	c.pointers = make(map[hlir.Pointer]Pointer)
+	c.frame = &frame{}
+	c.code = make(map[string]*function)
+	c.MaxDepth = DefaultMaxDepth
 	return c
 }
 
+// Clone returns a Context which runs the same functions with the same
+// input, output, filesystem, limits and hook as c, but with its own registers and
+// open files.
 func (c *Context) Clone() *Context {
 	return &Context{
 		Funcs:        c.Funcs,
 		Callables:    c.Callables,
 		RegisterData: c.RegisterData,
 
-		stdout: c.stdout,
-		stderr: c.stderr,
+		Stdin:  c.Stdin,
+		Stdout: c.Stdout,
+		Stderr: c.Stderr,
+		FS:     c.FS,
 
-		localValues:        c.localValues,
-		funcRetVal:         c.funcRetVal,
-		lastFuncCallRetVal: c.lastFuncCallRetVal,
-		tempValue:          c.tempValue,
-		funcArg:            c.funcArg,
-		pointers:           c.pointers,
+		MaxSteps: c.MaxSteps,
+		MaxDepth: c.MaxDepth,
+		Cancel:   c.Cancel,
+		Hook:     c.Hook,
+
+		frame: &frame{},
+		code:  c.code,
+	}
+}
+
+// SetArgs sets the arguments of the next function run with c to args, as
+// a []string. It's for running a main function declared as main(args
+// []string), whose first argument is the name of the program.
+func (c *Context) SetArgs(args []string) {
+	// Put the strings in a frame of their own, so that they're passed
+	// the same way as a slice from any other call.
+	env := &frame{}
+	for i, s := range args {
+		env.set(classLocal, 2*i, intValue(len(s)))
+		env.set(classLocal, 2*i+1, stringValue(s))
 	}
+	c.frame.setPointer(hlir.Pointer{hlir.FuncArg{Id: 1}}, Pointer{hlir.Pointer{hlir.LocalValue(0)}, env})
+	c.frame.set(classArg, 0, intValue(len(args)))
 }
 
 func (c *Context) SetRegister(r hlir.Register, val interface{}) error {
-	switch reg := r.(type) {
-	case hlir.LocalValue:
-		c.localValues[reg] = val
-	case hlir.FuncRetVal:
-		c.funcRetVal[reg] = val
-	case hlir.TempValue:
-		c.tempValue[reg] = val
-	case hlir.FuncArg:
-		c.funcArg[reg] = val
-	case hlir.Offset:
-		off, nctx := resolveOffset(reg, c)
-		nctx.SetRegister(off, val)
+	setRegister(r, valueOf(val), c.frame)
+	return nil
+}
+
+// Returns the value of a Go value in the VM.
+func valueOf(val interface{}) value {
+	switch v := val.(type) {
+	case int:
+		return intValue(v)
+	case bool:
+		return boolValue(v)
+	case byte:
+		return byteValue(v)
+	case string:
+		return stringValue(v)
+	case nil:
+		return value{}
 	default:
-		panic(fmt.Sprintf("Unhandled register type: %v", reflect.TypeOf(r).Name()))
+		panic(fmt.Sprintf("Unhandled value type: %T", val))
 	}
-	return nil
 }
 
 func (c *Context) writeStderr(msg string) {
-	fmt.Fprintf(c.stderr, "%s", msg)
+	fmt.Fprintf(c.Stderr, "%s", msg)
+}
+
+// Returns a reader for what was written to w, if it keeps it.
+func output(w io.Writer) io.Reader {
+	if s, ok := w.(fmt.Stringer); ok {
+		return strings.NewReader(s.String())
+	}
+	return strings.NewReader("")
+}
+
+// Adds f to the open files and returns its descriptor.
+func (c *Context) addFile(f File) int {
+	if c.files == nil {
+		c.files = make(map[int]File)
+		c.nextFd = 3
+	}
+	fd := c.nextFd
+	c.nextFd++
+	c.files[fd] = f
+	return fd
+}
+
+// Returns what writes to the file descriptor fd go to.
+func (c *Context) writer(fd int) (io.Writer, error) {
+	switch fd {
+	case 1:
+		return c.Stdout, nil
+	case 2:
+		return c.Stderr, nil
+	}
+	if f, ok := c.files[fd]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("Write to bad file descriptor %d", fd)
+}
+
+// Returns what reads from the file descriptor fd come from.
+func (c *Context) reader(fd int) (io.Reader, error) {
+	if fd == 0 {
+		return c.Stdin, nil
+	}
+	if f, ok := c.files[fd]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("Read from bad file descriptor %d", fd)
 }
@@ -0,0 +1,175 @@
+package vm
+
+import (
+	"sort"
+)
+
+// A BlockKind is the kind of code that a block is.
+type BlockKind uint8
+
+const (
+	// A statement of the source.
+	StatementBlock BlockKind = iota
+
+	// The body of an IF, the body of its ELSE, a case of a JumpTable and
+	// the body of a LOOP.
+	IfBlock
+	ElseBlock
+	CaseBlock
+	LoopBlock
+)
+
+func (k BlockKind) String() string {
+	switch k {
+	case StatementBlock:
+		return "statement"
+	case IfBlock:
+		return "if"
+	case ElseBlock:
+		return "else"
+	case CaseBlock:
+		return "case"
+	case LoopBlock:
+		return "loop"
+	}
+	return "unknown"
+}
+
+// A block is a statement or body of code in a function whose coverage is
+// recorded.
+type block struct {
+	kind BlockKind
+
+	// The first instruction of the block, which runs whenever the block
+	// does.
+	pc int
+
+	// The lines of the source that the block starts and ends on.
+	line, end int
+}
+
+// A CoverBlock is a statement or body of code in a function, and the number
+// of times it ran.
+type CoverBlock struct {
+	Func string
+	Kind BlockKind
+
+	// The lines of the source that the block starts and ends on, or 0 if
+	// they aren't known.
+	Line, EndLine int
+
+	Count int64
+}
+
+// A FuncCoverage is the coverage of a function.
+type FuncCoverage struct {
+	Func string
+
+	// The first line of the source that the function has code on.
+	Line int
+
+	// The number of blocks that the function has, and the number of them
+	// that ran.
+	Blocks, Covered int
+}
+
+// Percent returns the percentage of the function's blocks that ran. A
+// function without any blocks is fully covered.
+func (f FuncCoverage) Percent() float64 {
+	if f.Blocks == 0 {
+		return 100
+	}
+	return 100 * float64(f.Covered) / float64(f.Blocks)
+}
+
+// A Coverage records which statements of the functions in a Context, and
+// which bodies of their IFs, ELSEs, JumpTable cases and LOOPs, ran.
+type Coverage struct {
+	fns map[string]*function
+
+	// The number of times that each instruction of each function ran.
+	counts map[string][]int64
+}
+
+// NewCoverage returns a Coverage of the functions in ctx which nothing has
+// run in yet.
+func NewCoverage(ctx *Context) *Coverage {
+	ctx.checkCode()
+	c := &Coverage{
+		fns:    make(map[string]*function),
+		counts: make(map[string][]int64),
+	}
+	for name := range ctx.Funcs {
+		fn := ctx.function(name)
+		c.fns[name] = fn
+		c.counts[name] = make([]int64, len(fn.code))
+	}
+	return c
+}
+
+// Attach sets the Hook of ctx to one which adds what's run with ctx to c,
+// and then calls the Hook that ctx already had, if any. ctx must be the
+// Context that c was made with or a Clone of it, and each Clone must be
+// attached separately.
+func (c *Coverage) Attach(ctx *Context) {
+	next := ctx.Hook
+	ctx.Hook = func(ctx *Context) error {
+		f := ctx.Frame(0)
+		// Anything that's changed since c was made isn't covered.
+		if fn := f.fr.fn; c.fns[fn.name] == fn {
+			c.counts[fn.name][f.PC()]++
+		}
+		if next != nil {
+			return next(ctx)
+		}
+		return nil
+	}
+}
+
+// Blocks returns the blocks of every function in c, in order of their
+// functions' names and then of where they start.
+func (c *Coverage) Blocks() []CoverBlock {
+	var blocks []CoverBlock
+	for _, name := range c.names() {
+		fn := c.fns[name]
+		for _, b := range fn.blocks {
+			blocks = append(blocks, CoverBlock{
+				Func:    name,
+				Kind:    b.kind,
+				Line:    b.line,
+				EndLine: b.end,
+				Count:   c.counts[name][b.pc],
+			})
+		}
+	}
+	return blocks
+}
+
+// Functions returns the coverage of every function in c, in order of their
+// names.
+func (c *Coverage) Functions() []FuncCoverage {
+	var fns []FuncCoverage
+	for _, name := range c.names() {
+		fc := FuncCoverage{Func: name}
+		for _, b := range c.fns[name].blocks {
+			if b.line > 0 && (fc.Line == 0 || b.line < fc.Line) {
+				fc.Line = b.line
+			}
+			fc.Blocks++
+			if c.counts[name][b.pc] > 0 {
+				fc.Covered++
+			}
+		}
+		fns = append(fns, fc)
+	}
+	return fns
+}
+
+func (c *Coverage) names() []string {
+	names := make([]string, 0, len(c.fns))
+	for name := range c.fns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
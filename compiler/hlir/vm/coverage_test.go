@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/driusan/lang/compiler/hlir/opt"
+)
+
+const coverageProgram = `func kind(n int) (int) {
+	match n {
+	case 1:
+		return 10
+	case 2:
+		return 20
+	}
+	return 0
+}
+
+func count(n int) (int) {
+	mutable i = 0
+	while i < n {
+		if i > 5 {
+			return i
+		}
+		i = i + 1
+	}
+	return i
+}
+
+func unused() (int) {
+	return 3
+}
+
+func TestAll() () {
+	assert(kind(1) == 10)
+	assert(count(3) == 3)
+}
+`
+
+func TestCoverage(t *testing.T) {
+	// Keep the branches from being folded away.
+	def := opt.Default
+	opt.Default = opt.NewManager(opt.O0)
+	ctx, err := Parse(coverageProgram)
+	opt.Default = def
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cov := NewCoverage(ctx)
+	for i := 0; i < 2; i++ {
+		m := ctx.Clone()
+		cov.Attach(m)
+		if _, _, err := RunWithSideEffects("TestAll", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var blocks []string
+	for _, b := range cov.Blocks() {
+		if b.Func == "TestAll" {
+			continue
+		}
+		blocks = append(blocks, fmt.Sprintf("%v %v %d-%d: %d", b.Func, b.Kind, b.Line, b.EndLine, b.Count))
+	}
+	// The while statement starts with its condition, which runs before
+	// each iteration and once more to stop.
+	expected := []string{
+		"count statement 12-12: 2",
+		"count statement 13-13: 8",
+		"count loop 14-17: 6",
+		"count statement 14-14: 6",
+		"count if 15-15: 0",
+		"count statement 15-15: 0",
+		"count statement 17-17: 6",
+		"count statement 19-19: 2",
+		"kind statement 2-2: 2",
+		"kind case 4-4: 2",
+		"kind statement 4-4: 2",
+		"kind case 6-6: 0",
+		"kind statement 6-6: 0",
+		"kind statement 8-8: 0",
+		"unused statement 23-23: 0",
+	}
+	if !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("Unexpected blocks: got %q want %q", blocks, expected)
+	}
+
+	var fns []string
+	for _, f := range cov.Functions() {
+		fns = append(fns, fmt.Sprintf("%v %d %d/%d %.1f", f.Func, f.Line, f.Covered, f.Blocks, f.Percent()))
+	}
+	expected = []string{
+		"TestAll 27 2/2 100.0",
+		"count 12 6/8 75.0",
+		"kind 2 3/6 50.0",
+		"unused 23 0/1 0.0",
+	}
+	if !reflect.DeepEqual(fns, expected) {
+		t.Errorf("Unexpected functions: got %q want %q", fns, expected)
+	}
+}
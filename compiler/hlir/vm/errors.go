@@ -0,0 +1,271 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// An ErrorKind is the type of failure that stopped a program in the VM.
+type ErrorKind uint8
+
+const (
+	// A failure that isn't the fault of anything in particular that the
+	// program did, such as a register being used before it was set or
+	// a call to a function with effects that aren't allowed.
+	InternalError ErrorKind = iota
+
+	// An assert whose condition was false.
+	AssertionFailure
+
+	// An index outside of the bounds of an array, slice or string.
+	BadIndex
+
+	// A division or modulo by zero.
+	DivisionByZero
+
+	// A failure of a builtin to do I/O, such as opening a file that
+	// doesn't exist.
+	IOError
+
+	// Running out of steps, calls nested too deep, or cancellation.
+	LimitExceeded
+)
+
+var errorKindNames = [...]string{
+	InternalError:    "internal error",
+	AssertionFailure: "assertion failure",
+	BadIndex:         "bad index",
+	DivisionByZero:   "division by zero",
+	IOError:          "I/O error",
+	LimitExceeded:    "limit exceeded",
+}
+
+func (k ErrorKind) String() string {
+	if int(k) < len(errorKindNames) {
+		return errorKindNames[k]
+	}
+	return fmt.Sprintf("ErrorKind(%d)", k)
+}
+
+// A RuntimeError is returned when a program being run by the VM fails.
+type RuntimeError struct {
+	Kind ErrorKind
+
+	// What went wrong.
+	Err error
+
+	// The calls that were being made when it went wrong, with the function
+	// that it happened in first.
+	Stack []StackFrame
+}
+
+// A StackFrame is a call that was being made when a RuntimeError happened.
+type StackFrame struct {
+	Func string
+
+	// The line of the source that the function was at, or 0 if it's not
+	// known.
+	Line int
+
+	// The arguments that the function was called with.
+	Args []NamedValue
+}
+
+// A NamedValue is the value of a variable in the source, formatted for
+// printing.
+type NamedValue struct {
+	Name  string
+	Value string
+}
+
+func (e *RuntimeError) Error() string {
+	if len(e.Stack) == 0 || e.Stack[0].Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("line %d: %v", e.Stack[0].Line, e.Err)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Traceback returns the stack of e formatted for printing, with each call on
+// one line followed by where it was on the next. pos formats the line of the
+// source that a call was at. If pos is nil, it's printed as a line number.
+func (e *RuntimeError) Traceback(pos func(line int) string) string {
+	if pos == nil {
+		pos = func(line int) string {
+			return fmt.Sprintf("line %d", line)
+		}
+	}
+	var b strings.Builder
+	for _, f := range e.Stack {
+		args := make([]string, len(f.Args))
+		for i, a := range f.Args {
+			args[i] = a.Name + "=" + a.Value
+		}
+		fmt.Fprintf(&b, "%s(%s)\n", f.Func, strings.Join(args, ", "))
+		if f.Line > 0 {
+			fmt.Fprintf(&b, "\t%s\n", pos(f.Line))
+		}
+	}
+	return b.String()
+}
+
+// A fault is an error of a known kind that hasn't had the stack that it
+// happened in added yet.
+type fault struct {
+	kind ErrorKind
+	err  error
+}
+
+func (f fault) Error() string {
+	return f.err.Error()
+}
+
+var errDivisionByZero = fault{DivisionByZero, errors.New("integer divide by zero")}
+
+// Panics with a BadIndex fault.
+func badIndex(format string, args ...interface{}) {
+	panic(fault{BadIndex, fmt.Errorf(format, args...)})
+}
+
+// Returns err as a RuntimeError, with the calls that ctx is making as its
+// stack. If err is already a RuntimeError, it's returned unchanged.
+func (ctx *Context) runtimeError(err error) *RuntimeError {
+	if re, ok := err.(*RuntimeError); ok {
+		return re
+	}
+	re := &RuntimeError{Kind: InternalError, Err: err, Stack: ctx.backtrace()}
+	switch e := err.(type) {
+	case fault:
+		re.Kind, re.Err = e.kind, e.err
+	case assertionError:
+		re.Kind = AssertionFailure
+	}
+	return re
+}
+
+// Returns the RuntimeError for the value r that a panic was recovered with.
+func (ctx *Context) recovered(r interface{}) *RuntimeError {
+	if err, ok := r.(error); ok {
+		return ctx.runtimeError(err)
+	}
+	return ctx.runtimeError(fmt.Errorf("%v", r))
+}
+
+// Returns the calls that ctx is making, innermost first.
+func (ctx *Context) backtrace() []StackFrame {
+	stack := make([]StackFrame, 0, ctx.depth+1)
+	for i := ctx.depth - 1; i >= 0; i-- {
+		stack = append(stack, ctx.stackFrame(ctx.stack[i]))
+	}
+	if ctx.frame.fn != nil {
+		stack = append(stack, ctx.stackFrame(ctx.frame))
+	}
+	return stack
+}
+
+func (ctx *Context) stackFrame(fr *frame) StackFrame {
+	return StackFrame{
+		Func: fr.fn.name,
+		Line: fr.line(),
+		Args: fr.arguments(),
+	}
+}
+
+// Returns the arguments that fr was called with, by their names in the
+// source.
+func (fr *frame) arguments() []NamedValue {
+	rd := fr.fn.rd
+	n := 0
+	for r := range rd {
+		if fa, ok := r.(hlir.FuncArg); ok && int(fa.Id) >= n {
+			n = int(fa.Id) + 1
+		}
+	}
+
+	var args []NamedValue
+	for i := 0; i < n; {
+		// An argument in the source can be passed in more than one
+		// register, such as the length and base of a slice.
+		reg, info, ok := argument(rd, i)
+		if !ok {
+			i++
+			continue
+		}
+		regs := []hlir.Register{reg}
+		for i++; i < n; i++ {
+			next, ninfo, ok := argument(rd, i)
+			if !ok || ninfo.Variable.Name != info.Variable.Name {
+				break
+			}
+			regs = append(regs, next)
+		}
+		args = append(args, NamedValue{string(info.Variable.Name), formatVariable(info.Variable, regs, fr)})
+	}
+	return args
+}
+
+// Returns the register for FuncArg i in rd, and what it is.
+func argument(rd hlir.RegisterData, i int) (hlir.FuncArg, hlir.RegisterInfo, bool) {
+	for _, ref := range []bool{false, true} {
+		fa := hlir.FuncArg{Id: uint(i), Reference: ref}
+		if info, ok := rd[fa]; ok {
+			return fa, info, true
+		}
+	}
+	return hlir.FuncArg{}, hlir.RegisterInfo{}, false
+}
+
+// Formats the value of the variable v, which is in the registers regs of
+// fr. Anything which can't be read is printed as "?".
+func formatVariable(v ast.VarWithType, regs []hlir.Register, fr *frame) (s string) {
+	defer func() {
+		if r := recover(); r != nil {
+			s = "?"
+		}
+	}()
+	vals := make([]value, len(regs))
+	for i, r := range regs {
+		if _, ok := fr.pointers[hlir.Pointer{r}]; ok {
+			r = hlir.Pointer{r}
+		}
+		vals[i] = evalRegister(r, fr)
+	}
+
+	var typ ast.Type
+	if v.Typ != nil {
+		typ = v.Type()
+	}
+	switch t := typ.(type) {
+	case ast.SliceType, ast.ArrayType:
+		if len(vals) > 1 && vals[0] == intValue(len(vals)-1) {
+			// The length is followed by each element.
+			return formatValues(vals[1:])
+		}
+		if len(vals) == 2 {
+			return fmt.Sprintf("%v of length %v", t.TypeName(), vals[0])
+		}
+	}
+	if typ != nil && typ.TypeName() == "string" && len(vals) == 2 && vals[1].kind == kindString {
+		return fmt.Sprintf("%q", vals[1].s)
+	}
+	if len(vals) == 1 {
+		return vals[0].String()
+	}
+	return formatValues(vals)
+}
+
+// Formats vals as a list, such as "{1, 2}".
+func formatValues(vals []value) string {
+	strs := make([]string, len(vals))
+	for i, v := range vals {
+		strs[i] = v.String()
+	}
+	return "{" + strings.Join(strs, ", ") + "}"
+}
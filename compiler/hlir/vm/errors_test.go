@@ -0,0 +1,173 @@
+package vm
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/driusan/lang/compiler/hlir/opt"
+)
+
+const errorsProgram = `func divide(x int, y int) (int) {
+	let z = x / y
+	return z
+}
+
+func get(s []int, i int) (int) {
+	let v int = s[i]
+	return v
+}
+
+func DivideByZero() () -> affects(IO) {
+	let q = divide(3, 0)
+	PrintInt(q)
+}
+
+func BadSliceIndex() () -> affects(IO) {
+	let s []int = { 1, 2, 3 }
+	PrintInt(get(s, 5))
+}
+
+func BadArrayIndex() () -> affects(IO) {
+	let a [3]int = { 1, 2, 3 }
+	let i int = 4
+	let v int = a[i]
+	PrintInt(v)
+}
+
+func FailedAssertion() () -> affects(IO) {
+	let x = 3
+	assert(x > 3)
+}
+
+func GoodIndex() () -> affects(IO) {
+	let s []int = { 1, 2, 3 }
+	PrintInt(get(s, 2))
+}
+`
+
+// Runs fname in errorsProgram and returns the RuntimeError that it fails
+// with.
+func runtimeErrorOf(t *testing.T, ctx *Context, fname string) *RuntimeError {
+	t.Helper()
+	_, _, err := RunWithSideEffects(fname, ctx.Clone())
+	re, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("Unexpected error: got %v (%T) want a *RuntimeError", err, err)
+	}
+	return re
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	ctx, err := Parse(errorsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fname string
+		kind  ErrorKind
+		stack []StackFrame
+	}{
+		{
+			"DivideByZero",
+			DivisionByZero,
+			[]StackFrame{
+				{"divide", 2, []NamedValue{{"x", "3"}, {"y", "0"}}},
+				{"DivideByZero", 12, nil},
+			},
+		},
+		{
+			"BadSliceIndex",
+			BadIndex,
+			[]StackFrame{
+				{"get", 7, []NamedValue{{"s", "[]int of length 3"}, {"i", "5"}}},
+				{"BadSliceIndex", 18, nil},
+			},
+		},
+		{
+			"BadArrayIndex",
+			BadIndex,
+			[]StackFrame{
+				{"BadArrayIndex", 24, nil},
+			},
+		},
+		{
+			"FailedAssertion",
+			AssertionFailure,
+			[]StackFrame{
+				{"FailedAssertion", 30, nil},
+			},
+		},
+	}
+	for _, tc := range tests {
+		re := runtimeErrorOf(t, ctx, tc.fname)
+		if re.Kind != tc.kind {
+			t.Errorf("%v: unexpected kind: got %v want %v", tc.fname, re.Kind, tc.kind)
+		}
+		if !reflect.DeepEqual(re.Stack, tc.stack) {
+			t.Errorf("%v: unexpected stack: got %v want %v", tc.fname, re.Stack, tc.stack)
+		}
+	}
+}
+
+func TestUnusedDivisionByZero(t *testing.T) {
+	// The result isn't used, but the division still fails when it's
+	// optimized.
+	def := opt.Default
+	defer func() { opt.Default = def }()
+	for _, level := range []opt.Level{opt.O0, opt.O1, opt.O2} {
+		opt.Default = opt.NewManager(level)
+		ctx, err := Parse(`func main() () -> affects(IO) {
+	let z int = 5 / 0
+	PrintInt(1)
+}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if re := runtimeErrorOf(t, ctx, "main"); re.Kind != DivisionByZero {
+			t.Errorf("O%d: unexpected kind: got %v want %v", level, re.Kind, DivisionByZero)
+		}
+	}
+}
+
+func TestGoodIndex(t *testing.T) {
+	ctx, err := Parse(errorsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, _, err := RunWithSideEffects("GoodIndex", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(stdout); string(got) != "3" {
+		t.Errorf("Unexpected stdout: got %q want %q", got, "3")
+	}
+}
+
+func TestUndefinedFunction(t *testing.T) {
+	ctx, err := Parse(errorsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(ctx.Funcs, "divide")
+	re := runtimeErrorOf(t, ctx, "DivideByZero")
+	if re.Kind != InternalError {
+		t.Errorf("Unexpected kind: got %v want %v", re.Kind, InternalError)
+	}
+	if len(re.Stack) != 1 || re.Stack[0].Func != "DivideByZero" || re.Stack[0].Line != 12 {
+		t.Errorf("Unexpected stack: got %v", re.Stack)
+	}
+}
+
+func TestTraceback(t *testing.T) {
+	re := &RuntimeError{
+		Stack: []StackFrame{
+			{"divide", 2, []NamedValue{{"x", "3"}, {"y", "0"}}},
+			{"main", 0, nil},
+		},
+	}
+	expected := "divide(x=3, y=0)\n\tline 2\nmain()\n"
+	if got := re.Traceback(nil); got != expected {
+		t.Errorf("Unexpected traceback: got %q want %q", got, expected)
+	}
+}
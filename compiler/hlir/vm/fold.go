@@ -0,0 +1,284 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/compiler/hlir/opt"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// DefaultFuel is the number of opcodes that a call evaluated at compile time
+// can run before it's given up on.
+const DefaultFuel = 100000
+
+// A Fold is a function call which was replaced by the values it returned
+// at compile time.
+type Fold struct {
+	// The function that made the call.
+	Caller string
+
+	// The function that was called and the arguments it was called with.
+	Callee string
+	Args   []hlir.Register
+
+	// The values that the call returned.
+	Result []hlir.Register
+}
+
+func (f Fold) String() string {
+	args := make([]string, 0, len(f.Args))
+	for _, a := range f.Args {
+		args = append(args, fmt.Sprint(a))
+	}
+	results := make([]string, 0, len(f.Result))
+	for _, r := range f.Result {
+		results = append(results, fmt.Sprint(r))
+	}
+	return fmt.Sprintf("%v: folded %v(%v) to %v", f.Caller, f.Callee, strings.Join(args, ", "), strings.Join(results, ", "))
+}
+
+// FoldCalls evaluates the calls in ctx.Funcs to functions without effects
+// whose arguments are all literals, and replaces each call with the values
+// that it returned.
+//
+// Each call can run at most fuel opcodes. A call which runs out of fuel, has
+// an effect, or returns something other than an integer or bool is left
+// alone.
+func (ctx *Context) FoldCalls(fuel int) []Fold {
+	names := make([]string, 0, len(ctx.Funcs))
+	for name := range ctx.Funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var folds []Fold
+	for _, name := range names {
+		// Folding a call can make the arguments of another call
+		// literals, so keep going until nothing changes.
+		for {
+			f := ctx.Funcs[name]
+			fs := &funcFolds{
+				name:    name,
+				used:    usedCallValues(f.Body),
+				results: make(map[uint][]hlir.Register),
+			}
+			body := ctx.foldBlock(f.Body, fs, fuel)
+			if len(fs.folds) == 0 {
+				break
+			}
+			f.Body = hlir.ReplaceRegisters(body, func(r hlir.Register) hlir.Register {
+				if cv, ok := r.(hlir.LastFuncCallRetVal); ok {
+					if vals, ok := fs.results[cv.CallNum]; ok {
+						return vals[cv.RetNum]
+					}
+				}
+				return r
+			})
+			ctx.Funcs[name] = f
+			folds = append(folds, fs.folds...)
+		}
+	}
+	return folds
+}
+
+// The state of folding the calls in a single function.
+type funcFolds struct {
+	name string
+
+	// The values returned by each call which are used by the function,
+	// by call number.
+	used map[uint][]uint
+
+	// The values that uses of each folded call get replaced with, by
+	// call number.
+	results map[uint][]hlir.Register
+
+	folds []Fold
+}
+
+// Folds the calls in ops and the blocks nested in it, and returns the ops
+// with the folded calls removed.
+func (ctx *Context) foldBlock(ops []hlir.Opcode, fs *funcFolds, fuel int) []hlir.Opcode {
+	if ops == nil {
+		return nil
+	}
+	newops := make([]hlir.Opcode, 0, len(ops))
+	for _, op := range ops {
+		switch o := op.(type) {
+		case hlir.CALL:
+			if folded, ok := ctx.foldCall(o, fs, fuel); ok {
+				newops = append(newops, folded...)
+				continue
+			}
+		case hlir.IF:
+			o.ControlFlow = ctx.foldControlFlow(o.ControlFlow, fs, fuel)
+			o.ElseBody = ctx.foldBlock(o.ElseBody, fs, fuel)
+			op = o
+		case hlir.LOOP:
+			op = hlir.LOOP(ctx.foldControlFlow(hlir.ControlFlow(o), fs, fuel))
+		case hlir.JumpTable:
+			jt := make(hlir.JumpTable, 0, len(o))
+			for _, cf := range o {
+				jt = append(jt, ctx.foldControlFlow(cf, fs, fuel))
+			}
+			op = jt
+		case hlir.ASSERT:
+			o.Predicate.Body = ctx.foldBlock(o.Predicate.Body, fs, fuel)
+			op = o
+		}
+		newops = append(newops, op)
+	}
+	return newops
+}
+
+func (ctx *Context) foldControlFlow(cf hlir.ControlFlow, fs *funcFolds, fuel int) hlir.ControlFlow {
+	cf.Condition.Body = ctx.foldBlock(cf.Condition.Body, fs, fuel)
+	cf.Initializer = ctx.foldBlock(cf.Initializer, fs, fuel)
+	cf.Body = ctx.foldBlock(cf.Body, fs, fuel)
+	return cf
+}
+
+// Attempts to fold call. If it can be folded, the opcodes to replace it with
+// are returned.
+func (ctx *Context) foldCall(call hlir.CALL, fs *funcFolds, fuel int) ([]hlir.Opcode, bool) {
+	if !ctx.isFoldable(call) {
+		return nil, false
+	}
+
+	results, err := ctx.evaluateCall(call, fuel)
+	if err != nil {
+		return nil, false
+	}
+
+	fold := Fold{Caller: fs.name, Callee: string(call.FName), Args: call.Args, Result: results}
+	if call.TailCall {
+		// The callee would have set the return values of the caller.
+		var ops []hlir.Opcode
+		for i, r := range results {
+			ops = append(ops, hlir.MOV{Src: r, Dst: hlir.FuncRetVal(i)})
+		}
+		fs.folds = append(fs.folds, fold)
+		return ops, true
+	}
+	for _, n := range fs.used[call.CallNum] {
+		if n >= uint(len(results)) {
+			// Something uses a value that the call didn't return.
+			return nil, false
+		}
+	}
+	fs.results[call.CallNum] = results
+	fs.folds = append(fs.folds, fold)
+	return []hlir.Opcode{}, true
+}
+
+// Returns true if call is a call to a function without effects with only
+// literal arguments.
+func (ctx *Context) isFoldable(call hlir.CALL) bool {
+	if _, ok := ctx.Funcs[string(call.FName)]; !ok {
+		// Builtins
+		return false
+	}
+	decls := ctx.Callables[string(call.FName)]
+	if len(decls) != 1 {
+		return false
+	}
+	fd, ok := decls[0].(ast.FuncDecl)
+	if !ok || len(fd.Effects) > 0 {
+		return false
+	}
+	for _, arg := range fd.Args {
+		if arg.Reference {
+			return false
+		}
+	}
+	for _, arg := range call.Args {
+		switch arg.(type) {
+		case hlir.IntLiteral, hlir.StringLiteral:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Runs call in the VM without any effects allowed, and returns the values
+// that it returned as literals.
+func (ctx *Context) evaluateCall(call hlir.CALL, fuel int) (results []hlir.Register, err error) {
+	defer func() {
+		// Errors in running the function are returned, but lowering
+		// a function that the VM doesn't support to bytecode panics.
+		if r := recover(); r != nil {
+			results, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	cctx := NewContext()
+	cctx.Funcs = ctx.Funcs
+	cctx.Callables = ctx.Callables
+	cctx.RegisterData = ctx.RegisterData
+	cctx.MaxSteps = fuel
+
+	// As a tail call, the values that the callee returns are returned
+	// by the function making it, where they can be found afterwards.
+	call.TailCall = true
+	f := hlir.Func{Name: "fold", Body: []hlir.Opcode{call}}
+	if _, _, err := run(f, cctx, []ast.Effect{}); err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		v := cctx.frame.value(classRet, i)
+		switch v.kind {
+		case kindNone:
+			return results, nil
+		case kindInt, kindBool:
+			results = append(results, hlir.IntLiteral(v.n))
+		default:
+			return nil, fmt.Errorf("Can not fold value %v", v)
+		}
+	}
+}
+
+// Returns the return values of each call which are used in ops.
+func usedCallValues(ops []hlir.Opcode) map[uint][]uint {
+	used := make(map[uint][]uint)
+	hlir.ReplaceRegisters(ops, func(r hlir.Register) hlir.Register {
+		if cv, ok := r.(hlir.LastFuncCallRetVal); ok {
+			used[cv.CallNum] = append(used[cv.CallNum], cv.RetNum)
+		}
+		return r
+	})
+	return used
+}
+
+// foldPass is the optimization pass which folds calls with FoldCalls. It's
+// registered here rather than in package opt, since it runs the VM. Folding
+// a call can leave code that's unused, so it runs before dead code is
+// eliminated.
+type foldPass struct{}
+
+func init() {
+	opt.RegisterAfter(foldPass{}, opt.O1, "constfold")
+}
+
+func (foldPass) Name() string {
+	return "fold"
+}
+
+func (foldPass) Run(p *opt.Program) error {
+	machine := NewContext()
+	machine.Callables = p.Callables
+	machine.Funcs = make(map[string]hlir.Func)
+	for _, f := range p.Funcs {
+		machine.Funcs[f.Name] = f
+		machine.RegisterData[f.Name] = p.RegisterData[f.Name]
+	}
+	for _, f := range machine.FoldCalls(DefaultFuel) {
+		p.Remark("%v", f)
+	}
+	for i, f := range p.Funcs {
+		p.Funcs[i] = machine.Funcs[f.Name]
+	}
+	return nil
+}
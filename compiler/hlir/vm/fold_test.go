@@ -0,0 +1,37 @@
+package vm
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/driusan/lang/compiler/hlir/opt"
+)
+
+func TestFoldTwoCallsInOneOpcode(t *testing.T) {
+	// Both calls are used by the same SUB, so the one being folded has to
+	// be told apart from the one before it, and so do the values they
+	// return when they're not folded.
+	const src = `func sq(x int) (int) {
+	return x * x
+}
+
+func main() () -> affects(IO) {
+	PrintInt(sq(2) - sq(5))
+}`
+	def := opt.Default
+	defer func() { opt.Default = def }()
+	for _, level := range []opt.Level{opt.O0, opt.O1, opt.O2} {
+		opt.Default = opt.NewManager(level)
+		ctx, err := Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, _, err := RunWithSideEffects("main", ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, _ := ioutil.ReadAll(stdout); string(out) != "-21" {
+			t.Errorf("O%d: unexpected stdout: got %s want -21", level, out)
+		}
+	}
+}
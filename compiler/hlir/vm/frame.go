@@ -0,0 +1,265 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/driusan/lang/compiler/hlir"
+)
+
+// A regClass is a type of register. Each class of register has its own
+// slots in a frame.
+type regClass uint8
+
+const (
+	classLocal regClass = iota
+	classTemp
+	classArg
+	classRet
+	classCallRet
+
+	// Values of registers that don't have a slot of their own, such as
+	// offsets or pointers, which are loaded by the bytecode before being
+	// used.
+	classScratch
+
+	// Literals used by the function. They're shared by every frame
+	// running the same function and must not be written to.
+	classConst
+
+	numClasses
+)
+
+type valueKind uint8
+
+const (
+	kindNone valueKind = iota
+	kindInt
+	kindBool
+	kindByte
+	kindString
+)
+
+// A value is the contents of a register in the VM.
+//
+// Values are comparable, and two values are equal if and only if they're
+// the same kind and hold the same thing, so n must be 0 for strings and s
+// must be empty for everything else.
+type value struct {
+	kind valueKind
+	n    int
+	s    string
+}
+
+func intValue(n int) value {
+	return value{kind: kindInt, n: n}
+}
+
+func boolValue(b bool) value {
+	if b {
+		return value{kind: kindBool, n: 1}
+	}
+	return value{kind: kindBool}
+}
+
+func byteValue(b byte) value {
+	return value{kind: kindByte, n: int(b)}
+}
+
+func stringValue(s string) value {
+	return value{kind: kindString, s: s}
+}
+
+// Returns the Go value of v, for formatting.
+func (v value) iface() interface{} {
+	switch v.kind {
+	case kindInt:
+		return v.n
+	case kindBool:
+		return v.n != 0
+	case kindByte:
+		return byte(v.n)
+	case kindString:
+		return v.s
+	default:
+		return nil
+	}
+}
+
+func (v value) String() string {
+	return fmt.Sprintf("%v", v.iface())
+}
+
+// Returns the int in v. It panics if v isn't an int.
+func (v value) int() int {
+	if v.kind != kindInt {
+		v.notInt()
+	}
+	return v.n
+}
+
+func (v value) notInt() {
+	panic(fmt.Sprintf("interface conversion: interface {} is %T, not int", v.iface()))
+}
+
+// Returns true if a condition whose register has the value v should be
+// taken. Anything other than false or the integer 0 is true.
+func (v value) truthy() bool {
+	switch v.kind {
+	case kindBool, kindInt:
+		return v.n != 0
+	default:
+		return true
+	}
+}
+
+// An operand is the slot of a register in a frame.
+type operand struct {
+	class regClass
+	idx   uint32
+}
+
+// Returns the register that o is the slot for.
+func (o operand) register() hlir.Register {
+	switch o.class {
+	case classLocal:
+		return hlir.LocalValue(o.idx)
+	case classTemp:
+		return hlir.TempValue(o.idx)
+	case classArg:
+		return hlir.FuncArg{Id: uint(o.idx)}
+	case classRet:
+		return hlir.FuncRetVal(o.idx)
+	default:
+		return nil
+	}
+}
+
+// A frame holds the registers of a function being run by the VM.
+type frame struct {
+	fn   *function
+	regs [numClasses][]value
+
+	// The instruction of fn being run.
+	pc int
+
+	// Registers which point to a register in another frame, such as
+	// reference parameters or slices.
+	pointers map[hlir.Pointer]Pointer
+}
+
+// Prepares fr to run fn. Any registers which were already set keep their
+// values, so that the arguments can be set before the function is known.
+func (fr *frame) enter(fn *function) {
+	fr.fn = fn
+	for c := regClass(0); c < classConst; c++ {
+		fr.regs[c] = grow(fr.regs[c], fn.slots[c])
+	}
+	fr.regs[classConst] = fn.consts
+}
+
+// Returns the line of the source that fr is at, or 0 if it's not known.
+func (fr *frame) line() int {
+	if fr.fn == nil || fr.pc >= len(fr.fn.lines) {
+		return 0
+	}
+	return fr.fn.lines[fr.pc]
+}
+
+// Clears every register in fr, so that it can be reused for another call.
+func (fr *frame) reset() {
+	fr.fn = nil
+	fr.pc = 0
+	for c := regClass(0); c < classConst; c++ {
+		s := fr.regs[c]
+		for i := range s {
+			s[i] = value{}
+		}
+		fr.regs[c] = s[:0]
+	}
+	fr.regs[classConst] = nil
+	if len(fr.pointers) > 0 {
+		for k := range fr.pointers {
+			delete(fr.pointers, k)
+		}
+	}
+}
+
+// Returns s extended to at least n values. The values past the end of a
+// slice are always zero, since reset clears them before truncating.
+func grow(s []value, n int) []value {
+	if len(s) >= n {
+		return s
+	}
+	if cap(s) >= n {
+		return s[:n]
+	}
+	ns := make([]value, n, n+n/2)
+	copy(ns, s)
+	return ns
+}
+
+// Returns the value in slot i of class c, or panics if it's not set.
+func (fr *frame) get(o operand) value {
+	v := fr.regs[o.class][o.idx]
+	if v.kind == kindNone {
+		fr.missing(o)
+	}
+	return v
+}
+
+// Like get, but for slots which may be outside of the frame.
+func (fr *frame) load(o operand) value {
+	if int(o.idx) >= len(fr.regs[o.class]) {
+		fr.missing(o)
+	}
+	return fr.get(o)
+}
+
+func (fr *frame) missing(o operand) {
+	r := o.register()
+	switch o.class {
+	case classLocal:
+		panic(fmt.Sprintf("No variable named %v", r))
+	case classTemp:
+		panic(fmt.Sprintf("Unknown temp value: %v", r))
+	case classArg:
+		panic(fmt.Sprintf("Unknown FuncArg: %v", r))
+	case classCallRet:
+		for cv, idx := range fr.fn.callRets {
+			if idx == o.idx {
+				r = cv
+			}
+		}
+		panic(fmt.Sprintf("Unknown function return value %v (Known: %v)", r, fr.regs[classCallRet]))
+	default:
+		panic(fmt.Sprintf("Unset register %v", r))
+	}
+}
+
+// Sets slot i of class c to v, growing the frame if needed.
+func (fr *frame) set(c regClass, i int, v value) {
+	if i >= len(fr.regs[c]) {
+		fr.regs[c] = grow(fr.regs[c], i+1)
+	}
+	fr.regs[c][i] = v
+}
+
+// Returns the value in slot i of class c, which is the zero value if it's
+// not set.
+func (fr *frame) value(c regClass, i int) value {
+	if i >= len(fr.regs[c]) {
+		return value{}
+	}
+	return fr.regs[c][i]
+}
+
+func (fr *frame) setPointer(p hlir.Pointer, dst Pointer) {
+	if fr.pointers == nil {
+		fr.pointers = make(map[hlir.Pointer]Pointer)
+	}
+	fr.pointers[p] = dst
+}
+
+func (fr *frame) String() string {
+	return fmt.Sprintf("\tLocalValues: %v\n\tFuncRetVals: %v\n\tLastFuncCallRetVals: %v\n\tTempValues: %v\n\tFuncArgs: %v\n\tPointers: %v\n", fr.regs[classLocal], fr.regs[classRet], fr.regs[classCallRet], fr.regs[classTemp], fr.regs[classArg], fr.pointers)
+}
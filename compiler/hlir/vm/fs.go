@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// A File is a file opened by a program running in the VM.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// A FileSystem is the files that a program running in the VM can open with
+// the Open and Create builtins.
+type FileSystem interface {
+	// Opens the named file for reading.
+	Open(name string) (File, error)
+
+	// Creates the named file, truncating it if it already exists, and
+	// opens it for writing.
+	Create(name string) (File, error)
+}
+
+// HostFS is the filesystem of the host, with relative names resolved from the
+// working directory. It's what a Context uses unless told otherwise.
+type HostFS struct{}
+
+func (HostFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (HostFS) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+// DirFS is the files in a directory of the host. Names are relative to the
+// directory, and can't refer to anything outside of it.
+type DirFS string
+
+func (d DirFS) path(name string) string {
+	// Cleaning it as an absolute path removes any leading "..", so that
+	// it can't escape the directory.
+	return filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (d DirFS) Open(name string) (File, error) {
+	return os.Open(d.path(name))
+}
+
+func (d DirFS) Create(name string) (File, error) {
+	return os.Create(d.path(name))
+}
+
+// MemFS is a FileSystem whose files are only in memory, so that a program
+// can be run without touching the host.
+type MemFS struct {
+	files map[string][]byte
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string][]byte)}
+}
+
+// WriteFile sets the contents of the named file, creating it if it doesn't
+// exist.
+func (m *MemFS) WriteFile(name string, data []byte) {
+	m.files[path.Clean(name)] = append([]byte(nil), data...)
+}
+
+// ReadFile returns the contents of the named file.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	data, ok := m.files[path.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	data, ok := m.files[path.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{r: bytes.NewReader(data)}, nil
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	name = path.Clean(name)
+	m.files[name] = []byte{}
+	return &memFile{fs: m, name: name}, nil
+}
+
+// A memFile is a file in a MemFS. It's either open for reading from r, or
+// for writing to the file called name in fs.
+type memFile struct {
+	r *bytes.Reader
+
+	fs   *MemFS
+	name string
+
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.r == nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	return f.r.Read(p)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.fs == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.fs.files[f.name] = append(f.fs.files[f.name], p...)
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
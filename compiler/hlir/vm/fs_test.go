@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/driusan/lang/parser/sampleprograms"
+)
+
+// Runs main in prog with the input, output and filesystem set up by setup,
+// and returns what it wrote to stdout.
+func runWithIO(t *testing.T, prog string, setup func(*Context)) string {
+	t.Helper()
+	ctx, err := Parse(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout strings.Builder
+	ctx.Stdout = &stdout
+	setup(ctx)
+	if _, _, err := RunWithSideEffects("main", ctx); err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String()
+}
+
+func TestMemFSRead(t *testing.T) {
+	fs := NewMemFS()
+	fs.WriteFile("foo.txt", []byte("Hello, world!"))
+	got := runWithIO(t, sampleprograms.ReadSyscall, func(ctx *Context) {
+		ctx.FS = fs
+	})
+	if got != "Hello," {
+		t.Errorf("Unexpected stdout: got %q want %q", got, "Hello,")
+	}
+}
+
+func TestMemFSCreate(t *testing.T) {
+	fs := NewMemFS()
+	runWithIO(t, sampleprograms.CreateSyscall, func(ctx *Context) {
+		ctx.FS = fs
+	})
+	content, err := fs.ReadFile("foo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "Hello\n" {
+		t.Errorf("Unexpected content of foo.txt: got %q want %q", content, "Hello\n")
+	}
+}
+
+func TestMemFSNotExist(t *testing.T) {
+	ctx, err := Parse(sampleprograms.ReadSyscall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.FS = NewMemFS()
+	_, _, err = RunWithSideEffects("main", ctx)
+	if re, ok := err.(*RuntimeError); !ok || re.Kind != IOError || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error: got %v want a file not existing", err)
+	}
+}
+
+func TestDirFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "langtestDirFS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// foo.txt is opened relative to dir, and .. can't leave it.
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("Goodbye"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	got := runWithIO(t, strings.Replace(sampleprograms.ReadSyscall, "foo.txt", "../../foo.txt", 1), func(ctx *Context) {
+		ctx.FS = DirFS(dir)
+	})
+	if got != "Goodby" {
+		t.Errorf("Unexpected stdout: got %q want %q", got, "Goodby")
+	}
+}
+
+func TestStdin(t *testing.T) {
+	got := runWithIO(t, `
+func main () () -> affects(IO, Filesystem) {
+	mutable dta []byte = {0, 1, 2}
+	let n = Read(0, dta)
+	PrintByteSlice(dta)
+	PrintInt(n)
+}`, func(ctx *Context) {
+		ctx.Stdin = strings.NewReader("abcdef")
+	})
+	if got != "abc3" {
+		t.Errorf("Unexpected stdout: got %q want %q", got, "abc3")
+	}
+}
+
+func TestArgsAndStdin(t *testing.T) {
+	got := runWithIO(t, `
+func main (args []string) () -> affects(IO, Filesystem) {
+	for i, arg in args {
+		PrintInt(i)
+		PrintString(arg)
+	}
+	mutable dta []byte = {0, 1, 2}
+	let n = Read(0, dta)
+	PrintByteSlice(dta)
+	PrintInt(n)
+}`, func(ctx *Context) {
+		ctx.SetArgs([]string{"prog", "foo", "bar"})
+		ctx.Stdin = strings.NewReader("xyz")
+	})
+	if want := "0prog1foo2barxyz3"; got != want {
+		t.Errorf("Unexpected stdout: got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// A Hook is called by the VM before it runs each instruction of a program,
+// with the Context that the program is being run with. It can look at the
+// calls that the program is making with the Depth and Frame methods of the
+// Context. If it returns an error, the program stops with a RuntimeError for
+// it.
+type Hook func(ctx *Context) error
+
+// A Frame is a call that a program being run by the VM is making. It's only
+// valid until the Hook that it was looked at by returns.
+type Frame struct {
+	fr *frame
+}
+
+// Depth returns the number of calls that the program being run with ctx is
+// making, including the function that it was run with.
+func (ctx *Context) Depth() int {
+	return ctx.depth + 1
+}
+
+// Frame returns the ith call that the program being run with ctx is making,
+// counting from the innermost, which is 0. i must be less than ctx.Depth().
+func (ctx *Context) Frame(i int) Frame {
+	if i == ctx.depth {
+		return Frame{ctx.frame}
+	}
+	return Frame{ctx.stack[ctx.depth-1-i]}
+}
+
+// Func returns the name of the function that f is a call to.
+func (f Frame) Func() string {
+	return f.fr.fn.name
+}
+
+// Line returns the line of the source that f is at, or 0 if it's not known.
+func (f Frame) Line() int {
+	return f.fr.line()
+}
+
+// PC returns the index of the instruction that f is at in its function.
+func (f Frame) PC() int {
+	return f.fr.pc
+}
+
+// Args returns the arguments that f was called with, by their names in the
+// source.
+func (f Frame) Args() []NamedValue {
+	return f.fr.arguments()
+}
+
+// Locals returns the variables declared by the function of f which have
+// been set, by their names in the source. If more than one variable has the
+// same name, only the one declared last is returned.
+func (f Frame) Locals() []NamedValue {
+	return f.fr.locals()
+}
+
+// Matches the suffix of the name of a register holding part of a variable
+// other than its first one, such as an element of an array.
+var elementSuffix = regexp.MustCompile(`\[[0-9]+\]$`)
+
+// Registers of variables which the compiler declares itself are named after
+// the keyword that they're for, which can't be the name of a variable in
+// the source.
+var internalPrefixes = []string{"if.", "match.", "for."}
+
+func (fr *frame) locals() []NamedValue {
+	rd := fr.fn.rd
+	var lvs []hlir.LocalValue
+	for r := range rd {
+		if lv, ok := r.(hlir.LocalValue); ok {
+			lvs = append(lvs, lv)
+		}
+	}
+	sort.Slice(lvs, func(i, j int) bool { return lvs[i] < lvs[j] })
+
+	var locals []NamedValue
+	index := make(map[string]int)
+	for i := 0; i < len(lvs); {
+		// The registers of a variable are allocated one after the
+		// other, and named after it.
+		name := variableName(rd[lvs[i]])
+		regs := []hlir.Register{lvs[i]}
+		var v ast.VarWithType
+		for i++; i < len(lvs) && lvs[i] == lvs[i-1]+1 && variableName(rd[lvs[i]]) == name; i++ {
+			regs = append(regs, lvs[i])
+		}
+		for _, r := range regs {
+			if info := rd[r]; string(info.Variable.Name) == name {
+				v = info.Variable
+				break
+			}
+		}
+		if name == "" || isInternal(name) || fr.value(classLocal, int(regs[0].(hlir.LocalValue))).kind == kindNone {
+			continue
+		}
+		nv := NamedValue{name, formatVariable(v, regs, fr)}
+		if j, ok := index[name]; ok {
+			locals[j] = nv
+			continue
+		}
+		index[name] = len(locals)
+		locals = append(locals, nv)
+	}
+	return locals
+}
+
+// Returns the name in the source of the variable that the register with
+// info is part of.
+func variableName(info hlir.RegisterInfo) string {
+	return elementSuffix.ReplaceAllString(string(info.Variable.Name), "")
+}
+
+func isInternal(name string) bool {
+	for _, p := range internalPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
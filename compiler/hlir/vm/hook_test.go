@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/driusan/lang/compiler/hlir/opt"
+)
+
+const hookProgram = `func double(x int) (int) {
+	let y = x * 2
+	return y
+}
+
+func main() () -> affects(IO) {
+	let a = 3
+	let s string = "hi"
+	let arr []int = { 1, 2 }
+	let b = double(a)
+	PrintInt(b)
+}
+`
+
+func parseHookProgram(t *testing.T) *Context {
+	t.Helper()
+	// Keep the call to double from being folded.
+	def := opt.Default
+	opt.Default = opt.NewManager(opt.O0)
+	ctx, err := Parse(hookProgram)
+	opt.Default = def
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func TestHook(t *testing.T) {
+	ctx := parseHookProgram(t)
+	// The calls being made, args and locals at the start of each line.
+	var trace []string
+	lastDepth, lastLine := 0, 0
+	ctx.Hook = func(ctx *Context) error {
+		f := ctx.Frame(0)
+		if ctx.Depth() == lastDepth && f.Line() == lastLine {
+			return nil
+		}
+		lastDepth, lastLine = ctx.Depth(), f.Line()
+		var calls []string
+		for i := ctx.Depth() - 1; i >= 0; i-- {
+			calls = append(calls, ctx.Frame(i).Func())
+		}
+		trace = append(trace, fmt.Sprintf("%v:%d %v %v", calls, f.Line(), f.Args(), f.Locals()))
+		return nil
+	}
+	if _, _, err := RunWithSideEffects("main", ctx); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`[main]:7 [] []`,
+		`[main]:8 [] [{a 3}]`,
+		`[main]:9 [] [{a 3} {s "hi"}]`,
+		`[main]:10 [] [{a 3} {s "hi"} {arr {1, 2}}]`,
+		`[main double]:2 [{x 3}] []`,
+		`[main double]:3 [{x 3}] [{y 6}]`,
+		`[main]:10 [] [{a 3} {s "hi"} {arr {1, 2}}]`,
+		`[main]:11 [] [{a 3} {s "hi"} {arr {1, 2}} {b 6}]`,
+	}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Errorf("Unexpected trace:\ngot  %q\nwant %q", trace, expected)
+	}
+}
+
+func TestHookError(t *testing.T) {
+	ctx := parseHookProgram(t)
+	stop := errors.New("stopped")
+	ctx.Hook = func(ctx *Context) error {
+		if ctx.Depth() > 1 {
+			return stop
+		}
+		return nil
+	}
+	re := runtimeErrorOf(t, ctx, "main")
+	if !errors.Is(re, stop) {
+		t.Errorf("Unexpected error: got %v want %v", re, stop)
+	}
+	if len(re.Stack) != 2 || re.Stack[0].Func != "double" || re.Stack[0].Line != 2 {
+		t.Errorf("Unexpected stack: got %v", re.Stack)
+	}
+}
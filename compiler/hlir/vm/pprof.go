@@ -0,0 +1,168 @@
+package vm
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// WritePprof writes p to w as a gzipped profile.proto, the format read by
+// go tool pprof. Its samples count the instructions run and the calls made
+// by each stack of functions. pos gives the file and line in the file of a
+// line of the source. If pos is nil, the lines aren't in any file.
+func (p *Profile) WritePprof(w io.Writer, pos func(line int) (string, int)) error {
+	if pos == nil {
+		pos = func(line int) (string, int) {
+			return "", line
+		}
+	}
+	pb := &pprofBuilder{
+		strings:   map[string]int64{"": 0},
+		functions: make(map[string]uint64),
+		locations: make(map[callKey]uint64),
+		pos:       pos,
+	}
+	pb.strtab = []string{""}
+
+	instructions, calls, count := pb.str("instructions"), pb.str("calls"), pb.str("count")
+	for _, t := range [][2]int64{{instructions, count}, {calls, count}} {
+		var vt protobuf
+		vt.int(1, t[0])
+		vt.int(2, t[1])
+		pb.msg.bytes(1, vt)
+	}
+
+	var walk func(n *callNode, stack []uint64)
+	walk = func(n *callNode, stack []uint64) {
+		// The stack of the caller, with the line that this was
+		// called from.
+		if len(stack) > 0 {
+			stack[0] = pb.location(n.parent.fn, n.callLine)
+		}
+		if n.calls > 0 {
+			pb.sample(append([]uint64{pb.location(n.fn, n.entryLine)}, stack...), 0, n.calls)
+		}
+		for line, count := range n.self {
+			pb.sample(append([]uint64{pb.location(n.fn, line)}, stack...), count, 0)
+		}
+		for _, child := range n.children {
+			walk(child, append([]uint64{0}, stack...))
+		}
+	}
+	for _, child := range p.root.children {
+		walk(child, nil)
+	}
+
+	// The samples are already in msg, and the functions and locations
+	// are complete now that they've all been made.
+	pb.msg = append(pb.msg, pb.locs...)
+	pb.msg = append(pb.msg, pb.funcs...)
+	for _, s := range pb.strtab {
+		pb.msg.bytes(6, []byte(s))
+	}
+	pb.msg.int(14, instructions)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(pb.msg); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Builds a profile.proto message.
+type pprofBuilder struct {
+	msg, locs, funcs protobuf
+
+	strings map[string]int64
+	strtab  []string
+
+	functions map[string]uint64
+	locations map[callKey]uint64
+
+	pos func(line int) (string, int)
+}
+
+// Returns the index of s in the string table.
+func (pb *pprofBuilder) str(s string) int64 {
+	i, ok := pb.strings[s]
+	if !ok {
+		i = int64(len(pb.strtab))
+		pb.strings[s] = i
+		pb.strtab = append(pb.strtab, s)
+	}
+	return i
+}
+
+// Returns the id of the location of line in fn.
+func (pb *pprofBuilder) location(fn string, line int) uint64 {
+	k := callKey{fn, line}
+	if id, ok := pb.locations[k]; ok {
+		return id
+	}
+	file, fileLine := "", 0
+	if line > 0 {
+		file, fileLine = pb.pos(line)
+	}
+	fid, ok := pb.functions[fn]
+	if !ok {
+		fid = uint64(len(pb.functions) + 1)
+		pb.functions[fn] = fid
+		var f protobuf
+		f.uint(1, fid)
+		f.int(2, pb.str(fn))
+		f.int(3, pb.str(fn))
+		f.int(4, pb.str(file))
+		pb.funcs.bytes(5, f)
+	}
+
+	id := uint64(len(pb.locations) + 1)
+	pb.locations[k] = id
+	var l, ln protobuf
+	ln.uint(1, fid)
+	ln.int(2, int64(fileLine))
+	l.uint(1, id)
+	l.bytes(4, ln)
+	pb.locs.bytes(4, l)
+	return id
+}
+
+// Adds a sample with the values given to the profile.
+func (pb *pprofBuilder) sample(stack []uint64, instructions, calls int64) {
+	var s, ids, vals protobuf
+	for _, id := range stack {
+		ids.varint(id)
+	}
+	vals.varint(uint64(instructions))
+	vals.varint(uint64(calls))
+	s.bytes(1, ids)
+	s.bytes(2, vals)
+	pb.msg.bytes(2, s)
+}
+
+// A protobuf is an encoded protocol buffer message, which fields can be
+// appended to.
+type protobuf []byte
+
+func (b *protobuf) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protobuf) uint(field int, v uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+func (b *protobuf) int(field int, v int64) {
+	b.uint(field, uint64(v))
+}
+
+// Appends a field of wire type 2, such as a string, an embedded message or
+// a packed list of varints.
+func (b *protobuf) bytes(field int, v []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
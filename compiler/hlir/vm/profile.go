@@ -0,0 +1,278 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// A Profile counts the instructions run by programs in the VM, by the
+// function and line of the source that they're from and the calls that were
+// being made when they ran.
+type Profile struct {
+	// The calls that have been made, as a tree whose root is the
+	// functions run with RunWithSideEffects or RunWithLimitedEffects.
+	root callNode
+}
+
+// A callNode is a function called from a particular line of its caller,
+// with a particular chain of calls leading to the caller.
+type callNode struct {
+	fn     string
+	parent *callNode
+
+	// The line of the caller that the function was called from, and the
+	// line that it was at when it was first seen.
+	callLine, entryLine int
+
+	children map[callKey]*callNode
+	calls    int64
+
+	// The number of instructions run by the function itself, by line.
+	self map[int]int64
+}
+
+type callKey struct {
+	fn   string
+	line int
+}
+
+func (n *callNode) child(fn string, line int) *callNode {
+	k := callKey{fn, line}
+	c, ok := n.children[k]
+	if !ok {
+		if n.children == nil {
+			n.children = make(map[callKey]*callNode)
+		}
+		c = &callNode{fn: fn, parent: n, callLine: line, self: make(map[int]int64)}
+		n.children[k] = c
+	}
+	return c
+}
+
+// Returns the number of instructions run by the calls in the tree rooted at
+// n.
+func (n *callNode) total() int64 {
+	var t int64
+	for _, c := range n.self {
+		t += c
+	}
+	for _, c := range n.children {
+		t += c.total()
+	}
+	return t
+}
+
+// NewProfile returns an empty Profile.
+func NewProfile() *Profile {
+	return &Profile{}
+}
+
+// Attach sets the Hook of ctx to one which adds what's run with ctx to p, and
+// then calls the Hook that ctx already had, if any. Each Context must be
+// attached separately, even if it's a Clone of one that's already attached.
+func (p *Profile) Attach(ctx *Context) {
+	cur, depth := &p.root, 0
+	next := ctx.Hook
+	ctx.Hook = func(ctx *Context) error {
+		d := ctx.Depth()
+		f := ctx.Frame(0)
+		switch {
+		case d == depth+1:
+			// Every call runs at least one instruction before
+			// anything else happens, so calls are always seen one
+			// at a time.
+			callLine := 0
+			if d > 1 {
+				callLine = ctx.Frame(1).Line()
+			}
+			cur = cur.child(f.Func(), callLine)
+			cur.calls++
+			cur.entryLine = f.Line()
+		case d < depth:
+			// More than one call can return before the next
+			// instruction, if they're all at the end of their
+			// functions.
+			for ; depth > d; depth-- {
+				cur = cur.parent
+			}
+		}
+		depth = d
+		if cur.fn != f.Func() {
+			panic(fmt.Sprintf("profile is in %v, but the VM is in %v", cur.fn, f.Func()))
+		}
+		cur.self[f.Line()]++
+		if next != nil {
+			return next(ctx)
+		}
+		return nil
+	}
+}
+
+// A Cost is what was spent running a function or a line of the source.
+type Cost struct {
+	// The function, and the line of the source if it's the cost of a
+	// line. The line is 0 if it's the cost of a function, or if it's
+	// the cost of instructions which aren't from a known line.
+	Func string
+	Line int
+
+	// The number of calls made to the function, or that were made by
+	// the line.
+	Calls int64
+
+	// The number of instructions run by the function or line itself
+	// (Flat), and including the calls that it made (Cum). A call which
+	// is recursive is only counted once.
+	Flat, Cum int64
+}
+
+// Total returns the number of instructions run by everything in p.
+func (p *Profile) Total() int64 {
+	return p.root.total()
+}
+
+// Functions returns the cost of each function that has run, with the ones
+// that ran the most instructions themselves first.
+func (p *Profile) Functions() []Cost {
+	costs := make(map[string]*Cost)
+	cost := func(fn string) *Cost {
+		c, ok := costs[fn]
+		if !ok {
+			c = &Cost{Func: fn}
+			costs[fn] = c
+		}
+		return c
+	}
+	onStack := make(map[string]int)
+	var walk func(n *callNode)
+	walk = func(n *callNode) {
+		c := cost(n.fn)
+		c.Calls += n.calls
+		for _, count := range n.self {
+			c.Flat += count
+		}
+		if onStack[n.fn] == 0 {
+			c.Cum += n.total()
+		}
+		onStack[n.fn]++
+		for _, child := range n.children {
+			walk(child)
+		}
+		onStack[n.fn]--
+	}
+	for _, child := range p.root.children {
+		walk(child)
+	}
+	sorted := make([]Cost, 0, len(costs))
+	for _, c := range costs {
+		sorted = append(sorted, *c)
+	}
+	sortCosts(sorted)
+	return sorted
+}
+
+// Lines returns the cost of each line of the source that has run, with the
+// ones that ran the most instructions themselves first.
+func (p *Profile) Lines() []Cost {
+	costs := make(map[callKey]*Cost)
+	cost := func(fn string, line int) *Cost {
+		k := callKey{fn, line}
+		c, ok := costs[k]
+		if !ok {
+			c = &Cost{Func: fn, Line: line}
+			costs[k] = c
+		}
+		return c
+	}
+	// The lines that the calls being walked were made from.
+	onStack := make(map[callKey]int)
+	var walk func(n *callNode)
+	walk = func(n *callNode) {
+		for line, count := range n.self {
+			c := cost(n.fn, line)
+			c.Flat += count
+			if onStack[callKey{n.fn, line}] == 0 {
+				c.Cum += count
+			}
+		}
+		for _, child := range n.children {
+			k := callKey{n.fn, child.callLine}
+			c := cost(n.fn, child.callLine)
+			c.Calls += child.calls
+			if onStack[k] == 0 {
+				c.Cum += child.total()
+			}
+			onStack[k]++
+			walk(child)
+			onStack[k]--
+		}
+	}
+	for _, child := range p.root.children {
+		walk(child)
+	}
+	sorted := make([]Cost, 0, len(costs))
+	for _, c := range costs {
+		sorted = append(sorted, *c)
+	}
+	sortCosts(sorted)
+	return sorted
+}
+
+// Sorts costs with the most expensive first.
+func sortCosts(sorted []Cost) {
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		switch {
+		case a.Flat != b.Flat:
+			return a.Flat > b.Flat
+		case a.Cum != b.Cum:
+			return a.Cum > b.Cum
+		case a.Func != b.Func:
+			return a.Func < b.Func
+		default:
+			return a.Line < b.Line
+		}
+	})
+}
+
+// WriteReport writes a table of the cost of each function and line in p to
+// w. pos formats a line of the source. If pos is nil, it's printed as a line
+// number.
+func (p *Profile) WriteReport(w io.Writer, pos func(line int) string) error {
+	if pos == nil {
+		pos = func(line int) string {
+			return fmt.Sprintf("line %d", line)
+		}
+	}
+	total := p.Total()
+	percent := func(n int64) string {
+		if total == 0 {
+			return "0.00%"
+		}
+		return fmt.Sprintf("%.2f%%", 100*float64(n)/float64(total))
+	}
+	if _, err := fmt.Fprintf(w, "%d instructions\n\n", total); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "flat\tflat%%\tcum\tcum%%\tcalls\t\tfunction\n")
+	for _, c := range p.Functions() {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%d\t\t%s\n", c.Flat, percent(c.Flat), c.Cum, percent(c.Cum), c.Calls, c.Func)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(tw, "flat\tflat%%\tcum\tcum%%\tcalls\t\tline\n")
+	for _, c := range p.Lines() {
+		where := "?"
+		if c.Line > 0 {
+			where = pos(c.Line)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%d\t\t%s %s\n", c.Flat, percent(c.Flat), c.Cum, percent(c.Cum), c.Calls, c.Func, where)
+	}
+	return tw.Flush()
+}
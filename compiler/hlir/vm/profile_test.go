@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/driusan/lang/compiler/hlir/opt"
+)
+
+const profileProgram = `func fact(n int) (int) {
+	if n <= 1 {
+		return 1
+	}
+	return n * fact(n - 1)
+}
+
+func main() () -> affects(IO) {
+	PrintInt(fact(3))
+	PrintInt(fact(2))
+}
+`
+
+func TestProfile(t *testing.T) {
+	// Keep the calls to fact from being folded.
+	def := opt.Default
+	opt.Default = opt.NewManager(opt.O0)
+	ctx, err := Parse(profileProgram)
+	opt.Default = def
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProfile()
+	for i := 0; i < 2; i++ {
+		m := ctx.Clone()
+		m.Stdout = ioutil.Discard
+		p.Attach(m)
+		if _, _, err := RunWithSideEffects("main", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total := p.Total()
+	funcs := make(map[string]Cost)
+	var flat int64
+	for _, c := range p.Functions() {
+		funcs[c.Func] = c
+		flat += c.Flat
+	}
+	if flat != total {
+		t.Errorf("Flat costs of functions add up to %d, want %d", flat, total)
+	}
+	if c := funcs["main"]; c.Calls != 2 || c.Cum != total {
+		t.Errorf("Unexpected cost of main: got %+v want 2 calls and cum %d", c, total)
+	}
+	// fact(3) and fact(2) make 5 calls to it, and it only costs anything
+	// through itself.
+	if c := funcs["fact"]; c.Calls != 10 || c.Flat == 0 || c.Cum != c.Flat {
+		t.Errorf("Unexpected cost of fact: got %+v want 10 calls and cum equal to flat", c)
+	}
+
+	lines := make(map[int]Cost)
+	flat = 0
+	for _, c := range p.Lines() {
+		lines[c.Line] = c
+		flat += c.Flat
+	}
+	if flat != total {
+		t.Errorf("Flat costs of lines add up to %d, want %d", flat, total)
+	}
+	if c := lines[5]; c.Func != "fact" || c.Calls != 6 || c.Cum <= c.Flat || c.Cum >= funcs["fact"].Cum {
+		t.Errorf("Unexpected cost of line 5: got %+v", c)
+	}
+	if c := lines[9]; c.Func != "main" || c.Calls != 2 || c.Cum <= c.Flat {
+		t.Errorf("Unexpected cost of line 9: got %+v", c)
+	}
+
+	var report strings.Builder
+	if err := p.WriteReport(&report, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), "fact line 5") {
+		t.Errorf("Report doesn't have line 5 of fact:\n%s", report.String())
+	}
+
+	var pprof bytes.Buffer
+	if err := p.WritePprof(&pprof, nil); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(&pprof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"instructions", "calls", "main", "fact"} {
+		if !bytes.Contains(msg, []byte(s)) {
+			t.Errorf("pprof profile doesn't have %q", s)
+		}
+	}
+}
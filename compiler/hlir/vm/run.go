@@ -1,9 +1,9 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"reflect"
 	"strings"
 
@@ -13,8 +13,6 @@ import (
 
 var debug = false
 
-func Write(fd int, nbytes int, str *byte)
-
 // Run the HLIR function in a virtual machine, allowing all side-effects. This is primarily
 // used for testing or scripting.
 func RunWithSideEffects(f string, vm *Context) (stdout, stderr io.Reader, err error) {
@@ -24,620 +22,461 @@ func RunWithSideEffects(f string, vm *Context) (stdout, stderr io.Reader, err er
 // Run the HLIR function in a virtual machine, but only allow the allowed side-effects. This is
 // primarily used for compile time evaluation.
 func RunWithLimitedEffects(f string, vm *Context, allowed []ast.Effect) (stdout, stderr io.Reader, err error) {
+	if allowed == nil {
+		// nil means every effect is allowed to run, so use an
+		// empty list to allow none.
+		allowed = []ast.Effect{}
+	}
 	return run(vm.Funcs[f], vm, allowed)
 }
 
-func run(f hlir.Func, ctx *Context, allowedEffects []ast.Effect) (stdout, stderr io.Reader, err error) {
-	for _, op := range f.Body {
-		stop, err := runOp(op, ctx, allowedEffects)
-		if err != nil {
-			return strings.NewReader(ctx.stdout.String()), strings.NewReader(ctx.stderr.String()), err
+// Returns an error if calling fname has any effect that isn't in allowed.
+// A nil allowed list allows every effect.
+func checkEffects(fname string, ctx *Context, allowed []ast.Effect) error {
+	if allowed == nil {
+		return nil
+	}
+	for _, c := range ctx.Callables[fname] {
+		fd, ok := c.(ast.FuncDecl)
+		if !ok {
+			continue
 		}
-		if stop {
-			break
+	effects:
+		for _, e := range fd.Effects {
+			for _, a := range allowed {
+				if e == a {
+					continue effects
+				}
+			}
+			return fmt.Errorf("Call to %v has effect %v, which is not allowed", fname, e)
 		}
 	}
-	return strings.NewReader(ctx.stdout.String()), strings.NewReader(ctx.stderr.String()), nil
+	return nil
 }
 
-func runOp(op hlir.Opcode, ctx *Context, allowed []ast.Effect) (stop bool, err error) {
-	switch o := op.(type) {
-	case hlir.CALL:
-		newctx := ctx.Clone()
-		newctx.localValues = make(map[hlir.LocalValue]interface{})
-		newctx.funcRetVal = make(map[hlir.FuncRetVal]interface{})
-		newctx.lastFuncCallRetVal = make(map[hlir.LastFuncCallRetVal]interface{})
-		newctx.tempValue = make(map[hlir.TempValue]interface{})
-		newctx.funcArg = make(map[hlir.FuncArg]interface{})
-
-		rd := ctx.RegisterData[string(o.FName)]
-
-		switch string(o.FName) {
-		case "Write":
-			fd := evalRegister(o.Args[0], ctx)
-			l := evalRegister(o.Args[1], ctx)
-			s := evalRegister(o.Args[2], ctx)
-
-			switch fd.(int) {
-			case 1:
-				if s2, ok := s.(string); ok {
-					fmt.Fprintf(ctx.stdout, "%s", s2)
-				} else {
-					base, nctx := dereferencePointer(o.Args[2], ctx)
-				outer:
-					for {
-						switch o := base.(type) {
-						case hlir.LocalValue:
-							break outer
-						case hlir.Offset:
-							base, nctx = resolveOffset(o, nctx)
-							break outer
-						case hlir.SliceBasePointer:
-							break outer
-						default:
-							base, nctx = dereferencePointer(base, nctx)
-						}
-
-					}
-					ptr, ok := base.(hlir.SliceBasePointer)
-					if ok {
-						// It might not be a SliceBasePointer if it's
-						// a string
-						if o, ok := ptr.Register.(hlir.Offset); ok {
-							base, nctx = resolveOffset(o, nctx)
-						} else {
-							base = ptr.Register
-						}
-					}
-					for i := 0; i < l.(int); i++ {
-						ch := evalRegister(base, nctx)
-						if s, ok := ch.(string); ok {
-							// Hack because Strings and Byte slices aren't represented
-							// the same way in the VM, even though they should be
-							fmt.Fprintf(ctx.stdout, "%s", s)
-							break
-						}
-						fmt.Fprintf(ctx.stdout, "%c", evalRegister(base, nctx))
-						switch b := base.(type) {
-						case hlir.LocalValue:
-							base = b + 1
-						default:
-							panic(fmt.Sprintf("Unhandled register type in Write of byte slice %v", reflect.TypeOf(b)))
-						}
-					}
-				}
-			case 2:
-				if s2, ok := s.(string); ok {
-					ctx.writeStderr(s2)
-				} else {
-					base, nctx := dereferencePointer(o.Args[2], ctx)
-
-				outererr:
-					for {
-						switch o := base.(type) {
-						case hlir.LocalValue:
-							break outererr
-						case hlir.Offset:
-							base, nctx = resolveOffset(o, nctx)
-							break outererr
-						case hlir.SliceBasePointer:
-							break outererr
-						default:
-							base, nctx = dereferencePointer(base, nctx)
-						}
-
-					}
-					ptr, ok := base.(hlir.SliceBasePointer)
-					if ok {
-						// It might not be a SliceBasePointer if it's
-						// a string
-						if o, ok := ptr.Register.(hlir.Offset); ok {
-							base, nctx = resolveOffset(o, nctx)
-						} else {
-							base = ptr.Register
-						}
-					}
-					for i := 0; i < l.(int); i++ {
-						ch := evalRegister(base, nctx)
-						if s, ok := ch.(string); ok {
-							// Hack because Strings and Byte slices aren't represented
-							// the same way in the VM, even though they should be
-							ctx.writeStderr(fmt.Sprintf("%s", s))
-							break
-						}
-						ctx.writeStderr(fmt.Sprintf("%c", evalRegister(base, nctx)))
-						switch b := base.(type) {
-						case hlir.LocalValue:
-							base = b + 1
-						default:
-							panic(fmt.Sprintf("Unhandled register type in Write of byte slice %v", reflect.TypeOf(b)))
-						}
-					}
-				}
-			default:
-				if s2, ok := s.(string); ok {
-					Write(fd.(int), l.(int), &([]byte(s2)[0]))
-				} else {
-					panic("Unhandled write of non-string")
-				}
-			}
-		case "PrintString":
-			// Special case for some things in stdlib.
-			// FIXME: This should be more robust.
-			if len(o.Args) == 1 {
-				// It's a string literal
-				fmt.Fprintf(ctx.stdout, "%v", evalRegister(o.Args[0], ctx))
-			} else if len(o.Args) == 2 {
-				// It's a len, localvalue pair
-				l := evalRegister(o.Args[0], ctx)
-				s := evalRegister(o.Args[1], ctx)
-				if s2, ok := s.(string); ok {
-					fmt.Fprintf(ctx.stdout, "%v", s2)
-				} else {
-					base, nctx := dereferencePointer(o.Args[1], ctx)
+func run(f hlir.Func, ctx *Context, allowedEffects []ast.Effect) (stdout, stderr io.Reader, err error) {
+	ctx.checkCode()
+	fn := ctx.function(f.Name)
+	if fn == nil || !sameBody(fn.body, f.Body) {
+		fn = compile(f, ctx)
+	}
+	ctx.frame.enter(fn)
+	ctx.steps, ctx.remaining = 0, ctx.MaxSteps
+	err = ctx.exec(ctx.frame, allowedEffects)
+	return output(ctx.Stdout), output(ctx.Stderr), err
+}
 
-					for i := 0; i < l.(int); i++ {
-						ch := evalRegister(base, nctx)
-						if s, ok := ch.(string); ok {
-							// Hack because Strings and Byte slices aren't represented
-							// the same way in the VM, even though they should be
-							fmt.Fprintf(ctx.stdout, "%s", s)
-							break
-						}
-						if reg := evalRegister(base, nctx); reg != nil {
-							fmt.Fprintf(ctx.stdout, "%c", reg)
-						}
-						switch b := base.(type) {
-						case hlir.LocalValue:
-							base = b + 1
-						case hlir.FuncArg:
-						default:
-							panic("Unhandled register type in PrintByteSlice")
-						}
-					}
-				}
-			} else {
-				panic("Unhandled PrintString")
+// Runs the bytecode of the function that fr was entered with. Any error is
+// returned as a *RuntimeError.
+func (ctx *Context) exec(fr *frame, allowed []ast.Effect) (err error) {
+	depth := ctx.depth
+	defer func() {
+		if r := recover(); r != nil {
+			err = ctx.recovered(r)
+			// Release the frames of any calls that were being set
+			// up when it panicked.
+			for ctx.depth > depth {
+				ctx.pop()
 			}
-		case "PrintByteSlice":
-			// FIXME: This should be way more robust and also more efficient.
-			if len(o.Args) == 2 {
-				// It's a len, localvalue pair
-				l := evalRegister(o.Args[0], ctx)
-				base, nctx := dereferencePointer(o.Args[1], ctx)
-
-				for i := 0; i < l.(int); i++ {
-					ch := evalRegister(base, nctx)
-					if s, ok := ch.(string); ok {
-						// Hack because Strings and Byte slices aren't represented
-						// the same way in the VM, even though they should be
-						fmt.Fprintf(ctx.stdout, "%s", s)
-						break
-					}
-					fmt.Fprintf(ctx.stdout, "%c", evalRegister(base, nctx))
-					switch b := base.(type) {
-					case hlir.LocalValue:
-						base = b + 1
-					default:
-						panic("Unhandled register type in PrintByteSlice")
-					}
-				}
-			} else {
-				panic("Unhandled byte slice")
+		}
+	}()
+	code := fr.fn.code
+	for pc := 0; pc < len(code); pc++ {
+		fr.pc = pc
+		ctx.steps--
+		if ctx.steps < 0 {
+			if err := ctx.checkLimits(); err != nil {
+				return ctx.runtimeError(err)
 			}
-		case "len":
-			ctx.lastFuncCallRetVal[hlir.LastFuncCallRetVal{0, 0}] = evalRegister(o.Args[0], ctx)
-		case "PrintInt":
-			fmt.Fprintf(ctx.stdout, "%v", evalRegister(o.Args[0], ctx))
-		case "Create", "Open":
-			var name string
-			if len(o.Args) == 1 {
-				// It's a string literal
-				s := evalRegister(o.Args[0], ctx)
-				name = s.(string)
-			} else if len(o.Args) == 2 {
-				// It's a len, localvalue pair
-				l := evalRegister(o.Args[0], ctx)
-				s := evalRegister(o.Args[1], ctx)
-				if s2, ok := s.(string); ok {
-					name = s2
-				} else {
-					base, nctx := dereferencePointer(o.Args[1], ctx)
-
-					for i := 0; i < l.(int); i++ {
-						ch := evalRegister(base, nctx)
-						if s, ok := ch.(string); ok {
-							// Hack because Strings and Byte slices aren't represented
-							// the same way in the VM, even though they should be
-							name = s
-							break
-						}
-						name += fmt.Sprintf("%c", evalRegister(base, nctx))
-						switch b := base.(type) {
-						case hlir.LocalValue:
-							base = b + 1
-						default:
-							panic("Unhandled register type in PrintByteSlice")
-						}
-					}
-				}
+		}
+		in := &code[pc]
+		switch in.op {
+		case opMOV:
+			fr.regs[in.dst.class][in.dst.idx] = fr.get(in.a)
+		case opADD:
+			fr.regs[in.dst.class][in.dst.idx] = intValue(fr.get(in.a).int() + fr.get(in.b).int())
+		case opSUB:
+			fr.regs[in.dst.class][in.dst.idx] = intValue(fr.get(in.a).int() - fr.get(in.b).int())
+		case opMUL:
+			fr.regs[in.dst.class][in.dst.idx] = intValue(fr.get(in.a).int() * fr.get(in.b).int())
+		case opDIV:
+			b := fr.get(in.b).int()
+			if b == 0 {
+				return ctx.runtimeError(errDivisionByZero)
 			}
-			var syscall func(string) (*os.File, error)
-			if string(o.FName) == "Create" {
-				syscall = os.Create
-			} else if string(o.FName) == "Open" {
-				syscall = os.Open
+			fr.regs[in.dst.class][in.dst.idx] = intValue(fr.get(in.a).int() / b)
+		case opMOD:
+			b := fr.get(in.b).int()
+			if b == 0 {
+				return ctx.runtimeError(errDivisionByZero)
 			}
-
-			f, err := syscall(name)
-			if err != nil {
-				return true, err
+			fr.regs[in.dst.class][in.dst.idx] = intValue(fr.get(in.a).int() % b)
+		case opLT:
+			fr.regs[in.dst.class][in.dst.idx] = boolValue(fr.get(in.a).int() < fr.get(in.b).int())
+		case opGT:
+			fr.regs[in.dst.class][in.dst.idx] = boolValue(fr.get(in.a).int() > fr.get(in.b).int())
+		case opLTE:
+			fr.regs[in.dst.class][in.dst.idx] = boolValue(fr.get(in.a).int() <= fr.get(in.b).int())
+		case opGEQ:
+			fr.regs[in.dst.class][in.dst.idx] = boolValue(fr.get(in.a).int() >= fr.get(in.b).int())
+		case opEQ:
+			fr.regs[in.dst.class][in.dst.idx] = boolValue(fr.get(in.a) == fr.get(in.b))
+		case opNEQ:
+			fr.regs[in.dst.class][in.dst.idx] = boolValue(fr.get(in.a) != fr.get(in.b))
+		case opJMP:
+			pc = in.target - 1
+		case opJZ:
+			if !fr.get(in.a).truthy() {
+				pc = in.target - 1
 			}
-			ctx.lastFuncCallRetVal[hlir.LastFuncCallRetVal{0, 0}] = int(f.Fd())
-		case "Read":
-			fd := evalRegister(o.Args[0], ctx)
-			l := evalRegister(o.Args[1], ctx)
-			base, nctx := dereferencePointer(o.Args[2], ctx)
-			f := os.NewFile(uintptr(fd.(int)), "unknown")
-			bytes := make([]byte, l.(int), l.(int))
-			n, err := f.Read(bytes)
-			if err != nil && err != io.EOF {
-				return true, err
+		case opCALL:
+			if err := ctx.call(fr, in.call, allowed); err != nil {
+				return ctx.runtimeError(err)
 			}
-			for i := 0; i < l.(int); i++ {
-				reg := base.(hlir.LocalValue) + hlir.LocalValue(i)
-				nctx.SetRegister(reg, bytes[i])
+		case opRET:
+			return nil
+		case opASSERT:
+			if !fr.get(in.a).truthy() {
+				o := in.src.(hlir.ASSERT)
+				err := assertionError{string(o.Message), o.Node}
+				ctx.writeStderr(err.Error())
+				return ctx.runtimeError(err)
 			}
-			ctx.lastFuncCallRetVal[hlir.LastFuncCallRetVal{0, 0}] = int(n)
-		case "Close":
-			fd := evalRegister(o.Args[0], ctx)
-			f := os.NewFile(uintptr(fd.(int)), "unknown")
-			f.Close()
+		case opLOAD:
+			fr.regs[in.dst.class][in.dst.idx] = evalRegister(in.reg, fr)
+		case opSTORE:
+			setRegister(in.reg, fr.get(in.a), fr)
+		case opPOINTER:
+			movePointer(in.src.(hlir.MOV), fr)
+		case opBRANCH:
+			_, cont := in.src.(hlir.CONTINUE)
+			return ctx.runtimeError(loopBranch{depth: uint(in.target), cont: cont})
 		default:
-			for i, r := range o.Args {
-				farg := hlir.FuncArg{uint(i), false}
-				if _, ok := rd[farg]; !ok {
-					farg.Reference = true
-					if _, okref := rd[farg]; !okref {
-						panic(fmt.Sprintf("Function Argument %d does not have register data for %v", i, o.FName))
-					}
-				}
-				if !farg.Reference {
-					switch r := r.(type) {
-					case hlir.Pointer:
-						pointer := Pointer{r, ctx}
-						newctx.pointers[hlir.Pointer{farg}] = pointer
-					case hlir.SliceBasePointer:
-						// Convert it to a normal pointer when passing
-						// as an argument so that it dereferences properly.
-						pointer := Pointer{hlir.Pointer{r.Register}, ctx}
-						newctx.pointers[hlir.Pointer{farg}] = pointer
-					default:
-						newctx.funcArg[farg] = evalRegister(r, ctx)
-					}
-				} else {
-					pointer := Pointer{r, ctx}
-					newctx.pointers[hlir.Pointer{farg}] = pointer
-				}
-			}
-
-			fnc, ok := ctx.Funcs[string(o.FName)]
-			if !ok {
-				return true, fmt.Errorf("Call to undefined function %s", o.FName)
-			}
-			if _, _, err := run(fnc, newctx, allowed); err != nil {
-				return true, err
-			}
-
-			// Convert from funcRetVal in callee to lastFuncCallRetVal in caller
-			//ctx.lastFuncCallRetVal = make(map[hlir.LastFuncCallRetVal]interface{})
-			if o.TailCall {
-				ctx.funcRetVal = newctx.funcRetVal
-			} else {
-				for k, v := range newctx.funcRetVal {
-					ctx.lastFuncCallRetVal[hlir.LastFuncCallRetVal{0, uint(k)}] = v
-				}
-			}
+			panic(fmt.Sprintf("Unrecognized instruction: %v", in))
 		}
-	case hlir.MOV:
-		if fa, ok := o.Dst.(hlir.FuncArg); ok && fa.Reference {
-			// If moving into a variable that was declared as a reference,
-			// mutate in the source context
-			ctxptr := ctx.pointers[hlir.Pointer{fa}]
-			ptr := ctxptr.r.(hlir.Pointer)
-			ctxptr.ctx.SetRegister(ptr.Register, evalRegister(o.Src, ctx))
-		} else if ptr, ok := o.Src.(hlir.Pointer); ok {
-			// If moving a pointer into a variable, make that variable a
-			// pointer so that it can be used as a slice referece
-			dptr := hlir.Pointer{o.Dst}
+	}
+	return nil
+}
 
-			switch ptr.Register.(type) {
-			case hlir.Offset:
-				deref, derefctx := resolveOffset(ptr.Register.(hlir.Offset), ctx)
-				ctx.pointers[dptr] = Pointer{deref, derefctx}
-			default:
-				panic("Unhandled case for pointer MOV")
-			}
-		} else {
-			ctx.SetRegister(o.Dst, evalRegister(o.Src, ctx))
-		}
-	case hlir.RET:
-		return true, nil
-	case hlir.ADD:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int)+b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.SUB:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int)-b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.MUL:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int)*b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.DIV:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int)/b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.MOD:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int)%b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.LT:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int) < b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.GT:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int) > b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.LTE:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int) <= b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.GEQ:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		// FIXME: Handle non-int
-		if err := ctx.SetRegister(o.Dst, a.(int) >= b.(int)); err != nil {
-			return true, err
-		}
-	case hlir.EQ:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		if err := ctx.SetRegister(o.Dst, a == b); err != nil {
-			return true, err
-		}
-	case hlir.NEQ:
-		a := evalRegister(o.Left, ctx)
-		b := evalRegister(o.Right, ctx)
-		if err := ctx.SetRegister(o.Dst, a != b); err != nil {
-			return true, err
-		}
-	case hlir.LOOP:
-		for _, in := range o.Initializer {
-			stop, err := runOp(in, ctx, allowed)
-			if err != nil || stop {
-				return stop, err
-			}
+// Makes the call cs from the function running in fr.
+func (ctx *Context) call(fr *frame, cs *callSite, allowed []ast.Effect) error {
+	if cs.noEffects {
+		allowed = []ast.Effect{}
+	}
+	if err := checkEffects(cs.name, ctx, allowed); err != nil {
+		return err
+	}
+	if cs.builtin != nil {
+		v, err := cs.builtin(ctx, fr, cs.args)
+		if err != nil {
+			return fault{IOError, err}
 		}
-		for evalCondition(o.Condition, ctx, allowed) {
-			for _, in := range o.Body {
-				if stop, err := runOp(in, ctx, allowed); err != nil || stop {
-					return stop, err
-				}
-			}
+		if v.kind != kindNone {
+			fr.returned(cs, []value{v})
 		}
-	case hlir.IF:
-		for _, in := range o.Initializer {
-			if stop, err := runOp(in, ctx, allowed); err != nil || stop {
-				return stop, err
-			}
+		return nil
+	}
+	for i, arg := range cs.params {
+		if arg.missing {
+			panic(fmt.Sprintf("Function Argument %d does not have register data for %v", i, cs.name))
 		}
-		if evalCondition(o.Condition, ctx, allowed) {
-			for _, in := range o.Body {
-				if stop, err := runOp(in, ctx, allowed); err != nil || stop {
-					return stop, err
-				}
-			}
-		} else {
-			for _, in := range o.ElseBody {
-				if stop, err := runOp(in, ctx, allowed); err != nil || stop {
-					return stop, err
-				}
-			}
+	}
+	if cs.fn == nil {
+		cs.fn = ctx.function(cs.name)
+		if cs.fn == nil {
+			return fmt.Errorf("Call to undefined function %s", cs.name)
 		}
-	case hlir.JumpTable:
-	jumptable:
-		for _, cse := range o {
-			for _, in := range cse.Initializer {
-				if stop, err := runOp(in, ctx, allowed); err != nil || stop {
-					return stop, err
-				}
-			}
+	}
+	if ctx.MaxDepth > 0 && ctx.depth >= ctx.MaxDepth {
+		return fault{LimitExceeded, ErrDepthLimit}
+	}
 
-			if evalCondition(cse.Condition, ctx, allowed) {
-				for _, in := range cse.Body {
-					if stop, err := runOp(in, ctx, allowed); err != nil || stop {
-						return stop, err
-					}
-				}
-				break jumptable
-			}
-		}
-	case hlir.ASSERT:
-		if !evalCondition(o.Predicate, ctx, []ast.Effect{}) {
-			err := assertionError{string(o.Message), o.Node}
-			ctx.writeStderr(err.Error())
-			return true, err
+	callee := ctx.push(cs.fn)
+	for i := range cs.params {
+		arg := &cs.params[i]
+		if arg.pointer != nil {
+			callee.setPointer(hlir.Pointer{arg.farg}, Pointer{arg.pointer, fr})
+		} else {
+			callee.set(classArg, int(arg.farg.Id), fr.get(arg.val))
 		}
+	}
+	err := ctx.exec(callee, allowed)
+	if err == nil {
+		fr.returned(cs, callee.regs[classRet])
+	}
+	ctx.pop()
+	return err
+}
+
+// Stores the values rets returned by the call cs in fr, where the
+// caller expects them. For a tail call, that's the values returned by fr
+// itself.
+func (fr *frame) returned(cs *callSite, rets []value) {
+	if cs.tail {
+		old := fr.regs[classRet]
+		for i := range old {
+			old[i] = value{}
+		}
+		for i, v := range rets {
+			fr.set(classRet, i, v)
+		}
+		return
+	}
+	for i, idx := range cs.rets {
+		if idx < 0 {
+			continue
+		}
+		var v value
+		if i < len(rets) {
+			v = rets[i]
+		}
+		if v.kind == kindNone {
+			// The caller may read a value that the callee didn't
+			// return, such as the payload of an enum variant without
+			// one, so long as it doesn't use it. It mustn't see the
+			// value returned by an earlier call.
+			v = intValue(0)
+		}
+		fr.set(classCallRet, idx, v)
+	}
+}
+
+// Returns a frame to call fn in.
+func (ctx *Context) push(fn *function) *frame {
+	if ctx.depth == len(ctx.stack) {
+		ctx.stack = append(ctx.stack, &frame{})
+	}
+	fr := ctx.stack[ctx.depth]
+	ctx.depth++
+	fr.enter(fn)
+	return fr
+}
+
+// Releases the frame of the last call, so that it can be reused.
+func (ctx *Context) pop() {
+	ctx.depth--
+	ctx.stack[ctx.depth].reset()
+}
+
+// Makes the destination of a MOV of a pointer into a pointer to the
+// source, so that it can be used as a slice reference.
+func movePointer(o hlir.MOV, fr *frame) {
+	ptr := o.Src.(hlir.Pointer)
+	dptr := hlir.Pointer{o.Dst}
+
+	switch ptr.Register.(type) {
+	case hlir.Offset:
+		deref, derefframe := resolveOffset(ptr.Register.(hlir.Offset), fr)
+		fr.setPointer(dptr, Pointer{deref, derefframe})
 	default:
-		panic(fmt.Sprintf("Unrecognized op: %v", reflect.TypeOf(op).Name()))
+		panic("Unhandled case for pointer MOV")
 	}
-	return false, nil
 }
 
-func evalRegister(r hlir.Register, ctx *Context) interface{} {
+// Returns the value of any register in fr.
+func evalRegister(r hlir.Register, fr *frame) value {
 	switch reg := r.(type) {
 	case hlir.StringLiteral:
-		return strings.Replace(string(reg), `\n`, "\n", -1)
+		return stringValue(strings.Replace(string(reg), `\n`, "\n", -1))
 	case hlir.IntLiteral:
-		return int(reg)
+		return intValue(int(reg))
 	case hlir.LocalValue:
-		v, ok := ctx.localValues[reg]
-		if !ok {
-			panic(fmt.Sprintf("No variable named %v", reg))
-		}
-		return v
+		return fr.load(operand{classLocal, uint32(reg)})
 	case hlir.LastFuncCallRetVal:
-		// hlir numbers the calls so that it can attach different type
-		// information to it. The VM doesn't care, it just wants the last
-		// call.
-		reg.CallNum = 0
-		val, ok := ctx.lastFuncCallRetVal[reg]
+		idx, ok := fr.fn.callRets[reg]
 		if !ok {
-			panic(fmt.Sprintf("Unknown function return value %v (Known: %v)", reg, ctx.lastFuncCallRetVal))
+			panic(fmt.Sprintf("Unknown function return value %v", reg))
 		}
-		return val
+		return fr.load(operand{classCallRet, idx})
 	case hlir.TempValue:
-		v, ok := ctx.tempValue[reg]
-		if !ok {
-			panic(fmt.Sprintf("Unknown temp value: %v", reg))
-		}
-		return v
+		return fr.load(operand{classTemp, uint32(reg)})
 	case hlir.FuncArg:
 		if reg.Reference {
 			// If it's a reference parameter, we need to de-reference it
 			// to get its values
-			ctxptr := ctx.pointers[hlir.Pointer{reg}]
-			ptr := ctxptr.r.(hlir.Pointer)
-			return evalRegister(ptr.Register, ctxptr.ctx)
-		}
-		v, ok := ctx.funcArg[reg]
-		if !ok {
-			panic(fmt.Sprintf("Unknown FuncArg: %v", reg))
+			frptr := fr.pointers[hlir.Pointer{reg}]
+			ptr := frptr.r.(hlir.Pointer)
+			return evalRegister(ptr.Register, frptr.fr)
 		}
-		return v
+		return fr.load(operand{classArg, uint32(reg.Id)})
 	case hlir.Offset:
-		lv, nctx := resolveOffset(reg, ctx)
-		return evalRegister(lv, nctx)
+		if sb, ok := reg.Base.(hlir.SliceBasePointer); ok && reg.Container.Type().TypeName() == "string" {
+			// Indexing into the bytes of a string. Strings are stored
+			// in a single register in the VM, not one per byte.
+			s := evalRegister(sb.Register, fr)
+			if s.kind != kindString {
+				panic(fmt.Sprintf("interface conversion: interface {} is %T, not string", s.iface()))
+			}
+			i := evalRegister(reg.Offset, fr).int()
+			if i < 0 || i >= len(s.s) {
+				badIndex("index %d out of range for string of length %d", i, len(s.s))
+			}
+			return intValue(int(s.s[i]))
+		}
+		lv, nfr := resolveOffset(reg, fr)
+		return evalRegister(lv, nfr)
 	case hlir.Pointer:
-		p, ok := ctx.pointers[reg]
+		p, ok := fr.pointers[reg]
 		if !ok {
-			return evalRegister(reg.Register, ctx)
+			return evalRegister(reg.Register, fr)
 		}
-		return evalRegister(p.r, p.ctx)
+		return evalRegister(p.r, p.fr)
 	case hlir.SliceBasePointer:
-		return evalRegister(reg.Register, ctx)
+		return evalRegister(reg.Register, fr)
 	default:
 		panic(fmt.Sprintf("Unhandled type: %v", reflect.TypeOf(r).Name()))
 	}
 }
 
-func evalCondition(cond hlir.Condition, ctx *Context, allowed []ast.Effect) bool {
-	for _, inst := range cond.Body {
-		if stop, err := runOp(inst, ctx, allowed); err != nil || stop {
-			panic(err)
-		}
-	}
-	r := evalRegister(cond.Register, ctx)
-	if r == true || r == false {
-		return r.(bool)
+// Sets any register in fr to val.
+func setRegister(r hlir.Register, val value, fr *frame) {
+	switch reg := r.(type) {
+	case hlir.LocalValue:
+		fr.set(classLocal, int(reg), val)
+	case hlir.FuncRetVal:
+		fr.set(classRet, int(reg), val)
+	case hlir.TempValue:
+		fr.set(classTemp, int(reg), val)
+	case hlir.FuncArg:
+		if reg.Reference {
+			// Mutate the variable that the reference is to, in the
+			// frame that it came from.
+			frptr := fr.pointers[hlir.Pointer{reg}]
+			ptr := frptr.r.(hlir.Pointer)
+			setRegister(ptr.Register, val, frptr.fr)
+			return
+		}
+		fr.set(classArg, int(reg.Id), val)
+	case hlir.Offset:
+		off, nfr := resolveOffset(reg, fr)
+		setRegister(off, val, nfr)
+	default:
+		panic(fmt.Sprintf("Unhandled register type: %v", reflect.TypeOf(r).Name()))
 	}
-	return r != 0
 }
 
-func resolveOffset(o hlir.Offset, ctx *Context) (hlir.Register, *Context) {
+func resolveOffset(o hlir.Offset, fr *frame) (hlir.Register, *frame) {
 	switch b := o.Base.(type) {
 	case hlir.LocalValue:
 		bd := b
-		if p, ok := ctx.pointers[hlir.Pointer{b}]; ok {
+		var length hlir.Register
+		if p, ok := fr.pointers[hlir.Pointer{b}]; ok {
 			bd = p.r.(hlir.LocalValue)
+		} else if b > 0 {
+			length = b - 1
 		}
-		offset := evalRegister(o.Offset, ctx)
+		offset := evalRegister(o.Offset, fr).int()
+		checkIndex(o, offset, length, fr)
 		if o.Scale == 16 {
-			bd += hlir.LocalValue((offset.(int) * 2) + 1)
+			bd += hlir.LocalValue((offset * 2) + 1)
 		} else {
-			bd += hlir.LocalValue(offset.(int))
+			bd += hlir.LocalValue(offset)
 		}
-		return bd, ctx
+		return bd, fr
 	case hlir.FuncArg:
-		base, nctx := dereferencePointer(b, ctx)
+		base, nfr := dereferencePointer(b, fr)
 	resolveouter:
 		for {
 			switch o := base.(type) {
 			case hlir.LocalValue:
 				break resolveouter
 			case hlir.FuncArg:
-				base, nctx = dereferencePointer(base, nctx)
+				base, nfr = dereferencePointer(base, nfr)
 			case hlir.SliceBasePointer:
 				base = o.Register
 			default:
-				base, nctx = dereferencePointer(base, nctx)
+				base, nfr = dereferencePointer(base, nfr)
 			}
 
 		}
 		bd := base.(hlir.LocalValue)
-		offset := evalRegister(o.Offset, ctx)
+		var length hlir.Register
+		if b.Id > 0 {
+			length = hlir.FuncArg{b.Id - 1, b.Reference}
+		}
+		offset := evalRegister(o.Offset, fr).int()
+		checkIndex(o, offset, length, fr)
 		if o.Scale == 16 {
-			bd += hlir.LocalValue((offset.(int) * 2) + 1)
+			bd += hlir.LocalValue((offset * 2) + 1)
 		} else {
-			bd += hlir.LocalValue(offset.(int))
+			bd += hlir.LocalValue(offset)
 		}
-		return bd, nctx
+		return bd, nfr
 	default:
 		panic(fmt.Sprintf("Unhandled base type for Offset register: %v", reflect.TypeOf(o.Base)))
 	}
 }
 
-func dereferencePointer(r hlir.Register, ctx *Context) (hlir.Register, *Context) {
+// Panics if offset is outside of the array or slice that o indexes into.
+// A slice's length is in the register before its base, length, if it's in fr.
+func checkIndex(o hlir.Offset, offset int, length hlir.Register, fr *frame) {
+	if offset < 0 {
+		badIndex("index %d out of range for %v", offset, o.Container.Name)
+	}
+	switch t := o.Container.Type().(type) {
+	case ast.ArrayType:
+		if offset >= int(t.Size) {
+			badIndex("index %d out of range for %v of length %d", offset, o.Container.Name, t.Size)
+		}
+	case ast.SliceType:
+		if length == nil || fr.fn == nil || fr.fn.rd[length].Variable.Name != o.Container.Name {
+			return
+		}
+		// The length isn't always set, since it's removed by the
+		// optimizer if nothing else uses it.
+		var l value
+		switch r := length.(type) {
+		case hlir.LocalValue:
+			l = fr.value(classLocal, int(r))
+		case hlir.FuncArg:
+			if !r.Reference {
+				l = fr.value(classArg, int(r.Id))
+			}
+		}
+		if l.kind == kindInt && offset >= l.n {
+			badIndex("index %d out of range for %v of length %d", offset, o.Container.Name, l.n)
+		}
+	}
+}
+
+func dereferencePointer(r hlir.Register, fr *frame) (hlir.Register, *frame) {
 	switch reg := r.(type) {
 	case hlir.Pointer:
-		p, ok := ctx.pointers[reg]
+		p, ok := fr.pointers[reg]
 		if ok {
-			return p.r, p.ctx
+			return p.r, p.fr
 		}
-		return reg.Register, ctx
+		return reg.Register, fr
 	case hlir.FuncArg:
-		if v, ok := ctx.pointers[hlir.Pointer{reg}]; ok {
+		if v, ok := fr.pointers[hlir.Pointer{reg}]; ok {
 			if r, ok := v.r.(hlir.Pointer); ok {
-				return dereferencePointer(r, v.ctx)
+				return dereferencePointer(r, v.fr)
 			}
-			return v.r, v.ctx
+			return v.r, v.fr
 		}
 		panic("Could not dereference FuncArg")
 	case hlir.SliceBasePointer:
-		return r, ctx
+		return r, fr
 	default:
-		if v, ok := ctx.pointers[hlir.Pointer{reg}]; ok {
-			return v.r, v.ctx
+		if v, ok := fr.pointers[hlir.Pointer{reg}]; ok {
+			return v.r, v.fr
 		}
-		return r, ctx
+		return r, fr
+	}
+}
+
+// A loopBranch is returned for a BREAK or CONTINUE which isn't inside of
+// the loop that it refers to.
+type loopBranch struct {
+	depth uint
+	cont  bool
+}
+
+func (l loopBranch) Error() string {
+	if l.cont {
+		return fmt.Sprintf("continue %d outside of loop", l.depth)
 	}
+	return fmt.Sprintf("break %d outside of loop", l.depth)
 }
 
 type assertionError struct {
@@ -651,3 +490,54 @@ func (a assertionError) Error() string {
 	}
 	return fmt.Sprintf("assert %v failed: %s", a.src.PrettyPrint(0), string(a.Message))
 }
+
+// DefaultMaxDepth is the MaxDepth of a new Context. Each call made by the VM
+// uses the stack of the goroutine running it, so it's limited to keep an
+// infinite recursion from crashing the process.
+const DefaultMaxDepth = 100000
+
+// The number of instructions run between checks of whether Cancel is done.
+const checkInterval = 1024
+
+var (
+	// ErrStepLimit is the error of a RuntimeError for running more than
+	// MaxSteps instructions.
+	ErrStepLimit = errors.New("step limit exceeded")
+
+	// ErrDepthLimit is the error of a RuntimeError for nesting calls
+	// deeper than MaxDepth.
+	ErrDepthLimit = errors.New("maximum call depth exceeded")
+)
+
+// Called by exec when it runs out of steps. Returns an error if a limit has
+// been reached, and otherwise gives it more steps and calls the Hook.
+func (ctx *Context) checkLimits() error {
+	if ctx.Cancel != nil {
+		select {
+		case <-ctx.Cancel.Done():
+			return fault{LimitExceeded, ctx.Cancel.Err()}
+		default:
+		}
+	}
+	n := checkInterval
+	if ctx.Hook != nil {
+		// Come back here before the next instruction, so that the
+		// hook sees every one.
+		n = 1
+	}
+	if ctx.MaxSteps > 0 {
+		if ctx.remaining <= 0 {
+			return fault{LimitExceeded, ErrStepLimit}
+		}
+		if ctx.remaining < n {
+			n = ctx.remaining
+		}
+		ctx.remaining -= n
+	}
+	// The instruction that ran out is one of the steps.
+	ctx.steps = n - 1
+	if ctx.Hook != nil {
+		return ctx.Hook(ctx)
+	}
+	return nil
+}
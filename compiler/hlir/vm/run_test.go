@@ -0,0 +1,193 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/driusan/lang/compiler/hlir/opt"
+)
+
+// The recursive Fibonacci function isn't in the testsuite, since it takes
+// too long to be a useful test when compiled, but is a good measure of how
+// fast the VM makes calls.
+const recursiveFibonacci = `
+func fib(n int) (int) {
+	if n < 2 {
+		return n
+	}
+	return fib(n - 1) + fib(n - 2)
+}
+
+func main() () -> affects(IO) {
+	PrintInt(fib(20))
+}`
+
+const limitsProgram = `
+func forever() () -> affects(IO) {
+	mutable x = 0
+	while true {
+		x = x + 1
+	}
+}
+
+func recurse(n int) (int) {
+	return recurse(n + 1) + 1
+}
+
+func deep() () -> affects(IO) {
+	PrintInt(recurse(0))
+}
+
+func count(n int) (int) {
+	if n == 0 {
+		return 0
+	}
+	return count(n - 1) + 1
+}
+
+func shallow() () -> affects(IO) {
+	PrintInt(count(100))
+}`
+
+// Runs fname in limitsProgram with the limits set by setup, and checks that
+// it fails with want.
+func testLimit(t *testing.T, fname string, setup func(*Context), want error) {
+	t.Helper()
+	ctx, err := Parse(limitsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup(ctx)
+	_, _, err = RunWithSideEffects(fname, ctx)
+	re, ok := err.(*RuntimeError)
+	if !ok || re.Kind != LimitExceeded || !errors.Is(err, want) {
+		t.Errorf("Unexpected error: got %v want %v", err, want)
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	testLimit(t, "forever", func(ctx *Context) {
+		ctx.MaxSteps = 5000
+	}, ErrStepLimit)
+}
+
+func TestStepLimitIsExact(t *testing.T) {
+	// Don't let the optimizer evaluate the calls at compile time, so
+	// that there's more than one step.
+	def := opt.Default
+	opt.Default = opt.NewManager(opt.O0)
+	ctx, err := Parse(limitsProgram)
+	opt.Default = def
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Find how many steps the function takes, then check that it
+	// succeeds with exactly that many and fails with one fewer.
+	steps := 0
+	for n := 1; ; n++ {
+		ctx.MaxSteps = n
+		if _, _, err := RunWithSideEffects("shallow", ctx.Clone()); err == nil {
+			steps = n
+			break
+		}
+	}
+	ctx.MaxSteps = steps - 1
+	if _, _, err := RunWithSideEffects("shallow", ctx.Clone()); !errors.Is(err, ErrStepLimit) {
+		t.Errorf("Unexpected error with %d steps: got %v want %v", steps-1, err, ErrStepLimit)
+	}
+}
+
+func TestDepthLimit(t *testing.T) {
+	testLimit(t, "deep", func(ctx *Context) {
+		ctx.MaxDepth = 50
+	}, ErrDepthLimit)
+
+	// The default limit must be reached before the Go stack runs out.
+	testLimit(t, "deep", func(ctx *Context) {}, ErrDepthLimit)
+
+	ctx, err := Parse(limitsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.MaxDepth = 101
+	if _, _, err := RunWithSideEffects("shallow", ctx); err != nil {
+		t.Errorf("Unexpected error for calls within the limit: %v", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	testLimit(t, "forever", func(ctx *Context) {
+		cctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ctx.Cancel = cctx
+	}, context.Canceled)
+
+	testLimit(t, "forever", func(ctx *Context) {
+		cctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		t.Cleanup(cancel)
+		ctx.Cancel = cctx
+	}, context.DeadlineExceeded)
+}
+
+func TestConstantStepLimit(t *testing.T) {
+	_, err := Parse(`
+func forever() (int) {
+	mutable x = 0
+	while true {
+		x = x + 1
+	}
+	return x
+}
+
+let Forever = forever()
+
+func main() () -> affects(IO) {
+	PrintInt(Forever)
+}`)
+	if !errors.Is(err, ErrStepLimit) {
+		t.Errorf("Unexpected error: got %v want %v", err, ErrStepLimit)
+	}
+}
+
+func benchmarkProgram(b *testing.B, prog string) {
+	b.Helper()
+	// Don't let the optimizer evaluate the calls at compile time, the
+	// point is to measure the VM.
+	def := opt.Default
+	opt.Default = opt.NewManager(opt.O0)
+	ctx, err := Parse(prog)
+	opt.Default = def
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := RunWithSideEffects("main", ctx.Clone()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkFile(b *testing.B, name string) {
+	b.Helper()
+	prog, err := ioutil.ReadFile("../../../testsuite/" + name + ".l")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkProgram(b, string(prog))
+}
+
+func BenchmarkFibonacci(b *testing.B) {
+	benchmarkFile(b, "fibonacci")
+}
+
+func BenchmarkSumToTenRecursive(b *testing.B) {
+	benchmarkFile(b, "sumtotenrecursive")
+}
+
+func BenchmarkRecursiveFibonacci(b *testing.B) {
+	benchmarkProgram(b, recursiveFibonacci)
+}
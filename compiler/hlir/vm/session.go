@@ -0,0 +1,313 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// A Session runs a program in the VM one piece at a time, such as the input
+// to a REPL. The functions, types and constants that a piece declares can be
+// used by the pieces after it, and so can the mutable variables declared by
+// its statements if they're integers, bools or strings.
+type Session struct {
+	// The VM that the pieces are run in. Its input, output and limits
+	// can be changed between pieces, and files that a piece opens stay
+	// open for the ones after it.
+	Context *Context
+
+	parser *ast.Session
+	enums  hlir.EnumMap
+	consts hlir.Constants
+
+	// The mutable variables that have been kept from earlier pieces,
+	// initialized to the values that they had at the end of the last
+	// piece that ran successfully.
+	mutables []ast.MutStmt
+}
+
+// A Result is the value of a constant declared or an expression evaluated by
+// a piece of a program run in a Session.
+type Result struct {
+	// The name of the constant, or "" for an expression.
+	Name string
+
+	Value string
+	Type  string
+}
+
+func (r Result) String() string {
+	if r.Name == "" {
+		return fmt.Sprintf("%s : %s", r.Value, r.Type)
+	}
+	return fmt.Sprintf("%s = %s : %s", r.Name, r.Value, r.Type)
+}
+
+// NewSession returns a Session which nothing has been declared in yet.
+func NewSession() *Session {
+	ctx := NewContext()
+	ctx.Funcs = make(map[string]hlir.Func)
+	return &Session{
+		Context: ctx,
+		parser:  ast.NewSession(),
+		enums:   make(hlir.EnumMap),
+		consts:  make(hlir.Constants),
+	}
+}
+
+// Eval parses src as the next piece of the program, as described by
+// ast.Session.Parse, and runs it. It returns the value of each constant
+// that src declares and of the expression that its statements end with, if
+// any.
+func (s *Session) Eval(src string) ([]Result, error) {
+	emitLines := hlir.EmitLines
+	hlir.EmitLines = true
+	defer func() {
+		hlir.EmitLines = emitLines
+	}()
+
+	nodes, err := s.parser.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	ti, callables := s.parser.TypeInfo(), s.parser.Callables()
+	s.Context.Callables = callables
+
+	var results []Result
+	for _, n := range nodes {
+		switch v := n.(type) {
+		case ast.EnumTypeDefn:
+			_, newenums, _, err := hlir.Generate(v, ti, callables, s.enums)
+			if err != nil {
+				return results, err
+			}
+			for k, v := range newenums {
+				s.enums[k] = v
+			}
+		case ast.FuncDecl:
+			if err := s.Context.compileFunc(v, ti, s.enums, s.consts); err != nil {
+				return results, err
+			}
+		case ast.LetStmt:
+			val, err := s.Context.evaluateConstant(v, ti, s.enums, s.consts)
+			if err != nil {
+				return results, fmt.Errorf("Could not evaluate constant %v: %w", v.Var.Name, err)
+			}
+			s.consts[v.Var] = val
+			results = append(results, Result{
+				Name:  string(v.Var.Name),
+				Value: formatConstant(val, v.Var.Type()),
+				Type:  v.Var.Type().TypeName(),
+			})
+		case ast.BlockStmt:
+			r, err := s.run(v, ti)
+			if err != nil {
+				return results, err
+			}
+			results = append(results, r...)
+		}
+	}
+	return results, nil
+}
+
+// Runs the statements of block in a function of their own, after declaring
+// the mutable variables kept from earlier pieces.
+func (s *Session) run(block ast.BlockStmt, ti ast.TypeInformation) ([]Result, error) {
+	// The name can't conflict with a real function, since it isn't a
+	// valid identifier.
+	const name = "<input>"
+
+	var body ast.BlockStmt
+	for _, m := range s.mutables {
+		body.Stmts = append(body.Stmts, m)
+		body.Lines = append(body.Lines, 0)
+	}
+	fd := ast.FuncDecl{Name: name}
+
+	// An expression at the end is returned, so that its value can be
+	// printed.
+	var result ast.Value
+	if last := len(block.Stmts) - 1; last >= 0 {
+		if v, ok := block.Stmts[last].(ast.Value); ok && hasValue(v) {
+			result = v
+			if !isPrintable(v.Type(), s.parser.Types()) {
+				return nil, fmt.Errorf("Can not print a value of type %v", v.Type().TypeName())
+			}
+			block.Stmts[last] = ast.ReturnStmt{returnable(v, v.Type())}
+			fd.Return = []ast.VarWithType{{"", v.Type(), false}}
+		}
+	}
+	body.Stmts = append(body.Stmts, block.Stmts...)
+	body.Lines = append(body.Lines, block.Lines...)
+	fd.Body = body
+
+	if err := s.Context.compileFunc(fd, ti, s.enums, s.consts); err != nil {
+		return nil, err
+	}
+	defer func() {
+		delete(s.Context.Funcs, name)
+		delete(s.Context.RegisterData, name)
+		delete(s.Context.code, name)
+	}()
+
+	s.Context.frame.reset()
+	if _, _, err := RunWithSideEffects(name, s.Context); err != nil {
+		return nil, err
+	}
+
+	// Keep the values of the mutable variables for the next piece,
+	// including any that were just declared.
+	rd := s.Context.RegisterData[name]
+	for i, m := range s.mutables {
+		if v, ok := s.finalValue(m.Var, rd); ok {
+			s.mutables[i].InitialValue = v
+		}
+	}
+	for _, stmt := range block.Stmts {
+		m, ok := stmt.(ast.MutStmt)
+		if !ok {
+			continue
+		}
+		if v, ok := s.finalValue(m.Var, rd); ok {
+			m.InitialValue = v
+			s.mutables = append(s.mutables, m)
+			s.parser.Declare(m.Var, true)
+		}
+	}
+
+	if result == nil {
+		return nil, nil
+	}
+	return []Result{{
+		Value: s.formatResult(result.Type()),
+		Type:  result.Type().TypeName(),
+	}}, nil
+}
+
+// Returns true if v is an expression with a value, rather than a call to a
+// function which doesn't return anything.
+func hasValue(v ast.Value) bool {
+	if fc, ok := v.(ast.FuncCall); ok {
+		return len(fc.Returns) > 0
+	}
+	return v.Type() != nil
+}
+
+// Returns true if the value of an expression of type t can be printed by a
+// Session.
+func isPrintable(t ast.Type, types map[string]ast.TypeDefn) bool {
+	if _, ok := enumType(t, types); ok {
+		return true
+	}
+	_, ok := literalOf(value{}, t)
+	return ok
+}
+
+// Returns the enum that t is, if it's one.
+func enumType(t ast.Type, types map[string]ast.TypeDefn) (ast.EnumTypeDefn, bool) {
+	switch et := t.(type) {
+	case ast.EnumTypeDefn:
+		return et, true
+	}
+	if td, ok := types[t.TypeName()]; ok {
+		et, ok := td.ConcreteType.(ast.EnumTypeDefn)
+		return et, ok
+	}
+	return ast.EnumTypeDefn{}, false
+}
+
+// Returns the value that the mutable variable v had at the end of the
+// function whose registers are rd, as a literal.
+func (s *Session) finalValue(v ast.VarWithType, rd hlir.RegisterData) (ast.Value, bool) {
+	var regs []hlir.LocalValue
+	for r, info := range rd {
+		if lv, ok := r.(hlir.LocalValue); ok && info.Variable.Name == v.Name {
+			regs = append(regs, lv)
+		}
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i] < regs[j] })
+	if v.Type().TypeName() == "string" {
+		// The string is after its length.
+		for _, r := range regs {
+			if val := s.Context.frame.value(classLocal, int(r)); val.kind == kindString {
+				return literalOf(val, v.Type())
+			}
+		}
+		return nil, false
+	}
+	if len(regs) == 0 {
+		return nil, false
+	}
+	val := s.Context.frame.value(classLocal, int(regs[0]))
+	if val.kind == kindNone {
+		return nil, false
+	}
+	return literalOf(val, v.Type())
+}
+
+// Returns val as a literal of type t, if t is a type whose values can be
+// written as literals.
+func literalOf(val value, t ast.Type) (ast.Value, bool) {
+	if t == nil {
+		return nil, false
+	}
+	switch t.TypeName() {
+	case "string":
+		return ast.StringLiteral(strings.Replace(val.s, "\n", `\n`, -1)), true
+	case "bool":
+		return ast.BoolLiteral(val.n != 0), true
+	case "int", "uint", "int8", "uint8", "byte", "int16", "uint16", "int32", "uint32", "int64", "uint64":
+		return ast.IntLiteral(val.n), true
+	}
+	return nil, false
+}
+
+// Formats the value that the last piece run returned, which is of type t.
+func (s *Session) formatResult(t ast.Type) string {
+	fr := s.Context.frame
+	if et, ok := enumType(t, s.parser.Types()); ok {
+		variant := fr.value(classRet, 0).n
+		for _, o := range et.Options {
+			if s.enums[o.Constructor] != variant {
+				continue
+			}
+			strs := []string{o.Constructor}
+			for i := range o.Parameters {
+				strs = append(strs, fr.value(classRet, i+1).String())
+			}
+			return strings.Join(strs, " ")
+		}
+		return fmt.Sprintf("%v variant %d", t.TypeName(), variant)
+	}
+	switch t.TypeName() {
+	case "string":
+		// Depending on the expression the string is either returned
+		// on its own or after its length.
+		for i := 0; i < 2; i++ {
+			if v := fr.value(classRet, i); v.kind == kindString {
+				return fmt.Sprintf("%q", v.s)
+			}
+		}
+		return `""`
+	case "bool":
+		return fmt.Sprint(fr.value(classRet, 0).truthy())
+	}
+	return fr.value(classRet, 0).String()
+}
+
+// Formats the value of a constant of type t.
+func formatConstant(r hlir.Register, t ast.Type) string {
+	switch v := r.(type) {
+	case hlir.StringLiteral:
+		return fmt.Sprintf("%q", strings.Replace(string(v), `\n`, "\n", -1))
+	case hlir.IntLiteral:
+		if t.TypeName() == "bool" {
+			return fmt.Sprint(v != 0)
+		}
+		return fmt.Sprint(int(v))
+	}
+	return fmt.Sprint(r)
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	s := NewSession()
+	var stdout strings.Builder
+	s.Context.Stdout = &stdout
+	tests := []struct {
+		src    string
+		result string
+	}{
+		{"1 + 2", "[3 : int]"},
+		{"func double(x int) (int) {\n\treturn x * 2\n}", "[]"},
+		{"double(21)", "[42 : int]"},
+		{`let greeting = "hi"`, `[greeting = "hi" : string]`},
+		{"greeting", `["hi" : string]`},
+		{"let big = double(4) > 5", "[big = true : bool]"},
+		{"3 < 2", "[false : bool]"},
+		{"mutable n = 1", "[]"},
+		{"n = n + double(n)\nn", "[3 : int]"},
+		{"while n < 10 {\n\tn = n + 1\n}", "[]"},
+		{"PrintInt(n)", "[]"},
+		{"enum Colour = Red | Green | Blue", "[]"},
+		{"func favourite() (Colour) {\n\treturn Green\n}", "[]"},
+		{"favourite()", "[Green : Colour]"},
+	}
+	for _, tc := range tests {
+		results, err := s.Eval(tc.src)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.src, err)
+		}
+		var strs []string
+		for _, r := range results {
+			strs = append(strs, r.String())
+		}
+		if got := "[" + strings.Join(strs, " ") + "]"; got != tc.result {
+			t.Errorf("%q: unexpected results: got %v want %v", tc.src, got, tc.result)
+		}
+	}
+	if stdout.String() != "10" {
+		t.Errorf("Unexpected stdout: got %q want %q", stdout.String(), "10")
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	s := NewSession()
+	if _, err := s.Eval("mutable n = 1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{
+		"undefined(3)",
+		"n = 1 / 0",
+		"n = 5\nassert(n > 5)",
+		"func broken(",
+		"3 +",
+	} {
+		if _, err := s.Eval(src); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+	// Nothing that failed changed the variable.
+	results, err := s.Eval("n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Value != "1" {
+		t.Errorf("Unexpected results: got %v want n to be 1", results)
+	}
+}
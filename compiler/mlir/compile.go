@@ -21,7 +21,13 @@ const (
 // Compile takes an AST and writes the assembly that it compiles to to
 // w.
 func Generate(node ast.Node, typeInfo ast.TypeInformation, callables ast.Callables, enums hlir.EnumMap) (Func, hlir.EnumMap, error) {
-	hlirfunc, newenums, regData, err := hlir.Generate(node, typeInfo, callables, enums)
+	return GenerateWithConstants(node, typeInfo, callables, enums, nil)
+}
+
+// GenerateWithConstants is like Generate, but replaces uses of the top level
+// constants in consts with their values.
+func GenerateWithConstants(node ast.Node, typeInfo ast.TypeInformation, callables ast.Callables, enums hlir.EnumMap, consts hlir.Constants) (Func, hlir.EnumMap, error) {
+	hlirfunc, newenums, regData, err := hlir.GenerateWithConstants(node, typeInfo, callables, enums, consts)
 	if err != nil {
 		return Func{}, nil, err
 	}
@@ -31,6 +37,12 @@ func Generate(node ast.Node, typeInfo ast.TypeInformation, callables ast.Callabl
 	for k, v := range newenums {
 		enums[k] = v
 	}
+	return Convert(hlirfunc, callables, regData), enums, nil
+}
+
+// Convert lowers a function that has already been generated in the HLIR,
+// such as one that has been modified by a pass over the HLIR, to the MLIR.
+func Convert(hlirfunc hlir.Func, callables ast.Callables, regData hlir.RegisterData) Func {
 	branchNum = 0
 	ctx := NewContext(callables, regData)
 
@@ -40,7 +52,27 @@ func Generate(node ast.Node, typeInfo ast.TypeInformation, callables ast.Callabl
 	for _, op := range hlirfunc.Body {
 		f.Body = append(f.Body, ctx.convertOp(op, "", notComparison)...)
 	}
-	return f, enums, nil
+	return f
+}
+
+// Converts the condition c of a control flow opcode to a jump to label of
+// type jt.
+func (ctx *Context) convertCondition(c hlir.Condition, label Label, jt jumpType) []Opcode {
+	var ops []Opcode
+	for _, op := range c.Body {
+		ops = append(ops, ctx.convertOp(op, label, jt)...)
+	}
+	if len(c.Body) > 0 {
+		switch c.Body[len(c.Body)-1].(type) {
+		case hlir.EQ, hlir.NEQ, hlir.GT, hlir.GEQ, hlir.LT, hlir.LTE:
+			// The comparison was already converted to the jump.
+			return ops
+		}
+	}
+	// Condition was of the form "if x" for a boolean variable x, or a
+	// comparison that's been evaluated to a literal, so it's implicitly
+	// checking whether it's equal to true
+	return append(ops, ctx.convertOp(hlir.NEQ{Left: c.Register, Right: hlir.IntLiteral(0)}, label, jt)...)
 }
 
 func (ctx *Context) convertOp(op hlir.Opcode, conditionLabel Label, jt jumpType) []Opcode {
@@ -130,29 +162,30 @@ func (ctx *Context) convertOp(op hlir.Opcode, conditionLabel Label, jt jumpType)
 			ops = append(ops, ctx.convertOp(op, end, notComparison)...)
 		}
 		ops = append(ops, cond)
-		for _, op := range o.Condition.Body {
-			ops = append(ops, ctx.convertOp(op, end, jumpFailure)...)
-		}
+		ops = append(ops, ctx.convertCondition(o.Condition, end, jumpFailure)...)
 
+		ctx.loops = append(ctx.loops, loopLabels{cond, end})
 		for _, op := range o.Body {
 			ops = append(ops, ctx.convertOp(op, end, notComparison)...)
 		}
+		ctx.loops = ctx.loops[:len(ctx.loops)-1]
 		ops = append(ops, JMP{cond})
 		ops = append(ops, end)
 		return ops
+	case hlir.LINE:
+		// Native code doesn't keep track of where it is in the
+		// source.
+		return nil
+	case hlir.BREAK:
+		return []Opcode{JMP{ctx.loops[len(ctx.loops)-1-int(o.Depth)].end}}
+	case hlir.CONTINUE:
+		return []Opcode{JMP{ctx.loops[len(ctx.loops)-1-int(o.Depth)].cond}}
 	case hlir.IF:
 		var ops []Opcode
 		elselabel := Label(fmt.Sprintf("if%delse", branchNum))
 		end := Label(fmt.Sprintf("if%delsedone", branchNum))
 		branchNum++
-		for _, op := range o.ControlFlow.Condition.Body {
-			ops = append(ops, ctx.convertOp(op, elselabel, jumpFailure)...)
-		}
-		if len(o.ControlFlow.Condition.Body) == 0 {
-			// Condition was of the form "if x" for a boolean variable x, so it's
-			// implicitly checking whether it's equal to true
-			ops = append(ops, ctx.convertOp(hlir.NEQ{Left: o.ControlFlow.Register, Right: hlir.IntLiteral(0)}, elselabel, jumpFailure)...)
-		}
+		ops = append(ops, ctx.convertCondition(o.ControlFlow.Condition, elselabel, jumpFailure)...)
 		for _, op := range o.Body {
 			ops = append(ops, ctx.convertOp(op, elselabel, notComparison)...)
 		}
@@ -175,10 +208,7 @@ func (ctx *Context) convertOp(op hlir.Opcode, conditionLabel Label, jt jumpType)
 		end := Label(fmt.Sprintf("match%ddone", branchNum))
 
 		for i, c := range o {
-			caselabel := labels[i]
-			for _, op := range c.Condition.Body {
-				ops = append(ops, ctx.convertOp(op, caselabel, jumpSuccess)...)
-			}
+			ops = append(ops, ctx.convertCondition(c.Condition, labels[i], jumpSuccess)...)
 		}
 		ops = append(ops, JMP{end})
 		for i, c := range o {
@@ -299,15 +329,7 @@ func (ctx *Context) convertOp(op hlir.Opcode, conditionLabel Label, jt jumpType)
 		assertend := Label(fmt.Sprintf("assert%ddone", branchNum))
 		branchNum++
 
-		if len(o.Predicate.Body) == 0 {
-			// Condition was of the form "if x" for a boolean variable x, so it's
-			// implicitly checking whether it's equal to true
-			ops = append(ops, ctx.convertOp(hlir.EQ{Left: o.Predicate.Register, Right: hlir.IntLiteral(0)}, assertend, jumpFailure)...)
-		} else {
-			for _, op := range o.Predicate.Body {
-				ops = append(ops, ctx.convertOp(op, assertend, jumpSuccess)...)
-			}
-		}
+		ops = append(ops, ctx.convertCondition(o.Predicate, assertend, jumpSuccess)...)
 
 		msg := fmt.Sprintf("assertion %v failed", o.Node.PrettyPrint(0))
 		if o.Message != "" {
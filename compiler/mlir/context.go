@@ -12,6 +12,14 @@ type Context struct {
 	Callables    ast.Callables
 	RegisterData hlir.RegisterData
 	curFunc      *Func
+
+	// The labels of the loops enclosing the op currently being
+	// converted, innermost last.
+	loops []loopLabels
+}
+
+type loopLabels struct {
+	cond, end Label
 }
 
 func NewContext(c ast.Callables, rd hlir.RegisterData) *Context {
@@ -0,0 +1,262 @@
+package ssa
+
+import (
+	"math"
+
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// Returns the register that r is stored in when converted back to the
+// MLIR.
+func location(r mlir.Register) mlir.Register {
+	if v, ok := r.(*Value); ok {
+		return v.Var
+	}
+	return r
+}
+
+func isTemp(r mlir.Register) bool {
+	switch r.(type) {
+	case mlir.TempValue, mlir.UTempValue:
+		return true
+	}
+	return false
+}
+
+// The value that each variable holds at a point in a function.
+type holdings map[mlir.Register]*Value
+
+func (h holdings) copy() holdings {
+	c := make(holdings, len(h))
+	for r, v := range h {
+		c[r] = v
+	}
+	return c
+}
+
+// Updates h for the result of running i.
+func (h holdings) run(i *Instr) {
+	if i.Op == Call {
+		// The backend doesn't preserve TempValues across calls.
+		for r := range h {
+			if isTemp(r) {
+				delete(h, r)
+			}
+		}
+	}
+	if v, ok := i.Dst.(*Value); ok {
+		h[v.Var] = v
+	}
+}
+
+// The values which are held by their variables at the start of each block.
+//
+// Since the optimizations replace reads of one value with another, and
+// converting back from SSA stores each value in its original variable,
+// a read can only be replaced with a value that's still in its variable at
+// that point.
+type availability struct {
+	in map[*Block]holdings
+}
+
+func (f *Func) availability() *availability {
+	a := &availability{in: make(map[*Block]holdings)}
+	_, order := dominators(f)
+	out := make(map[*Block]holdings)
+	entry := f.Blocks[0]
+	for changed := true; changed; {
+		changed = false
+		for _, b := range order {
+			var in holdings
+			if b == entry {
+				in = make(holdings)
+				for r, v := range f.Vars {
+					in[r] = v
+				}
+			}
+			for _, p := range b.Preds {
+				o, ok := out[p]
+				if !ok {
+					continue
+				}
+				if in == nil {
+					in = o.copy()
+					continue
+				}
+				for r, v := range in {
+					if o[r] != v {
+						delete(in, r)
+					}
+				}
+			}
+			if in == nil {
+				in = make(holdings)
+			}
+			for _, phi := range b.Phis {
+				in.run(phi)
+			}
+			if old, ok := a.in[b]; ok && sameHoldings(old, in) {
+				continue
+			}
+			a.in[b] = in
+			o := in.copy()
+			for _, i := range b.Instrs {
+				o.run(i)
+			}
+			out[b] = o
+			changed = true
+		}
+	}
+	return a
+}
+
+func sameHoldings(a, b holdings) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for r, v := range a {
+		if b[r] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the variable of v holds v before the idx'th instruction of
+// b, or at the end of b if idx is the number of instructions in it.
+func (a *availability) holds(v *Value, b *Block, idx int) bool {
+	if isTemp(v.Var) {
+		// The backend only knows which register a TempValue is in
+		// after it's written to, and the order that it sees the code
+		// in isn't the order that it runs in, so TempValues can only be
+		// read in the same block that they're written in.
+		if v.Def == nil || v.Def.Op == Phi || v.Def.Block != b {
+			return false
+		}
+		if def := indexOf(b, v.Def); def < 0 || def >= idx {
+			return false
+		}
+	}
+	h := a.in[b].copy()
+	for _, i := range b.Instrs[:idx] {
+		h.run(i)
+	}
+	return h[v.Var] == v
+}
+
+func indexOf(b *Block, i *Instr) int {
+	for j, instr := range b.Instrs {
+		if instr == i {
+			return j
+		}
+	}
+	return -1
+}
+
+// A use is a read of a register by an instruction, or by the comparison at
+// the end of a block.
+type use struct {
+	// The instruction, or nil if it's the comparison at the end of b.
+	i   *Instr
+	b   *Block
+	arg int
+}
+
+func (u use) get() mlir.Register {
+	if u.i == nil {
+		return u.b.CondArgs[u.arg]
+	}
+	return u.i.Args[u.arg]
+}
+
+func (u use) set(r mlir.Register) {
+	if u.i == nil {
+		u.b.CondArgs[u.arg] = r
+	} else {
+		u.i.Args[u.arg] = r
+	}
+}
+
+// Returns the block and index of the instruction where the use reads its
+// register. A phi reads its argument at the end of the predecessor that it
+// comes from.
+func (u use) point() (*Block, int) {
+	switch {
+	case u.i == nil:
+		return u.b, len(u.b.Instrs)
+	case u.i.Op == Phi:
+		p := u.b.Preds[u.arg]
+		return p, len(p.Instrs)
+	}
+	return u.b, indexOf(u.b, u.i)
+}
+
+// Returns every use of each value in f.
+func (f *Func) uses() map[*Value][]use {
+	uses := make(map[*Value][]use)
+	add := func(u use) {
+		if v, ok := u.get().(*Value); ok {
+			uses[v] = append(uses[v], u)
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, i := range b.Phis {
+			for j := range i.Args {
+				add(use{i, b, j})
+			}
+		}
+		for _, i := range b.Instrs {
+			for j := range i.Args {
+				add(use{i, b, j})
+			}
+		}
+		if b.Term == Branch {
+			add(use{nil, b, 0})
+			add(use{nil, b, 1})
+		}
+	}
+	return uses
+}
+
+// Returns true if the read of old by u can be replaced by r, without
+// changing the meaning of the program or generating code that the backend
+// can't handle.
+func (a *availability) canReplace(u use, old *Value, r mlir.Register) bool {
+	if u.i != nil && u.i.Op == Mod && u.arg == 0 && r.Signed() != old.Signed() {
+		// The signedness of the left side decides which division
+		// instruction is used.
+		return false
+	}
+	if u.i != nil && u.i.Op == Sub {
+		// A SUB is converted back to a copy of the left side to the
+		// destination followed by the subtraction, which would
+		// overwrite the right side if it's in the destination.
+		args := []mlir.Register{location(u.i.Args[0]), location(u.i.Args[1])}
+		args[u.arg] = location(r)
+		dst := location(u.i.Dst)
+		if sameRegister(args[1], dst) && !sameRegister(args[0], dst) {
+			return false
+		}
+	}
+	switch n := r.(type) {
+	case mlir.IntLiteral:
+		if u.i != nil && u.i.Op == Copy {
+			return true
+		}
+		// Other instructions only take 32 bit immediates.
+		return n >= math.MinInt32 && n <= math.MaxInt32
+	case *Value:
+		if n == old {
+			return false
+		}
+		if u.i != nil && u.i.Op == Phi && !sameRegister(n.Var, phiVar(u.i)) {
+			// Phis are converted back by copying their arguments
+			// into their variable, which may overwrite another
+			// argument if it's in a different variable.
+			return false
+		}
+		b, idx := u.point()
+		return a.holds(n, b, idx)
+	}
+	return false
+}
@@ -0,0 +1,485 @@
+package ssa
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// Build converts f to SSA form.
+func Build(f mlir.Func) *Func {
+	sf := &Func{
+		Name:            f.Name,
+		NumArgs:         f.NumArgs,
+		NumLocals:       f.NumLocals,
+		LargestFuncCall: f.LargestFuncCall,
+		Vars:            make(map[mlir.Register]*Value),
+	}
+	vars := variables(f.Body)
+	for _, v := range vars {
+		sf.Vars[v] = sf.newValue(v, nil)
+	}
+	sf.split(f.Body)
+	sf.removeUnreachable()
+
+	idom, order := dominators(sf)
+	sf.insertPhis(vars, idom, order)
+	sf.rename(idom, order)
+	return sf
+}
+
+// Returns true if r is a type of register that can be converted to values.
+// It doesn't mean that it will be, since a LocalValue whose address is
+// taken can't be.
+func isVar(r mlir.Register) bool {
+	switch r.(type) {
+	case mlir.TempValue, mlir.UTempValue, mlir.LocalValue:
+		return true
+	}
+	return false
+}
+
+// Returns true if a and b are the same register. Registers which contain
+// an ast.Type can't be compared with ==, since some types are slices.
+func sameRegister(a, b mlir.Register) bool {
+	switch a.(type) {
+	case mlir.TempValue, mlir.UTempValue, mlir.LocalValue, mlir.IntLiteral, mlir.StringLiteral, mlir.FuncRetVal, mlir.FuncCallArg, *Value:
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Returns the registers used in body which can be converted to values, in
+// the order that they're first used.
+func variables(body []mlir.Opcode) []mlir.Register {
+	// LocalValues are laid out in memory in order, so indexing from the
+	// address of one may reach any LocalValue after it.
+	lowestAddressed := -1
+	addressed := func(r mlir.Register) {
+		for {
+			switch v := r.(type) {
+			case mlir.Offset:
+				r = v.Base
+				continue
+			case mlir.LocalValue:
+				if lowestAddressed < 0 || int(v.Id) < lowestAddressed {
+					lowestAddressed = int(v.Id)
+				}
+			}
+			return
+		}
+	}
+
+	// Registers used to calculate an address are excluded, since the
+	// amd64 backend keeps copies of them in physical registers without
+	// updating them when the register is written to.
+	excluded := make(map[mlir.Register]bool)
+	var exclude func(r mlir.Register)
+	exclude = func(r mlir.Register) {
+		switch v := r.(type) {
+		case mlir.Offset:
+			exclude(v.Offset)
+			exclude(v.Base)
+		case mlir.Pointer:
+			exclude(v.Register)
+		case mlir.SliceBasePointer:
+			exclude(v.Register)
+		default:
+			if isVar(r) {
+				excluded[r] = true
+			}
+		}
+	}
+
+	var vars []mlir.Register
+	seen := make(map[mlir.Register]bool)
+	infos := make(map[uint]mlir.LocalValue)
+	for _, op := range body {
+		if mov, ok := op.(mlir.MOV); ok {
+			if _, ok := mov.Src.(mlir.Pointer); ok {
+				// The backend treats the destination as the base
+				// of a slice from then on.
+				exclude(mov.Dst)
+			}
+		}
+		for _, r := range op.Registers() {
+			switch v := r.(type) {
+			case mlir.Offset:
+				addressed(v.Base)
+				exclude(v)
+			case mlir.Pointer:
+				addressed(v.Register)
+				exclude(v)
+			case mlir.SliceBasePointer:
+				addressed(v.Register)
+				exclude(v)
+			case mlir.LocalValue:
+				if lv, ok := infos[v.Id]; ok && lv != v {
+					// The same LocalValue with different sizes
+					// can't be tracked as one register.
+					excluded[lv] = true
+					excluded[v] = true
+				}
+				infos[v.Id] = v
+			}
+			if isVar(r) && !seen[r] {
+				seen[r] = true
+				vars = append(vars, r)
+			}
+		}
+	}
+
+	var result []mlir.Register
+	for _, r := range vars {
+		if excluded[r] {
+			continue
+		}
+		if lv, ok := r.(mlir.LocalValue); ok {
+			if lv.Size() != 8 || (lowestAddressed >= 0 && int(lv.Id) >= lowestAddressed) {
+				continue
+			}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// Returns the *Value for r if it's a variable of f, or r if it isn't.
+func (f *Func) lookup(r mlir.Register, current map[mlir.Register][]*Value) mlir.Register {
+	if !isVar(r) {
+		return r
+	}
+	if stack, ok := current[r]; ok {
+		return stack[len(stack)-1]
+	}
+	return r
+}
+
+func addEdge(from, to *Block) {
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
+
+// Splits body into the blocks of f, without converting any registers to
+// values.
+func (f *Func) split(body []mlir.Opcode) {
+	labels := make(map[mlir.Label]*Block)
+	jumps := make(map[*Block]mlir.Label)
+	var cur *Block
+	block := func() *Block {
+		if cur == nil {
+			cur = &Block{}
+			f.Blocks = append(f.Blocks, cur)
+		}
+		return cur
+	}
+	branch := func(c Cmp, j mlir.ConditionalJump) {
+		b := block()
+		b.Term = Branch
+		b.Cond = c
+		b.CondArgs = [2]mlir.Register{j.Src, j.Dst}
+		jumps[b] = j.Label
+		cur = nil
+	}
+	instr := func(i *Instr) {
+		b := block()
+		i.Block = b
+		b.Instrs = append(b.Instrs, i)
+	}
+	for _, op := range body {
+		switch o := op.(type) {
+		case mlir.Label:
+			if cur != nil && (cur.Label != "" || len(cur.Instrs) > 0) {
+				cur = nil
+			}
+			b := block()
+			b.Label = o
+			labels[o] = b
+		case mlir.JMP:
+			b := block()
+			b.Term = Jump
+			jumps[b] = o.Label
+			cur = nil
+		case mlir.JE:
+			branch(EQ, o.ConditionalJump)
+		case mlir.JNE:
+			branch(NE, o.ConditionalJump)
+		case mlir.JL:
+			branch(LT, o.ConditionalJump)
+		case mlir.JLE:
+			branch(LE, o.ConditionalJump)
+		case mlir.JG:
+			branch(GT, o.ConditionalJump)
+		case mlir.JGE:
+			branch(GE, o.ConditionalJump)
+		case mlir.RET:
+			block().Term = Return
+			cur = nil
+		case mlir.MOV:
+			instr(&Instr{Op: Copy, Dst: o.Dst, Args: []mlir.Register{o.Src}})
+		case mlir.ADD:
+			instr(&Instr{Op: Add, Dst: o.Dst, Args: []mlir.Register{o.Dst, o.Src}})
+		case mlir.SUB:
+			instr(&Instr{Op: Sub, Dst: o.Dst, Args: []mlir.Register{o.Dst, o.Src}})
+		case mlir.MUL:
+			instr(&Instr{Op: Mul, Dst: o.Dst, Args: []mlir.Register{o.Left, o.Right}})
+		case mlir.DIV:
+			instr(&Instr{Op: Div, Dst: o.Dst, Args: []mlir.Register{o.Left, o.Right}})
+		case mlir.MOD:
+			instr(&Instr{Op: Mod, Dst: o.Dst, Args: []mlir.Register{o.Left, o.Right}})
+		case mlir.CALL:
+			args := make([]mlir.Register, len(o.Args))
+			copy(args, o.Args)
+			instr(&Instr{Op: Call, Args: args, FName: o.FName, TailCall: o.TailCall})
+		default:
+			panic(fmt.Sprintf("Unhandled opcode converting to SSA: %v", reflect.TypeOf(op)))
+		}
+	}
+	if len(f.Blocks) == 0 || f.Blocks[len(f.Blocks)-1].Term == Branch {
+		// Make sure that there's a block for the function to start
+		// in, and for a branch at the end to continue to.
+		block()
+	}
+
+	target := func(l mlir.Label) *Block {
+		b, ok := labels[l]
+		if !ok {
+			panic(fmt.Sprintf("Jump to unknown label %v", l.Inline()))
+		}
+		return b
+	}
+	for i, b := range f.Blocks {
+		switch b.Term {
+		case Fallthrough:
+			if i+1 < len(f.Blocks) {
+				addEdge(b, f.Blocks[i+1])
+			}
+		case Jump:
+			addEdge(b, target(jumps[b]))
+		case Branch:
+			addEdge(b, target(jumps[b]))
+			addEdge(b, f.Blocks[i+1])
+		}
+	}
+}
+
+// Removes the blocks which can't be reached from the entry block, and
+// numbers the rest.
+func (f *Func) removeUnreachable() {
+	reachable := make(map[*Block]bool)
+	var visit func(*Block)
+	visit = func(b *Block) {
+		if reachable[b] {
+			return
+		}
+		reachable[b] = true
+		for _, s := range b.Succs {
+			visit(s)
+		}
+	}
+	visit(f.Blocks[0])
+
+	blocks := f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if reachable[b] {
+			blocks = append(blocks, b)
+			continue
+		}
+		for _, s := range b.Succs {
+			if reachable[s] {
+				s.removePred(b)
+			}
+		}
+	}
+	f.Blocks = blocks
+	for i, b := range f.Blocks {
+		b.ID = i
+	}
+}
+
+// Removes the edges from p to b from the predecessors of b, along with the
+// arguments of the phis in b which come from them.
+func (b *Block) removePred(p *Block) {
+	for i := 0; i < len(b.Preds); {
+		if b.Preds[i] != p {
+			i++
+			continue
+		}
+		b.Preds = append(b.Preds[:i:i], b.Preds[i+1:]...)
+		for _, phi := range b.Phis {
+			phi.Args = append(phi.Args[:i:i], phi.Args[i+1:]...)
+		}
+	}
+}
+
+// Returns the registers read by b before writing to them, and the
+// registers written by b. Only variables of f are included.
+func (f *Func) useDef(b *Block) (use, def map[mlir.Register]bool) {
+	use, def = make(map[mlir.Register]bool), make(map[mlir.Register]bool)
+	read := func(r mlir.Register) {
+		if isVar(r) && f.Vars[r] != nil && !def[r] {
+			use[r] = true
+		}
+	}
+	for _, i := range b.Instrs {
+		for _, a := range i.Args {
+			read(a)
+		}
+		if i.Dst != nil && isVar(i.Dst) && f.Vars[i.Dst] != nil {
+			def[i.Dst] = true
+		}
+	}
+	if b.Term == Branch {
+		read(b.CondArgs[0])
+		read(b.CondArgs[1])
+	}
+	return use, def
+}
+
+// Returns the variables which are live at the start of each block, before
+// the blocks are converted to SSA form.
+func (f *Func) liveIn() map[*Block]map[mlir.Register]bool {
+	uses := make(map[*Block]map[mlir.Register]bool)
+	defs := make(map[*Block]map[mlir.Register]bool)
+	live := make(map[*Block]map[mlir.Register]bool)
+	for _, b := range f.Blocks {
+		uses[b], defs[b] = f.useDef(b)
+		live[b] = make(map[mlir.Register]bool)
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(f.Blocks) - 1; i >= 0; i-- {
+			b := f.Blocks[i]
+			in := live[b]
+			add := func(r mlir.Register) {
+				if !in[r] {
+					in[r] = true
+					changed = true
+				}
+			}
+			for r := range uses[b] {
+				add(r)
+			}
+			for _, s := range b.Succs {
+				for r := range live[s] {
+					if !defs[b][r] {
+						add(r)
+					}
+				}
+			}
+		}
+	}
+	return live
+}
+
+// Inserts a phi for each variable at the start of each block where
+// different assignments to it meet, if the variable is read afterwards.
+func (f *Func) insertPhis(vars []mlir.Register, idom map[*Block]*Block, order []*Block) {
+	frontiers := dominanceFrontiers(idom, order)
+	live := f.liveIn()
+	for _, v := range vars {
+		var work []*Block
+		for _, b := range f.Blocks {
+			for _, i := range b.Instrs {
+				if i.Dst != nil && sameRegister(i.Dst, v) {
+					work = append(work, b)
+					break
+				}
+			}
+		}
+		hasPhi := make(map[*Block]bool)
+		for len(work) > 0 {
+			b := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, d := range frontiers[b] {
+				if hasPhi[d] || !live[d][v] {
+					continue
+				}
+				hasPhi[d] = true
+				phi := &Instr{Op: Phi, Dst: v, Args: make([]mlir.Register, len(d.Preds)), Block: d}
+				for i := range phi.Args {
+					phi.Args[i] = v
+				}
+				d.Phis = append(d.Phis, phi)
+				work = append(work, d)
+			}
+		}
+	}
+}
+
+// Returns the variable that a phi chooses a value for.
+func phiVar(phi *Instr) mlir.Register {
+	if v, ok := phi.Dst.(*Value); ok {
+		return v.Var
+	}
+	return phi.Dst
+}
+
+// Replaces every read and write of a variable with the value that it
+// refers to.
+func (f *Func) rename(idom map[*Block]*Block, order []*Block) {
+	children := make(map[*Block][]*Block)
+	for _, b := range order {
+		if d := idom[b]; d != b {
+			children[d] = append(children[d], b)
+		}
+	}
+
+	current := make(map[mlir.Register][]*Value)
+	for r, v := range f.Vars {
+		current[r] = []*Value{v}
+	}
+	define := func(i *Instr) mlir.Register {
+		if !isVar(i.Dst) {
+			return nil
+		}
+		if _, ok := current[i.Dst]; !ok {
+			return nil
+		}
+		v := f.newValue(i.Dst, i)
+		current[i.Dst] = append(current[i.Dst], v)
+		i.Dst = v
+		return v.Var
+	}
+
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		var defined []mlir.Register
+		for _, phi := range b.Phis {
+			if r := define(phi); r != nil {
+				defined = append(defined, r)
+			}
+		}
+		for _, i := range b.Instrs {
+			for j, a := range i.Args {
+				i.Args[j] = f.lookup(a, current)
+			}
+			if r := define(i); r != nil {
+				defined = append(defined, r)
+			}
+		}
+		if b.Term == Branch {
+			for j, a := range b.CondArgs {
+				b.CondArgs[j] = f.lookup(a, current)
+			}
+		}
+		for _, s := range b.Succs {
+			for k, p := range s.Preds {
+				if p != b {
+					continue
+				}
+				for _, phi := range s.Phis {
+					phi.Args[k] = f.lookup(phiVar(phi), current)
+				}
+			}
+		}
+		for _, c := range children[b] {
+			visit(c)
+		}
+		for _, r := range defined {
+			current[r] = current[r][:len(current[r])-1]
+		}
+	}
+	visit(f.Blocks[0])
+}
@@ -0,0 +1,67 @@
+package ssa
+
+import (
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// Returns the register that the result of i is always a copy of, or nil if
+// it isn't a copy. A phi is a copy if every argument other than the phi
+// itself is the same.
+func copyOf(i *Instr) mlir.Register {
+	switch i.Op {
+	case Copy:
+		switch src := i.Args[0].(type) {
+		case *Value, mlir.IntLiteral:
+			return src
+		}
+	case Phi:
+		var src mlir.Register
+		for _, a := range i.Args {
+			if a == i.Dst {
+				continue
+			}
+			switch a.(type) {
+			case *Value, mlir.IntLiteral:
+			default:
+				return nil
+			}
+			if src != nil && src != a {
+				return nil
+			}
+			src = a
+		}
+		return src
+	}
+	return nil
+}
+
+// CopyPropagation replaces reads of values which are copies of another
+// value or an integer literal with what they're a copy of. Returns true if
+// anything was replaced.
+//
+// The copies themselves are left in place for DeadCode to remove once
+// nothing reads them.
+func CopyPropagation(f *Func) bool {
+	av := f.availability()
+	uses := f.uses()
+	changed := false
+	for _, b := range f.Blocks {
+		for _, i := range append(b.Phis[:len(b.Phis):len(b.Phis)], b.Instrs...) {
+			dst, ok := i.Dst.(*Value)
+			if !ok {
+				continue
+			}
+			src := copyOf(i)
+			if src == nil {
+				continue
+			}
+			for _, u := range uses[dst] {
+				if u.get() == dst && av.canReplace(u, dst, src) {
+					u.set(src)
+					changed = true
+				}
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,69 @@
+package ssa
+
+import (
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// Returns true if i can be removed when nothing reads its result.
+func removable(i *Instr) bool {
+	if _, ok := i.Dst.(*Value); !ok {
+		return false
+	}
+	switch i.Op {
+	case Copy, Add, Sub, Mul, Phi:
+		return true
+	case Div, Mod:
+		// A division by 0 (or of the smallest integer by -1) crashes
+		// the program, so it needs to stay unless it can't happen.
+		r, ok := i.Args[1].(mlir.IntLiteral)
+		return ok && r != 0 && r != -1
+	}
+	return false
+}
+
+// DeadCode removes the instructions whose results are never read. Returns
+// true if anything was removed.
+func DeadCode(f *Func) bool {
+	removed := false
+	for {
+		read := make(map[*Value]bool)
+		for v, us := range f.uses() {
+			for _, u := range us {
+				// A phi which is only read by itself is still
+				// dead.
+				if u.i == nil || u.i.Dst != v {
+					read[v] = true
+				}
+			}
+		}
+		dead := func(i *Instr) bool {
+			return removable(i) && !read[i.Dst.(*Value)]
+		}
+		changed := false
+		for _, b := range f.Blocks {
+			phis := b.Phis[:0]
+			for _, i := range b.Phis {
+				if dead(i) {
+					changed = true
+					continue
+				}
+				phis = append(phis, i)
+			}
+			b.Phis = phis
+
+			instrs := b.Instrs[:0]
+			for _, i := range b.Instrs {
+				if dead(i) {
+					changed = true
+					continue
+				}
+				instrs = append(instrs, i)
+			}
+			b.Instrs = instrs
+		}
+		if !changed {
+			return removed
+		}
+		removed = true
+	}
+}
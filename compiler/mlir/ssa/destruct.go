@@ -0,0 +1,219 @@
+package ssa
+
+import (
+	"fmt"
+
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// MLIR converts f back to the MLIR. Every value is stored in the variable
+// that it came from, and each phi is replaced by copying its argument into
+// its variable on the edges where the argument isn't already there.
+func (f *Func) MLIR() mlir.Func {
+	mf := mlir.Func{
+		Name:            f.Name,
+		NumArgs:         f.NumArgs,
+		NumLocals:       f.NumLocals,
+		LargestFuncCall: f.LargestFuncCall,
+	}
+	d := &destructor{f: f, targets: make(map[*Block]bool)}
+	// Every block that's jumped to needs a label before any code that
+	// jumps to it is emitted, since it may be a jump backwards.
+	for i, b := range f.Blocks {
+		for k, s := range b.Succs {
+			if (b.Term == Branch && k == 0) || i+1 >= len(f.Blocks) || s != f.Blocks[i+1] {
+				d.label(s)
+			}
+		}
+	}
+	for i, b := range f.Blocks {
+		var next *Block
+		if i+1 < len(f.Blocks) {
+			next = f.Blocks[i+1]
+		}
+		d.block(b, next)
+	}
+	if len(d.edges) > 0 {
+		// The code for edges goes after the rest of the function,
+		// which can't fall through into it.
+		if len(d.body) > 0 {
+			switch d.body[len(d.body)-1].(type) {
+			case mlir.RET, mlir.JMP:
+			default:
+				d.body = append(d.body, mlir.RET{})
+			}
+		}
+		d.body = append(d.body, d.edges...)
+	}
+	mf.Body = d.body
+	return mf
+}
+
+type destructor struct {
+	f *Func
+
+	body []mlir.Opcode
+	// The code for the edges out of conditional jumps which need to
+	// copy a phi argument.
+	edges []mlir.Opcode
+
+	numLabels int
+	// The blocks which are jumped to. Other blocks don't need a label.
+	targets map[*Block]bool
+}
+
+// Returns the label of b, giving it one if it doesn't have one.
+func (d *destructor) label(b *Block) mlir.Label {
+	if b.Label == "" {
+		b.Label = d.newLabel()
+	}
+	d.targets[b] = true
+	return b.Label
+}
+
+func (d *destructor) newLabel() mlir.Label {
+	d.numLabels++
+	return mlir.Label(fmt.Sprintf("ssa%d", d.numLabels-1))
+}
+
+// Returns the copies needed for the phis at the other end of the k'th edge
+// out of b.
+func phiCopies(b *Block, k int) []mlir.Opcode {
+	succ := b.Succs[k]
+	// If b has multiple edges to succ, they're in the same order in
+	// b.Succs and succ.Preds.
+	n := 0
+	for _, s := range b.Succs[:k] {
+		if s == succ {
+			n++
+		}
+	}
+	pred := -1
+	for j, p := range succ.Preds {
+		if p == b {
+			if n == 0 {
+				pred = j
+				break
+			}
+			n--
+		}
+	}
+
+	var ops []mlir.Opcode
+	for _, phi := range succ.Phis {
+		src, dst := location(phi.Args[pred]), phiVar(phi)
+		if !sameRegister(src, dst) {
+			ops = append(ops, mlir.MOV{Src: src, Dst: dst})
+		}
+	}
+	return ops
+}
+
+func (d *destructor) emit(ops ...mlir.Opcode) {
+	d.body = append(d.body, ops...)
+}
+
+// Converts b back to the MLIR. next is the block after it, if any.
+func (d *destructor) block(b *Block, next *Block) {
+	if d.targets[b] {
+		d.emit(b.Label)
+	}
+	for _, i := range b.Instrs {
+		d.instr(i)
+	}
+	// Continues to the k'th successor of b without a jump if it's the
+	// next block.
+	continueTo := func(k int) {
+		d.emit(phiCopies(b, k)...)
+		if s := b.Succs[k]; s != next {
+			d.emit(mlir.JMP{Label: d.label(s)})
+		}
+	}
+	switch b.Term {
+	case Fallthrough:
+		if len(b.Succs) == 0 {
+			if next != nil {
+				d.emit(mlir.RET{})
+			}
+			return
+		}
+		continueTo(0)
+	case Jump:
+		continueTo(0)
+	case Branch:
+		target := d.label(b.Succs[0])
+		if copies := phiCopies(b, 0); len(copies) > 0 {
+			edge := d.newLabel()
+			d.edges = append(d.edges, edge)
+			d.edges = append(d.edges, copies...)
+			d.edges = append(d.edges, mlir.JMP{Label: target})
+			target = edge
+		}
+		l, r, cmp := location(b.CondArgs[0]), location(b.CondArgs[1]), b.Cond
+		if isTemp(r) && !isTemp(l) {
+			// The backend only supports comparing to a
+			// TempValue if the left side is also one.
+			l, r, cmp = r, l, cmp.swapped()
+		}
+		d.emit(conditionalJump(cmp, mlir.ConditionalJump{Label: target, Src: l, Dst: r}))
+		continueTo(1)
+	case Return:
+		d.emit(mlir.RET{})
+	}
+}
+
+func conditionalJump(c Cmp, j mlir.ConditionalJump) mlir.Opcode {
+	switch c {
+	case EQ:
+		return mlir.JE{ConditionalJump: j}
+	case NE:
+		return mlir.JNE{ConditionalJump: j}
+	case LT:
+		return mlir.JL{ConditionalJump: j}
+	case LE:
+		return mlir.JLE{ConditionalJump: j}
+	case GT:
+		return mlir.JG{ConditionalJump: j}
+	case GE:
+		return mlir.JGE{ConditionalJump: j}
+	}
+	panic("Unknown comparison")
+}
+
+func (d *destructor) instr(i *Instr) {
+	args := make([]mlir.Register, len(i.Args))
+	for j, a := range i.Args {
+		args[j] = location(a)
+	}
+	dst := location(i.Dst)
+	switch i.Op {
+	case Copy:
+		if !sameRegister(args[0], dst) {
+			d.emit(mlir.MOV{Src: args[0], Dst: dst})
+		}
+	case Add:
+		switch {
+		case sameRegister(args[0], dst):
+			d.emit(mlir.ADD{Src: args[1], Dst: dst})
+		case sameRegister(args[1], dst):
+			d.emit(mlir.ADD{Src: args[0], Dst: dst})
+		default:
+			d.emit(mlir.MOV{Src: args[0], Dst: dst}, mlir.ADD{Src: args[1], Dst: dst})
+		}
+	case Sub:
+		if !sameRegister(args[0], dst) {
+			d.emit(mlir.MOV{Src: args[0], Dst: dst})
+		}
+		d.emit(mlir.SUB{Src: args[1], Dst: dst})
+	case Mul:
+		d.emit(mlir.MUL{Left: args[0], Right: args[1], Dst: dst})
+	case Div:
+		d.emit(mlir.DIV{Left: args[0], Right: args[1], Dst: dst})
+	case Mod:
+		d.emit(mlir.MOD{Left: args[0], Right: args[1], Dst: dst})
+	case Call:
+		d.emit(mlir.CALL{FName: i.FName, Args: args, TailCall: i.TailCall})
+	default:
+		panic(fmt.Sprintf("Unhandled instruction converting from SSA: %v", i))
+	}
+}
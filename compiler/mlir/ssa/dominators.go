@@ -0,0 +1,109 @@
+package ssa
+
+// Returns the immediate dominator of each block in f, and the blocks in
+// reverse postorder. The entry block is its own immediate dominator.
+//
+// This uses the algorithm from "A Simple, Fast Dominance Algorithm" by
+// Cooper, Harvey and Kennedy, which works well for the small graphs of
+// most functions.
+func dominators(f *Func) (map[*Block]*Block, []*Block) {
+	var order []*Block
+	seen := make(map[*Block]bool)
+	var visit func(*Block)
+	visit = func(b *Block) {
+		seen[b] = true
+		for _, s := range b.Succs {
+			if !seen[s] {
+				visit(s)
+			}
+		}
+		order = append(order, b)
+	}
+	entry := f.Blocks[0]
+	visit(entry)
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	rpo := make(map[*Block]int)
+	for i, b := range order {
+		rpo[b] = i
+	}
+
+	idom := map[*Block]*Block{entry: entry}
+	intersect := func(a, b *Block) *Block {
+		for a != b {
+			for rpo[a] > rpo[b] {
+				a = idom[a]
+			}
+			for rpo[b] > rpo[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range order[1:] {
+			var d *Block
+			for _, p := range b.Preds {
+				if idom[p] == nil {
+					continue
+				}
+				if d == nil {
+					d = p
+				} else {
+					d = intersect(p, d)
+				}
+			}
+			if idom[b] != d {
+				idom[b] = d
+				changed = true
+			}
+		}
+	}
+	return idom, order
+}
+
+// Returns true if a dominates b.
+func dominates(idom map[*Block]*Block, a, b *Block) bool {
+	for {
+		if a == b {
+			return true
+		}
+		if idom[b] == b {
+			return false
+		}
+		b = idom[b]
+	}
+}
+
+// Returns the dominance frontier of each block: the blocks which it doesn't
+// strictly dominate, but dominates a predecessor of.
+func dominanceFrontiers(idom map[*Block]*Block, order []*Block) map[*Block][]*Block {
+	frontiers := make(map[*Block][]*Block)
+	for _, b := range order {
+		if len(b.Preds) < 2 {
+			continue
+		}
+		for _, p := range b.Preds {
+			for runner := p; runner != idom[b]; runner = idom[runner] {
+				if !containsBlock(frontiers[runner], b) {
+					frontiers[runner] = append(frontiers[runner], b)
+				}
+				if runner == idom[runner] {
+					break
+				}
+			}
+		}
+	}
+	return frontiers
+}
+
+func containsBlock(blocks []*Block, b *Block) bool {
+	for _, blk := range blocks {
+		if blk == b {
+			return true
+		}
+	}
+	return false
+}
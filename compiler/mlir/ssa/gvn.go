@@ -0,0 +1,91 @@
+package ssa
+
+import (
+	"fmt"
+
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// The operation and operands of an arithmetic instruction, which are the
+// same for every instruction that computes the same result.
+type expression struct {
+	op   Op
+	l, r mlir.Register
+}
+
+// Returns the expression computed by i, if it's an arithmetic instruction
+// on values and literals.
+func expressionOf(i *Instr) (expression, bool) {
+	switch i.Op {
+	case Add, Sub, Mul, Div, Mod:
+	default:
+		return expression{}, false
+	}
+	if _, ok := i.Dst.(*Value); !ok {
+		return expression{}, false
+	}
+	for _, a := range i.Args {
+		switch a.(type) {
+		case *Value, mlir.IntLiteral:
+		default:
+			return expression{}, false
+		}
+	}
+	e := expression{i.Op, i.Args[0], i.Args[1]}
+	if (e.op == Add || e.op == Mul) && fmt.Sprint(e.l) > fmt.Sprint(e.r) {
+		e.l, e.r = e.r, e.l
+	}
+	return e, true
+}
+
+// ValueNumbering finds arithmetic instructions which compute the same
+// expression as an instruction that dominates them, and replaces reads of
+// their result with the result of the earlier instruction. Returns true if
+// anything was replaced.
+//
+// Since the earlier result needs to still be in its register where it's
+// read, this mostly finds repeated calculations in the same block.
+func ValueNumbering(f *Func) bool {
+	idom, order := dominators(f)
+	children := make(map[*Block][]*Block)
+	for _, b := range order {
+		if d := idom[b]; d != b {
+			children[d] = append(children[d], b)
+		}
+	}
+	av := f.availability()
+	uses := f.uses()
+	changed := false
+
+	available := make(map[expression]*Value)
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		var added []expression
+		for _, i := range b.Instrs {
+			e, ok := expressionOf(i)
+			if !ok {
+				continue
+			}
+			dst := i.Dst.(*Value)
+			if prev, ok := available[e]; ok {
+				for _, u := range uses[dst] {
+					if u.get() == dst && av.canReplace(u, dst, prev) {
+						u.set(prev)
+						changed = true
+					}
+				}
+				continue
+			}
+			available[e] = dst
+			added = append(added, e)
+		}
+		for _, c := range children[b] {
+			visit(c)
+		}
+		for _, e := range added {
+			delete(available, e)
+		}
+	}
+	visit(f.Blocks[0])
+	return changed
+}
@@ -0,0 +1,418 @@
+package ssa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/driusan/lang/compiler/mlir"
+	"github.com/driusan/lang/parser/ast"
+)
+
+// An interpreter for the MLIR, so that tests can check what a program does
+// before and after converting it to SSA form without assembling it.
+//
+// Memory is a flat array of bytes. Each call gets a new area for its local
+// values laid out the same way as the amd64 backend does, and an area for
+// the arguments of the functions that it calls, which is where the callee
+// finds its FuncArgs.
+type machine struct {
+	funcs map[mlir.Fname]mlir.Func
+
+	mem []byte
+	sp  int
+
+	// String literals are stored after the stack, so that they aren't
+	// overwritten when a function returns.
+	strings map[mlir.StringLiteral]int
+	data    int
+
+	// The first return value, which is in AX for the amd64 backend.
+	ax int
+
+	stdout, stderr bytes.Buffer
+	steps          int
+}
+
+// Returned when a program uses something that the interpreter doesn't
+// support.
+var errUnsupported = errors.New("unsupported by interpreter")
+
+type frame struct {
+	f        mlir.Func
+	args     int
+	locals   map[uint]int
+	callArgs int
+	temps    map[mlir.Register]int
+
+	// LocalValues which hold the address of the first element of a
+	// slice, rather than being the first element of an array.
+	sliceBase map[uint]bool
+}
+
+func newMachine(funcs []mlir.Func) *machine {
+	m := &machine{
+		funcs:   make(map[mlir.Fname]mlir.Func),
+		mem:     make([]byte, 1<<22),
+		sp:      8,
+		data:    1 << 21,
+		strings: make(map[mlir.StringLiteral]int),
+	}
+	for _, f := range funcs {
+		m.funcs[mlir.Fname(f.Name)] = f
+	}
+	return m
+}
+
+func (m *machine) alloc(n int) int {
+	m.sp = (m.sp + 7) &^ 7
+	addr := m.sp
+	m.sp += n
+	if m.sp > 1<<21 {
+		panic("out of memory")
+	}
+	return addr
+}
+
+func (m *machine) load(addr, size int, signed bool) int {
+	if size == 0 {
+		size = 8
+	}
+	var v uint64
+	switch size {
+	case 1:
+		v = uint64(m.mem[addr])
+		if signed {
+			return int(int8(v))
+		}
+	case 2:
+		v = uint64(binary.LittleEndian.Uint16(m.mem[addr:]))
+		if signed {
+			return int(int16(v))
+		}
+	case 4:
+		v = uint64(binary.LittleEndian.Uint32(m.mem[addr:]))
+		if signed {
+			return int(int32(v))
+		}
+	default:
+		v = binary.LittleEndian.Uint64(m.mem[addr:])
+	}
+	return int(v)
+}
+
+func (m *machine) store(addr, size, v int) {
+	switch size {
+	case 1:
+		m.mem[addr] = byte(v)
+	case 2:
+		binary.LittleEndian.PutUint16(m.mem[addr:], uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(m.mem[addr:], uint32(v))
+	default:
+		binary.LittleEndian.PutUint64(m.mem[addr:], uint64(v))
+	}
+}
+
+func (m *machine) stringAddr(s mlir.StringLiteral) int {
+	if addr, ok := m.strings[s]; ok {
+		return addr
+	}
+	str := strings.Replace(string(s), `\n`, "\n", -1)
+	addr := m.data + 8
+	m.data = (addr + len(str) + 7) &^ 7
+	copy(m.mem[addr:], str)
+	m.strings[s] = addr
+	return addr
+}
+
+// Runs the program starting at main, and returns what it wrote to stdout
+// and stderr.
+func (m *machine) run() (stdout, stderr string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok && errors.Is(e, errUnsupported) {
+				err = e
+				return
+			}
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	args := m.alloc(8 * 16)
+	m.call("main", args)
+	return m.stdout.String(), m.stderr.String(), nil
+}
+
+func (m *machine) call(name mlir.Fname, args int) {
+	switch name {
+	case "PrintInt":
+		fmt.Fprintf(&m.stdout, "%d", m.load(args, 8, true))
+		return
+	case "Write":
+		fd, n, p := m.load(args, 8, true), m.load(args+8, 8, true), m.load(args+16, 8, false)
+		switch fd {
+		case 1:
+			m.stdout.Write(m.mem[p : p+n])
+		case 2:
+			m.stderr.Write(m.mem[p : p+n])
+		default:
+			panic(fmt.Errorf("write to %d: %w", fd, errUnsupported))
+		}
+		m.ax = n
+		return
+	case "len":
+		m.ax = m.load(args, 8, true)
+		return
+	}
+	f, ok := m.funcs[name]
+	if !ok {
+		panic(fmt.Errorf("function %v: %w", name, errUnsupported))
+	}
+
+	sp := m.sp
+	defer func() { m.sp = sp }()
+	fr := &frame{
+		f:         f,
+		args:      args,
+		locals:    make(map[uint]int),
+		temps:     make(map[mlir.Register]int),
+		sliceBase: make(map[uint]bool),
+	}
+	for _, op := range f.Body {
+		for _, r := range op.Registers() {
+			m.layout(fr, r)
+		}
+	}
+	fr.callArgs = m.alloc(8 * (2*int(f.LargestFuncCall) + 8))
+
+	labels := make(map[mlir.Label]int)
+	for i, op := range f.Body {
+		if l, ok := op.(mlir.Label); ok {
+			labels[l] = i
+		}
+	}
+	for pc := 0; pc < len(f.Body); pc++ {
+		m.steps++
+		if m.steps > 10000000 {
+			panic("too many steps")
+		}
+		switch o := f.Body[pc].(type) {
+		case mlir.Label:
+		case mlir.RET:
+			return
+		case mlir.JMP:
+			pc = labels[o.Label]
+		case mlir.JE, mlir.JNE, mlir.JL, mlir.JLE, mlir.JG, mlir.JGE:
+			j := reflect.ValueOf(o).Field(0).Interface().(mlir.ConditionalJump)
+			l, r := m.read(fr, j.Src), m.read(fr, j.Dst)
+			var taken bool
+			switch o.(type) {
+			case mlir.JE:
+				taken = l == r
+			case mlir.JNE:
+				taken = l != r
+			case mlir.JL:
+				taken = l < r
+			case mlir.JLE:
+				taken = l <= r
+			case mlir.JG:
+				taken = l > r
+			case mlir.JGE:
+				taken = l >= r
+			}
+			if taken {
+				pc = labels[j.Label]
+			}
+		case mlir.MOV:
+			m.mov(fr, o)
+		case mlir.ADD:
+			m.write(fr, o.Dst, m.read(fr, o.Dst)+m.read(fr, o.Src))
+		case mlir.SUB:
+			m.write(fr, o.Dst, m.read(fr, o.Dst)-m.read(fr, o.Src))
+		case mlir.MUL:
+			m.write(fr, o.Dst, m.read(fr, o.Left)*m.read(fr, o.Right))
+		case mlir.DIV:
+			m.write(fr, o.Dst, m.read(fr, o.Left)/m.read(fr, o.Right))
+		case mlir.MOD:
+			l, r := m.read(fr, o.Left), m.read(fr, o.Right)
+			if o.Left.Signed() {
+				m.write(fr, o.Dst, l%r)
+			} else {
+				m.write(fr, o.Dst, int(uint64(l)%uint64(r)))
+			}
+		case mlir.CALL:
+			m.callOp(fr, o)
+			if o.TailCall {
+				return
+			}
+		default:
+			panic(fmt.Sprintf("unhandled opcode %v", reflect.TypeOf(o)))
+		}
+	}
+}
+
+// Allocates the memory for any LocalValue in r the first time that it's
+// seen, the same way that the amd64 backend lays them out.
+func (m *machine) layout(fr *frame, r mlir.Register) {
+	switch v := r.(type) {
+	case mlir.LocalValue:
+		if _, ok := fr.locals[v.Id]; !ok {
+			// Arrays are consecutive LocalValues, so they aren't
+			// aligned.
+			fr.locals[v.Id] = m.sp
+			m.sp += v.Size()
+		}
+	case mlir.Offset:
+		m.layout(fr, v.Offset)
+		m.layout(fr, v.Base)
+	case mlir.Pointer:
+		m.layout(fr, v.Register)
+	case mlir.SliceBasePointer:
+		m.layout(fr, v.Register)
+	}
+}
+
+// Returns the address of the first element that the base of an Offset
+// refers to.
+func (m *machine) base(fr *frame, r mlir.Register) int {
+	switch v := r.(type) {
+	case mlir.LocalValue:
+		if fr.sliceBase[v.Id] {
+			return m.read(fr, v)
+		}
+		return fr.locals[v.Id]
+	case mlir.FuncArg:
+		return m.load(fr.args+8*int(v.Id), 8, false)
+	case mlir.SliceBasePointer:
+		return m.read(fr, v.Register)
+	}
+	panic(fmt.Sprintf("unhandled offset base %v", reflect.TypeOf(r)))
+}
+
+func (m *machine) address(fr *frame, o mlir.Offset) int {
+	return m.base(fr, o.Base) + m.read(fr, o.Offset)*int(o.Scale)
+}
+
+func (m *machine) read(fr *frame, r mlir.Register) int {
+	switch v := r.(type) {
+	case mlir.IntLiteral:
+		return int(v)
+	case mlir.StringLiteral:
+		return m.stringAddr(v)
+	case mlir.TempValue, mlir.UTempValue:
+		return fr.temps[v]
+	case mlir.LocalValue:
+		return m.load(fr.locals[v.Id], v.Size(), v.Signed())
+	case mlir.FuncArg:
+		if v.Reference {
+			return m.load(m.load(fr.args+8*int(v.Id), 8, false), v.Size(), v.Signed())
+		}
+		return m.load(fr.args+8*int(v.Id), v.Size(), v.Signed())
+	case mlir.FuncRetVal:
+		if v.Id == 0 {
+			return m.ax
+		}
+		return m.load(fr.callArgs+8*int(v.Id), 8, v.Signed())
+	case mlir.Pointer:
+		switch p := v.Register.(type) {
+		case mlir.LocalValue:
+			return fr.locals[p.Id]
+		case mlir.Offset:
+			return m.address(fr, p)
+		}
+	case mlir.Offset:
+		return m.load(m.address(fr, v), int(v.Scale), false)
+	}
+	panic(fmt.Sprintf("unhandled register %v", reflect.TypeOf(r)))
+}
+
+func (m *machine) write(fr *frame, r mlir.Register, val int) {
+	switch v := r.(type) {
+	case mlir.TempValue, mlir.UTempValue:
+		fr.temps[v] = val
+	case mlir.LocalValue:
+		m.store(fr.locals[v.Id], v.Size(), val)
+	case mlir.FuncArg:
+		if v.Reference {
+			m.store(m.load(fr.args+8*int(v.Id), 8, false), v.Size(), val)
+		} else {
+			m.store(fr.args+8*int(v.Id), v.Size(), val)
+		}
+	case mlir.FuncRetVal:
+		if v.Id == 0 {
+			m.ax = val
+		} else {
+			m.store(fr.args+8*int(v.Id), 8, val)
+		}
+	case mlir.Offset:
+		m.store(m.address(fr, v), int(v.Scale), val)
+	default:
+		panic(fmt.Sprintf("unhandled destination %v", reflect.TypeOf(r)))
+	}
+}
+
+func (m *machine) mov(fr *frame, o mlir.MOV) {
+	val := m.read(fr, o.Src)
+	if p, ok := o.Src.(mlir.Pointer); ok {
+		if _, ok := p.Register.(mlir.Offset); ok {
+			if lv, ok := o.Dst.(mlir.LocalValue); ok {
+				fr.sliceBase[lv.Id] = true
+			}
+		}
+	}
+	// Moving to a larger register extends the value based on the
+	// signedness of the destination.
+	if src, dst := o.Src.Size(), o.Dst.Size(); src != 0 && src < dst && src < 8 {
+		mask := 1<<(8*uint(src)) - 1
+		val &= mask
+		if o.Dst.Signed() && val&(1<<(8*uint(src)-1)) != 0 {
+			val -= mask + 1
+		}
+	}
+	m.write(fr, o.Dst, val)
+}
+
+func (m *machine) callOp(fr *frame, o mlir.CALL) {
+	type arg struct{ slot, val int }
+	var args []arg
+	for i, a := range o.Args {
+		switch v := a.(type) {
+		case mlir.SliceBasePointer:
+			switch b := v.Register.(type) {
+			case mlir.LocalValue:
+				args = append(args, arg{i, fr.locals[b.Id]})
+			case mlir.FuncArg:
+				args = append(args, arg{i, m.read(fr, b)})
+			case mlir.Offset:
+				args = append(args, arg{i, m.address(fr, b)})
+			}
+		case mlir.Offset:
+			addr := m.address(fr, v)
+			if v.Scale == 16 {
+				args = append(args, arg{i, m.load(addr, 8, false)}, arg{i*2 + 1, m.load(addr+8, 8, false)})
+				continue
+			}
+			size := v.Base.Size()
+			if fa, ok := v.Base.(mlir.FuncArg); ok {
+				size = 8
+				if t, ok := fa.Type.(ast.ArrayType); ok && t.Base.TypeName() == "byte" {
+					size = 1
+				}
+			}
+			args = append(args, arg{i, m.load(addr, size, false)})
+		default:
+			args = append(args, arg{i, m.read(fr, a)})
+		}
+	}
+	dst := fr.callArgs
+	if o.TailCall {
+		dst = fr.args
+	}
+	for _, a := range args {
+		m.store(dst+8*a.slot, 8, a.val)
+	}
+	m.call(o.FName, dst)
+}
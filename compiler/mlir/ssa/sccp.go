@@ -0,0 +1,290 @@
+package ssa
+
+import (
+	"math"
+
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// A lattice value for constant propagation. Values start out unknown, and
+// become a constant when the first assignment that can run is found. If
+// another assignment that can run gives a different value, it becomes
+// overdefined and can't be replaced by a constant.
+type lattice struct {
+	state int
+	c     int
+}
+
+const (
+	unknown = iota
+	constant
+	overdefined
+)
+
+func meet(a, b lattice) lattice {
+	switch {
+	case a.state == unknown:
+		return b
+	case b.state == unknown:
+		return a
+	case a.state == constant && b.state == constant && a.c == b.c:
+		return a
+	}
+	return lattice{state: overdefined}
+}
+
+// The state of sparse conditional constant propagation over a function.
+type sccp struct {
+	f      *Func
+	uses   map[*Value][]use
+	values map[*Value]lattice
+
+	// The edges which can be taken, by their block and index in Succs,
+	// and the blocks which can be reached.
+	edges  map[*Block][]bool
+	blocks map[*Block]bool
+
+	blockWork []*Block
+	instrWork []use
+}
+
+// ConstantPropagation finds values which always have the same constant
+// value, and replaces reads of them with a literal. Branches which always go
+// the same way are replaced by jumps, and blocks which can't be reached are
+// removed. Returns true if anything was changed.
+//
+// This is sparse conditional constant propagation, as described by Wegman
+// and Zadeck: code that can't run doesn't prevent a value from being a
+// constant, and branches on constants are only followed in the direction
+// that they go.
+func ConstantPropagation(f *Func) bool {
+	s := &sccp{
+		f:      f,
+		uses:   f.uses(),
+		values: make(map[*Value]lattice),
+		edges:  make(map[*Block][]bool),
+		blocks: make(map[*Block]bool),
+	}
+	for _, b := range f.Blocks {
+		s.edges[b] = make([]bool, len(b.Succs))
+	}
+	s.reach(f.Blocks[0])
+	for len(s.blockWork) > 0 || len(s.instrWork) > 0 {
+		if n := len(s.blockWork); n > 0 {
+			b := s.blockWork[n-1]
+			s.blockWork = s.blockWork[:n-1]
+			for _, i := range b.Phis {
+				s.visit(i)
+			}
+			for _, i := range b.Instrs {
+				s.visit(i)
+			}
+			s.visitTerm(b)
+			continue
+		}
+		n := len(s.instrWork)
+		u := s.instrWork[n-1]
+		s.instrWork = s.instrWork[:n-1]
+		if !s.blocks[u.b] {
+			continue
+		}
+		if u.i == nil {
+			s.visitTerm(u.b)
+		} else {
+			s.visit(u.i)
+		}
+	}
+	return s.rewrite()
+}
+
+func (s *sccp) reach(b *Block) {
+	if !s.blocks[b] {
+		s.blocks[b] = true
+		s.blockWork = append(s.blockWork, b)
+	}
+}
+
+// Marks the k'th edge out of b as taken.
+func (s *sccp) take(b *Block, k int) {
+	if s.edges[b][k] {
+		return
+	}
+	s.edges[b][k] = true
+	succ := b.Succs[k]
+	if s.blocks[succ] {
+		// The phis may have a new argument.
+		for _, phi := range succ.Phis {
+			s.visit(phi)
+		}
+		return
+	}
+	s.reach(succ)
+}
+
+// Returns true if an edge from the pred'th predecessor of b can be taken.
+func (s *sccp) predTaken(b *Block, pred int) bool {
+	p := b.Preds[pred]
+	for k, succ := range p.Succs {
+		if succ == b && s.edges[p][k] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sccp) value(r mlir.Register) lattice {
+	switch v := r.(type) {
+	case mlir.IntLiteral:
+		return lattice{constant, int(v)}
+	case *Value:
+		if v.Def == nil {
+			// The value the variable had when the function was
+			// entered.
+			return lattice{state: overdefined}
+		}
+		return s.values[v]
+	}
+	return lattice{state: overdefined}
+}
+
+func (s *sccp) visit(i *Instr) {
+	dst, ok := i.Dst.(*Value)
+	if !ok {
+		return
+	}
+	var l lattice
+	switch i.Op {
+	case Phi:
+		for j, a := range i.Args {
+			if s.predTaken(i.Block, j) {
+				l = meet(l, s.value(a))
+			}
+		}
+	case Copy:
+		l = s.value(i.Args[0])
+	case Add, Sub, Mul, Div, Mod:
+		left, right := s.value(i.Args[0]), s.value(i.Args[1])
+		switch {
+		case left.state == overdefined || right.state == overdefined:
+			l = lattice{state: overdefined}
+		case left.state == constant && right.state == constant:
+			if c, ok := arith(i.Op, left.c, right.c); ok {
+				l = lattice{constant, c}
+			} else {
+				l = lattice{state: overdefined}
+			}
+		}
+	default:
+		l = lattice{state: overdefined}
+	}
+	if old := s.values[dst]; old != l {
+		s.values[dst] = l
+		s.instrWork = append(s.instrWork, s.uses[dst]...)
+	}
+}
+
+// Returns the result of op on l and r, if it can be calculated at compile
+// time with the same result that it would have at runtime.
+func arith(op Op, l, r int) (int, bool) {
+	switch op {
+	case Add:
+		return l + r, true
+	case Sub:
+		return l - r, true
+	case Mul:
+		return l * r, true
+	case Div, Mod:
+		// The backend doesn't sign extend the dividend, so only
+		// positive numbers divide the same way as in Go.
+		if l < 0 || r <= 0 || l > math.MaxInt32 {
+			return 0, false
+		}
+		if op == Div {
+			return l / r, true
+		}
+		return l % r, true
+	}
+	return 0, false
+}
+
+func (s *sccp) visitTerm(b *Block) {
+	switch b.Term {
+	case Fallthrough, Jump:
+		for k := range b.Succs {
+			s.take(b, k)
+		}
+	case Branch:
+		l, r := s.value(b.CondArgs[0]), s.value(b.CondArgs[1])
+		switch {
+		case l.state == constant && r.state == constant:
+			if b.Cond.eval(l.c, r.c) {
+				s.take(b, 0)
+			} else {
+				s.take(b, 1)
+			}
+		case l.state == overdefined || r.state == overdefined:
+			s.take(b, 0)
+			s.take(b, 1)
+		}
+	}
+}
+
+// Replaces the constants and removes the code that can't run that were
+// found by the analysis.
+func (s *sccp) rewrite() bool {
+	f := s.f
+	changed := false
+	av := f.availability()
+	for v, l := range s.values {
+		if l.state != constant {
+			continue
+		}
+		for _, u := range s.uses[v] {
+			if !s.blocks[u.b] || u.get() != v {
+				continue
+			}
+			if av.canReplace(u, v, mlir.IntLiteral(l.c)) {
+				u.set(mlir.IntLiteral(l.c))
+				changed = true
+			}
+		}
+	}
+
+	for _, b := range f.Blocks {
+		if !s.blocks[b] || b.Term != Branch || b.Succs[0] == b.Succs[1] {
+			continue
+		}
+		taken, notTaken := s.edges[b][0], s.edges[b][1]
+		switch {
+		case taken && !notTaken:
+			b.Succs[1].removePred(b)
+			b.Succs = b.Succs[:1]
+			b.Term = Jump
+		case notTaken && !taken:
+			b.Succs[0].removePred(b)
+			b.Succs = b.Succs[1:]
+			b.Term = Fallthrough
+		default:
+			continue
+		}
+		b.CondArgs = [2]mlir.Register{}
+		changed = true
+	}
+
+	blocks := f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if s.blocks[b] {
+			blocks = append(blocks, b)
+			continue
+		}
+		for _, succ := range b.Succs {
+			succ.removePred(b)
+		}
+		changed = true
+	}
+	f.Blocks = blocks
+	for i, b := range f.Blocks {
+		b.ID = i
+	}
+	return changed
+}
@@ -0,0 +1,309 @@
+// Package ssa converts functions in the MLIR to static single assignment
+// form, optimizes them, and converts them back to the MLIR.
+//
+// The MLIR is a flat list of opcodes which may assign to the same
+// LocalValue or TempValue any number of times. In SSA form, the opcodes are
+// split into basic blocks and every assignment defines a new Value, with
+// phi instructions choosing between the values that reach the start of a
+// block from its predecessors. This makes it possible to know exactly which
+// assignment every read of a register sees, which the optimizations in this
+// package depend on.
+//
+// Only registers which are always read and written directly are converted
+// to values. Registers whose address is taken, that are used to index into
+// memory, or that don't hold a full 8 byte value are left alone, since they
+// can be read or modified in ways that aren't visible to the conversion.
+//
+// Converting back to the MLIR doesn't allocate new registers: every value
+// is stored in the register that it came from. The optimizations only
+// replace a read of one value with another value when the register of the
+// other value still holds it at the point of the read, so the code that
+// the amd64 backend generates for TempValues stays valid.
+package ssa
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/driusan/lang/compiler/mlir"
+)
+
+// A Value is the result of a single assignment to a register.
+type Value struct {
+	ID int
+
+	// The register that the value is stored in.
+	Var mlir.Register
+
+	// The instruction which defines the value, or nil if it's the value
+	// that Var has when the function is entered.
+	Def *Instr
+}
+
+func (v *Value) String() string {
+	return fmt.Sprintf("v%d", v.ID)
+}
+
+func (v *Value) Size() int {
+	return v.Var.Size()
+}
+
+func (v *Value) Signed() bool {
+	return v.Var.Signed()
+}
+
+// An Op is the operation done by an instruction.
+type Op int
+
+const (
+	// Dst = Args[0]
+	Copy Op = iota
+	// Dst = Args[0] + Args[1]
+	Add
+	// Dst = Args[0] - Args[1]
+	Sub
+	// Dst = Args[0] * Args[1]
+	Mul
+	// Dst = Args[0] / Args[1]
+	Div
+	// Dst = Args[0] % Args[1]
+	Mod
+	// Calls a function with Args. Calls have no Dst. The values that
+	// they return are read from FuncRetVals, which aren't converted to
+	// values.
+	Call
+	// Dst = Args[i] when coming from the i'th predecessor of the block.
+	Phi
+)
+
+func (o Op) String() string {
+	switch o {
+	case Copy:
+		return "COPY"
+	case Add:
+		return "ADD"
+	case Sub:
+		return "SUB"
+	case Mul:
+		return "MUL"
+	case Div:
+		return "DIV"
+	case Mod:
+		return "MOD"
+	case Call:
+		return "CALL"
+	case Phi:
+		return "PHI"
+	}
+	return fmt.Sprintf("Op(%d)", int(o))
+}
+
+// An Instr is an instruction in a Block.
+type Instr struct {
+	Op Op
+
+	// The register written to. It's a *Value if the register is in SSA
+	// form, and the register itself if it isn't, such as when writing
+	// to memory or to a return value of the function.
+	Dst mlir.Register
+
+	// The registers read. Like Dst, they're a *Value if the register is
+	// in SSA form.
+	Args []mlir.Register
+
+	// The function called by a Call.
+	FName    mlir.Fname
+	TailCall bool
+
+	Block *Block
+}
+
+func (i *Instr) String() string {
+	args := make([]string, len(i.Args))
+	for j, a := range i.Args {
+		args[j] = fmt.Sprint(a)
+	}
+	switch i.Op {
+	case Call:
+		if i.TailCall {
+			return fmt.Sprintf("CALL %v (%v) (tail)", i.FName, strings.Join(args, ", "))
+		}
+		return fmt.Sprintf("CALL %v (%v)", i.FName, strings.Join(args, ", "))
+	case Phi:
+		for j, a := range i.Args {
+			args[j] = fmt.Sprintf("%v: %v", i.Block.Preds[j], a)
+		}
+	}
+	return fmt.Sprintf("%v = %v %v", i.Dst, i.Op, strings.Join(args, ", "))
+}
+
+// A Cmp is the comparison done at the end of a block which ends in a
+// conditional jump.
+type Cmp int
+
+const (
+	EQ Cmp = iota
+	NE
+	LT
+	LE
+	GT
+	GE
+)
+
+func (c Cmp) String() string {
+	switch c {
+	case EQ:
+		return "JE"
+	case NE:
+		return "JNE"
+	case LT:
+		return "JL"
+	case LE:
+		return "JLE"
+	case GT:
+		return "JG"
+	case GE:
+		return "JGE"
+	}
+	return fmt.Sprintf("Cmp(%d)", int(c))
+}
+
+// Returns the comparison which has the same result as c with the operands
+// swapped.
+func (c Cmp) swapped() Cmp {
+	switch c {
+	case LT:
+		return GT
+	case LE:
+		return GE
+	case GT:
+		return LT
+	case GE:
+		return LE
+	}
+	return c
+}
+
+// Returns the result of comparing l to r.
+func (c Cmp) eval(l, r int) bool {
+	switch c {
+	case EQ:
+		return l == r
+	case NE:
+		return l != r
+	case LT:
+		return l < r
+	case LE:
+		return l <= r
+	case GT:
+		return l > r
+	case GE:
+		return l >= r
+	}
+	panic("Unknown comparison")
+}
+
+// The way that a block ends.
+type Term int
+
+const (
+	// The block continues to the block after it, or returns if it's the
+	// last block.
+	Fallthrough Term = iota
+	// The block jumps to its only successor.
+	Jump
+	// The block compares CondArgs with Cond, and jumps to its first
+	// successor if it's true. Otherwise, it continues to its second
+	// successor, which is the block after it.
+	Branch
+	// The block returns from the function.
+	Return
+)
+
+// A Block is a basic block: a list of instructions which are always run
+// from the first to the last.
+type Block struct {
+	ID int
+
+	// The label at the start of the block, if anything jumps to it.
+	Label mlir.Label
+
+	Phis   []*Instr
+	Instrs []*Instr
+
+	Term     Term
+	Cond     Cmp
+	CondArgs [2]mlir.Register
+
+	Succs []*Block
+	Preds []*Block
+}
+
+func (b *Block) String() string {
+	return fmt.Sprintf("B%d", b.ID)
+}
+
+// A Func is a function in SSA form.
+type Func struct {
+	Name                                string
+	NumArgs, NumLocals, LargestFuncCall uint
+
+	// The blocks of the function in the order that they're laid out in
+	// the MLIR. The first block is the entry.
+	Blocks []*Block
+
+	// The registers which are converted to values, and the value that
+	// each one has when the function is entered.
+	Vars map[mlir.Register]*Value
+
+	numValues int
+}
+
+func (f *Func) newValue(v mlir.Register, def *Instr) *Value {
+	f.numValues++
+	return &Value{ID: f.numValues - 1, Var: v, Def: def}
+}
+
+func (f *Func) String() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "func %v:\n", f.Name)
+	for _, b := range f.Blocks {
+		fmt.Fprintf(&s, "%v", b)
+		if b.Label != "" {
+			fmt.Fprintf(&s, " (%v)", b.Label.Inline())
+		}
+		fmt.Fprintf(&s, ": preds %v\n", b.Preds)
+		for _, i := range b.Phis {
+			fmt.Fprintf(&s, "\t%v\n", i)
+		}
+		for _, i := range b.Instrs {
+			fmt.Fprintf(&s, "\t%v\n", i)
+		}
+		switch b.Term {
+		case Fallthrough:
+			if len(b.Succs) > 0 {
+				fmt.Fprintf(&s, "\tFALLTHROUGH %v\n", b.Succs[0])
+			}
+		case Jump:
+			fmt.Fprintf(&s, "\tJMP %v\n", b.Succs[0])
+		case Branch:
+			fmt.Fprintf(&s, "\t%v %v, %v, %v else %v\n", b.Cond, b.CondArgs[0], b.CondArgs[1], b.Succs[0], b.Succs[1])
+		case Return:
+			fmt.Fprintf(&s, "\tRET\n")
+		}
+	}
+	return s.String()
+}
+
+// Optimize converts f to SSA form, runs every optimization in the package
+// on it, and converts it back to the MLIR.
+func Optimize(f mlir.Func) mlir.Func {
+	sf := Build(f)
+	ConstantPropagation(sf)
+	for changed := true; changed; {
+		changed = CopyPropagation(sf)
+		changed = ValueNumbering(sf) || changed
+		changed = DeadCode(sf) || changed
+	}
+	return sf.MLIR()
+}
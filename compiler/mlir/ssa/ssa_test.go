@@ -0,0 +1,241 @@
+package ssa
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/driusan/lang/stdlib"
+
+	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/compiler/hlir/opt"
+	"github.com/driusan/lang/compiler/hlir/vm"
+	"github.com/driusan/lang/compiler/mlir"
+
+	"github.com/driusan/lang/parser/ast"
+)
+
+// Generates the MLIR for every function in the program src, along with the
+// stdlib helpers that the backend links into every program.
+func generate(src string) ([]mlir.Func, error) {
+	prog, ti, c, err := ast.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	enums := make(hlir.EnumMap)
+	for _, v := range prog {
+		if _, ok := v.(ast.EnumTypeDefn); ok {
+			_, opts, err := mlir.Generate(v, ti, c, enums)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range opts {
+				enums[k] = v
+			}
+		}
+	}
+	consts, err := vm.EvaluateConstants(prog, ti, c, enums)
+	if err != nil {
+		return nil, err
+	}
+	ir, err := opt.Generate(prog, ti, c, enums, consts)
+	if err != nil {
+		return nil, err
+	}
+	if err := opt.NewManager(opt.O2).Run(ir); err != nil {
+		return nil, err
+	}
+	var funcs []mlir.Func
+	for _, fnc := range ir.Funcs {
+		funcs = append(funcs, mlir.Convert(fnc, c, ir.RegisterData[fnc.Name]))
+	}
+	for _, helper := range []string{stdlib.PrintByteSlice, stdlib.PrintString} {
+		nodes, ti, c, err := ast.Parse(helper)
+		if err != nil {
+			return nil, err
+		}
+		f, _, err := mlir.Generate(nodes[0], ti, c, nil)
+		if err != nil {
+			return nil, err
+		}
+		funcs = append(funcs, f)
+	}
+	return funcs, nil
+}
+
+// Like generate, but a panic while generating the code is returned as an
+// error, since not every program in the testsuite is supported by the MLIR.
+func safeGenerate(src string) (funcs []mlir.Func, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return generate(src)
+}
+
+func run(funcs []mlir.Func) (stdout, stderr string, err error) {
+	return newMachine(funcs).run()
+}
+
+// TestTestSuite checks that every program in the testsuite does the same
+// thing before and after being optimized in SSA form.
+func TestTestSuite(t *testing.T) {
+	files, err := filepath.Glob("../../../testsuite/*.l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".l")
+		t.Run(name, func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			funcs, err := safeGenerate(string(src))
+			if err != nil {
+				t.Skipf("can not generate MLIR: %v", err)
+			}
+			estdout, estderr, eerr := run(funcs)
+			if errors.Is(eerr, errUnsupported) {
+				t.Skip(eerr)
+			}
+
+			optimized := make([]mlir.Func, len(funcs))
+			for i, f := range funcs {
+				optimized[i] = Optimize(f)
+			}
+			stdout, stderr, err := run(optimized)
+			if fmt.Sprint(err) != fmt.Sprint(eerr) {
+				t.Errorf("Unexpected error: got %v want %v", err, eerr)
+			}
+			if stdout != estdout {
+				t.Errorf("Unexpected stdout: got %q want %q", stdout, estdout)
+			}
+			if stderr != estderr {
+				t.Errorf("Unexpected stderr: got %q want %q", stderr, estderr)
+			}
+			if t.Failed() {
+				for i := range funcs {
+					t.Logf("%v:\n%v\n=>\n%v", funcs[i].Name, funcs[i].Body, optimized[i].Body)
+				}
+			}
+		})
+	}
+}
+
+var (
+	i64 = ast.TypeInfo{Size: 8, Signed: true}
+	lv0 = mlir.LocalValue{Id: 0, Info: i64}
+	lv1 = mlir.LocalValue{Id: 1, Info: i64}
+	arg = mlir.FuncArg{Id: 0, Info: i64}
+)
+
+func TestBuildPhis(t *testing.T) {
+	// Sums the numbers from P0 down to 1.
+	f := mlir.Func{
+		Name: "sum",
+		Body: []mlir.Opcode{
+			mlir.MOV{Src: arg, Dst: lv0},
+			mlir.MOV{Src: mlir.IntLiteral(0), Dst: lv1},
+			mlir.Label("loop"),
+			mlir.JLE{ConditionalJump: mlir.ConditionalJump{Label: "end", Src: lv0, Dst: mlir.IntLiteral(0)}},
+			mlir.ADD{Src: lv0, Dst: lv1},
+			mlir.SUB{Src: mlir.IntLiteral(1), Dst: lv0},
+			mlir.JMP{Label: "loop"},
+			mlir.Label("end"),
+			mlir.MOV{Src: lv1, Dst: mlir.FuncRetVal{Id: 0, Info: i64}},
+			mlir.RET{},
+		},
+		NumArgs:   1,
+		NumLocals: 2,
+	}
+	sf := Build(f)
+	var loop *Block
+	for _, b := range sf.Blocks {
+		if b.Label == "loop" {
+			loop = b
+		}
+	}
+	if loop == nil {
+		t.Fatalf("No loop block in\n%v", sf)
+	}
+	if len(loop.Preds) != 2 {
+		t.Errorf("Unexpected number of loop predecessors: got %v want 2", len(loop.Preds))
+	}
+	if len(loop.Phis) != 2 {
+		t.Fatalf("Unexpected number of phis: got %v want 2\n%v", len(loop.Phis), sf)
+	}
+	for _, phi := range loop.Phis {
+		if len(phi.Args) != len(loop.Preds) {
+			t.Errorf("Unexpected number of phi arguments: got %v want %v", len(phi.Args), len(loop.Preds))
+		}
+	}
+
+	// Converting back without optimizing shouldn't need any copies.
+	if got, want := fmt.Sprint(sf.MLIR().Body), fmt.Sprint(f.Body); got != want {
+		t.Errorf("Unexpected MLIR: got %v want %v", got, want)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		Name string
+		Body []mlir.Opcode
+		Want []mlir.Opcode
+	}{
+		{
+			"copy propagation",
+			[]mlir.Opcode{
+				mlir.MOV{Src: arg, Dst: lv0},
+				mlir.MOV{Src: lv0, Dst: lv1},
+				mlir.CALL{FName: "PrintInt", Args: []mlir.Register{lv1}},
+			},
+			[]mlir.Opcode{
+				mlir.MOV{Src: arg, Dst: lv0},
+				mlir.CALL{FName: "PrintInt", Args: []mlir.Register{lv0}},
+			},
+		},
+		{
+			"value numbering",
+			[]mlir.Opcode{
+				mlir.MOV{Src: arg, Dst: lv0},
+				mlir.MUL{Left: lv0, Right: mlir.IntLiteral(3), Dst: mlir.TempValue(0)},
+				mlir.MUL{Left: mlir.IntLiteral(3), Right: lv0, Dst: mlir.TempValue(1)},
+				mlir.ADD{Src: mlir.TempValue(1), Dst: mlir.TempValue(0)},
+				mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.TempValue(0)}},
+			},
+			[]mlir.Opcode{
+				mlir.MOV{Src: arg, Dst: lv0},
+				mlir.MUL{Left: lv0, Right: mlir.IntLiteral(3), Dst: mlir.TempValue(0)},
+				mlir.ADD{Src: mlir.TempValue(0), Dst: mlir.TempValue(0)},
+				mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.TempValue(0)}},
+			},
+		},
+		{
+			"constant branch",
+			[]mlir.Opcode{
+				mlir.MOV{Src: mlir.IntLiteral(1), Dst: lv0},
+				mlir.JNE{ConditionalJump: mlir.ConditionalJump{Label: "else", Src: lv0, Dst: mlir.IntLiteral(1)}},
+				mlir.CALL{FName: "PrintInt", Args: []mlir.Register{lv0}},
+				mlir.JMP{Label: "done"},
+				mlir.Label("else"),
+				mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.IntLiteral(2)}},
+				mlir.Label("done"),
+			},
+			[]mlir.Opcode{
+				mlir.CALL{FName: "PrintInt", Args: []mlir.Register{mlir.IntLiteral(1)}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		f := mlir.Func{Name: "main", Body: tc.Body, NumArgs: 1, NumLocals: 2, LargestFuncCall: 1}
+		got := Optimize(f)
+		if fmt.Sprint(got.Body) != fmt.Sprint(tc.Want) {
+			t.Errorf("%v: got %v want %v", tc.Name, got.Body, tc.Want)
+		}
+	}
+}
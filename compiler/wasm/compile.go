@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"github.com/driusan/lang/compiler/hlir"
+	"github.com/driusan/lang/compiler/hlir/opt"
+	"github.com/driusan/lang/compiler/hlir/vm"
 	"github.com/driusan/lang/parser/ast"
 )
 
@@ -37,26 +39,27 @@ func Parse(src string) (Module, error) {
 
 	}
 
-	// Generate the IR for the functions.
-	for _, v := range nodes {
-		switch v.(type) {
-		case ast.FuncDecl:
-			fnc, _, registers, err := hlir.Generate(v, ti, callables, enums)
-			if err != nil {
-				return Module{}, err
-			}
-			ctx.registerData = registers
+	consts, err := vm.EvaluateConstants(nodes, ti, callables, enums)
+	if err != nil {
+		return Module{}, err
+	}
 
-			rfnc, err := Generate(fnc, &ctx)
-			if err != nil {
-				return Module{}, err
-			}
-			ctx.Functions = append(ctx.Functions, rfnc)
-		case ast.TypeDefn, ast.EnumTypeDefn:
-			// No IR for types, we've already verified them.
-		default:
-			panic("Unhandled AST node type for code generation")
+	// Generate and optimize the IR for the functions.
+	prog, err := opt.Generate(nodes, ti, callables, enums, consts)
+	if err != nil {
+		return Module{}, err
+	}
+	if err := opt.Default.Run(prog); err != nil {
+		return Module{}, err
+	}
+	for _, fnc := range prog.Funcs {
+		ctx.registerData = prog.RegisterData[fnc.Name]
+
+		rfnc, err := Generate(fnc, &ctx)
+		if err != nil {
+			return Module{}, err
 		}
+		ctx.Functions = append(ctx.Functions, rfnc)
 	}
 
 	mem := ctx.memTop
@@ -126,6 +129,13 @@ func Generate(hlfnc hlir.Func, ctx *Context) (Func, error) {
 								ctx.addMemoryVar(lv)
 							}
 						}
+					case ast.TypeLiteral:
+						if base != "string" {
+							panic(fmt.Sprintf("Unhandle offset base type: %v for base: %v", reflect.TypeOf(base), reg))
+						}
+						// Indexing into a string reads directly from the
+						// string's data, there's no variables to move to
+						// memory.
 					default:
 						panic(fmt.Sprintf("Unhandle offset base type: %v for base: %v", reflect.TypeOf(base), reg))
 					}
@@ -361,7 +371,11 @@ func evaluateOp(opi hlir.Opcode, ctx *Context) ([]Instruction, error) {
 				ops = append(ops, storeOp(op.Dst, ctx))
 			}
 		case hlir.TempValue:
-			// Do nothing, it's already on the stack
+			// If it's the result of another operation, it's already
+			// on the stack. Otherwise, push it.
+			if _, ok := op.Src.(hlir.TempValue); !ok {
+				ops = append(ops, getValue(op.Src, ctx)...)
+			}
 		case hlir.LocalValue:
 			typeinfo := ctx.registerData[d]
 			if typeinfo.TypeInfo.Size > 4 {
@@ -531,20 +545,12 @@ func evaluateOp(opi hlir.Opcode, ctx *Context) ([]Instruction, error) {
 		}
 		return ops, nil
 	case hlir.IF:
-		ops := []Instruction{}
-		for _, cond := range op.Condition.Body {
-			condops, err := evaluateOp(cond, ctx)
-			if err != nil {
-				return nil, err
-			}
-			ops = append(ops, condops...)
-		}
-		switch op.Condition.Register.(type) {
-		case hlir.TempValue:
-		default:
-			panic(fmt.Sprintf("Unhandled Condition type: %v", reflect.TypeOf(op.Condition.Register)))
+		ops, err := evaluateCondition(op.Condition, ctx)
+		if err != nil {
+			return nil, err
 		}
 		ops = append(ops, If{})
+		ctx.blockDepth++
 		for _, b := range op.Body {
 			bops, err := evaluateOp(b, ctx)
 			if err != nil {
@@ -562,6 +568,7 @@ func evaluateOp(opi hlir.Opcode, ctx *Context) ([]Instruction, error) {
 				ops = append(ops, bops...)
 			}
 		}
+		ctx.blockDepth--
 		ops = append(ops, End{})
 		return ops, nil
 	case hlir.LOOP:
@@ -575,19 +582,14 @@ func evaluateOp(opi hlir.Opcode, ctx *Context) ([]Instruction, error) {
 		}
 
 		ops = append(ops, Loop{})
-		for _, cond := range op.Condition.Body {
-			condops, err := evaluateOp(cond, ctx)
-			if err != nil {
-				return nil, err
-			}
-			ops = append(ops, condops...)
+		ctx.loops = append(ctx.loops, ctx.blockDepth+1)
+		ctx.blockDepth += 2
+		condops, err := evaluateCondition(op.Condition, ctx)
+		if err != nil {
+			return nil, err
 		}
+		ops = append(ops, condops...)
 
-		switch op.Condition.Register.(type) {
-		case hlir.TempValue:
-		default:
-			panic(fmt.Sprintf("Unhandled Condition type: %v", reflect.TypeOf(op.Condition.Register)))
-		}
 		// Negate the condition, because br_if breaks out if the condition is true.
 		ops = append(ops, I32EQZ{})
 		ops = append(ops, BrIf(1))
@@ -601,19 +603,31 @@ func evaluateOp(opi hlir.Opcode, ctx *Context) ([]Instruction, error) {
 		ops = append(ops, Br(0))
 		ops = append(ops, End{}) // Loop
 		ops = append(ops, End{}) // Block
+		ctx.blockDepth -= 2
+		ctx.loops = ctx.loops[:len(ctx.loops)-1]
 		return ops, nil
+	case hlir.LINE:
+		return nil, nil
+	case hlir.BREAK:
+		// Branch to the end of the block surrounding the loop.
+		block := ctx.loops[len(ctx.loops)-1-int(op.Depth)]
+		return []Instruction{Br(ctx.blockDepth - block)}, nil
+	case hlir.CONTINUE:
+		// Branch to the start of the loop, which is nested one
+		// deeper than its block.
+		block := ctx.loops[len(ctx.loops)-1-int(op.Depth)]
+		return []Instruction{Br(ctx.blockDepth - block - 1)}, nil
 	case hlir.JumpTable:
 		ops := []Instruction{}
 
 		for i, condition := range op {
-			for _, cond := range condition.Condition.Body {
-				condops, err := evaluateOp(cond, ctx)
-				if err != nil {
-					return nil, err
-				}
-				ops = append(ops, condops...)
+			condops, err := evaluateCondition(condition.Condition, ctx)
+			if err != nil {
+				return nil, err
 			}
+			ops = append(ops, condops...)
 			ops = append(ops, If{})
+			ctx.blockDepth++
 			for _, op := range condition.Body {
 				bops, err := evaluateOp(op, ctx)
 				if err != nil {
@@ -628,6 +642,7 @@ func evaluateOp(opi hlir.Opcode, ctx *Context) ([]Instruction, error) {
 		for range op {
 			ops = append(ops, End{})
 		}
+		ctx.blockDepth -= len(op)
 		return ops, nil
 
 	case hlir.GT:
@@ -755,6 +770,28 @@ func evaluateOp(opi hlir.Opcode, ctx *Context) ([]Instruction, error) {
 	}
 }
 
+// Evaluates the condition c of a control flow opcode, leaving the value
+// to branch on on the stack.
+func evaluateCondition(c hlir.Condition, ctx *Context) ([]Instruction, error) {
+	ops := []Instruction{}
+	for _, cond := range c.Body {
+		condops, err := evaluateOp(cond, ctx)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, condops...)
+	}
+	switch v := c.Register.(type) {
+	case hlir.TempValue:
+	case hlir.IntLiteral:
+		// The condition was evaluated at compile time.
+		ops = append(ops, I32Const(v))
+	default:
+		panic(fmt.Sprintf("Unhandled Condition type: %v", reflect.TypeOf(c.Register)))
+	}
+	return ops, nil
+}
+
 func getValue(reg hlir.Register, ctx *Context) []Instruction {
 	switch v := reg.(type) {
 	case hlir.StringLiteral:
@@ -833,6 +870,13 @@ func getValue(reg hlir.Register, ctx *Context) []Instruction {
 				ops = append(ops, GetLocal(base.Id), I32Add{}, loadOp(v, ctx))
 				return ops
 			}
+		case hlir.SliceBasePointer:
+			// Indexing into the bytes of a string. The string points
+			// to its length, and the data follows it.
+			ops := getValue(base.Register, ctx)
+			ops = append(ops, getValue(v.Offset, ctx)...)
+			ops = append(ops, I32Add{}, I32Const(8), I32Add{}, I32Load8U{})
+			return ops
 		default:
 			panic("Unhandled type of offset")
 		}
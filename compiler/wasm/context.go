@@ -29,6 +29,13 @@ type Context struct {
 	curFuncMemVariables   map[hlir.Register]uint
 	curFuncLocalVariables map[hlir.Register]uint
 	curFuncMaxMem         uint
+
+	// The number of blocks (including ifs and loops) enclosing the
+	// instruction being generated, and the depth of the outer block
+	// of each enclosing loop, so that breaks can calculate the
+	// relative depth to branch to.
+	blockDepth int
+	loops      []int
 }
 
 func encodeStrInt(s string) string {
@@ -245,5 +252,7 @@ func NewContext(c ast.Callables) Context {
 		make(map[hlir.Register]uint),
 		make(map[hlir.Register]uint),
 		0,
+		0,
+		nil,
 	}
 }
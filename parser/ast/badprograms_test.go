@@ -105,6 +105,27 @@ func ExampleMutStatementScopeShadow2() {
 	// Output: Can not shadow mutable variable "n".
 }
 
+func ExampleForLoopAssignment() {
+	if err := buildAST(invalidprograms.ForLoopAssignment); err != nil {
+		fmt.Println(err.Error())
+	}
+	// Output: Can not assign to immutable let variable "i".
+}
+
+func ExampleForLoopNotCollection() {
+	if err := buildAST(invalidprograms.ForLoopNotCollection); err != nil {
+		fmt.Println(err.Error())
+	}
+	// Output: Can not iterate over value of type int
+}
+
+func ExampleRangeTypeMismatch() {
+	if err := buildAST(invalidprograms.RangeTypeMismatch); err != nil {
+		fmt.Println(err.Error())
+	}
+	// Output: Incompatible types for range: "int" and "string".
+}
+
 func ExampleTooBigUInt8() {
 	if err := buildAST(invalidprograms.TooBigUint8); err != nil {
 		fmt.Println(err.Error())
@@ -136,3 +157,155 @@ func ExampleWrongArgUserType() {
 
 	// Output: Incompatible call to foo: argument s must be of type fint (got int)
 }
+
+func ExampleBreakOutsideLoop() {
+	if err := buildAST(invalidprograms.BreakOutsideLoop); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Break outside of loop.
+}
+
+func ExampleInvalidLoopLabel() {
+	if err := buildAST(invalidprograms.InvalidLoopLabel); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Invalid loop label "outer".
+}
+
+func ExampleTupleFieldAssignment() {
+	if err := buildAST(invalidprograms.TupleFieldAssignment); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Can not assign to immutable let variable "p".
+}
+
+func ExampleTupleWithInvalidField() {
+	if err := buildAST(invalidprograms.TupleWithInvalidField); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Tuple does not have component named z
+}
+
+func ExampleIncompleteNestedMatch() {
+	if err := buildAST(invalidprograms.IncompleteNestedMatch); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Inexhaustive match for enum type "Maybe Maybe int": Missing case "Just Nothing".
+}
+
+func ExampleGuardedMatch() {
+	if err := buildAST(invalidprograms.GuardedMatch); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Inexhaustive match for enum type "Maybe int": Missing case "Just _".
+}
+
+func ExampleIncompleteTupleMatch() {
+	if err := buildAST(invalidprograms.IncompleteTupleMatch); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Inexhaustive match for type "(Foo, int)": Missing case "(B, _)".
+}
+
+func ExampleIfExprWithoutElse() {
+	if err := buildAST(invalidprograms.IfExprWithoutElse); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: If expression must have an else branch.
+}
+
+func ExampleMismatchedIfExpr() {
+	if err := buildAST(invalidprograms.MismatchedIfExpr); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Incompatible types for branches of expression: "int" and "string".
+}
+
+func ExampleMismatchedMatchExpr() {
+	if err := buildAST(invalidprograms.MismatchedMatchExpr); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Incompatible types for branches of expression: "int" and "string".
+}
+
+func ExampleInexhaustiveMatchExpr() {
+	if err := buildAST(invalidprograms.InexhaustiveMatchExpr); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Inexhaustive match for type "int": Missing case "_".
+}
+
+func ExampleMatchExprWithoutValue() {
+	if err := buildAST(invalidprograms.MatchExprWithoutValue); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Branch of expression must end with a value.
+}
+
+func ExampleConstantBeforeDeclaration() {
+	if err := buildAST(invalidprograms.ConstantBeforeDeclaration); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Use of undefined variable "Size".
+}
+
+func ExampleConstantCallsLaterFunc() {
+	if err := buildAST(invalidprograms.ConstantCallsLaterFunc); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Use of undefined variable "square".
+}
+
+func ExampleDuplicateConstant() {
+	if err := buildAST(invalidprograms.DuplicateConstant); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Constant "Size" is already declared.
+}
+
+func ExampleArrayConstant() {
+	if err := buildAST(invalidprograms.ArrayConstant); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Constant "Sizes" must be an integer, bool or string, not [3]int.
+}
+
+func ExampleAssignToConstant() {
+	if err := buildAST(invalidprograms.AssignToConstant); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Can not assign to immutable let variable "Size".
+}
+
+func ExampleInlineAndNoInline() {
+	if err := buildAST(invalidprograms.InlineAndNoInline); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: A function can only have one of inline or noinline.
+}
+
+func ExampleUnknownFuncAttribute() {
+	if err := buildAST(invalidprograms.UnknownFuncAttribute); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// Output: Invalid function attribute. Expecting 'affects', 'inline' or 'noinline', not fast
+}
@@ -6,8 +6,8 @@ import (
 	"reflect"
 )
 
-func consumeWhileLoop(start int, tokens []token.Token, c *Context) (int, Node, error) {
-	l := WhileLoop{}
+func consumeWhileLoop(start int, tokens []token.Token, c *Context, label string) (int, Node, error) {
+	l := WhileLoop{Label: label}
 
 	if tokens[start] != token.Keyword("while") {
 		return 0, nil, fmt.Errorf("Invalid while loop")
@@ -20,6 +20,7 @@ func consumeWhileLoop(start int, tokens []token.Token, c *Context) (int, Node, e
 	l.Condition = cv
 
 	c2 := c.Clone()
+	c2.Loops = append(c2.Loops, label)
 	bn, block, err := consumeBlock(start+cn+1, tokens, &c2)
 	if err != nil {
 		return 0, nil, err
@@ -29,6 +30,158 @@ func consumeWhileLoop(start int, tokens []token.Token, c *Context) (int, Node, e
 	return cn + bn + 1, l, nil
 }
 
+// Consumes a break or continue statement, with an optional label.
+func consumeLoopBranch(start int, tokens []token.Token, c *Context) (int, Node, error) {
+	kw := tokens[start]
+	if len(c.Loops) == 0 {
+		if kw == token.Keyword("break") {
+			return 0, nil, fmt.Errorf("Break outside of loop.")
+		}
+		return 0, nil, fmt.Errorf("Continue outside of loop.")
+	}
+
+	// The label has to be on the same line, otherwise the next token is
+	// the start of the next statement.
+	label := ""
+	if start+1 < len(tokens) && c.line(start+1) == c.line(start) {
+		if l, ok := tokens[start+1].(token.Unknown); ok {
+			label = l.String()
+		}
+	}
+
+	n := 1
+	if label != "" {
+		found := false
+		for _, l := range c.Loops {
+			if l == label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, nil, fmt.Errorf(`Invalid loop label "%v".`, label)
+		}
+		n++
+	}
+	if kw == token.Keyword("break") {
+		return n, BreakStmt{label}, nil
+	}
+	return n, ContinueStmt{label}, nil
+}
+
+func consumeForLoop(start int, tokens []token.Token, c *Context, label string) (int, Node, error) {
+	l := ForLoop{Label: label}
+
+	if tokens[start] != token.Keyword("for") {
+		return 0, nil, fmt.Errorf("Invalid for loop")
+	}
+
+	// Parse the names of the loop variables. Either "for x in" or
+	// "for i, x in"
+	var names []string
+	i := start + 1
+	for ; i < len(tokens); i++ {
+		name, ok := tokens[i].(token.Unknown)
+		if !ok {
+			return 0, nil, fmt.Errorf("Invalid variable name in for loop: %v", tokens[i])
+		}
+		if _, ok := c.Mutables[name.String()]; ok {
+			return 0, nil, fmt.Errorf("Can not shadow mutable variable \"%v\".", name)
+		}
+		names = append(names, name.String())
+		i++
+		if tokens[i] != token.Char(",") {
+			break
+		}
+	}
+	if len(names) > 2 {
+		return 0, nil, fmt.Errorf("Too many variables in for loop")
+	}
+	if tokens[i] != token.Keyword("in") {
+		return 0, nil, fmt.Errorf("Expected in in for loop, got %v", tokens[i])
+	}
+	i++
+
+	vn, val, err := consumeValue(i, tokens, c, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	i += vn
+
+	if tokens[i] == token.Operator("..") {
+		// It's a range
+		if len(names) != 1 {
+			return 0, nil, fmt.Errorf("Ranges only have one loop variable")
+		}
+		en, end, err := consumeValue(i+1, tokens, c, true)
+		if err != nil {
+			return 0, nil, err
+		}
+		i += en + 1
+		if err := c.isCompatibleRange(val, end); err != nil {
+			return 0, nil, err
+		}
+		l.Start = val
+		l.End = end
+		l.Index = VarWithType{Variable(names[0]), val.Type(), false}
+	} else {
+		coll, ok := val.(VarWithType)
+		if !ok {
+			if val.Type() == nil {
+				return 0, nil, fmt.Errorf("Can not iterate over %v", reflect.TypeOf(val))
+			}
+			// The name can't conflict with a variable in the
+			// program, since it isn't a valid identifier.
+			coll = VarWithType{Variable("for.collection"), val.Type(), false}
+			l.CollectionValue = val
+		}
+		var elem Type
+		switch t := coll.Typ.(type) {
+		case ArrayType:
+			elem = t.Base
+		case SliceType:
+			elem = t.Base
+		default:
+			if coll.Type().TypeName() != "string" {
+				if l.CollectionValue != nil {
+					return 0, nil, fmt.Errorf("Can not iterate over value of type %v", coll.Type().TypeName())
+				}
+				return 0, nil, fmt.Errorf("Can not iterate over %v of type %v", coll.Name, coll.Type().TypeName())
+			}
+			elem = TypeLiteral("byte")
+		}
+		l.Collection = coll
+		if len(names) == 2 {
+			l.Index = VarWithType{Variable(names[0]), TypeLiteral("int"), false}
+			l.Value = VarWithType{Variable(names[1]), elem, false}
+		} else {
+			l.Value = VarWithType{Variable(names[0]), elem, false}
+		}
+	}
+
+	// The loop variables are let variables scoped to the body, so they
+	// can't be assigned to.
+	c2 := c.Clone()
+	if l.Index.Name != "" && l.Index.Name != "_" {
+		c2.Variables[l.Index.Name.String()] = l.Index
+	} else {
+		l.Index.Name = ""
+	}
+	if l.Value.Name != "" && l.Value.Name != "_" {
+		c2.Variables[l.Value.Name.String()] = l.Value
+	} else {
+		l.Value.Name = ""
+	}
+
+	c2.Loops = append(c2.Loops, label)
+	bn, block, err := consumeBlock(i, tokens, &c2)
+	if err != nil {
+		return 0, nil, err
+	}
+	l.Body = block
+	return i + bn - start, l, nil
+}
+
 func consumeCondition(start int, tokens []token.Token, c *Context) (int, BoolValue, error) {
 	n, cond, err := consumeValue(start, tokens, c, true)
 	if err != nil {
@@ -58,3 +211,20 @@ func consumeCondition(start int, tokens []token.Token, c *Context) (int, BoolVal
 		return 0, nil, fmt.Errorf("Unsupported comparison %s", reflect.TypeOf(val))
 	}
 }
+
+// Returns an error if start and end can't be the bounds of the same range.
+func (c *Context) isCompatibleRange(start, end Value) error {
+	if start.Type() == nil || end.Type() == nil {
+		return fmt.Errorf("Bounds of range %v..%v do not have a value.", start, end)
+	}
+	if start.Type().TypeName() == end.Type().TypeName() {
+		return nil
+	}
+	if IsLiteral(start) && c.IsCompatibleType(end.Type(), start) == nil {
+		return nil
+	}
+	if IsLiteral(end) && c.IsCompatibleType(start.Type(), end) == nil {
+		return nil
+	}
+	return fmt.Errorf(`Incompatible types for range: "%v" and "%v".`, start.Type().TypeName(), end.Type().TypeName())
+}
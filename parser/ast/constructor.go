@@ -25,6 +25,8 @@ func topLevelNode(T token.Token) (Node, error) {
 			return TypeDefn{}, nil
 		case "enum":
 			return EnumTypeDefn{}, nil
+		case "let":
+			return LetStmt{}, nil
 		}
 		return nil, fmt.Errorf("Invalid top level keyword: %v", t)
 	default:
@@ -71,27 +73,24 @@ func stripWhitespaceAndComments(tokens []token.Token) []token.Token {
 	return t2
 }
 
-// Construct constructs the top level ASTNodes for a file.
-func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error) {
-	var nodes []Node
-	ti := TypeInformation{
-		("int"):    TypeInfo{0, true},
-		("uint"):   TypeInfo{0, false},
-		("int8"):   TypeInfo{1, true},
-		("uint8"):  TypeInfo{1, false},
-		("byte"):   TypeInfo{1, false},
-		("int16"):  TypeInfo{2, true},
-		("uint16"): TypeInfo{2, false},
-		("int32"):  TypeInfo{4, true},
-		("uint32"): TypeInfo{4, false},
-		("int64"):  TypeInfo{8, true},
-		("uint64"): TypeInfo{8, false},
-		("bool"):   TypeInfo{1, false},
-		("string"): TypeInfo{0, false},
+// Returns the lines of the tokens that stripWhitespaceAndComments keeps.
+func stripLines(tokens []token.Token, lines []int) []int {
+	l2 := make([]int, 0, len(tokens))
+	for i, t := range tokens {
+		switch t.(type) {
+		case token.Whitespace, token.CommentDelimiter, token.LineComment, token.BlockComment:
+			continue
+		default:
+			l2 = append(l2, lines[i])
+		}
 	}
+	return l2
+}
 
-	c := NewContext()
-
+// Construct constructs the top level ASTNodes for a file.
+func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error) {
+	p := newParser()
+	p.c.Lines = stripLines(tokens, token.Lines(tokens))
 	tokens = stripWhitespaceAndComments(tokens)
 	if debug {
 		for i := 0; i < len(tokens); i++ {
@@ -99,20 +98,71 @@ func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error)
 		}
 	}
 
-	callables := make(Callables)
-	for k, v := range c.Functions {
-		callables[k] = append(callables[k], v)
+	err := extractPrototypes(tokens, &p.c)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	err := extractPrototypes(tokens, &c)
+	nodes, err := p.topLevel(tokens)
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	return nodes, p.ti, p.callables, nil
+}
 
+// A parser holds what's been declared by the top level of the program that
+// it's parsing.
+type parser struct {
+	c         Context
+	ti        TypeInformation
+	callables Callables
+
+	// The top level constants and functions that have been declared so
+	// far. A function can only use constants declared before it, and the
+	// initializer of a constant can only call functions declared before
+	// it, so that the constants can be evaluated in order at compile time.
+	constants map[string]VarWithType
+	declared  map[string]Callable
+}
+
+func newParser() *parser {
+	p := &parser{
+		c: NewContext(),
+		ti: TypeInformation{
+			("int"):    TypeInfo{0, true},
+			("uint"):   TypeInfo{0, false},
+			("int8"):   TypeInfo{1, true},
+			("uint8"):  TypeInfo{1, false},
+			("byte"):   TypeInfo{1, false},
+			("int16"):  TypeInfo{2, true},
+			("uint16"): TypeInfo{2, false},
+			("int32"):  TypeInfo{4, true},
+			("uint32"): TypeInfo{4, false},
+			("int64"):  TypeInfo{8, true},
+			("uint64"): TypeInfo{8, false},
+			("bool"):   TypeInfo{1, false},
+			("string"): TypeInfo{0, false},
+		},
+		callables: make(Callables),
+		constants: make(map[string]VarWithType),
+		declared:  NewContext().Functions,
+	}
+	for k, v := range p.c.Functions {
+		p.callables[k] = append(p.callables[k], v)
+	}
+	return p
+}
+
+// Parses the top level declarations in tokens, whose prototypes must already
+// have been extracted into p.c.
+func (p *parser) topLevel(tokens []token.Token) ([]Node, error) {
+	var nodes []Node
+	c, ti, callables := &p.c, p.ti, p.callables
+	constants, declared := p.constants, p.declared
 	for i := 0; i < len(tokens); i++ {
 		// Parse the top level "func" or "proc" keyword
 		cn, err := topLevelNode(tokens[i])
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, err
 		}
 
 		switch cur := cn.(type) {
@@ -120,6 +170,9 @@ func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error)
 			// move past the "func" keyword and reset the local
 			// variables and mutables, since we're in a new function.
 			c.Variables = make(map[string]VarWithType)
+			for k, v := range constants {
+				c.Variables[k] = v
+			}
 			c.Mutables = make(map[string]VarWithType)
 			c.PureContext = true
 			i++
@@ -129,13 +182,14 @@ func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error)
 			cur.Name = tokens[i].String()
 			i++
 
-			n, a, r, e, err := consumePrototype(i, tokens, &c)
+			n, a, r, e, inline, err := consumePrototype(i, tokens, c)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, err
 			}
 			cur.Args = a
 			cur.Return = r
 			cur.Effects = e
+			cur.Inline = inline
 			c.CurFunc = cur
 			i += n
 
@@ -147,19 +201,45 @@ func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error)
 			}
 			c.Functions[cur.Name] = cur
 
-			n, block, err := consumeBlock(i, tokens, &c)
+			n, block, err := consumeBlock(i, tokens, c)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, err
 			}
 			cur.Body = block
 
 			i += n - 1
 			nodes = append(nodes, cur)
 			callables[cur.Name] = append(callables[cur.Name], cur)
+			declared[cur.Name] = cur
+		case LetStmt:
+			c2 := c.Clone()
+			c2.Variables = make(map[string]VarWithType)
+			for k, v := range constants {
+				c2.Variables[k] = v
+			}
+			c2.Mutables = make(map[string]VarWithType)
+			c2.Functions = declared
+			c2.CurFunc = nil
+			if i+1 < len(tokens) {
+				if _, ok := constants[tokens[i+1].String()]; ok {
+					return nil, fmt.Errorf(`Constant "%v" is already declared.`, tokens[i+1])
+				}
+			}
+			n, v, err := consumeLetStmt(i, tokens, &c2)
+			if err != nil {
+				return nil, err
+			}
+			cur = v.(LetStmt)
+			if !isConstantType(cur.Var.Type()) {
+				return nil, fmt.Errorf(`Constant "%v" must be an integer, bool or string, not %v.`, cur.Var.Name, cur.Var.Type().TypeName())
+			}
+			constants[string(cur.Var.Name)] = cur.Var
+			i += n - 1
+			nodes = append(nodes, cur)
 		case TypeDefn:
-			n, params, err := consumeIdentifiersUntilEquals(i+1, tokens, &c)
+			n, params, err := consumeIdentifiersUntilEquals(i+1, tokens, c)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, err
 			}
 			i += n + 1
 			if len(params) != 1 {
@@ -167,9 +247,9 @@ func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error)
 			}
 			cur.Name = params[0].String()
 
-			n, ty, err := consumeType(i+1, tokens, &c)
+			n, ty, err := consumeType(i+1, tokens, c)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, err
 			}
 			cur.ConcreteType = ty
 			//c.Types[cur.Name] = cur
@@ -177,9 +257,9 @@ func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error)
 			i += n
 			nodes = append(nodes, cur)
 		case EnumTypeDefn:
-			n, typeNames, err := consumeIdentifiersUntilEquals(i+1, tokens, &c)
+			n, typeNames, err := consumeIdentifiersUntilEquals(i+1, tokens, c)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, err
 			}
 			i += n + 1
 
@@ -189,9 +269,9 @@ func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error)
 			for _, param := range typeNames[1:] {
 				pv = append(pv, param.String())
 			}
-			n, options, err := consumeEnumTypeList(i+1, tokens, &c)
+			n, options, err := consumeEnumTypeList(i+1, tokens, c)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, err
 			}
 			for _, constructor := range options {
 				constructor.ParentType = TypeLiteral(cur.Name)
@@ -210,26 +290,26 @@ func Construct(tokens []token.Token) ([]Node, TypeInformation, Callables, error)
 			nodes = append(nodes, cur)
 		}
 	}
-	return nodes, ti, callables, nil
+	return nodes, nil
 }
 
-func consumePrototype(start int, tokens []token.Token, c *Context) (n int, args []VarWithType, retn []VarWithType, effects []Effect, err error) {
+func consumePrototype(start int, tokens []token.Token, c *Context) (n int, args []VarWithType, retn []VarWithType, effects []Effect, inline InlineHint, err error) {
 	n, argsDefn, err := consumeTupleType(start, tokens, c)
 	if err != nil {
-		return 0, nil, nil, nil, err
+		return 0, nil, nil, nil, 0, err
 	}
 
 	n2, retDefn, err := consumeTypeList(start+n, tokens, *c)
 	if err != nil {
-		return 0, nil, nil, nil, err
+		return 0, nil, nil, nil, 0, err
 	}
 
 	// FIXME: Consume the effect list, don't skip it.
-	n3, effects, err := consumeEffectList(start+n+n2, tokens, c)
+	n3, effects, inline, err := consumeEffectList(start+n+n2, tokens, c)
 	if err != nil {
-		return 0, nil, nil, nil, err
+		return 0, nil, nil, nil, 0, err
 	}
-	return n + n2 + n3, argsDefn, retDefn, effects, nil
+	return n + n2 + n3, argsDefn, retDefn, effects, inline, nil
 }
 
 func extractPrototypes(tokens []token.Token, c *Context) error {
@@ -260,6 +340,10 @@ func extractPrototypes(tokens []token.Token, c *Context) error {
 			i += n
 
 			c.Functions[cur.Name] = cur
+		case LetStmt:
+			// Constants are parsed once all the function prototypes
+			// are known.
+			i += skipConstant(i, tokens) - 1
 		case TypeDefn:
 			n, params, err := consumeIdentifiersUntilEquals(i+1, tokens, c)
 			if err != nil {
@@ -328,13 +412,14 @@ func extractPrototypes(tokens []token.Token, c *Context) error {
 			cur.Name = tokens[i].String()
 			i++
 
-			n, a, r, e, err := consumePrototype(i, tokens, c)
+			n, a, r, e, inline, err := consumePrototype(i, tokens, c)
 			if err != nil {
 				return err
 			}
 			cur.Args = a
 			cur.Return = r
 			cur.Effects = e
+			cur.Inline = inline
 			i += n
 
 			n, err = skipBlock(i, tokens, c)
@@ -344,6 +429,8 @@ func extractPrototypes(tokens []token.Token, c *Context) error {
 			i += n
 
 			c.Functions[cur.Name] = cur
+		case LetStmt:
+			i += skipConstant(i, tokens) - 1
 		case TypeDefn:
 			n, params, err := consumeIdentifiersUntilEquals(i+1, tokens, c)
 			if err != nil {
@@ -410,7 +497,7 @@ func consumeBlock(start int, tokens []token.Token, c *Context) (int, BlockStmt,
 			if err != nil {
 				return 0, BlockStmt{}, err
 			}
-			blockStmt.Stmts = append(blockStmt.Stmts, subblock)
+			blockStmt.add(subblock, i, c)
 			i += n
 			continue
 		} else if tokens[i] == token.Char("}") {
@@ -420,12 +507,18 @@ func consumeBlock(start int, tokens []token.Token, c *Context) (int, BlockStmt,
 		if err != nil {
 			return 0, BlockStmt{}, err
 		}
-		blockStmt.Stmts = append(blockStmt.Stmts, stmt)
+		blockStmt.add(stmt, i, c)
 		i += n - 1
 	}
 	return 0, BlockStmt{}, fmt.Errorf("Unterminated block statement")
 }
 
+// Adds stmt, which starts at token i, to the end of b.
+func (b *BlockStmt) add(stmt Node, i int, c *Context) {
+	b.Stmts = append(b.Stmts, stmt)
+	b.Lines = append(b.Lines, c.line(i))
+}
+
 func consumeStmt(start int, tokens []token.Token, c *Context) (int, Node, error) {
 	switch t := tokens[start].(type) {
 	case token.Unknown:
@@ -444,6 +537,9 @@ func consumeStmt(start int, tokens []token.Token, c *Context) (int, Node, error)
 				return 0, nil, fmt.Errorf("Call to undefined function: %v", tokens[start])
 			}
 		case token.Char("."):
+			if start+3 < len(tokens) && tokens[start+3] == token.Operator("=") {
+				return consumeFieldAssignment(start, tokens, c)
+			}
 			n, fc, err := consumeFuncCall(start+2, tokens, c, []Value{c.Variables[tokens[start].String()]})
 			if err != nil {
 				return 0, nil, err
@@ -478,6 +574,32 @@ func consumeStmt(start int, tokens []token.Token, c *Context) (int, Node, error)
 				Variable: av,
 				Value:    val,
 			}, nil
+		case token.Char(":"):
+			// A labeled loop.
+			if start+2 >= len(tokens) {
+				return 0, nil, fmt.Errorf("Invalid token at end of file.")
+			}
+			label := t.String()
+			for _, l := range c.Loops {
+				if l == label {
+					return 0, nil, fmt.Errorf(`Duplicate loop label "%v".`, label)
+				}
+			}
+			var n int
+			var l Node
+			var err error
+			switch tokens[start+2] {
+			case token.Keyword("while"):
+				n, l, err = consumeWhileLoop(start+2, tokens, c, label)
+			case token.Keyword("for"):
+				n, l, err = consumeForLoop(start+2, tokens, c, label)
+			default:
+				return 0, nil, fmt.Errorf("Label %v must precede a loop.", label)
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			return n + 2, l, nil
 		case token.Operator("="):
 			if !c.IsVariable(t.String()) {
 				return 0, nil, fmt.Errorf("Invalid variable for assignment: %v", tokens[start])
@@ -517,7 +639,11 @@ func consumeStmt(start int, tokens []token.Token, c *Context) (int, Node, error)
 			}
 			return n + 1, ReturnStmt{Val: nd}, nil
 		case "while":
-			return consumeWhileLoop(start, tokens, c)
+			return consumeWhileLoop(start, tokens, c, "")
+		case "for":
+			return consumeForLoop(start, tokens, c, "")
+		case "break", "continue":
+			return consumeLoopBranch(start, tokens, c)
 		case "if":
 			return consumeIfStmt(start, tokens, c)
 		case "match":
@@ -532,6 +658,53 @@ func consumeStmt(start int, tokens []token.Token, c *Context) (int, Node, error)
 	}
 }
 
+// Consumes an assignment to a single field of a mutable tuple, of the form
+// "x.y = value".
+func consumeFieldAssignment(start int, tokens []token.Token, c *Context) (int, Node, error) {
+	name := tokens[start].String()
+	if !c.IsVariable(name) {
+		return 0, nil, fmt.Errorf("Invalid variable for assignment: %v", name)
+	}
+	if !c.IsMutable(name) {
+		return 0, nil, fmt.Errorf(`Can not assign to immutable let variable "%v".`, name)
+	}
+	v := c.Variables[name]
+	tt, ok := UnderlyingTuple(v.Type())
+	if !ok {
+		return 0, nil, fmt.Errorf("Can not assign to field of non-tuple variable %v", name)
+	}
+
+	elem := Variable(tokens[start+2].String())
+	var field VarWithType
+	for i := range tt {
+		if tt[i].Name == elem {
+			field = VarWithType{v.Name + "." + elem, tt[i].Type(), v.Reference}
+			break
+		}
+	}
+	if field.Name == "" {
+		return 0, nil, fmt.Errorf("Tuple does not have component named %v", elem)
+	}
+
+	n, val, err := consumeValue(start+4, tokens, c, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	if IsLiteral(val) {
+		if err := c.IsCompatibleType(field.Type(), val); err != nil {
+			return 0, nil, fmt.Errorf(`Incompatible assignment for variable "%v": %v.`, field.Name, err)
+		}
+	} else if val.Type().TypeName() != field.Type().TypeName() {
+		return 0, nil, fmt.Errorf(`Incompatible assignment for variable "%v": can not assign %v to %v.`, field.Name, val.Type().TypeName(), field.Type().TypeName())
+	}
+
+	// n for the value, 3 for the field, and one for the = sign.
+	return n + 4, AssignmentOperator{
+		Variable: field,
+		Value:    val,
+	}, nil
+}
+
 func consumeFuncCall(start int, tokens []token.Token, c *Context, mvals []Value) (int, FuncCall, error) {
 	name := tokens[start].String()
 	f := FuncCall{
@@ -588,6 +761,10 @@ argLoop:
 				if err := c.IsCompatibleType(arg.Type(), f.UserArgs[i]); err != nil {
 					return 0, FuncCall{}, fmt.Errorf("Incompatible call to %v: argument %v must be of type %v (got %v)", name, arg.Name, arg.Type().PrettyPrint(0), f.UserArgs[i].Type())
 				}
+			} else if ev, ok := f.UserArgs[i].(EnumValue); ok {
+				if !c.isCompatibleEnumValue(arg.Type(), ev) {
+					return 0, FuncCall{}, fmt.Errorf("Incompatible call to %v: argument %v must be of type %v (got %v)", name, arg.Name, arg.Type().PrettyPrint(0), f.UserArgs[i].Type())
+				}
 			} else {
 				if arg.Type().TypeName() != f.UserArgs[i].Type().TypeName() {
 					return 0, FuncCall{}, fmt.Errorf("Incompatible call to %v: argument %v must be of type %v (got %v)", name, arg.Name, arg.Type().PrettyPrint(0), f.UserArgs[i].Type())
@@ -713,9 +890,10 @@ func consumeMutStmt(start int, tokens []token.Token, c *Context) (int, Node, err
 				if !ok {
 					return 0, nil, fmt.Errorf("Invalid type: %v", tn)
 				}
-				if et, ok := ct.ConcreteType.(EnumTypeDefn); ok {
-					l.Var.Typ = et
-				} else {
+				switch ct.ConcreteType.(type) {
+				case EnumTypeDefn, UserType:
+					l.Var.Typ = ct.ConcreteType
+				default:
 					l.Var.Typ = UserType{ct.ConcreteType, tn}
 				}
 			} else {
@@ -729,7 +907,7 @@ func consumeMutStmt(start int, tokens []token.Token, c *Context) (int, Node, err
 
 			}
 		case token.Char:
-			if l.Var.Typ == nil && t == "[" {
+			if l.Var.Typ == nil && (t == "[" || t == "(") {
 				n, ty, err := consumeType(i, tokens, c)
 				if err != nil {
 					return 0, nil, err
@@ -908,32 +1086,49 @@ func consumeTypeList(start int, tokens []token.Token, c Context) (int, []VarWith
 	return 0, nil, fmt.Errorf("Could not parse arguments")
 }
 
-func consumeEffectList(start int, tokens []token.Token, c *Context) (int, []Effect, error) {
+// Consumes the effect list of a function, and the attributes that can
+// follow it, such as "-> affects(IO) noinline".
+func consumeEffectList(start int, tokens []token.Token, c *Context) (int, []Effect, InlineHint, error) {
 	i := start
 	if tokens[i] == token.Char("{") {
 		// No effects, but no error
-		return 0, nil, nil
+		return 0, nil, InlineDefault, nil
 	}
 	if tokens[i] != token.Operator("->") {
-		return 0, nil, fmt.Errorf("Not at start of an effect list. Expecting '->', not '%v'", tokens[i])
-	}
-	if tokens[i+1] != token.Keyword("affects") {
-		return 0, nil, fmt.Errorf("Not at start of an effect list. Expecting 'affects', not %v", tokens[i+1])
+		return 0, nil, 0, fmt.Errorf("Not at start of an effect list. Expecting '->', not '%v'", tokens[i])
 	}
-	i += 2
 
 	var effects []Effect
+	inline := InlineDefault
+	affects := false
 	for i++; i < len(tokens); i++ {
-		if tokens[i] == token.Char(",") {
-			continue
-		}
-
-		if tokens[i] == token.Char(")") {
-			return i - start + 1, effects, nil
+		switch tokens[i] {
+		case token.Char("{"):
+			return i - start, effects, inline, nil
+		case token.Keyword("inline"), token.Keyword("noinline"):
+			if inline != InlineDefault {
+				return 0, nil, 0, fmt.Errorf("A function can only have one of inline or noinline.")
+			}
+			inline = InlineAlways
+			if tokens[i] == token.Keyword("noinline") {
+				inline = InlineNever
+			}
+		case token.Keyword("affects"):
+			if affects {
+				return 0, nil, 0, fmt.Errorf("A function can only have one effect list.")
+			}
+			affects = true
+			for i += 2; i < len(tokens) && tokens[i] != token.Char(")"); i++ {
+				if tokens[i] == token.Char(",") {
+					continue
+				}
+				effects = append(effects, Effect(tokens[i].String()))
+			}
+		default:
+			return 0, nil, 0, fmt.Errorf("Invalid function attribute. Expecting 'affects', 'inline' or 'noinline', not %v", tokens[i])
 		}
-		effects = append(effects, Effect(tokens[i].String()))
 	}
-	return 0, nil, fmt.Errorf("Effect lists must end with a block start.")
+	return 0, nil, 0, fmt.Errorf("Effect lists must end with a block start.")
 }
 
 func consumeType(start int, tokens []token.Token, c *Context) (int, Type, error) {
@@ -1090,6 +1285,35 @@ func skipBlock(start int, tokens []token.Token, c *Context) (int, error) {
 	return i - 1 - start, nil
 }
 
+// Returns the number of tokens in the top level let statement starting at
+// start, which ends at the next top level declaration.
+func skipConstant(start int, tokens []token.Token) int {
+	depth := 0
+	for i := start + 1; i < len(tokens); i++ {
+		switch tokens[i] {
+		case token.Char("{"), token.Char("("):
+			depth++
+		case token.Char("}"), token.Char(")"):
+			depth--
+		case token.Keyword("func"), token.Keyword("type"), token.Keyword("enum"), token.Keyword("let"):
+			if depth == 0 {
+				return i - start
+			}
+		}
+	}
+	return len(tokens) - start
+}
+
+// Returns true if t is a type that a top level constant can have.
+func isConstantType(t Type) bool {
+	switch t.TypeName() {
+	case "int", "uint", "int8", "uint8", "byte", "int16", "uint16",
+		"int32", "uint32", "int64", "uint64", "bool", "string":
+		return true
+	}
+	return false
+}
+
 func skipPrototype(start int, tokens []token.Token, c *Context) (int, error) {
 	n, err := skipTuple(start, tokens, c)
 	if err != nil {
@@ -1129,10 +1353,6 @@ func skipEffectList(start int, tokens []token.Token, c *Context) (int, error) {
 	if tokens[i] != token.Operator("->") {
 		return 0, fmt.Errorf("Not at start of an effect list. Expecting '->', not '%v'", tokens[i])
 	}
-	if tokens[i+1] != token.Keyword("affects") {
-		return 0, fmt.Errorf("Not at start of an effect list. Expecting 'affects', not %v", tokens[i+1])
-	}
-	i += 2
 
 	for ; i < len(tokens); i++ {
 		if tokens[i] == token.Char("{") {
@@ -8,6 +8,14 @@ type Context struct {
 	PureContext bool // true if inside a pure function.
 	EnumOptions map[string]EnumOption
 	CurFunc     Callable
+
+	// The labels of the loops enclosing the current block, with the
+	// innermost loop last. Unlabeled loops have an empty label.
+	Loops []string
+
+	// The line of the source that each token being parsed is on, by
+	// index, if it's known.
+	Lines []int
 }
 
 func NewContext() Context {
@@ -160,9 +168,19 @@ func (c Context) Clone() Context {
 	}
 	c2.PureContext = c.PureContext
 	c2.CurFunc = c.CurFunc
+	c2.Loops = append([]string(nil), c.Loops...)
+	c2.Lines = c.Lines
 	return c2
 }
 
+// Returns the line of the source that token i is on, or 0 if it's not known.
+func (c Context) line(i int) int {
+	if i < 0 || i >= len(c.Lines) {
+		return 0
+	}
+	return c.Lines[i]
+}
+
 func (c Context) IsVariable(s string) bool {
 	for _, v := range c.Variables {
 		if string(v.Name) == s {
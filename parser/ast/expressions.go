@@ -0,0 +1,160 @@
+package ast
+
+import (
+	"fmt"
+
+	"github.com/driusan/lang/parser/token"
+)
+
+// Consumes the body of a branch of an if or match expression, up to (but not
+// including) the token where end returns true. The body is a list of
+// statements like any other block, but the last one must be a value, which
+// is the value of the branch.
+func consumeBranchBody(start int, tokens []token.Token, c *Context, end func(token.Token) bool) (int, BlockStmt, error) {
+	var b BlockStmt
+	for i := start; i < len(tokens); {
+		if end(tokens[i]) {
+			if len(b.Stmts) == 0 {
+				return 0, BlockStmt{}, fmt.Errorf("Branch of expression must have a value.")
+			}
+			if _, ok := branchValue(b); !ok {
+				return 0, BlockStmt{}, fmt.Errorf("Branch of expression must end with a value.")
+			}
+			return i - start, b, nil
+		}
+		n, stmt, err := consumeBranchStmt(i, tokens, c, end)
+		if err != nil {
+			return 0, BlockStmt{}, err
+		}
+		b.add(stmt, i, c)
+		i += n
+	}
+	return 0, BlockStmt{}, fmt.Errorf("Unterminated expression branch")
+}
+
+// Consumes a single statement in the body of a branch of an expression. If
+// the statement is the last one in the branch and is a value, the value is
+// returned instead.
+func consumeBranchStmt(start int, tokens []token.Token, c *Context, end func(token.Token) bool) (int, Node, error) {
+	last := func(n int) bool {
+		return start+n < len(tokens) && end(tokens[start+n])
+	}
+	switch t := tokens[start].(type) {
+	case token.Keyword:
+		switch t {
+		case "if", "match":
+			// An if or match at the end of a branch is the value of
+			// the branch, otherwise it's a statement.
+			n, v, err := consumeValue(start, tokens, c, false)
+			if err == nil && last(n) {
+				return n, v, nil
+			}
+			sn, stmt, serr := consumeStmt(start, tokens, c)
+			if serr != nil {
+				return 0, nil, serr
+			}
+			if err != nil && last(sn) {
+				return 0, nil, err
+			}
+			return sn, stmt, nil
+		case "cast":
+		default:
+			return consumeStmt(start, tokens, c)
+		}
+	case token.Unknown:
+		if start+1 < len(tokens) {
+			switch tokens[start+1] {
+			case token.Char(":"), token.Operator("="):
+				return consumeStmt(start, tokens, c)
+			case token.Char("."):
+				if start+3 < len(tokens) && tokens[start+3] == token.Operator("=") {
+					return consumeStmt(start, tokens, c)
+				}
+			}
+		}
+	}
+	n, v, err := consumeValue(start, tokens, c, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	if start+n < len(tokens) && tokens[start+n] == token.Operator("=") {
+		// Assigning to an index of an array.
+		return consumeStmt(start, tokens, c)
+	}
+	if _, ok := v.(FuncCall); !ok && !last(n) {
+		return 0, nil, fmt.Errorf("Value %v is not used.", v)
+	}
+	return n, v, nil
+}
+
+// Returns the value of a branch of an if or match expression.
+func branchValue(b BlockStmt) (Value, bool) {
+	if len(b.Stmts) == 0 {
+		return nil, false
+	}
+	switch b.Stmts[len(b.Stmts)-1].(type) {
+	case LetStmt, MutStmt:
+		return nil, false
+	}
+	v, ok := b.Stmts[len(b.Stmts)-1].(Value)
+	return v, ok
+}
+
+// Returns the type of an expression whose branches have the values vals.
+//
+// Branch types unify the same way that values passed to a function do: a
+// literal or an enumerated value is compatible with any type that it could
+// be assigned to, and any other value must have the same type as the other
+// branches.
+func (c *Context) unifyBranchTypes(vals []Value) (Type, error) {
+	var typ Type
+	words := 0
+	for _, v := range vals {
+		switch ev := v.(type) {
+		case EnumValue:
+			if typ == nil || words > 0 {
+				// The most specific enum value determines the
+				// type, since "Nothing" could be any Maybe.
+				if n := len(ev.Parameters) + 1; n > words {
+					typ, words = ev.Type(), n
+				}
+			}
+			continue
+		}
+		if !IsLiteral(v) {
+			typ, words = v.Type(), 0
+			break
+		}
+	}
+	if typ == nil {
+		typ = vals[0].Type()
+	}
+	if _, ok := UnderlyingTuple(typ); ok {
+		return nil, fmt.Errorf("Branches of an expression can not be tuples.")
+	}
+	for _, v := range vals {
+		if err := c.isCompatibleBranch(typ, v); err != nil {
+			return nil, err
+		}
+	}
+	return typ, nil
+}
+
+func (c *Context) isCompatibleBranch(typ Type, v Value) error {
+	if v.Type() == nil {
+		return fmt.Errorf("Branch %v of expression does not have a value.", v)
+	}
+	if v.Type().TypeName() == typ.TypeName() {
+		return nil
+	}
+	if ev, ok := v.(EnumValue); ok {
+		if c.isCompatibleEnumValue(typ, ev) {
+			return nil
+		}
+	} else if IsLiteral(v) {
+		if _, ok := c.Types[typ.TypeName()]; ok && c.IsCompatibleType(typ, v) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf(`Incompatible types for branches of expression: "%v" and "%v".`, typ.TypeName(), v.Type().TypeName())
+}
@@ -60,10 +60,24 @@ type FuncDecl struct {
 	Args    TupleType
 	Return  TupleType
 	Effects []Effect
+	Inline  InlineHint
 
 	Body BlockStmt
 }
 
+// An InlineHint is an attribute of a function declaration which tells the
+// optimizer whether calls to the function should be inlined.
+type InlineHint uint8
+
+const (
+	// Let the optimizer decide.
+	InlineDefault InlineHint = iota
+	// Declared with "-> inline". Inline every call that can be inlined.
+	InlineAlways
+	// Declared with "-> noinline". Never inline calls.
+	InlineNever
+)
+
 func (pd FuncDecl) Node() Node {
 	return pd
 }
@@ -63,7 +63,7 @@ func consumeElseStmt(start int, tokens []token.Token, c *Context) (int, BlockStm
 		if err != nil {
 			return 0, BlockStmt{}, err
 		}
-		return bn + 1, BlockStmt{[]Node{block}}, nil
+		return bn + 1, BlockStmt{Stmts: []Node{block}, Lines: []int{c.line(start + 1)}}, nil
 	case token.Char("{"):
 		bn, block, err := consumeBlock(start+1, tokens, c)
 		if err != nil {
@@ -74,3 +74,91 @@ func consumeElseStmt(start int, tokens []token.Token, c *Context) (int, BlockStm
 		return 0, BlockStmt{}, fmt.Errorf("Invalid else statement")
 	}
 }
+
+// An IfExpr is an if statement used as a value. The value of each branch is
+// the value of the last statement in its block.
+type IfExpr struct {
+	Condition BoolValue
+	Body      BlockStmt
+	Else      BlockStmt
+	Typ       Type
+}
+
+func (i IfExpr) String() string {
+	return fmt.Sprintf("IfExpr{Condition: %v,\n\tBody: %v,\n\tElse: %v,\n\tType: %v}", i.Condition, i.Body, i.Else, i.Typ)
+}
+
+func (i IfExpr) Node() Node {
+	return i
+}
+
+func (i IfExpr) Type() Type {
+	return i.Typ
+}
+
+func (i IfExpr) Value() interface{} {
+	return nil
+}
+
+func (i IfExpr) PrettyPrint(lvl int) string {
+	panic("Not implemented")
+}
+
+func consumeIfExpr(start int, tokens []token.Token, c *Context) (int, IfExpr, error) {
+	l := IfExpr{}
+
+	if tokens[start] != token.Keyword("if") {
+		return 0, IfExpr{}, fmt.Errorf("Invalid if expression")
+	}
+	cn, cv, err := consumeCondition(start+1, tokens, c)
+	if err != nil {
+		return 0, IfExpr{}, err
+	}
+	l.Condition = cv
+
+	i := start + cn + 1
+	endBlock := func(t token.Token) bool {
+		return t == token.Char("}")
+	}
+	if tokens[i] != token.Char("{") {
+		return 0, IfExpr{}, fmt.Errorf("Invalid if expression")
+	}
+	c2 := c.Clone()
+	bn, block, err := consumeBranchBody(i+1, tokens, &c2, endBlock)
+	if err != nil {
+		return 0, IfExpr{}, err
+	}
+	l.Body = block
+	i += bn + 2
+
+	if i >= len(tokens) || tokens[i] != token.Keyword("else") {
+		return 0, IfExpr{}, fmt.Errorf("If expression must have an else branch.")
+	}
+	switch tokens[i+1] {
+	case token.Keyword("if"):
+		en, elseif, err := consumeIfExpr(i+1, tokens, c)
+		if err != nil {
+			return 0, IfExpr{}, err
+		}
+		l.Else = BlockStmt{Stmts: []Node{elseif}, Lines: []int{c.line(i + 1)}}
+		i += en + 1
+	case token.Char("{"):
+		c3 := c.Clone()
+		en, elseblock, err := consumeBranchBody(i+2, tokens, &c3, endBlock)
+		if err != nil {
+			return 0, IfExpr{}, err
+		}
+		l.Else = elseblock
+		i += en + 3
+	default:
+		return 0, IfExpr{}, fmt.Errorf("Invalid else expression")
+	}
+
+	bv, _ := branchValue(l.Body)
+	ev, _ := branchValue(l.Else)
+	l.Typ, err = c.unifyBranchTypes([]Value{bv, ev})
+	if err != nil {
+		return 0, IfExpr{}, err
+	}
+	return i - start, l, nil
+}
@@ -2,6 +2,7 @@ package ast
 
 import (
 	"fmt"
+	"strings"
 )
 
 func IsLiteral(v Value) bool {
@@ -20,6 +21,38 @@ func IsLiteral(v Value) bool {
 	}
 }
 
+// Returns true if the enum value ev can be used as a value of the type typ.
+// An option such as "Nothing" from "Maybe x" doesn't know the concrete types
+// of the parameters of its enum, so only the parameters that it was
+// constructed with need to match.
+func (c *Context) isCompatibleEnumValue(typ Type, ev EnumValue) bool {
+	if typ.TypeName() == ev.TypeName() {
+		return true
+	}
+	words := strings.Fields(typ.TypeName())
+	if len(words) == 0 || words[0] != ev.Constructor.Type().TypeName() {
+		return false
+	}
+	ptypes := constructorTypes(ev.Constructor, typ, c)
+	for i, p := range ev.Parameters {
+		if ptypes[i] == nil {
+			return false
+		}
+		if pv, ok := p.(EnumValue); ok {
+			if !c.isCompatibleEnumValue(ptypes[i], pv) {
+				return false
+			}
+		} else if IsLiteral(p) {
+			if _, ok := c.Types[ptypes[i].TypeName()]; !ok || c.IsCompatibleType(ptypes[i], p) != nil {
+				return false
+			}
+		} else if p.Type().TypeName() != ptypes[i].TypeName() {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Context) IsCompatibleType(typ Type, v Value) error {
 	switch t := typ.(type) {
 	case SumType:
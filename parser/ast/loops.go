@@ -7,6 +7,10 @@ import (
 type WhileLoop struct {
 	Condition BoolValue
 	Body      BlockStmt
+
+	// The label of the loop, if any, for use by break and continue
+	// statements in nested loops.
+	Label string
 }
 
 func (l WhileLoop) Node() Node {
@@ -20,3 +24,82 @@ func (l WhileLoop) String() string {
 func (l WhileLoop) PrettyPrint(lvl int) string {
 	panic("Not implemented")
 }
+
+// A ForLoop iterates over either the elements of a collection (an array,
+// slice, or string) or a half-open range of integers.
+//
+// Index and Value are the (immutable) loop variables. For ranges, only
+// Index is set. Either may have an empty name if the program doesn't
+// refer to it.
+type ForLoop struct {
+	Index, Value VarWithType
+
+	// Set when iterating over a collection. If the collection is an
+	// expression rather than a variable, CollectionValue is the
+	// expression and Collection is a hidden variable which it's
+	// evaluated into once, before the first iteration.
+	Collection      VarWithType
+	CollectionValue Value
+
+	// Set when iterating over a range. End is exclusive.
+	Start, End Value
+
+	Body BlockStmt
+
+	// The label of the loop, if any.
+	Label string
+}
+
+func (l ForLoop) Node() Node {
+	return l
+}
+
+func (l ForLoop) String() string {
+	if l.Start != nil {
+		return fmt.Sprintf("ForLoop{\n\tIndex: %v\n\tStart: %v\n\tEnd: %v\n\tBody: %v\n}", l.Index, l.Start, l.End, l.Body)
+	}
+	if l.CollectionValue != nil {
+		return fmt.Sprintf("ForLoop{\n\tIndex: %v\n\tValue: %v\n\tCollection: %v = %v\n\tBody: %v\n}", l.Index, l.Value, l.Collection, l.CollectionValue, l.Body)
+	}
+	return fmt.Sprintf("ForLoop{\n\tIndex: %v\n\tValue: %v\n\tCollection: %v\n\tBody: %v\n}", l.Index, l.Value, l.Collection, l.Body)
+}
+
+func (l ForLoop) PrettyPrint(lvl int) string {
+	panic("Not implemented")
+}
+
+// A BreakStmt exits the innermost loop, or the loop named by Label if
+// it's set.
+type BreakStmt struct {
+	Label string
+}
+
+func (b BreakStmt) Node() Node {
+	return b
+}
+
+func (b BreakStmt) String() string {
+	return fmt.Sprintf("BreakStmt{%v}", b.Label)
+}
+
+func (b BreakStmt) PrettyPrint(lvl int) string {
+	panic("Not implemented")
+}
+
+// A ContinueStmt skips to the next iteration of the innermost loop, or the
+// loop named by Label if it's set.
+type ContinueStmt struct {
+	Label string
+}
+
+func (c ContinueStmt) Node() Node {
+	return c
+}
+
+func (c ContinueStmt) String() string {
+	return fmt.Sprintf("ContinueStmt{%v}", c.Label)
+}
+
+func (c ContinueStmt) PrettyPrint(lvl int) string {
+	panic("Not implemented")
+}
@@ -3,7 +3,6 @@ package ast
 import (
 	"fmt"
 	"reflect"
-	"strings"
 
 	"github.com/driusan/lang/parser/token"
 )
@@ -11,7 +10,16 @@ import (
 type MatchCase struct {
 	LocalVariables []VarWithType
 	Variable       Value
-	Body           BlockStmt
+
+	// The pattern that the case matches, or nil if the case is a value
+	// that gets compared against the condition.
+	Pattern Pattern
+
+	// An optional bool that must also be true for the case to match.
+	// Variables bound by the pattern are available in the guard.
+	Guard Value
+
+	Body BlockStmt
 }
 
 func (i MatchCase) Node() Node {
@@ -19,7 +27,7 @@ func (i MatchCase) Node() Node {
 }
 
 func (i MatchCase) String() string {
-	return fmt.Sprintf("MatchCase{Locals: %v\n\tVariable: %v,\n\tBody: %v}", i.LocalVariables, i.Variable, i.Body)
+	return fmt.Sprintf("MatchCase{Locals: %v\n\tVariable: %v,\n\tPattern: %v,\n\tGuard: %v,\n\tBody: %v}", i.LocalVariables, i.Variable, i.Pattern, i.Guard, i.Body)
 
 }
 
@@ -44,7 +52,82 @@ func (i MatchStmt) PrettyPrint(lvl int) string {
 	panic("Not implemented")
 }
 
+// A MatchExpr is a match statement used as a value. The value of each case
+// is the value of the last statement in its body.
+type MatchExpr struct {
+	MatchStmt
+	Typ Type
+}
+
+func (m MatchExpr) String() string {
+	return fmt.Sprintf("MatchExpr{Condition: %v,\n\tBody: %v,\n\tType: %v}", m.Condition, m.Cases, m.Typ)
+}
+
+func (m MatchExpr) Node() Node {
+	return m
+}
+
+func (m MatchExpr) Type() Type {
+	return m.Typ
+}
+
+func (m MatchExpr) Value() interface{} {
+	return nil
+}
+
 func consumeMatchStmt(start int, tokens []token.Token, c *Context) (int, MatchStmt, error) {
+	return consumeMatch(start, tokens, c, false)
+}
+
+func consumeMatchExpr(start int, tokens []token.Token, c *Context) (int, MatchExpr, error) {
+	n, m, err := consumeMatch(start, tokens, c, true)
+	if err != nil {
+		return 0, MatchExpr{}, err
+	}
+	if m.Condition == BoolLiteral(true) {
+		// There's nothing to check the exhaustiveness of, so there
+		// must be a case that's always true.
+		exhaustive := false
+		for _, mc := range m.Cases {
+			if b, ok := mc.Variable.(BoolLiteral); ok && bool(b) && mc.Guard == nil {
+				exhaustive = true
+			}
+		}
+		if !exhaustive {
+			return 0, MatchExpr{}, fmt.Errorf(`Inexhaustive match expression: Missing case "true".`)
+		}
+	} else if st, ok := m.Condition.Type().(SumType); ok {
+		for _, t := range st {
+			covered := false
+			for _, mc := range m.Cases {
+				if mc.Variable.Type().TypeName() == t.TypeName() {
+					covered = true
+				}
+			}
+			if !covered {
+				return 0, MatchExpr{}, fmt.Errorf(`Inexhaustive match for type "%v": Missing case "%v".`, st.TypeName(), t.TypeName())
+			}
+		}
+	} else if !mustBeExhaustive(m.Condition.Type(), c) {
+		if err := checkExhaustiveness(m.Condition.Type(), m.Cases, c); err != nil {
+			return 0, MatchExpr{}, err
+		}
+	}
+
+	var vals []Value
+	for _, mc := range m.Cases {
+		v, _ := branchValue(mc.Body)
+		vals = append(vals, v)
+	}
+	typ, err := c.unifyBranchTypes(vals)
+	if err != nil {
+		return 0, MatchExpr{}, err
+	}
+	return n, MatchExpr{m, typ}, nil
+}
+
+// Consumes a match statement, or a match expression if expr is true.
+func consumeMatch(start int, tokens []token.Token, c *Context, expr bool) (int, MatchStmt, error) {
 	l := MatchStmt{}
 
 	if tokens[start] != token.Keyword("match") {
@@ -68,33 +151,18 @@ func consumeMatchStmt(start int, tokens []token.Token, c *Context) (int, MatchSt
 		return 0, MatchStmt{}, fmt.Errorf("Invalid match statement")
 	}
 
-	concreteMap := make(map[string]Type)
 	for i := start + cn + 2; i < len(tokens); {
 		c2 := c.Clone()
 		switch l.Condition.Type().(type) {
 		case SumType:
-			n, cs, err := consumeTypeCase(i, tokens, &c2, l.Condition)
+			n, cs, err := consumeTypeCase(i, tokens, &c2, l.Condition, expr)
 			if err != nil {
 				return 0, MatchStmt{}, err
 			}
 			l.Cases = append(l.Cases, cs)
 			i += n
 		default:
-			if concretes := strings.Fields(string(l.Condition.Type().TypeName())); len(concretes) > 1 {
-				// Convert the generic type's parameters to the concrete typename,
-				// not the generic type, so that the case can look them up properly.
-				// FIXME: There should be a better way than splitting the type name
-				// on whitespace
-				td, ok := c.Types[concretes[0]]
-				if !ok {
-					panic("Expected parameterized enumerated option")
-				}
-				for i, v := range concretes[1:] {
-					concreteMap[td.Parameters[i]] = TypeLiteral(v)
-				}
-			}
-
-			n, cs, err := consumeCase(i, tokens, &c2, concreteMap)
+			n, cs, err := consumeCase(i, tokens, &c2, l.Condition, expr)
 			if err != nil {
 				return 0, MatchStmt{}, err
 			}
@@ -102,8 +170,7 @@ func consumeMatchStmt(start int, tokens []token.Token, c *Context) (int, MatchSt
 			i += n
 		}
 		if tokens[i] == token.Char("}") {
-			ct := c.Types[l.Condition.Type().TypeName()].ConcreteType
-			if _, ok := ct.(EnumTypeDefn); ok {
+			if mustBeExhaustive(l.Condition.Type(), c) {
 				if err := checkExhaustiveness(l.Condition.Type(), l.Cases, c); err != nil {
 					return 0, MatchStmt{}, err
 				}
@@ -114,24 +181,30 @@ func consumeMatchStmt(start int, tokens []token.Token, c *Context) (int, MatchSt
 	return 0, MatchStmt{}, fmt.Errorf("Invalid match statement")
 }
 
-func consumeCase(start int, tokens []token.Token, c *Context, genericMap map[string]Type) (int, MatchCase, error) {
+func consumeCase(start int, tokens []token.Token, c *Context, condition Value, expr bool) (int, MatchCase, error) {
 	l := MatchCase{}
 	var n int
 	if tokens[start] != token.Keyword("case") {
 		return 0, MatchCase{}, fmt.Errorf("Invalid case statement. Unexpected '%v' at %d", tokens[start], start)
 	}
-	if eo := c.EnumeratedOption(tokens[start+1].String()); eo != nil {
-		n = 1
-		for _, t := range eo.Parameters {
-			varname := tokens[start+1+n].String()
-			c.Variables[varname] = VarWithType{
-				Name: Variable(varname),
-				Typ:  genericMap[t],
+	if isPatternCase(start+1, tokens, c, condition) {
+		n2, p, err := consumePattern(start+1, tokens, c, condition.Type())
+		if err != nil {
+			return 0, MatchCase{}, err
+		}
+		l.Pattern = p
+		l.LocalVariables = patternVariables(p)
+		for i, v := range l.LocalVariables {
+			for _, v2 := range l.LocalVariables[:i] {
+				if v.Name == v2.Name {
+					return 0, MatchCase{}, fmt.Errorf(`Variable "%v" bound more than once in pattern.`, v.Name)
+				}
 			}
-			l.LocalVariables = append(l.LocalVariables, c.Variables[varname])
-			n += 1
 		}
-		l.Variable = *eo
+		if cp, ok := p.(ConstructorPattern); ok {
+			l.Variable = cp.Constructor
+		}
+		n = n2
 	} else {
 		n2, v, err := consumeValue(start+1, tokens, c, false)
 		if err != nil {
@@ -141,24 +214,67 @@ func consumeCase(start int, tokens []token.Token, c *Context, genericMap map[str
 		n = n2
 
 	}
+	if tokens[start+n+1] == token.Keyword("if") {
+		n2, g, err := consumeValue(start+n+2, tokens, c, false)
+		if err != nil {
+			return 0, MatchCase{}, err
+		}
+		if g.Type() == nil || g.Type().TypeName() != "bool" {
+			return 0, MatchCase{}, fmt.Errorf("Case guard must be a bool.")
+		}
+		l.Guard = g
+		n += n2 + 1
+	}
 	if tokens[start+n+1] != token.Char(":") {
 		return 0, MatchCase{}, fmt.Errorf("Invalid case statement at token %v. Expected ':', not '%v'", start, tokens[start+n+1])
 	}
+	if expr {
+		bn, body, err := consumeBranchBody(start+n+2, tokens, c, endCase)
+		if err != nil {
+			return 0, MatchCase{}, err
+		}
+		l.Body = body
+		return n + 2 + bn, l, nil
+	}
 	for i := start + n + 2; i < len(tokens); {
-		if tokens[i] == token.Keyword("case") || tokens[i] == token.Char("}") {
+		if endCase(tokens[i]) {
 			return i - start, l, nil
 		}
 		n, stmt, err := consumeStmt(i, tokens, c)
 		if err != nil {
 			return 0, MatchCase{}, err
 		}
-		l.Body.Stmts = append(l.Body.Stmts, stmt)
+		l.Body.add(stmt, i, c)
 		i += n
 	}
 	return 0, MatchCase{}, fmt.Errorf("Unterminated case statement")
 }
 
-func consumeTypeCase(start int, tokens []token.Token, c *Context, condition Value) (int, MatchCase, error) {
+// Returns true if t ends the body of a case.
+func endCase(t token.Token) bool {
+	return t == token.Keyword("case") || t == token.Char("}")
+}
+
+// Returns true if the case starting at start should be parsed as a pattern
+// that destructures the condition, rather than a value to compare it to.
+// Cases for enumerated types and tuples are always patterns, and any case
+// can be the wildcard "_".
+func isPatternCase(start int, tokens []token.Token, c *Context, condition Value) bool {
+	if condition == BoolLiteral(true) {
+		// A match without a condition is a chain of bool cases.
+		return false
+	}
+	if tokens[start] == token.Unknown("_") {
+		return true
+	}
+	if _, ok := enumType(condition.Type(), c); ok {
+		return true
+	}
+	_, ok := UnderlyingTuple(condition.Type())
+	return ok
+}
+
+func consumeTypeCase(start int, tokens []token.Token, c *Context, condition Value, expr bool) (int, MatchCase, error) {
 	l := MatchCase{}
 	var n int
 	if tokens[start] != token.Keyword("case") {
@@ -181,37 +297,55 @@ func consumeTypeCase(start int, tokens []token.Token, c *Context, condition Valu
 	if tokens[start+n+1] != token.Char(":") {
 		return 0, MatchCase{}, fmt.Errorf("Invalid case statement at token %v. Expected ':', not '%v'", start, tokens[start+n+1])
 	}
+	if expr {
+		bn, body, err := consumeBranchBody(start+n+2, tokens, c, endCase)
+		if err != nil {
+			return 0, MatchCase{}, err
+		}
+		l.Body = body
+		return n + 2 + bn, l, nil
+	}
 	for i := start + n + 2; i < len(tokens); {
-		if tokens[i] == token.Keyword("case") || tokens[i] == token.Char("}") {
+		if endCase(tokens[i]) {
 			return i - start, l, nil
 		}
 		n, stmt, err := consumeStmt(i, tokens, c)
 		if err != nil {
 			return 0, MatchCase{}, err
 		}
-		l.Body.Stmts = append(l.Body.Stmts, stmt)
+		l.Body.add(stmt, i, c)
 		i += n
 	}
 	return 0, MatchCase{}, fmt.Errorf("Unterminated case statement")
 }
 
+// Returns an error describing a value of type t that isn't matched by any of
+// the cases. A case with a guard might not match even if its pattern does, so
+// guarded cases don't count towards covering a value.
 func checkExhaustiveness(t Type, mc []MatchCase, c *Context) error {
-	allcases := make(map[string]bool)
-	for _, eo := range c.EnumOptions {
-		if eo.Type().TypeName() == t.TypeName() {
-			allcases[eo.Constructor] = false
-		}
-	}
-
+	var rows [][]Pattern
 	for _, m := range mc {
-		if eo, ok := m.Variable.(EnumOption); ok {
-			allcases[eo.Constructor] = true
+		if m.Guard != nil {
+			continue
 		}
-	}
-	for c, v := range allcases {
-		if v == false {
-			return fmt.Errorf(`Inexhaustive match for enum type "%v": Missing case "%v".`, t.TypeName(), c)
+		if m.Pattern != nil {
+			rows = append(rows, []Pattern{m.Pattern})
+		} else {
+			switch v := m.Variable.(type) {
+			case IntLiteral, BoolLiteral:
+				// Other values are compared to the condition,
+				// so they don't cover anything that a pattern
+				// could.
+				rows = append(rows, []Pattern{v})
+			}
 		}
 	}
-	return nil
+	missing := uncoveredPatterns(rows, []Type{t}, c)
+	if missing == nil {
+		return nil
+	}
+	if _, ok := enumType(t, c); ok {
+		return fmt.Errorf(`Inexhaustive match for enum type "%v": Missing case "%v".`, t.TypeName(), missing[0])
+	}
+	return fmt.Errorf(`Inexhaustive match for type "%v": Missing case "%v".`, t.TypeName(), missing[0])
 }
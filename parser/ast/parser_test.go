@@ -22,7 +22,7 @@ func compare(v1, v2 Node) bool {
 		MulOperator, DivOperator,
 		NotEqualsComparison,
 		GreaterOrEqualComparison, LessThanOrEqualComparison,
-		TypeLiteral:
+		TypeLiteral, BreakStmt, ContinueStmt:
 		return v1 == v2
 	}
 
@@ -201,7 +201,39 @@ func compare(v1, v2 Node) bool {
 		if !ok {
 			return false
 		}
-		return compare(v1a.Condition, v2a.Condition) && compare(v1a.Body, v2a.Body)
+		return v1a.Label == v2a.Label && compare(v1a.Condition, v2a.Condition) && compare(v1a.Body, v2a.Body)
+	}
+	if v1a, ok := v1.(ForLoop); ok {
+		v2a, ok := v2.(ForLoop)
+		if !ok {
+			return false
+		}
+		if (v1a.Start == nil) != (v2a.Start == nil) {
+			return false
+		}
+		if v1a.Start != nil && !(compare(v1a.Start, v2a.Start) && compare(v1a.End, v2a.End)) {
+			return false
+		}
+		if v1a.Collection.Name != "" || v2a.Collection.Name != "" {
+			if !compare(v1a.Collection, v2a.Collection) {
+				return false
+			}
+		}
+		if (v1a.CollectionValue == nil) != (v2a.CollectionValue == nil) {
+			return false
+		}
+		if v1a.CollectionValue != nil && !compare(v1a.CollectionValue, v2a.CollectionValue) {
+			return false
+		}
+		if v1a.Index != v2a.Index || v1a.Label != v2a.Label {
+			return false
+		}
+		if v1a.Value.Name != "" || v2a.Value.Name != "" {
+			if !compare(v1a.Value, v2a.Value) {
+				return false
+			}
+		}
+		return compare(v1a.Body, v2a.Body)
 	}
 	if v1a, ok := v1.(IfStmt); ok {
 		v2a, ok := v2.(IfStmt)
@@ -210,6 +242,20 @@ func compare(v1, v2 Node) bool {
 		}
 		return compare(v1a.Condition, v2a.Condition) && compare(v1a.Body, v2a.Body) && compare(v1a.Else, v2a.Else)
 	}
+	if v1a, ok := v1.(IfExpr); ok {
+		v2a, ok := v2.(IfExpr)
+		if !ok {
+			return false
+		}
+		return compare(v1a.Condition, v2a.Condition) && compare(v1a.Body, v2a.Body) && compare(v1a.Else, v2a.Else) && compare(v1a.Typ, v2a.Typ)
+	}
+	if v1a, ok := v1.(MatchExpr); ok {
+		v2a, ok := v2.(MatchExpr)
+		if !ok {
+			return false
+		}
+		return compare(v1a.MatchStmt, v2a.MatchStmt) && compare(v1a.Typ, v2a.Typ)
+	}
 	if v1a, ok := v1.(EnumTypeDefn); ok {
 		v2a, ok := v2.(EnumTypeDefn)
 		if !ok {
@@ -277,7 +323,53 @@ func compare(v1, v2 Node) bool {
 				return false
 			}
 		}
-		return compare(v1a.Variable, v2a.Variable) && compare(v1a.Body, v2a.Body)
+		if (v1a.Guard == nil) != (v2a.Guard == nil) {
+			return false
+		}
+		if v1a.Guard != nil && !compare(v1a.Guard, v2a.Guard) {
+			return false
+		}
+		if v2a.Pattern != nil && !compare(v1a.Pattern, v2a.Pattern) {
+			return false
+		}
+		if (v1a.Variable == nil) != (v2a.Variable == nil) {
+			return false
+		}
+		if v1a.Variable != nil && !compare(v1a.Variable, v2a.Variable) {
+			return false
+		}
+		return compare(v1a.Body, v2a.Body)
+	}
+	if v1a, ok := v1.(WildcardPattern); ok {
+		v2a, ok := v2.(WildcardPattern)
+		return ok && compare(v1a.Typ, v2a.Typ)
+	}
+	if v1a, ok := v1.(ConstructorPattern); ok {
+		v2a, ok := v2.(ConstructorPattern)
+		if !ok || v1a.Constructor.Constructor != v2a.Constructor.Constructor {
+			return false
+		}
+		if len(v1a.Parameters) != len(v2a.Parameters) {
+			return false
+		}
+		for i := range v1a.Parameters {
+			if !compare(v1a.Parameters[i], v2a.Parameters[i]) {
+				return false
+			}
+		}
+		return compare(v1a.Typ, v2a.Typ)
+	}
+	if v1a, ok := v1.(TuplePattern); ok {
+		v2a, ok := v2.(TuplePattern)
+		if !ok || len(v1a.Fields) != len(v2a.Fields) {
+			return false
+		}
+		for i := range v1a.Fields {
+			if !compare(v1a.Fields[i], v2a.Fields[i]) {
+				return false
+			}
+		}
+		return true
 	}
 	if v1a, ok := v1.(EnumOption); ok {
 		v2a, ok := v2.(EnumOption)
@@ -432,6 +524,12 @@ func compare(v1, v2 Node) bool {
 		}
 		return false
 	}
+	if v1a, ok := v1.(TupleUpdate); ok {
+		if v2a, ok := v2.(TupleUpdate); ok {
+			return compare(v1a.Base, v2a.Base) && compare(v1a.Values, v2a.Values)
+		}
+		return false
+	}
 	if v1a, ok := v1.(Slice); ok {
 		if v2a, ok := v2.(Slice); ok {
 			if v1a.Size != v2a.Size {
@@ -480,7 +578,7 @@ func TestParseFizzBuzz(t *testing.T) {
 			Return:  nil,
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{Name: "terminate", Typ: TypeLiteral("bool")},
 						InitialValue: BoolLiteral(false),
@@ -495,7 +593,7 @@ func TestParseFizzBuzz(t *testing.T) {
 							Right: BoolLiteral(true),
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								IfStmt{
 									Condition: EqualityComparison{
 										Left: ModOperator{
@@ -505,7 +603,7 @@ func TestParseFizzBuzz(t *testing.T) {
 										Right: IntLiteral(0),
 									},
 									Body: BlockStmt{
-										[]Node{
+										Stmts: []Node{
 											FuncCall{
 												Name: "PrintString",
 												UserArgs: []Value{
@@ -515,7 +613,7 @@ func TestParseFizzBuzz(t *testing.T) {
 										},
 									},
 									Else: BlockStmt{
-										[]Node{
+										Stmts: []Node{
 											IfStmt{
 												Condition: EqualityComparison{
 													Left: ModOperator{
@@ -525,7 +623,7 @@ func TestParseFizzBuzz(t *testing.T) {
 													Right: IntLiteral(0),
 												},
 												Body: BlockStmt{
-													[]Node{
+													Stmts: []Node{
 														FuncCall{
 															Name: "PrintString",
 															UserArgs: []Value{
@@ -535,7 +633,7 @@ func TestParseFizzBuzz(t *testing.T) {
 													},
 												},
 												Else: BlockStmt{
-													[]Node{
+													Stmts: []Node{
 														IfStmt{
 															Condition: EqualityComparison{
 																Left: ModOperator{
@@ -545,7 +643,7 @@ func TestParseFizzBuzz(t *testing.T) {
 																Right: IntLiteral(0),
 															},
 															Body: BlockStmt{
-																[]Node{
+																Stmts: []Node{
 																	FuncCall{
 																		Name: "PrintString",
 																		UserArgs: []Value{
@@ -555,7 +653,7 @@ func TestParseFizzBuzz(t *testing.T) {
 																},
 															},
 															Else: BlockStmt{
-																[]Node{
+																Stmts: []Node{
 																	FuncCall{
 																		Name: "PrintInt",
 																		UserArgs: []Value{
@@ -590,7 +688,7 @@ func TestParseFizzBuzz(t *testing.T) {
 										Right: IntLiteral(100),
 									},
 									Body: BlockStmt{
-										[]Node{
+										Stmts: []Node{
 											AssignmentOperator{
 												Variable: VarWithType{"terminate", TypeLiteral("bool"), false},
 												Value:    BoolLiteral(true),
@@ -630,7 +728,7 @@ func TestHelloWorld(t *testing.T) {
 			Return:  nil,
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintString",
 						UserArgs: []Value{
@@ -691,7 +789,7 @@ func TestLetStatement(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"n", TypeLiteral("int"), false},
 						Val: IntLiteral(5),
@@ -732,7 +830,7 @@ func TestLetStatementShadow(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"n", TypeLiteral("int"), false},
 						Val: IntLiteral(5),
@@ -790,7 +888,7 @@ func TestMutStatement(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"x", TypeLiteral("int"), false},
 						InitialValue: IntLiteral(3),
@@ -847,7 +945,7 @@ func TestTwoProcs(t *testing.T) {
 				VarWithType{"", TypeLiteral("int"), false},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					ReturnStmt{
 						Val: IntLiteral(3),
 					},
@@ -860,7 +958,7 @@ func TestTwoProcs(t *testing.T) {
 			Return:  nil,
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -897,7 +995,7 @@ func TestOutOfOrder(t *testing.T) {
 			Return:  nil,
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -916,7 +1014,7 @@ func TestOutOfOrder(t *testing.T) {
 				VarWithType{Name: "", Typ: TypeLiteral("int")},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					ReturnStmt{
 						Val: IntLiteral(3),
 					},
@@ -951,7 +1049,7 @@ func TestSumToTen(t *testing.T) {
 				{Typ: TypeLiteral("int")},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"val", TypeLiteral("int"), false},
 						InitialValue: VarWithType{"x", TypeLiteral("int"), false},
@@ -966,7 +1064,7 @@ func TestSumToTen(t *testing.T) {
 							Right: IntLiteral(0),
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								AssignmentOperator{
 									Variable: VarWithType{"sum", TypeLiteral("int"), false},
 									Value: AdditionOperator{
@@ -992,7 +1090,7 @@ func TestSumToTen(t *testing.T) {
 			Name:    "main",
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -1034,7 +1132,7 @@ func TestSimpleFunc(t *testing.T) {
 				VarWithType{Name: "", Typ: TypeLiteral("int")},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					ReturnStmt{
 						Val: IntLiteral(3),
 					},
@@ -1047,7 +1145,7 @@ func TestSimpleFunc(t *testing.T) {
 			Return:  nil,
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -1088,7 +1186,7 @@ func TestSumToTenRecursive(t *testing.T) {
 				{Typ: TypeLiteral("int")},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					ReturnStmt{
 						Val: FuncCall{
 							Name: "partial_sum",
@@ -1111,14 +1209,14 @@ func TestSumToTenRecursive(t *testing.T) {
 				{Typ: TypeLiteral("int")},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					IfStmt{
 						Condition: EqualityComparison{
 							Left:  VarWithType{"x", TypeLiteral("int"), false},
 							Right: IntLiteral(0),
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								ReturnStmt{
 									Val: VarWithType{"partial", TypeLiteral("int"), false},
 								},
@@ -1147,7 +1245,7 @@ func TestSumToTenRecursive(t *testing.T) {
 			Name:    "main",
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -1190,7 +1288,7 @@ func TestSomeMath(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{Name: "add", Typ: TypeLiteral("int")},
 						Val: AdditionOperator{
@@ -1370,7 +1468,7 @@ func TestEqualComparisonMath(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"a", TypeLiteral("int"), false},
 						InitialValue: IntLiteral(3),
@@ -1385,7 +1483,7 @@ func TestEqualComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`true\n`)},
@@ -1393,7 +1491,7 @@ func TestEqualComparisonMath(t *testing.T) {
 							},
 						},
 						Else: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`false\n`)},
@@ -1407,7 +1505,7 @@ func TestEqualComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -1461,7 +1559,7 @@ func TestNotEqualComparisonMath(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"a", TypeLiteral("int"), false},
 						InitialValue: IntLiteral(3),
@@ -1476,7 +1574,7 @@ func TestNotEqualComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`true\n`)},
@@ -1484,7 +1582,7 @@ func TestNotEqualComparisonMath(t *testing.T) {
 							},
 						},
 						Else: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`false\n`)},
@@ -1498,7 +1596,7 @@ func TestNotEqualComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -1551,7 +1649,7 @@ func TestGreaterComparisonMath(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"a", TypeLiteral("int"), false},
 						InitialValue: IntLiteral(4),
@@ -1566,7 +1664,7 @@ func TestGreaterComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`true\n`)},
@@ -1574,7 +1672,7 @@ func TestGreaterComparisonMath(t *testing.T) {
 							},
 						},
 						Else: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`false\n`)},
@@ -1588,7 +1686,7 @@ func TestGreaterComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -1641,7 +1739,7 @@ func TestGreaterOrEqualComparisonMath(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"a", TypeLiteral("int"), false},
 						InitialValue: IntLiteral(4),
@@ -1656,7 +1754,7 @@ func TestGreaterOrEqualComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`true\n`)},
@@ -1664,7 +1762,7 @@ func TestGreaterOrEqualComparisonMath(t *testing.T) {
 							},
 						},
 						Else: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`false\n`)},
@@ -1678,7 +1776,7 @@ func TestGreaterOrEqualComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -1732,7 +1830,7 @@ func TestLessThanComparisonMath(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"a", TypeLiteral("int"), false},
 						InitialValue: IntLiteral(4),
@@ -1747,7 +1845,7 @@ func TestLessThanComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`true\n`)},
@@ -1755,7 +1853,7 @@ func TestLessThanComparisonMath(t *testing.T) {
 							},
 						},
 						Else: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`false\n`)},
@@ -1769,7 +1867,7 @@ func TestLessThanComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -1822,7 +1920,7 @@ func TestLessThanOrEqualComparisonMath(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"a", TypeLiteral("int"), false},
 						InitialValue: IntLiteral(1),
@@ -1837,7 +1935,7 @@ func TestLessThanOrEqualComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`true\n`)},
@@ -1845,7 +1943,7 @@ func TestLessThanOrEqualComparisonMath(t *testing.T) {
 							},
 						},
 						Else: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name:     "PrintString",
 									UserArgs: []Value{StringLiteral(`false\n`)},
@@ -1859,7 +1957,7 @@ func TestLessThanOrEqualComparisonMath(t *testing.T) {
 							Right: VarWithType{"b", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -1916,7 +2014,7 @@ func TestUserDefinedType(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"x", UserType{TypeLiteral("int"), "Foo"}, false},
 						Val: IntLiteral(4),
@@ -1957,7 +2055,7 @@ func TestTypeInference(t *testing.T) {
 			Return: []VarWithType{{"", TypeLiteral("int"), false}},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"a", TypeLiteral("int"), false},
 						InitialValue: VarWithType{"x", TypeLiteral("int"), false},
@@ -1982,7 +2080,7 @@ func TestTypeInference(t *testing.T) {
 							Right: IntLiteral(3),
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								ReturnStmt{VarWithType{"a", TypeLiteral("int"), false}},
 							},
 						},
@@ -1998,7 +2096,7 @@ func TestTypeInference(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -2070,7 +2168,7 @@ func TestEnumType(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 
 					LetStmt{
 						Var: VarWithType{
@@ -2103,7 +2201,7 @@ func TestEnumType(t *testing.T) {
 							MatchCase{
 								Variable: EnumOption{"A", nil, TypeLiteral("Foo")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2116,7 +2214,7 @@ func TestEnumType(t *testing.T) {
 							MatchCase{
 								Variable: EnumOption{"B", nil, TypeLiteral("Foo")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2168,7 +2266,7 @@ func TestEnumTypeInferred(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 
 					LetStmt{
 						Var: VarWithType{"a", TypeLiteral("Foo"), false},
@@ -2180,7 +2278,7 @@ func TestEnumTypeInferred(t *testing.T) {
 							MatchCase{
 								Variable: EnumOption{"A", nil, TypeLiteral("Foo")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2193,7 +2291,7 @@ func TestEnumTypeInferred(t *testing.T) {
 							MatchCase{
 								Variable: EnumOption{"B", nil, TypeLiteral("Foo")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2238,7 +2336,7 @@ func TestIfElseMatch(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 
 					LetStmt{
 						Var: VarWithType{"x", TypeLiteral("int"), false},
@@ -2253,7 +2351,7 @@ func TestIfElseMatch(t *testing.T) {
 									Right: IntLiteral(3),
 								},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2270,7 +2368,7 @@ func TestIfElseMatch(t *testing.T) {
 								},
 
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2287,7 +2385,7 @@ func TestIfElseMatch(t *testing.T) {
 								},
 
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2343,14 +2441,14 @@ func TestGenericEnumType(t *testing.T) {
 				},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					IfStmt{
 						Condition: GreaterComparison{
 							Left:  VarWithType{"x", TypeLiteral("int"), false},
 							Right: IntLiteral(3),
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								ReturnStmt{EnumValue{Constructor: EnumOption{"Nothing", nil, TypeLiteral("Maybe")}}},
 							},
 						},
@@ -2370,7 +2468,7 @@ func TestGenericEnumType(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 
 					LetStmt{
 						Var: VarWithType{"x", TypeLiteral("Maybe int"), false},
@@ -2387,7 +2485,7 @@ func TestGenericEnumType(t *testing.T) {
 							MatchCase{
 								Variable: EnumOption{"Nothing", nil, TypeLiteral("Maybe")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2403,7 +2501,7 @@ func TestGenericEnumType(t *testing.T) {
 								},
 								Variable: EnumOption{"Just", []string{"a"}, TypeLiteral("Maybe")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintInt",
 											UserArgs: []Value{
@@ -2436,7 +2534,7 @@ func TestGenericEnumType(t *testing.T) {
 							MatchCase{
 								Variable: EnumOption{"Nothing", nil, TypeLiteral("Maybe")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -2452,7 +2550,7 @@ func TestGenericEnumType(t *testing.T) {
 								},
 								Variable: EnumOption{"Just", []string{"a"}, TypeLiteral("Maybe")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 
 											Name: "PrintInt",
@@ -2517,7 +2615,7 @@ func TestMatchParam(t *testing.T) {
 				},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MatchStmt{
 						Condition: VarWithType{"x", TypeLiteral("Maybe int"), false},
 						Cases: []MatchCase{
@@ -2527,7 +2625,7 @@ func TestMatchParam(t *testing.T) {
 								},
 								Variable: EnumOption{"Just", []string{"x"}, TypeLiteral("Maybe")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										ReturnStmt{VarWithType{"n", TypeLiteral("int"), false}},
 									},
 								},
@@ -2535,7 +2633,7 @@ func TestMatchParam(t *testing.T) {
 							MatchCase{
 								Variable: EnumOption{"Nothing", nil, TypeLiteral("Maybe")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										ReturnStmt{IntLiteral(0)},
 									},
 								},
@@ -2552,7 +2650,7 @@ func TestMatchParam(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -2615,7 +2713,7 @@ func TestMatchParam2(t *testing.T) {
 			},
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintString",
 						UserArgs: []Value{
@@ -2631,7 +2729,7 @@ func TestMatchParam2(t *testing.T) {
 								},
 								Variable: EnumOption{"Just", []string{"x"}, TypeLiteral("Maybe")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										ReturnStmt{VarWithType{"n", TypeLiteral("int"), false}},
 									},
 								},
@@ -2639,7 +2737,7 @@ func TestMatchParam2(t *testing.T) {
 							MatchCase{
 								Variable: EnumOption{"Nothing", nil, TypeLiteral("Maybe")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										ReturnStmt{IntLiteral(0)},
 									},
 								},
@@ -2656,7 +2754,7 @@ func TestMatchParam2(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -2708,7 +2806,7 @@ func TestSimpleAlgorithm(t *testing.T) {
 				},
 			},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 
 					MutStmt{
 						Var:          VarWithType{"total", TypeLiteral("int"), false},
@@ -2736,7 +2834,7 @@ func TestSimpleAlgorithm(t *testing.T) {
 							Right: VarWithType{"high", TypeLiteral("int"), false},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								IfStmt{
 									Condition: EqualityComparison{
 										Left: ModOperator{
@@ -2746,7 +2844,7 @@ func TestSimpleAlgorithm(t *testing.T) {
 										Right: IntLiteral(0),
 									},
 									Body: BlockStmt{
-										[]Node{
+										Stmts: []Node{
 											AssignmentOperator{
 												Variable: VarWithType{"total", TypeLiteral("int"), false},
 												Value: AdditionOperator{
@@ -2782,7 +2880,7 @@ func TestSimpleAlgorithm(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -2823,7 +2921,7 @@ func TestConcreteTypeInt64(t *testing.T) {
 			Return:  nil,
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"x", TypeLiteral("int64"), false},
 						Val: IntLiteral(-4),
@@ -2866,7 +2964,7 @@ func TestSimpleArray(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"n",
 							ArrayType{
@@ -2928,7 +3026,7 @@ func TestSimpleArrayInference(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"n",
 							ArrayType{
@@ -2990,7 +3088,7 @@ func TestArrayMutation(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var: VarWithType{"n",
 							ArrayType{
@@ -3110,7 +3208,7 @@ func TestReferenceVariable(t *testing.T) {
 			},
 			Effects: []Effect{"mutate"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					AssignmentOperator{
 						Variable: VarWithType{"x", TypeLiteral("int"), true},
 						Value:    IntLiteral(4),
@@ -3132,7 +3230,7 @@ func TestReferenceVariable(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var:          VarWithType{"var", TypeLiteral("int"), false},
 						InitialValue: IntLiteral(3),
@@ -3207,7 +3305,7 @@ func TestSimpleSlice(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"n",
 							SliceType{
@@ -3267,7 +3365,7 @@ func TestSimpleSliceInference(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"n",
 							SliceType{
@@ -3342,7 +3440,7 @@ func TestSliceMutation(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var: VarWithType{"n",
 							SliceType{
@@ -3454,7 +3552,7 @@ func TestSliceParam(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"b",
@@ -3493,7 +3591,7 @@ func TestSliceParam(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintByteSlice",
 						UserArgs: []Value{
@@ -3536,7 +3634,7 @@ func TestReadSyscall(t *testing.T) {
 			Effects: []Effect{"IO", "Filesystem"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"fd",
@@ -3644,7 +3742,7 @@ func TestSliceLength(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -3702,7 +3800,7 @@ func TestIndexAssignment(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -3801,7 +3899,7 @@ func TestIndexedAddition(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -3925,7 +4023,7 @@ func TestPrecedence(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -3982,7 +4080,7 @@ func TestLetCondition(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"i",
@@ -4005,7 +4103,7 @@ func TestLetCondition(t *testing.T) {
 							Right: IntLiteral(1),
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -4015,7 +4113,7 @@ func TestLetCondition(t *testing.T) {
 							},
 						},
 						Else: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -4039,7 +4137,7 @@ func TestLetCondition(t *testing.T) {
 							Right: IntLiteral(1),
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -4049,7 +4147,7 @@ func TestLetCondition(t *testing.T) {
 							},
 						},
 						Else: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -4074,7 +4172,7 @@ func TestLetCondition(t *testing.T) {
 							Right: IntLiteral(3),
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								FuncCall{
 									Name: "PrintInt",
 									UserArgs: []Value{
@@ -4120,7 +4218,7 @@ func TestUnbufferedCat2(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var: VarWithType{"buf",
 							SliceType{
@@ -4164,7 +4262,7 @@ func TestUnbufferedCat2(t *testing.T) {
 							},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								LetStmt{
 									Var: VarWithType{"file", TypeLiteral("uint64"), false},
 									Val: FuncCall{
@@ -4210,7 +4308,7 @@ func TestUnbufferedCat2(t *testing.T) {
 										Right: IntLiteral(0),
 									},
 									Body: BlockStmt{
-										[]Node{
+										Stmts: []Node{
 											FuncCall{
 												Name: "PrintByteSlice",
 												UserArgs: []Value{
@@ -4269,7 +4367,7 @@ func TestMethodSyntax(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"foo",
 							TypeLiteral("int"),
@@ -4343,7 +4441,7 @@ func TestUnbufferedCat3(t *testing.T) {
 			Effects: []Effect{"IO"},
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var: VarWithType{"buf",
 							SliceType{
@@ -4387,7 +4485,7 @@ func TestUnbufferedCat3(t *testing.T) {
 							},
 						},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								LetStmt{
 									Var: VarWithType{"file", TypeLiteral("uint64"), false},
 									Val: FuncCall{
@@ -4433,7 +4531,7 @@ func TestUnbufferedCat3(t *testing.T) {
 										Right: IntLiteral(0),
 									},
 									Body: BlockStmt{
-										[]Node{
+										Stmts: []Node{
 											FuncCall{
 												Name: "PrintByteSlice",
 												UserArgs: []Value{
@@ -4493,7 +4591,7 @@ func TestAssignmentToVariableIndex(t *testing.T) {
 
 			Body: BlockStmt{
 
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var: VarWithType{"x",
 							ArrayType{
@@ -4599,7 +4697,7 @@ func TestAssignmentToSliceVariableIndex(t *testing.T) {
 
 			Body: BlockStmt{
 
-				[]Node{
+				Stmts: []Node{
 					MutStmt{
 						Var: VarWithType{"x",
 							SliceType{
@@ -4700,7 +4798,7 @@ func TestCastBuiltin(t *testing.T) {
 
 			Body: BlockStmt{
 
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"foo",
@@ -4760,7 +4858,7 @@ func TestAssertionFail(t *testing.T) {
 			Effects: nil,
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					Assertion{
 						Predicate: BoolLiteral(false),
 					},
@@ -4794,7 +4892,7 @@ func TestAssertionPass(t *testing.T) {
 			Effects: nil,
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					Assertion{
 						Predicate: BoolLiteral(true),
 					},
@@ -4828,7 +4926,7 @@ func TestAssertionFailWithMessage(t *testing.T) {
 			Effects: nil,
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					Assertion{
 						Predicate: BoolLiteral(false),
 						Message:   "This always fails",
@@ -4863,7 +4961,7 @@ func TestAssertionPassWithMessage(t *testing.T) {
 			Effects: nil,
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					Assertion{
 						Predicate: BoolLiteral(true),
 						Message:   "You should never see this",
@@ -4926,14 +5024,14 @@ func TestSumTypeFuncCall(t *testing.T) {
 			Return:  nil,
 			Effects: []Effect{"IO"},
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					MatchStmt{
 						Condition: VarWithType{Name: "x", Typ: SumType{TypeLiteral("int"), TypeLiteral("string")}},
 						Cases: []MatchCase{
 							MatchCase{
 								Variable: VarWithType{Name: "x", Typ: TypeLiteral("int")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 
 										FuncCall{
 											Name: "PrintInt",
@@ -4947,7 +5045,7 @@ func TestSumTypeFuncCall(t *testing.T) {
 							MatchCase{
 								Variable: VarWithType{Name: "x", Typ: TypeLiteral("string")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -4968,7 +5066,7 @@ func TestSumTypeFuncCall(t *testing.T) {
 			Return:  nil,
 			Effects: nil,
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "foo",
 						UserArgs: []Value{
@@ -5014,11 +5112,11 @@ func TestSumTypeFuncReturn(t *testing.T) {
 			},
 			Effects: nil,
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					IfStmt{
 						Condition: VarWithType{"x", TypeLiteral("bool"), false},
 						Body: BlockStmt{
-							[]Node{
+							Stmts: []Node{
 								ReturnStmt{
 									Val: IntLiteral(3),
 								},
@@ -5037,7 +5135,7 @@ func TestSumTypeFuncReturn(t *testing.T) {
 			Return:  nil,
 			Effects: nil,
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -5059,7 +5157,7 @@ func TestSumTypeFuncReturn(t *testing.T) {
 							MatchCase{
 								Variable: VarWithType{Name: "x", Typ: TypeLiteral("int")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintInt",
 											UserArgs: []Value{
@@ -5072,7 +5170,7 @@ func TestSumTypeFuncReturn(t *testing.T) {
 							MatchCase{
 								Variable: VarWithType{Name: "x", Typ: TypeLiteral("string")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -5105,7 +5203,7 @@ func TestSumTypeFuncReturn(t *testing.T) {
 							MatchCase{
 								Variable: VarWithType{Name: "x", Typ: TypeLiteral("int")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintInt",
 											UserArgs: []Value{
@@ -5118,7 +5216,7 @@ func TestSumTypeFuncReturn(t *testing.T) {
 							MatchCase{
 								Variable: VarWithType{Name: "x", Typ: TypeLiteral("string")},
 								Body: BlockStmt{
-									[]Node{
+									Stmts: []Node{
 										FuncCall{
 											Name: "PrintString",
 											UserArgs: []Value{
@@ -5159,7 +5257,7 @@ func TestLineComment(t *testing.T) {
 			Return:  nil,
 			Effects: nil,
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -5204,7 +5302,7 @@ func TestBlockComment(t *testing.T) {
 			Return:  nil,
 			Effects: nil,
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -5249,7 +5347,7 @@ func TestProductTypeValue(t *testing.T) {
 			Return:  nil,
 			Effects: nil,
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -5320,7 +5418,7 @@ func TestUserProductTypeValue(t *testing.T) {
 			Return:  nil,
 			Effects: nil,
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{
 							"x",
@@ -5417,7 +5515,7 @@ func TestSliceFromArray(t *testing.T) {
 			Effects: nil,
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"x",
 							ArrayType{
@@ -5555,7 +5653,7 @@ func TestArrayArg(t *testing.T) {
 			Effects: nil,
 
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					FuncCall{
 						Name: "PrintInt",
 						UserArgs: []Value{
@@ -5670,7 +5768,7 @@ func TestArrayArg(t *testing.T) {
 			Return:  nil,
 			Effects: nil,
 			Body: BlockStmt{
-				[]Node{
+				Stmts: []Node{
 					LetStmt{
 						Var: VarWithType{"n",
 							ArrayType{
@@ -5738,3 +5836,635 @@ func TestArrayArg(t *testing.T) {
 		}
 	}
 }
+
+func TestForRange(t *testing.T) {
+	ast, _, _ := buildAst(t, "forrange")
+
+	expected := []Node{
+		FuncDecl{
+			Name:    "main",
+			Args:    nil,
+			Return:  nil,
+			Effects: []Effect{"IO"},
+			Body: BlockStmt{
+				Stmts: []Node{
+					MutStmt{
+						Var:          VarWithType{"sum", TypeLiteral("int"), false},
+						InitialValue: IntLiteral(0),
+					},
+					ForLoop{
+						Index: VarWithType{"i", TypeLiteral("int"), false},
+						Start: IntLiteral(0),
+						End:   IntLiteral(5),
+						Body: BlockStmt{
+							Stmts: []Node{
+								FuncCall{
+									Name: "PrintInt",
+									UserArgs: []Value{
+										VarWithType{"i", TypeLiteral("int"), false},
+									},
+								},
+								AssignmentOperator{
+									Variable: VarWithType{"sum", TypeLiteral("int"), false},
+									Value: AdditionOperator{
+										Left:  VarWithType{"sum", TypeLiteral("int"), false},
+										Right: VarWithType{"i", TypeLiteral("int"), false},
+									},
+								},
+							},
+						},
+					},
+					FuncCall{
+						Name: "PrintString",
+						UserArgs: []Value{
+							StringLiteral(`\n`),
+						},
+					},
+					FuncCall{
+						Name: "PrintInt",
+						UserArgs: []Value{
+							VarWithType{"sum", TypeLiteral("int"), false},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for i, v := range expected {
+		if !compare(ast[i], v) {
+			t.Errorf("Node %d: got %v want %v (%v, %v)", i, ast[i], v, reflect.TypeOf(ast[i]), reflect.TypeOf(v))
+		}
+	}
+}
+
+func TestForArray(t *testing.T) {
+	ast, _, _ := buildAst(t, "forarray")
+
+	arr := VarWithType{"x",
+		ArrayType{
+			Base: TypeLiteral("int"),
+			Size: IntLiteral(3),
+		},
+		false,
+	}
+	expected := []Node{
+		FuncDecl{
+			Name:    "main",
+			Args:    nil,
+			Return:  nil,
+			Effects: []Effect{"IO"},
+			Body: BlockStmt{
+				Stmts: []Node{
+					LetStmt{
+						Var: arr,
+						Val: ArrayLiteral{
+							IntLiteral(4),
+							IntLiteral(5),
+							IntLiteral(6),
+						},
+					},
+					ForLoop{
+						Index:      VarWithType{"i", TypeLiteral("int"), false},
+						Value:      VarWithType{"v", TypeLiteral("int"), false},
+						Collection: arr,
+						Body: BlockStmt{
+							Stmts: []Node{
+								FuncCall{
+									Name: "PrintInt",
+									UserArgs: []Value{
+										VarWithType{"i", TypeLiteral("int"), false},
+									},
+								},
+								FuncCall{
+									Name: "PrintString",
+									UserArgs: []Value{
+										StringLiteral(":"),
+									},
+								},
+								FuncCall{
+									Name: "PrintInt",
+									UserArgs: []Value{
+										VarWithType{"v", TypeLiteral("int"), false},
+									},
+								},
+								FuncCall{
+									Name: "PrintString",
+									UserArgs: []Value{
+										StringLiteral(`\n`),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for i, v := range expected {
+		if !compare(ast[i], v) {
+			t.Errorf("Node %d: got %v want %v (%v, %v)", i, ast[i], v, reflect.TypeOf(ast[i]), reflect.TypeOf(v))
+		}
+	}
+}
+
+func TestForExpr(t *testing.T) {
+	ast, _, _ := buildAst(t, "forexpr")
+
+	if len(ast) < 1 {
+		t.Fatalf("Unexpected number of nodes: %v", len(ast))
+	}
+	main, ok := ast[0].(FuncDecl)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[0]))
+	}
+
+	// The array literal is evaluated into a hidden variable, which the
+	// loop iterates over.
+	expected := ForLoop{
+		Index: VarWithType{"i", TypeLiteral("int"), false},
+		Value: VarWithType{"v", TypeLiteral("int"), false},
+		Collection: VarWithType{"for.collection",
+			ArrayType{
+				Base: TypeLiteral("int"),
+				Size: IntLiteral(3),
+			},
+			false,
+		},
+		CollectionValue: ArrayLiteral{
+			IntLiteral(4),
+			IntLiteral(5),
+			IntLiteral(6),
+		},
+		Body: BlockStmt{
+			Stmts: []Node{
+				FuncCall{
+					Name: "PrintInt",
+					UserArgs: []Value{
+						AdditionOperator{
+							Left:  VarWithType{"i", TypeLiteral("int"), false},
+							Right: VarWithType{"v", TypeLiteral("int"), false},
+						},
+					},
+				},
+			},
+		},
+	}
+	if !compare(main.Body.Stmts[0], expected) {
+		t.Errorf("Unexpected loop: got %v want %v", main.Body.Stmts[0], expected)
+	}
+}
+
+func TestLabeledLoop(t *testing.T) {
+	ast, _, _ := buildAst(t, "labeledloop")
+
+	i := VarWithType{"i", TypeLiteral("int"), false}
+	j := VarWithType{"j", TypeLiteral("int"), false}
+	expected := []Node{
+		FuncDecl{
+			Name:    "main",
+			Args:    nil,
+			Return:  nil,
+			Effects: []Effect{"IO"},
+			Body: BlockStmt{
+				Stmts: []Node{
+					ForLoop{
+						Label: "outer",
+						Index: i,
+						Start: IntLiteral(0),
+						End:   IntLiteral(5),
+						Body: BlockStmt{
+							Stmts: []Node{
+								ForLoop{
+									Index: j,
+									Start: IntLiteral(0),
+									End:   IntLiteral(5),
+									Body: BlockStmt{
+										Stmts: []Node{
+											IfStmt{
+												Condition: GreaterComparison{j, i},
+												Body: BlockStmt{
+													Stmts: []Node{
+														FuncCall{
+															Name: "PrintString",
+															UserArgs: []Value{
+																StringLiteral(`\n`),
+															},
+														},
+														ContinueStmt{"outer"},
+													},
+												},
+											},
+											IfStmt{
+												Condition: EqualityComparison{i, IntLiteral(3)},
+												Body: BlockStmt{
+													Stmts: []Node{
+														BreakStmt{"outer"},
+													},
+												},
+											},
+											FuncCall{
+												Name: "PrintInt",
+												UserArgs: []Value{
+													j,
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+					FuncCall{
+						Name: "PrintString",
+						UserArgs: []Value{
+							StringLiteral("done"),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for i, v := range expected {
+		if !compare(ast[i], v) {
+			t.Errorf("Node %d: got %v want %v (%v, %v)", i, ast[i], v, reflect.TypeOf(ast[i]), reflect.TypeOf(v))
+		}
+	}
+}
+
+func TestLoopBranchLabels(t *testing.T) {
+	// A label has to be on the same line as the break or continue, so an
+	// identifier on the next line starts the next statement, even when
+	// it's followed by something that isn't the start of an assignment
+	// or a call.
+	tokens, err := token.Tokenize(strings.NewReader(`func main() () -> affects(IO) {
+	outer: for i in 0..3 {
+		if i == 1 {
+			continue
+		}
+		for j in 0..i {
+			break
+			inner: for k in 0..j {
+				continue outer
+			}
+		}
+		break
+		PrintInt(i)
+	}
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ast, _, _, err := Construct(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := VarWithType{"i", TypeLiteral("int"), false}
+	j := VarWithType{"j", TypeLiteral("int"), false}
+	k := VarWithType{"k", TypeLiteral("int"), false}
+	expected := FuncDecl{
+		Name:    "main",
+		Effects: []Effect{"IO"},
+		Body: BlockStmt{
+			Stmts: []Node{
+				ForLoop{
+					Label: "outer",
+					Index: i,
+					Start: IntLiteral(0),
+					End:   IntLiteral(3),
+					Body: BlockStmt{
+						Stmts: []Node{
+							IfStmt{
+								Condition: EqualityComparison{i, IntLiteral(1)},
+								Body: BlockStmt{
+									Stmts: []Node{
+										ContinueStmt{},
+									},
+								},
+							},
+							ForLoop{
+								Index: j,
+								Start: IntLiteral(0),
+								End:   i,
+								Body: BlockStmt{
+									Stmts: []Node{
+										BreakStmt{},
+										ForLoop{
+											Label: "inner",
+											Index: k,
+											Start: IntLiteral(0),
+											End:   j,
+											Body: BlockStmt{
+												Stmts: []Node{
+													ContinueStmt{"outer"},
+												},
+											},
+										},
+									},
+								},
+							},
+							BreakStmt{},
+							FuncCall{
+								Name:     "PrintInt",
+								UserArgs: []Value{i},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if len(ast) != 1 || !compare(ast[0], expected) {
+		t.Errorf("Unexpected AST: got %v want %v", ast, expected)
+	}
+}
+
+func TestTupleWith(t *testing.T) {
+	ast, _, _ := buildAst(t, "tuplewith")
+
+	pt := UserType{
+		TupleType{
+			VarWithType{"x", TypeLiteral("int"), false},
+			VarWithType{"y", TypeLiteral("int"), false},
+			VarWithType{"name", TypeLiteral("string"), false},
+		},
+		"Point",
+	}
+	p := VarWithType{"p", pt, false}
+	if len(ast) < 2 {
+		t.Fatalf("Unexpected number of nodes: %v", len(ast))
+	}
+	main, ok := ast[1].(FuncDecl)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[1]))
+	}
+
+	expected := []Node{
+		LetStmt{
+			Var: p,
+			Val: TupleValue{IntLiteral(3), IntLiteral(4), StringLiteral("p")},
+		},
+		LetStmt{
+			Var: VarWithType{"q", pt, false},
+			Val: TupleUpdate{
+				Base: p,
+				Values: TupleValue{
+					VarWithType{"p.x", TypeLiteral("int"), false},
+					IntLiteral(10),
+					StringLiteral("q"),
+				},
+			},
+		},
+	}
+	for i, v := range expected {
+		if !compare(main.Body.Stmts[i], v) {
+			t.Errorf("Node %d: got %v want %v", i, main.Body.Stmts[i], v)
+		}
+	}
+}
+
+func TestMatchGuard(t *testing.T) {
+	ast, _, _ := buildAst(t, "matchguard")
+	if len(ast) < 3 {
+		t.Fatalf("Unexpected number of nodes: %v", len(ast))
+	}
+	describe, ok := ast[1].(FuncDecl)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[1]))
+	}
+
+	mi := TypeLiteral("Maybe int")
+	x := VarWithType{"x", mi, false}
+	n := VarWithType{"n", TypeLiteral("int"), false}
+	just := EnumOption{"Just", []string{"x"}, TypeLiteral("Maybe")}
+	nothing := EnumOption{"Nothing", nil, TypeLiteral("Maybe")}
+	printString := func(s string) BlockStmt {
+		return BlockStmt{
+			Stmts: []Node{
+				FuncCall{
+					Name:     "PrintString",
+					UserArgs: []Value{StringLiteral(s)},
+				},
+			},
+		}
+	}
+	expected := MatchStmt{
+		Condition: x,
+		Cases: []MatchCase{
+			MatchCase{
+				LocalVariables: []VarWithType{n},
+				Variable:       just,
+				Pattern:        ConstructorPattern{just, []Pattern{n}, mi},
+				Guard:          GreaterComparison{n, IntLiteral(0)},
+				Body:           printString("positive"),
+			},
+			MatchCase{
+				LocalVariables: []VarWithType{n},
+				Variable:       just,
+				Pattern:        ConstructorPattern{just, []Pattern{n}, mi},
+				Guard:          LessThanComparison{n, IntLiteral(0)},
+				Body:           printString("negative"),
+			},
+			MatchCase{
+				Variable: just,
+				Pattern:  ConstructorPattern{just, []Pattern{WildcardPattern{TypeLiteral("int")}}, mi},
+				Body:     printString("zero"),
+			},
+			MatchCase{
+				Variable: nothing,
+				Pattern:  ConstructorPattern{nothing, nil, mi},
+				Body:     printString("nothing"),
+			},
+		},
+	}
+	if !compare(describe.Body.Stmts[0], expected) {
+		t.Errorf("Unexpected match statement: got %v want %v", describe.Body.Stmts[0], expected)
+	}
+}
+
+func TestMatchTuple(t *testing.T) {
+	ast, _, _ := buildAst(t, "matchtuple")
+	if len(ast) < 3 {
+		t.Fatalf("Unexpected number of nodes: %v", len(ast))
+	}
+	main, ok := ast[2].(FuncDecl)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[2]))
+	}
+
+	m, ok := main.Body.Stmts[3].(MatchStmt)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want MatchStmt", reflect.TypeOf(main.Body.Stmts[3]))
+	}
+	if len(m.Cases) != 2 {
+		t.Fatalf("Unexpected number of cases: got %v want 2", len(m.Cases))
+	}
+	intt := TypeLiteral("int")
+	x := VarWithType{"x", intt, false}
+	y := VarWithType{"y", intt, false}
+	patterns := []Pattern{
+		TuplePattern{Fields: []Pattern{IntLiteral(0), y}},
+		TuplePattern{Fields: []Pattern{x, y}},
+	}
+	for i, p := range patterns {
+		if !compare(m.Cases[i].Pattern, p) {
+			t.Errorf("Case %d: got pattern %v want %v", i, m.Cases[i].Pattern, p)
+		}
+	}
+	if !compare(m.Cases[1].Body.Stmts[0], FuncCall{
+		Name:     "PrintInt",
+		UserArgs: []Value{AdditionOperator{x, y}},
+	}) {
+		t.Errorf("Unexpected body: got %v", m.Cases[1].Body)
+	}
+}
+
+func TestIfExpr(t *testing.T) {
+	ast, _, _ := buildAst(t, "ifexpr")
+	if len(ast) < 4 {
+		t.Fatalf("Unexpected number of nodes: %v", len(ast))
+	}
+	main, ok := ast[3].(FuncDecl)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[3]))
+	}
+	x := VarWithType{"x", TypeLiteral("int"), false}
+	expected := LetStmt{
+		Var: VarWithType{"s", TypeLiteral("string"), false},
+		Val: IfExpr{
+			Condition: GreaterComparison{x, IntLiteral(3)},
+			Body:      BlockStmt{Stmts: []Node{StringLiteral("big")}},
+			Else:      BlockStmt{Stmts: []Node{StringLiteral("small")}},
+			Typ:       TypeLiteral("string"),
+		},
+	}
+	if !compare(main.Body.Stmts[1], expected) {
+		t.Errorf("Unexpected let statement: got %v want %v", main.Body.Stmts[1], expected)
+	}
+
+	sign, ok := ast[1].(FuncDecl)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[1]))
+	}
+	ret, ok := sign.Body.Stmts[0].(ReturnStmt)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want ReturnStmt", reflect.TypeOf(sign.Body.Stmts[0]))
+	}
+	e, ok := ret.Val.(IfExpr)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want IfExpr", reflect.TypeOf(ret.Val))
+	}
+	if _, ok := e.Else.Stmts[0].(IfExpr); !ok {
+		t.Errorf("Unexpected else: got %v want IfExpr", e.Else)
+	}
+	if !compare(e.Typ, TypeLiteral("int")) {
+		t.Errorf("Unexpected type: got %v want int", e.Typ)
+	}
+}
+
+func TestMatchExpr(t *testing.T) {
+	ast, _, _ := buildAst(t, "matchexpr")
+	if len(ast) < 2 {
+		t.Fatalf("Unexpected number of nodes: %v", len(ast))
+	}
+	describe, ok := ast[1].(FuncDecl)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[1]))
+	}
+	l, ok := describe.Body.Stmts[0].(LetStmt)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want LetStmt", reflect.TypeOf(describe.Body.Stmts[0]))
+	}
+	m, ok := l.Val.(MatchExpr)
+	if !ok {
+		t.Fatalf("Unexpected value: got %v want MatchExpr", reflect.TypeOf(l.Val))
+	}
+	if !compare(m.Typ, TypeLiteral("string")) {
+		t.Errorf("Unexpected type: got %v want string", m.Typ)
+	}
+	if len(m.Cases) != 3 {
+		t.Fatalf("Unexpected number of cases: got %v want 3", len(m.Cases))
+	}
+	for i, v := range []Value{StringLiteral("none"), StringLiteral("big"), StringLiteral("some")} {
+		if !compare(m.Cases[i].Body, BlockStmt{Stmts: []Node{v}}) {
+			t.Errorf("Case %d: got body %v want %v", i, m.Cases[i].Body, v)
+		}
+	}
+	if m.Cases[1].Guard == nil {
+		t.Errorf("Case 1: missing guard")
+	}
+}
+
+func TestConstants(t *testing.T) {
+	ast, _, _ := buildAst(t, "constants")
+	if len(ast) != 9 {
+		t.Fatalf("Unexpected number of nodes: %v", len(ast))
+	}
+	expected := []Node{
+		LetStmt{
+			Var: VarWithType{"Stdout", TypeLiteral("uint64"), false},
+			Val: IntLiteral(1),
+		},
+		LetStmt{
+			Var: VarWithType{"One", TypeLiteral("int"), false},
+			Val: IntLiteral(1),
+		},
+		LetStmt{
+			Var: VarWithType{"Greeting", TypeLiteral("string"), false},
+			Val: StringLiteral(`hello\n`),
+		},
+	}
+	for i, e := range expected {
+		if !compare(ast[i], e) {
+			t.Errorf("Unexpected constant %d: got %v want %v", i, ast[i], e)
+		}
+	}
+	size := VarWithType{"Size", TypeLiteral("int"), false}
+	bigger := LetStmt{
+		Var: VarWithType{"Bigger", TypeLiteral("int"), false},
+		Val: AdditionOperator{size, VarWithType{"One", TypeLiteral("int"), false}},
+	}
+	if !compare(ast[5], bigger) {
+		t.Errorf("Unexpected constant: got %v want %v", ast[5], bigger)
+	}
+
+	main, ok := ast[8].(FuncDecl)
+	if !ok {
+		t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[8]))
+	}
+	greet := FuncCall{
+		Name:     "PrintString",
+		UserArgs: []Value{VarWithType{"Greeting", TypeLiteral("string"), false}},
+	}
+	if !compare(main.Body.Stmts[0], greet) {
+		t.Errorf("Unexpected call: got %v want %v", main.Body.Stmts[0], greet)
+	}
+}
+
+func TestInlineAttributes(t *testing.T) {
+	ast, _, _ := buildAst(t, "inline")
+	if len(ast) != 4 {
+		t.Fatalf("Unexpected number of nodes: %v", len(ast))
+	}
+	expected := []struct {
+		Name    string
+		Inline  InlineHint
+		Effects []Effect
+	}{
+		{"add", InlineDefault, nil},
+		{"cube", InlineAlways, nil},
+		{"greet", InlineNever, []Effect{"IO"}},
+		{"main", InlineDefault, []Effect{"IO"}},
+	}
+	for i, e := range expected {
+		fd, ok := ast[i].(FuncDecl)
+		if !ok {
+			t.Fatalf("Unexpected node: got %v want FuncDecl", reflect.TypeOf(ast[i]))
+		}
+		if fd.Name != e.Name || fd.Inline != e.Inline || !reflect.DeepEqual(fd.Effects, e.Effects) {
+			t.Errorf("Unexpected function %d: got %v %v %v want %v %v %v", i, fd.Name, fd.Inline, fd.Effects, e.Name, e.Inline, e.Effects)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/driusan/lang/parser/token"
+)
+
+// A Pattern is matched against a value by a case of a match statement.
+//
+// Patterns can be nested inside of constructor and tuple patterns. Besides
+// the pattern types defined here, a VarWithType matches any value and binds
+// it to the variable, and an IntLiteral or BoolLiteral matches a value that
+// is equal to it.
+type Pattern interface {
+	Node
+	Type() Type
+}
+
+// A WildcardPattern matches any value without binding it. It is written as
+// "_".
+type WildcardPattern struct {
+	Typ Type
+}
+
+func (p WildcardPattern) Node() Node {
+	return p
+}
+
+func (p WildcardPattern) Type() Type {
+	return p.Typ
+}
+
+func (p WildcardPattern) String() string {
+	return "_"
+}
+
+func (p WildcardPattern) PrettyPrint(lvl int) string {
+	return nTabs(lvl) + "_"
+}
+
+// A ConstructorPattern matches a value of an enumerated type that was
+// created by Constructor, if each of the constructor's parameters also
+// matches the corresponding pattern in Parameters.
+type ConstructorPattern struct {
+	Constructor EnumOption
+	Parameters  []Pattern
+
+	// The concrete type being matched, ie. "Maybe int" rather than
+	// "Maybe".
+	Typ Type
+}
+
+func (p ConstructorPattern) Node() Node {
+	return p
+}
+
+func (p ConstructorPattern) Type() Type {
+	return p.Typ
+}
+
+func (p ConstructorPattern) String() string {
+	return fmt.Sprintf("ConstructorPattern{%v, Parameters: %v}", p.Constructor.Constructor, p.Parameters)
+}
+
+func (p ConstructorPattern) PrettyPrint(lvl int) string {
+	return nTabs(lvl) + patternString(p)
+}
+
+// A TuplePattern matches a tuple if each field matches the corresponding
+// pattern in Fields.
+type TuplePattern struct {
+	Fields []Pattern
+	Typ    TupleType
+}
+
+func (p TuplePattern) Node() Node {
+	return p
+}
+
+func (p TuplePattern) Type() Type {
+	return p.Typ
+}
+
+func (p TuplePattern) String() string {
+	return fmt.Sprintf("TuplePattern{%v}", p.Fields)
+}
+
+func (p TuplePattern) PrettyPrint(lvl int) string {
+	return nTabs(lvl) + patternString(p)
+}
+
+// Returns the pattern as it would be written in a case.
+func patternString(p Pattern) string {
+	switch pt := p.(type) {
+	case ConstructorPattern:
+		rv := pt.Constructor.Constructor
+		for _, sub := range pt.Parameters {
+			s := patternString(sub)
+			if cp, ok := sub.(ConstructorPattern); ok && len(cp.Parameters) > 0 {
+				s = "(" + s + ")"
+			}
+			rv += " " + s
+		}
+		return rv
+	case TuplePattern:
+		fields := make([]string, len(pt.Fields))
+		for i, f := range pt.Fields {
+			fields[i] = patternString(f)
+		}
+		return "(" + strings.Join(fields, ", ") + ")"
+	case VarWithType:
+		return string(pt.Name)
+	default:
+		return fmt.Sprintf("%v", p)
+	}
+}
+
+// Returns the variables bound by p, in the order that they appear.
+func patternVariables(p Pattern) []VarWithType {
+	switch pt := p.(type) {
+	case VarWithType:
+		return []VarWithType{pt}
+	case ConstructorPattern:
+		var vars []VarWithType
+		for _, sub := range pt.Parameters {
+			vars = append(vars, patternVariables(sub)...)
+		}
+		return vars
+	case TuplePattern:
+		var vars []VarWithType
+		for _, sub := range pt.Fields {
+			vars = append(vars, patternVariables(sub)...)
+		}
+		return vars
+	}
+	return nil
+}
+
+// Returns the definition of the enumerated type t, if it is one. t may be a
+// concrete instance of a parameterized type such as "Maybe int".
+func enumType(t Type, c *Context) (EnumTypeDefn, bool) {
+	if t == nil {
+		return EnumTypeDefn{}, false
+	}
+	words := strings.Fields(t.TypeName())
+	if len(words) == 0 {
+		return EnumTypeDefn{}, false
+	}
+	et, ok := c.Types[words[0]].ConcreteType.(EnumTypeDefn)
+	return et, ok
+}
+
+// Returns true if a match statement on a value of type t must cover every
+// possible value. This is the case for enumerated types, and tuples that
+// contain them.
+func mustBeExhaustive(t Type, c *Context) bool {
+	if _, ok := enumType(t, c); ok {
+		return true
+	}
+	if tt, ok := UnderlyingTuple(t); ok {
+		for _, field := range tt {
+			if mustBeExhaustive(field.Typ, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the concrete types of the parameters of a parameterized type name
+// such as "Maybe int" or "Maybe Maybe int", using the number of parameters
+// of each type to decide where each parameter ends.
+func typeArguments(name string, c *Context) []Type {
+	words := strings.Fields(name)
+	if len(words) == 0 {
+		return nil
+	}
+	// Returns the index after the end of the type starting at words[i]
+	var typeEnd func(i int) int
+	typeEnd = func(i int) int {
+		if i >= len(words) {
+			return i
+		}
+		td := c.Types[words[i]]
+		i++
+		for range td.Parameters {
+			i = typeEnd(i)
+		}
+		return i
+	}
+	var args []Type
+	for i, j := 1, 0; j < len(c.Types[words[0]].Parameters) && i < len(words); j++ {
+		end := typeEnd(i)
+		args = append(args, TypeLiteral(strings.Join(words[i:end], " ")))
+		i = end
+	}
+	return args
+}
+
+// Returns the concrete types of the parameters of the enum option eo, when
+// it's constructing a value of type t.
+func constructorTypes(eo EnumOption, t Type, c *Context) []Type {
+	params := c.Types[eo.ParentType.TypeName()].Parameters
+	args := typeArguments(t.TypeName(), c)
+	types := make([]Type, len(eo.Parameters))
+	for i, name := range eo.Parameters {
+		for j, param := range params {
+			if param == name && j < len(args) {
+				types[i] = args[j]
+			}
+		}
+	}
+	return types
+}
+
+// Consumes a pattern matching a value of type typ, declaring any variables
+// that it binds in c.
+func consumePattern(start int, tokens []token.Token, c *Context, typ Type) (int, Pattern, error) {
+	if start >= len(tokens) {
+		return 0, nil, fmt.Errorf("Missing pattern")
+	}
+	switch t := tokens[start].(type) {
+	case token.Char:
+		if t != token.Char("(") {
+			break
+		}
+		if tt, ok := UnderlyingTuple(typ); ok {
+			return consumeTuplePattern(start, tokens, c, tt)
+		}
+		n, p, err := consumePattern(start+1, tokens, c, typ)
+		if err != nil {
+			return 0, nil, err
+		}
+		if start+n+1 >= len(tokens) || tokens[start+n+1] != token.Char(")") {
+			return 0, nil, fmt.Errorf("Missing ')' in pattern")
+		}
+		return n + 2, p, nil
+	case token.Unknown:
+		name := t.String()
+		if name == "_" {
+			return 1, WildcardPattern{typ}, nil
+		}
+		if eo := c.EnumeratedOption(name); eo != nil {
+			return consumeConstructorPattern(start, tokens, c, typ, *eo)
+		}
+		if _, err := strconv.Atoi(name); err != nil && name != "true" && name != "false" {
+			if typ == nil {
+				return 0, nil, fmt.Errorf(`Can not determine type of variable "%v" in pattern.`, name)
+			}
+			v := VarWithType{Name: Variable(name), Typ: typ}
+			c.Variables[name] = v
+			return 1, v, nil
+		}
+	}
+	n, v, err := consumeValue(start, tokens, c, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch v.(type) {
+	case IntLiteral, BoolLiteral:
+	default:
+		return 0, nil, fmt.Errorf(`Invalid pattern "%v".`, tokens[start])
+	}
+	if _, ok := c.Types[typeName(typ)]; !ok {
+		return 0, nil, fmt.Errorf(`Invalid pattern "%v" for type "%v".`, v, typeName(typ))
+	}
+	if err := c.IsCompatibleType(typ, v); err != nil {
+		return 0, nil, fmt.Errorf(`Invalid pattern "%v": %v.`, v, err)
+	}
+	return n, v, nil
+}
+
+func consumeConstructorPattern(start int, tokens []token.Token, c *Context, typ Type, eo EnumOption) (int, Pattern, error) {
+	if _, ok := enumType(typ, c); !ok || strings.Fields(typ.TypeName())[0] != eo.ParentType.TypeName() {
+		return 0, nil, fmt.Errorf(`Invalid pattern: "%v" is not an option of type "%v".`, eo.Constructor, typeName(typ))
+	}
+	p := ConstructorPattern{Constructor: eo, Typ: typ}
+	n := 1
+	for _, ptyp := range constructorTypes(eo, typ, c) {
+		pn, sub, err := consumePattern(start+n, tokens, c, ptyp)
+		if err != nil {
+			return 0, nil, err
+		}
+		p.Parameters = append(p.Parameters, sub)
+		n += pn
+	}
+	return n, p, nil
+}
+
+func consumeTuplePattern(start int, tokens []token.Token, c *Context, typ TupleType) (int, Pattern, error) {
+	p := TuplePattern{Typ: typ}
+	i := start + 1
+	for i < len(tokens) {
+		if len(p.Fields) >= len(typ) {
+			return 0, nil, fmt.Errorf("Too many fields in pattern for tuple %v", typ.TypeName())
+		}
+		n, sub, err := consumePattern(i, tokens, c, typ[len(p.Fields)].Typ)
+		if err != nil {
+			return 0, nil, err
+		}
+		p.Fields = append(p.Fields, sub)
+		i += n
+		if i >= len(tokens) {
+			break
+		}
+		switch tokens[i] {
+		case token.Char(","):
+			i++
+		case token.Char(")"):
+			if len(p.Fields) != len(typ) {
+				return 0, nil, fmt.Errorf("Not enough fields in pattern for tuple %v", typ.TypeName())
+			}
+			return i + 1 - start, p, nil
+		default:
+			return 0, nil, fmt.Errorf("Unexpected '%v' in tuple pattern", tokens[i])
+		}
+	}
+	return 0, nil, fmt.Errorf("Missing ')' in pattern")
+}
+
+func typeName(t Type) string {
+	if t == nil {
+		return ""
+	}
+	return t.TypeName()
+}
+
+// Returns true if the pattern matches any value.
+func isWildcard(p Pattern) bool {
+	switch p.(type) {
+	case WildcardPattern, VarWithType:
+		return true
+	}
+	return false
+}
+
+// Finds values of the given types that aren't matched by any of the rows of
+// patterns, and returns a pattern for each type describing the first such
+// value. Returns nil if every value is matched.
+//
+// This is the "usefulness" algorithm from Maranget's "Warnings for pattern
+// matching": the rows are specialized by each constructor that the first
+// column could have, and the remaining columns are checked recursively.
+func uncoveredPatterns(rows [][]Pattern, types []Type, c *Context) []string {
+	if len(types) == 0 {
+		if len(rows) == 0 {
+			return []string{}
+		}
+		return nil
+	}
+	t := types[0]
+
+	// Returns the rows that match a value whose first column was created
+	// by a constructor with the given number of parameters, with the first
+	// column replaced by the patterns for each parameter.
+	specialize := func(arity int, matches func(p Pattern) ([]Pattern, bool)) [][]Pattern {
+		var srows [][]Pattern
+		for _, r := range rows {
+			var sub []Pattern
+			if isWildcard(r[0]) {
+				sub = make([]Pattern, arity)
+				for i := range sub {
+					sub[i] = WildcardPattern{}
+				}
+			} else if params, ok := matches(r[0]); ok {
+				sub = append(sub, params...)
+			} else {
+				continue
+			}
+			srows = append(srows, append(sub, r[1:]...))
+		}
+		return srows
+	}
+
+	if et, ok := enumType(t, c); ok {
+		for _, eo := range et.Options {
+			ptypes := constructorTypes(eo, t, c)
+			srows := specialize(len(ptypes), func(p Pattern) ([]Pattern, bool) {
+				switch pt := p.(type) {
+				case ConstructorPattern:
+					return pt.Parameters, pt.Constructor.Constructor == eo.Constructor
+				case EnumOption:
+					return nil, len(ptypes) == 0 && pt.Constructor == eo.Constructor
+				case EnumValue:
+					return nil, len(ptypes) == 0 && pt.Constructor.Constructor == eo.Constructor
+				}
+				return nil, false
+			})
+			if missing := uncoveredPatterns(srows, append(ptypes, types[1:]...), c); missing != nil {
+				name := eo.Constructor
+				for _, param := range missing[:len(ptypes)] {
+					if strings.Contains(param, " ") && !strings.HasPrefix(param, "(") {
+						param = "(" + param + ")"
+					}
+					name += " " + param
+				}
+				return append([]string{name}, missing[len(ptypes):]...)
+			}
+		}
+		return nil
+	}
+	if tt, ok := UnderlyingTuple(t); ok {
+		ftypes := make([]Type, len(tt))
+		for i, field := range tt {
+			ftypes[i] = field.Typ
+		}
+		srows := specialize(len(tt), func(p Pattern) ([]Pattern, bool) {
+			tp, ok := p.(TuplePattern)
+			return tp.Fields, ok
+		})
+		if missing := uncoveredPatterns(srows, append(ftypes, types[1:]...), c); missing != nil {
+			tuple := "(" + strings.Join(missing[:len(tt)], ", ") + ")"
+			return append([]string{tuple}, missing[len(tt):]...)
+		}
+		return nil
+	}
+	if t != nil && t.TypeName() == "bool" {
+		for _, b := range []BoolLiteral{true, false} {
+			srows := specialize(0, func(p Pattern) ([]Pattern, bool) {
+				bl, ok := p.(BoolLiteral)
+				return nil, ok && bl == b
+			})
+			if missing := uncoveredPatterns(srows, types[1:], c); missing != nil {
+				return append([]string{fmt.Sprintf("%v", bool(b))}, missing...)
+			}
+		}
+		return nil
+	}
+
+	// Other types have too many values to enumerate, so only a wildcard
+	// can cover them.
+	srows := specialize(0, func(p Pattern) ([]Pattern, bool) {
+		return nil, false
+	})
+	if missing := uncoveredPatterns(srows, types[1:], c); missing != nil {
+		return append([]string{"_"}, missing...)
+	}
+	return nil
+}
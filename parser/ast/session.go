@@ -0,0 +1,170 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/driusan/lang/parser/token"
+)
+
+// A Session parses a program one piece at a time, such as the input to a
+// REPL. Each piece can use anything declared by the pieces before it.
+type Session struct {
+	p *parser
+
+	// The variables which statements can use, other than the constants.
+	variables, mutables map[string]VarWithType
+}
+
+// NewSession returns a Session which nothing has been declared in yet.
+func NewSession() *Session {
+	return &Session{
+		p:         newParser(),
+		variables: make(map[string]VarWithType),
+		mutables:  make(map[string]VarWithType),
+	}
+}
+
+// TypeInfo returns the types that have been declared in s.
+func (s *Session) TypeInfo() TypeInformation {
+	return s.p.ti
+}
+
+// Callables returns the functions that have been declared in s.
+func (s *Session) Callables() Callables {
+	return s.p.callables
+}
+
+// Types returns the type definitions that have been declared in s, by name.
+func (s *Session) Types() map[string]TypeDefn {
+	return s.p.c.Types
+}
+
+// Declare makes v usable by the statements of later pieces.
+func (s *Session) Declare(v VarWithType, mutable bool) {
+	s.variables[string(v.Name)] = v
+	if mutable {
+		s.mutables[string(v.Name)] = v
+	}
+}
+
+// Parse parses the next piece of the program, src.
+//
+// If src starts with "func", "type", "enum" or "let", it's a list of top level
+// declarations, which are returned as they would be by Construct. Otherwise
+// it's a list of statements, which is returned as a single BlockStmt. The
+// last statement can be an expression. Variables declared by the statements
+// can't be used by later pieces unless they're passed to Declare.
+func (s *Session) Parse(src string) (nodes []Node, err error) {
+	tokens, err := token.Tokenize(strings.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	lines := stripLines(tokens, token.Lines(tokens))
+	tokens = stripWhitespaceAndComments(tokens)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	// The parser assumes that it's been given a valid program, and
+	// panics on a lot of things that a person typing into a REPL can get
+	// wrong, so don't let those take the session down with them.
+	defer func() {
+		if r := recover(); r != nil {
+			nodes, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	if _, err := topLevelNode(tokens[0]); err == nil {
+		return s.declarations(tokens, lines)
+	}
+	block, err := s.statements(tokens, lines)
+	if err != nil {
+		return nil, err
+	}
+	return []Node{block}, nil
+}
+
+func (s *Session) declarations(tokens []token.Token, lines []int) ([]Node, error) {
+	// Work on a copy, so that nothing is declared if there's an error.
+	p := *s.p
+	p.c = s.p.c.Clone()
+	p.c.Lines = lines
+	p.ti = make(TypeInformation)
+	for k, v := range s.p.ti {
+		p.ti[k] = v
+	}
+	p.callables = make(Callables)
+	for k, v := range s.p.callables {
+		p.callables[k] = v
+	}
+	p.constants = make(map[string]VarWithType)
+	for k, v := range s.p.constants {
+		p.constants[k] = v
+	}
+	p.declared = make(map[string]Callable)
+	for k, v := range s.p.declared {
+		p.declared[k] = v
+	}
+
+	// A function which is declared again replaces the old one.
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i] == token.Keyword("func") {
+			delete(p.callables, tokens[i+1].String())
+		}
+	}
+	if err := extractPrototypes(tokens, &p.c); err != nil {
+		return nil, err
+	}
+	nodes, err := p.topLevel(tokens)
+	if err != nil {
+		return nil, err
+	}
+	p.c.Lines = nil
+	*s.p = p
+	return nodes, nil
+}
+
+func (s *Session) statements(tokens []token.Token, lines []int) (BlockStmt, error) {
+	c := s.p.c.Clone()
+	c.Lines = lines
+	c.Variables = make(map[string]VarWithType)
+	c.Mutables = make(map[string]VarWithType)
+	for k, v := range s.p.constants {
+		c.Variables[k] = v
+	}
+	for k, v := range s.variables {
+		c.Variables[k] = v
+	}
+	for k, v := range s.mutables {
+		c.Mutables[k] = v
+	}
+	c.PureContext = false
+	c.CurFunc = FuncDecl{}
+
+	var block BlockStmt
+	for i := 0; i < len(tokens); {
+		if n, v, err := consumeValue(i, tokens, &c, false); err == nil && i+n == len(tokens) {
+			block.add(v, i, &c)
+			break
+		}
+		var n int
+		var stmt Node
+		var err error
+		if tokens[i] == token.Char("{") {
+			c2 := c.Clone()
+			n, stmt, err = consumeBlock(i, tokens, &c2)
+		} else {
+			n, stmt, err = consumeStmt(i, tokens, &c)
+		}
+		if err != nil {
+			return BlockStmt{}, err
+		}
+		if n <= 0 {
+			return BlockStmt{}, fmt.Errorf("Invalid statement: %v", tokens[i])
+		}
+		block.add(stmt, i, &c)
+		i += n
+	}
+	return block, nil
+}
@@ -234,6 +234,10 @@ func (ls LetStmt) PrettyPrint(lvl int) string {
 
 type BlockStmt struct {
 	Stmts []Node
+
+	// The line of the source that each statement starts on, or 0 if it's
+	// not known.
+	Lines []int
 }
 
 func (b BlockStmt) Node() Node {
@@ -608,6 +612,44 @@ func (tv TupleValue) Value() interface{} {
 	return nil
 }
 
+// A TupleUpdate is a copy of the tuple variable Base with some of its
+// fields replaced, created with "base with (name: value, ...)".
+type TupleUpdate struct {
+	Base VarWithType
+
+	// The value of every field of the new tuple, in order. Fields
+	// which aren't being replaced refer to the field of Base.
+	Values TupleValue
+}
+
+func (tu TupleUpdate) Node() Node {
+	return tu
+}
+
+func (tu TupleUpdate) PrettyPrint(lvl int) string {
+	return nTabs(lvl) + tu.Base.PrettyPrint(0) + " with " + tu.Values.PrettyPrint(0)
+}
+
+func (tu TupleUpdate) Type() Type {
+	return tu.Base.Type()
+}
+
+func (tu TupleUpdate) Value() interface{} {
+	return nil
+}
+
+// Returns the tuple type underlying t, if t is a tuple or a user defined
+// tuple type.
+func UnderlyingTuple(t Type) (TupleType, bool) {
+	switch tt := t.(type) {
+	case TupleType:
+		return tt, true
+	case UserType:
+		return UnderlyingTuple(tt.Typ)
+	}
+	return nil, false
+}
+
 type UserType struct {
 	Typ  Type
 	Name string
@@ -20,6 +20,8 @@ func isInfixOperator(pos int, tokens []token.Token) bool {
 		}
 	case token.Char:
 		return t == "[" || t == "."
+	case token.Keyword:
+		return t == "with"
 	}
 	return false
 }
@@ -397,6 +399,18 @@ func consumeValue(start int, tokens []token.Token, c *Context, forcebrackets boo
 				return consumeLetStmt(i, tokens, c)
 			case "cast":
 				return consumeCastStmt(i, tokens, c)
+			case "if":
+				n, v, err := consumeIfExpr(i, tokens, c)
+				if err != nil {
+					return 0, nil, err
+				}
+				return i + n - start, v, nil
+			case "match":
+				n, v, err := consumeMatchExpr(i, tokens, c)
+				if err != nil {
+					return 0, nil, err
+				}
+				return i + n - start, v, nil
 			default:
 				return 0, nil, fmt.Errorf("Only let statements may be used inside of a value context.")
 			}
@@ -549,11 +563,83 @@ func consumeInfix(start int, tokens []token.Token, c *Context, left Value) (int,
 			}
 			return nm + 1, fc, nil
 		}
+	case token.Keyword("with"):
+		return consumeTupleUpdate(start, tokens, c, left)
 	default:
 		panic(fmt.Sprintf("Unhandled infix operator %v at %v", tokens[start].String(), start))
 	}
 }
 
+// Consumes the "with (name: value, ...)" part of a tuple update, where left
+// is the tuple being copied.
+func consumeTupleUpdate(start int, tokens []token.Token, c *Context, left Value) (int, Value, error) {
+	base, ok := left.(VarWithType)
+	if !ok {
+		return 0, nil, fmt.Errorf("Can only use with on tuple variables")
+	}
+	tt, ok := UnderlyingTuple(base.Type())
+	if !ok {
+		return 0, nil, fmt.Errorf("Can only use with on tuple variables")
+	}
+	if start+1 >= len(tokens) || tokens[start+1] != token.Char("(") {
+		return 0, nil, fmt.Errorf("Expected ( after with")
+	}
+
+	// Start with a copy of every field, and then replace the ones that
+	// are being updated.
+	values := make(TupleValue, len(tt))
+	for i := range tt {
+		values[i] = VarWithType{base.Name + "." + tt[i].Name, tt[i].Type(), base.Reference}
+	}
+	updated := make(map[Variable]bool)
+
+	i := start + 2
+	for i+1 < len(tokens) {
+		name := Variable(tokens[i].String())
+		field := -1
+		for j := range tt {
+			if tt[j].Name == name {
+				field = j
+				break
+			}
+		}
+		if field < 0 {
+			return 0, nil, fmt.Errorf("Tuple does not have component named %v", name)
+		}
+		if updated[name] {
+			return 0, nil, fmt.Errorf("Duplicate component %v in with expression", name)
+		}
+		updated[name] = true
+		if tokens[i+1] != token.Char(":") {
+			return 0, nil, fmt.Errorf("Expected : after %v in with expression", name)
+		}
+
+		n, v, err := consumeValue(i+2, tokens, c, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		if IsLiteral(v) {
+			if err := c.IsCompatibleType(tt[field].Type(), v); err != nil {
+				return 0, nil, fmt.Errorf("Incompatible value for component %v: %v", name, err)
+			}
+		} else if v.Type().TypeName() != tt[field].Type().TypeName() {
+			return 0, nil, fmt.Errorf("Incompatible value for component %v: can not assign %v to %v", name, v.Type().TypeName(), tt[field].Type().TypeName())
+		}
+		values[field] = v
+		i += n + 2
+
+		switch tokens[i] {
+		case token.Char(")"):
+			return i - start, TupleUpdate{Base: base, Values: values}, nil
+		case token.Char(","):
+			i++
+		default:
+			return 0, nil, fmt.Errorf("Unexpected token %v in with expression", tokens[i])
+		}
+	}
+	return 0, nil, fmt.Errorf("Unterminated with expression")
+}
+
 func consumeBracketsOrTupleValue(start int, tokens []token.Token, c *Context, forceBrackets bool) (int, Value, error) {
 	var ret TupleValue
 	tuple := false
@@ -0,0 +1,50 @@
+package invalidprograms
+
+// ConstantBeforeDeclaration uses a constant in a function declared before
+// the constant.
+const ConstantBeforeDeclaration = `
+func main() () -> affects(IO) {
+	PrintInt(Size)
+}
+
+let Size = 3`
+
+// ConstantCallsLaterFunc calls a function in the initializer of a constant
+// before the function is declared, so it can not be evaluated yet.
+const ConstantCallsLaterFunc = `
+let Size = square(3)
+
+func square(x int) (int) {
+	return x * x
+}
+
+func main() () -> affects(IO) {
+	PrintInt(Size)
+}`
+
+// DuplicateConstant declares the same constant twice.
+const DuplicateConstant = `
+let Size = 3
+let Size = 4
+
+func main() () -> affects(IO) {
+	PrintInt(Size)
+}`
+
+// ArrayConstant declares a constant with a type that can not be evaluated
+// at compile time.
+const ArrayConstant = `
+let Sizes [3]int = { 1, 2, 3 }
+
+func main() () -> affects(IO) {
+	PrintInt(Sizes[0])
+}`
+
+// AssignToConstant modifies a constant.
+const AssignToConstant = `
+let Size = 3
+
+func main() () -> affects(IO) {
+	Size = 4
+	PrintInt(Size)
+}`
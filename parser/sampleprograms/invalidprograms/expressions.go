@@ -0,0 +1,61 @@
+package invalidprograms
+
+// IfExprWithoutElse uses an if expression without an else, so it does not
+// have a value when the condition is false.
+const IfExprWithoutElse = `
+func main() () -> affects(IO) {
+	let x = 3
+	let y = if x > 2 { 1 }
+	PrintInt(y)
+}`
+
+// MismatchedIfExpr has an if expression whose branches have different types.
+const MismatchedIfExpr = `
+func main() () -> affects(IO) {
+	let x = 3
+	let y = if x > 2 { "big" } else { x }
+	PrintString(y)
+}`
+
+// MismatchedMatchExpr has a match expression whose cases have different
+// types.
+const MismatchedMatchExpr = `
+enum Maybe x = Nothing | Just x
+
+func foo(x Maybe int) () -> affects(IO) {
+	let y = match x {
+	case Just n: n
+	case Nothing: "nothing"
+	}
+	PrintInt(y)
+}
+
+func main() () -> affects(IO) {
+	foo(Nothing)
+}`
+
+// InexhaustiveMatchExpr has a match expression which does not have a value
+// for every int.
+const InexhaustiveMatchExpr = `
+func main() () -> affects(IO) {
+	let x = 3
+	let y = match x {
+	case 1: "one"
+	case 2: "two"
+	}
+	PrintString(y)
+}`
+
+// MatchExprWithoutValue has a match expression with a case that ends with a
+// let statement instead of a value.
+const MatchExprWithoutValue = `
+func main() () -> affects(IO) {
+	let x = 3
+	let y = match x {
+	case 1:
+		PrintString("one")
+	case _:
+		let z = 2
+	}
+	PrintInt(y)
+}`
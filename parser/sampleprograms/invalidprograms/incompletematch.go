@@ -12,3 +12,48 @@ func main() () -> affects(IO) {
 		PrintString("I am B\n")
 	}
 }`
+
+const IncompleteNestedMatch = `
+enum Maybe x = Nothing | Just x
+
+func foo(x Maybe Maybe int) (int) {
+	match x {
+	case Just (Just y):
+		return y
+	case Nothing:
+		return 0
+	}
+}
+
+func main() () -> affects(IO) {
+	PrintInt(foo(Nothing))
+}`
+
+const GuardedMatch = `
+enum Maybe x = Nothing | Just x
+
+func foo(x Maybe int) (int) {
+	match x {
+	case Just y if y > 0:
+		return y
+	case Nothing:
+		return 0
+	}
+}
+
+func main() () -> affects(IO) {
+	PrintInt(foo(Nothing))
+}`
+
+const IncompleteTupleMatch = `
+enum Foo = A | B
+
+func main() () -> affects(IO) {
+	let x = (A, 3)
+	match x {
+	case (A, _):
+		PrintString("I am A\n")
+	case (B, 0):
+		PrintString("I am B0\n")
+	}
+}`
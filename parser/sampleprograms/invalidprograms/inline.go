@@ -0,0 +1,21 @@
+package invalidprograms
+
+// InlineAndNoInline declares a function as both inline and noinline.
+const InlineAndNoInline = `
+func square(x int) (int) -> inline noinline {
+	return x * x
+}
+
+func main() () -> affects(IO) {
+	PrintInt(square(3))
+}`
+
+// UnknownFuncAttribute uses an attribute which doesn't exist.
+const UnknownFuncAttribute = `
+func square(x int) (int) -> fast {
+	return x * x
+}
+
+func main() () -> affects(IO) {
+	PrintInt(square(3))
+}`
@@ -48,3 +48,44 @@ const MutStatementScopeShadow2 = `func main() () -> affects(IO) {
 		PrintString(n)
 	}
 }`
+
+// ForLoopAssignment tries to assign to the variable of a for loop,
+// which is immutable.
+const ForLoopAssignment = `func main() () -> affects(IO) {
+	for i in 0..5 {
+		i = i + 1
+		PrintInt(i)
+	}
+}`
+
+// ForLoopNotCollection tries to iterate over an int, which isn't a
+// collection.
+const ForLoopNotCollection = `func main() () -> affects(IO) {
+	for i in 3 + 4 {
+		PrintInt(i)
+	}
+}`
+
+// RangeTypeMismatch uses a range whose end isn't the same type as its
+// start.
+const RangeTypeMismatch = `func main() () -> affects(IO) {
+	let s = "abc"
+	for i in 0..s {
+		PrintInt(i)
+	}
+}`
+
+// TupleFieldAssignment tries to assign to a field of an immutable tuple.
+const TupleFieldAssignment = `func main() () -> affects(IO) {
+	let p (x int, y int) = (3, 4)
+	p.x = 5
+	PrintInt(p.x)
+}`
+
+// TupleWithInvalidField tries to update a field that doesn't exist in a
+// with expression.
+const TupleWithInvalidField = `func main() () -> affects(IO) {
+	let p (x int, y int) = (3, 4)
+	let q = p with (z: 5)
+	PrintInt(q.x)
+}`
@@ -0,0 +1,19 @@
+package invalidprograms
+
+// BreakOutsideLoop uses break when not in a loop.
+const BreakOutsideLoop = `func main() () -> affects(IO) {
+	if true {
+		break
+	}
+}`
+
+// InvalidLoopLabel tries to continue a loop label that doesn't refer to
+// an enclosing loop.
+const InvalidLoopLabel = `func main() () -> affects(IO) {
+	outer: for i in 0..5 {
+		PrintInt(i)
+	}
+	for j in 0..5 {
+		continue outer
+	}
+}`
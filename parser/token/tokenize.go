@@ -20,7 +20,8 @@ const (
 func addToken(cur []Token, val string) []Token {
 	switch val {
 	case "func", "mutable", "let", "while", "if", "else", "return", "type",
-		"enum", "match", "case", "cast", "as", "affects", "assert":
+		"enum", "match", "case", "cast", "as", "affects", "assert",
+		"for", "in", "break", "continue", "with", "inline", "noinline":
 		return append(cur, Keyword(val))
 	case "(", ")", "{", "}", `"`, `,`, ":", ".":
 		return append(cur, Char(val))
@@ -29,7 +30,7 @@ func addToken(cur []Token, val string) []Token {
 	case "+", "-", "*", "/", "%",
 		"<=", "<", "==", ">", ">=", "=", "!=",
 		"|",
-		"->":
+		"->", "..":
 		return append(cur, Operator(val))
 	case "int", "bool", "string",
 		"uint8", "uint16", "uint32", "uint64",
@@ -42,6 +43,23 @@ func addToken(cur []Token, val string) []Token {
 	return append(cur, Unknown(val))
 }
 
+// Lines returns the line of the source that each token in tokens starts on,
+// counting from 1.
+func Lines(tokens []Token) []int {
+	lines := make([]int, len(tokens))
+	line := 1
+	for i, t := range tokens {
+		lines[i] = line
+		line += strings.Count(t.String(), "\n")
+		if _, ok := t.(LineComment); ok {
+			// The newline that ends a line comment isn't part of
+			// the token.
+			line++
+		}
+	}
+	return lines
+}
+
 func Tokenize(r io.RuneScanner) ([]Token, error) {
 	var currentToken string
 	var tokens []Token
@@ -124,8 +142,23 @@ func Tokenize(r io.RuneScanner) ([]Token, error) {
 				if currentToken != "" {
 					tokens = addToken(tokens, currentToken)
 				}
-				tokens = append(tokens, Char(string(c)))
 				currentToken = ""
+				if c == '.' {
+					// Two dots in a row is the range operator, not
+					// two field accesses.
+					peekedToken, _, err := r.ReadRune()
+					if err == nil {
+						if peekedToken == '.' {
+							tokens = append(tokens, Operator(".."))
+							currentContext = DefaultContext
+							continue
+						}
+						if err := r.UnreadRune(); err != nil {
+							panic(err)
+						}
+					}
+				}
+				tokens = append(tokens, Char(string(c)))
 				if c == '"' {
 					currentContext = StringContext
 				} else {
@@ -576,6 +576,74 @@ func TestSingleCharInput(t *testing.T) {
 	}
 }
 
+func TestRangeOperator(t *testing.T) {
+	tk, err := Tokenize(strings.NewReader("for i in 0..n {"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Token{
+		Keyword("for"),
+		Whitespace(" "),
+		Unknown("i"),
+		Whitespace(" "),
+		Keyword("in"),
+		Whitespace(" "),
+		Unknown("0"),
+		Operator(".."),
+		Unknown("n"),
+		Whitespace(" "),
+		Char("{"),
+	}
+
+	if len(tk) != len(expected) {
+		t.Fatalf("Unexpected number of tokens. Got: %v", tk)
+	}
+	for i, tok := range expected {
+		if tok != tk[i] {
+			t.Errorf("Unexpected token: got %v want %v", tk[i], expected[i])
+		}
+	}
+}
+
+func TestInlineKeywords(t *testing.T) {
+	tk, err := Tokenize(strings.NewReader("() -> inline {} () -> noinline {"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Token{
+		Char("("),
+		Char(")"),
+		Whitespace(" "),
+		Operator("->"),
+		Whitespace(" "),
+		Keyword("inline"),
+		Whitespace(" "),
+		Char("{"),
+		Char("}"),
+		Whitespace(" "),
+		Char("("),
+		Char(")"),
+		Whitespace(" "),
+		Operator("->"),
+		Whitespace(" "),
+		Keyword("noinline"),
+		Whitespace(" "),
+		Char("{"),
+	}
+
+	if len(tk) != len(expected) {
+		t.Fatalf("Unexpected number of tokens. Got: %v", tk)
+	}
+	for i, tok := range expected {
+		if tok != tk[i] {
+			t.Errorf("Unexpected token: got %v want %v", tk[i], expected[i])
+		}
+		if !tk[i].IsValid() {
+			t.Errorf("Invalid token: %v", tk[i])
+		}
+	}
+}
+
 func TestSimpleArray(t *testing.T) {
 	tokens, err := Tokenize(strings.NewReader(sampleprograms.SimpleArray))
 	expected := []Token{
@@ -883,3 +951,46 @@ func TestBlockComment(t *testing.T) {
 	}
 
 }
+
+func TestLines(t *testing.T) {
+	tokens, err := Tokenize(strings.NewReader("let x = 1 // one\n/* two\nthree */ let y\n\n= \"a\nb\" z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := Lines(tokens)
+	if len(lines) != len(tokens) {
+		t.Fatalf("Unexpected number of lines: got %d want %d", len(lines), len(tokens))
+	}
+	expected := []struct {
+		tok  Token
+		line int
+	}{
+		{Keyword("let"), 1},
+		{Unknown("x"), 1},
+		{Operator("="), 1},
+		{Unknown("1"), 1},
+		{Keyword("let"), 3},
+		{Unknown("y"), 3},
+		{Operator("="), 5},
+		{String("a\nb"), 5},
+		{Unknown("z"), 6},
+	}
+	var got []Token
+	for i, tok := range tokens {
+		switch tok.(type) {
+		case Whitespace, LineComment, BlockComment, CommentDelimiter, Char:
+			continue
+		}
+		got = append(got, tok)
+		if len(got) > len(expected) {
+			t.Fatalf("Unexpected token %v", tok)
+		}
+		e := expected[len(got)-1]
+		if tok != e.tok || lines[i] != e.line {
+			t.Errorf("Unexpected token %d: got %v on line %d want %v on line %d", len(got)-1, tok, lines[i], e.tok, e.line)
+		}
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Unexpected number of tokens: got %d want %d", len(got), len(expected))
+	}
+}
@@ -18,7 +18,9 @@ func (k Keyword) IsValid() bool {
 	case "while", "mutable", "let", "func",
 		"if", "else", "else if", "return",
 		"type", "match", "enum", "case",
-		"affects", "assert":
+		"affects", "assert", "for", "in",
+		"break", "continue", "with",
+		"inline", "noinline":
 		return true
 	}
 	return false
@@ -47,8 +49,9 @@ func (o Operator) IsValid() bool {
 	switch o {
 	case "+", "-", "*", "/", "%", // math
 		"<=", "<", "==", ">", ">=", "!=", // comparison
-		"=", // assignment
-		"|", // other
+		"=",  // assignment
+		"|",  // other
+		"..", // ranges
 		"->":
 		return true
 	}